@@ -0,0 +1,341 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/fio"
+	"bitcast-go/selferror"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//增量备份：备份目录中保存一个备份清单，以及每一次备份的子目录
+//每次备份只拷贝上一次备份之后新生成的旧数据文件，其他的数据文件引用之前备份中的文件
+//merge之后的数据文件会复用旧的文件id，所以数据文件使用 (文件id, merge的批次) 来标识
+//索引文件等元数据每次都完整拷贝，只有merge会修改的hint索引文件和数据文件一样，merge的批次没有变化时引用之前备份中的文件
+
+const backupManifestName = "backup-manifest"
+const backupCopyBufferSize = 1024 * 1024
+
+// BackupManifest 备份清单，记录了所有的备份
+type BackupManifest struct {
+	Backups []*BackupInfo
+}
+
+// BackupInfo 一次备份的信息
+type BackupInfo struct {
+	Id        uint32
+	Time      time.Time
+	DataFiles []*BackupFile //恢复这次备份需要的所有数据文件，可能保存在之前的备份中
+	MetaFiles []*BackupFile //索引文件等元数据，除了merge的批次没有变化的hint索引文件，都保存在这次备份的目录中
+}
+
+// BackupFile 备份中的一个文件
+type BackupFile struct {
+	Name       string
+	BackupId   uint32 //文件保存在哪一次备份的目录中
+	MergeEpoch uint32 //数据文件或者hint索引文件是哪一次merge生成的，使用merge完成时第一个没有参与merge的文件id标识，0表示没有经过merge
+	Size       int64
+	CRC        uint32 //整个文件的crc校验值
+}
+
+func backupSubDir(backupDir string, backupId uint32) string {
+	return filepath.Join(backupDir, fmt.Sprintf("%06d", backupId))
+}
+
+// BackUpIncremental 增量备份到backupDir目录中，只拷贝上一次备份之后新生成的旧数据文件
+// 和检查点使用同一个快照，只在封存活跃文件和获取持久化索引的快照时阻塞写入，拷贝文件期间只会推迟merge切换数据文件
+func (db *DB) BackUpIncremental(backupDir string) (*BackupInfo, error) {
+	manifest, err := readBackupManifest(db.fs, backupDir)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{Id: 1, Time: time.Now()}
+	//上一次备份中的数据文件以及hint索引文件
+	backedUp := make(map[string]*BackupFile)
+	if n := len(manifest.Backups); n > 0 {
+		last := manifest.Backups[n-1]
+		info.Id = last.Id + 1
+		for _, file := range last.DataFiles {
+			backedUp[backupFileKey(file.Name, file.MergeEpoch)] = file
+		}
+		for _, file := range last.MetaFiles {
+			if file.Name == data.HintFileName {
+				backedUp[backupFileKey(file.Name, file.MergeEpoch)] = file
+			}
+		}
+	}
+	subDir := backupSubDir(backupDir, info.Id)
+	if err := db.fs.RemoveAll(subDir); err != nil {
+		return nil, err
+	}
+	if err := db.fs.MkdirAll(subDir); err != nil {
+		return nil, err
+	}
+
+	//拷贝文件期间，merge不能删除或者替换旧的数据文件以及hint索引文件
+	db.fileRemoveLock.RLock()
+	defer db.fileRemoveLock.RUnlock()
+
+	snap, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.release()
+	for _, file := range snap.files {
+		//hint文件可以从数据文件中重建
+		if file.hintFile {
+			continue
+		}
+		//merge之前的数据文件和hint索引文件属于同一次merge，merge的批次没有变化时引用之前备份中的文件
+		var fileEpoch uint32
+		if (file.dataFile && dataFileId(file.name) < snap.mergeEpoch) || file.name == data.HintFileName {
+			fileEpoch = snap.mergeEpoch
+		}
+		if file.dataFile || file.name == data.HintFileName {
+			if backupFile, ok := backedUp[backupFileKey(file.name, fileEpoch)]; ok {
+				info.addFile(backupFile, file.dataFile)
+				continue
+			}
+		}
+		size, crc, err := db.copySnapshotFileWithCRC(file, filepath.Join(subDir, file.name))
+		if err != nil {
+			return nil, err
+		}
+		info.addFile(&BackupFile{
+			Name:       file.name,
+			BackupId:   info.Id,
+			MergeEpoch: fileEpoch,
+			Size:       size,
+			CRC:        crc,
+		}, file.dataFile)
+	}
+
+	//最后写入清单，之前失败的备份不会出现在清单中
+	manifest.Backups = append(manifest.Backups, info)
+	if err := writeBackupManifest(db.fs, backupDir, manifest); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (info *BackupInfo) addFile(file *BackupFile, dataFile bool) {
+	if dataFile {
+		info.DataFiles = append(info.DataFiles, file)
+	} else {
+		info.MetaFiles = append(info.MetaFiles, file)
+	}
+}
+
+// 把快照中的一个文件拷贝到destPath，同时计算大小和crc
+func (db *DB) copySnapshotFileWithCRC(file *snapshotFile, destPath string) (int64, uint32, error) {
+	return writeFileFrom(db.fs.IoType(), destPath, func(w io.Writer) error {
+		_, _, err := db.writeSnapshotFile(file, w)
+		return err
+	})
+}
+
+// Restore 使用backupDir中最近的一次备份，在targetDir中恢复出完整的数据目录
+// targetDir必须不存在，恢复时会校验每个文件以及其中每一条记录的crc，失败时删除targetDir
+func Restore(backupDir, targetDir string) error {
+	return restoreBackup(fio.OSFileSystem{}, backupDir, 0, targetDir)
+}
+
+// 恢复指定的备份，backupId为0时恢复最近的一次备份
+func restoreBackup(fs fio.FileSystem, backupDir string, backupId uint32, targetDir string) (err error) {
+	manifest, err := readBackupManifest(fs, backupDir)
+	if err != nil {
+		return err
+	}
+	var info *BackupInfo
+	for _, backup := range manifest.Backups {
+		if backupId == 0 || backup.Id == backupId {
+			info = backup
+		}
+	}
+	if info == nil {
+		return selferror.ErrBackupNotFound
+	}
+
+	if _, err := fs.Stat(targetDir); err == nil {
+		return selferror.ErrRestoreDirExists
+	}
+	if err := fs.MkdirAll(targetDir); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = fs.RemoveAll(targetDir)
+		}
+	}()
+
+	ioType := fs.IoType()
+	for _, file := range append(info.DataFiles, info.MetaFiles...) {
+		src := filepath.Join(backupSubDir(backupDir, file.BackupId), file.Name)
+		size, crc, err := copyFileWithCRC(ioType, src, filepath.Join(targetDir, file.Name))
+		if err != nil {
+			return err
+		}
+		if size != file.Size || crc != file.CRC {
+			return fmt.Errorf("%w: %s", selferror.ErrBackupCorrupted, src)
+		}
+	}
+	//逐条校验数据文件中的记录
+	for _, file := range info.DataFiles {
+		if err := verifyDataFile(targetDir, dataFileId(file.Name), ioType); err != nil {
+			return fmt.Errorf("%w: %s: %v", selferror.ErrBackupCorrupted, file.Name, err)
+		}
+	}
+	return nil
+}
+
+// 读取数据文件中的每一条记录，读取时会校验crc
+func verifyDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) error {
+	dataFile, err := data.OpenDataFile(dirPath, fileId, ioType)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	var offset int64
+	for {
+		_, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+func readBackupManifest(fs fio.FileSystem, backupDir string) (*BackupManifest, error) {
+	manifest := &BackupManifest{}
+	err := readJSONFile(fs, filepath.Join(backupDir, backupManifestName), manifest)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(manifest.Backups, func(i, j int) bool {
+		return manifest.Backups[i].Id < manifest.Backups[j].Id
+	})
+	return manifest, nil
+}
+
+func writeBackupManifest(fs fio.FileSystem, backupDir string, manifest *BackupManifest) error {
+	return writeJSONFile(fs, filepath.Join(backupDir, backupManifestName), manifest)
+}
+
+// 读取json文件，文件不存在时返回的错误满足os.IsNotExist
+func readJSONFile(fs fio.FileSystem, fileName string, v interface{}) error {
+	if _, err := fs.Stat(fileName); err != nil {
+		return err
+	}
+	ioManager, err := fio.NewIoManager(fileName, fs.IoType())
+	if err != nil {
+		return err
+	}
+	defer ioManager.Close()
+	size, err := ioManager.Size()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := ioManager.Read(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// 先写入临时文件再重命名，保证json文件是完整的
+func writeJSONFile(fs fio.FileSystem, fileName string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmpFileName := fileName + ".tmp"
+	if err := fs.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ioManager, err := fio.NewIoManager(tmpFileName, fs.IoType())
+	if err != nil {
+		return err
+	}
+	if _, err := ioManager.Write(buf); err != nil {
+		_ = ioManager.Close()
+		return err
+	}
+	if err := ioManager.Sync(); err != nil {
+		_ = ioManager.Close()
+		return err
+	}
+	if err := ioManager.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmpFileName, fileName)
+}
+
+// 流式拷贝文件，同时计算大小和crc，目标文件已经存在时会被覆盖
+func copyFileWithCRC(ioType fio.FileIOType, src, dest string) (int64, uint32, error) {
+	destFile, err := fio.NewIoManager(dest, ioType)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer destFile.Close()
+	if err := destFile.Truncate(0); err != nil {
+		return 0, 0, err
+	}
+	size, crc, err := readFileWithCRC(ioType, src, destFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, crc, destFile.Sync()
+}
+
+// 分块读取文件写入到w中，同时计算大小和crc
+func readFileWithCRC(ioType fio.FileIOType, fileName string, w io.Writer) (int64, uint32, error) {
+	file, err := fio.NewIoManager(fileName, ioType)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var offset int64
+	var crc uint32
+	buf := make([]byte, backupCopyBufferSize)
+	for {
+		n, err := file.Read(buf, offset)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return 0, 0, err
+			}
+			crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return offset, crc, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+func backupFileKey(name string, mergeEpoch uint32) string {
+	return fmt.Sprintf("%s@%d", name, mergeEpoch)
+}
+
+// 从数据文件名中解析出文件id
+func dataFileId(name string) uint32 {
+	var fileId uint32
+	_, _ = fmt.Sscanf(strings.TrimSuffix(name, data.DataFileNameSuffix), "%d", &fileId)
+	return fileId
+}
@@ -0,0 +1,171 @@
+package bitcast_go
+
+import (
+	"archive/tar"
+	"bitcast-go/fio"
+	"bitcast-go/selferror"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+//流式备份：把数据库的一致性快照写成一个tar流，方便上传到对象存储
+//tar流中依次是数据文件、元数据文件，最后是记录了每个文件大小和crc的备份清单
+
+// BackupTo 把数据库的一致性快照以tar流的形式写入到w中
+// 和检查点使用同一个快照，只在封存活跃文件和获取持久化索引的快照时持有db.mu，写入tar流期间只会推迟merge切换数据文件
+func (db *DB) BackupTo(w io.Writer) error {
+	_, err := db.BackupToWithPosition(w)
+	return err
+}
+
+// BackupToWithPosition 和BackupTo相同，同时返回快照对应的订阅位置，从这个位置订阅可以收到快照之后的所有写入
+func (db *DB) BackupToWithPosition(w io.Writer) (WatchPosition, error) {
+	//写入tar流期间，merge不能替换或者删除数据文件以及hint索引文件
+	db.fileRemoveLock.RLock()
+	defer db.fileRemoveLock.RUnlock()
+
+	snap, err := db.snapshot()
+	if err != nil {
+		return WatchPosition{}, err
+	}
+	defer snap.release()
+	return snap.position, db.writeStreamBackup(w, snap.files)
+}
+
+// 把快照中的文件和备份清单写成tar流，hint文件可以从数据文件中重建，不需要写入
+func (db *DB) writeStreamBackup(w io.Writer, files []*snapshotFile) error {
+	info := &BackupInfo{Time: time.Now()}
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		if file.hintFile {
+			continue
+		}
+		header := &tar.Header{Name: file.name, Mode: int64(fio.DataFilePerm), Size: file.size, ModTime: info.Time}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		size, crc, err := db.writeSnapshotFile(file, tw)
+		if err != nil {
+			return err
+		}
+		backupFile := &BackupFile{Name: file.name, Size: size, CRC: crc}
+		//旧的数据文件恢复时需要校验每一条记录
+		if file.dataFile {
+			info.DataFiles = append(info.DataFiles, backupFile)
+		} else {
+			info.MetaFiles = append(info.MetaFiles, backupFile)
+		}
+	}
+
+	//文件的crc在写入的过程中计算，所以清单放在最后
+	manifest, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: backupManifestName, Mode: int64(fio.DataFilePerm), Size: int64(len(manifest)), ModTime: info.Time}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// RestoreFrom 从BackupTo写入的tar流中恢复出完整的数据目录
+// dir必须不存在，恢复时会校验每个文件以及其中每一条记录的crc，失败时删除dir
+func RestoreFrom(r io.Reader, dir string) error {
+	return restoreFromStream(fio.OSFileSystem{}, r, dir)
+}
+
+func restoreFromStream(fs fio.FileSystem, r io.Reader, dir string) (err error) {
+	if _, err := fs.Stat(dir); err == nil {
+		return selferror.ErrRestoreDirExists
+	}
+	if err := fs.MkdirAll(dir); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = fs.RemoveAll(dir)
+		}
+	}()
+
+	var info *BackupInfo
+	restored := make(map[string]*BackupFile)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		//只能是数据目录中的文件，避免写到目录之外
+		if header.Typeflag != tar.TypeReg || filepath.Base(header.Name) != header.Name || header.Name == ".." {
+			return fmt.Errorf("%w: unexpected entry %s", selferror.ErrBackupCorrupted, header.Name)
+		}
+		if header.Name == backupManifestName {
+			info = &BackupInfo{}
+			if err := json.NewDecoder(tr).Decode(info); err != nil {
+				return fmt.Errorf("%w: %v", selferror.ErrBackupCorrupted, err)
+			}
+			continue
+		}
+		size, crc, err := writeFileWithCRC(fs.IoType(), filepath.Join(dir, header.Name), tr)
+		if err != nil {
+			return err
+		}
+		restored[header.Name] = &BackupFile{Name: header.Name, Size: size, CRC: crc}
+	}
+	if info == nil {
+		return fmt.Errorf("%w: manifest is missing", selferror.ErrBackupCorrupted)
+	}
+
+	//清单中的文件都存在并且大小和crc一致，同时没有多余的文件
+	expected := append(append([]*BackupFile{}, info.DataFiles...), info.MetaFiles...)
+	if len(expected) != len(restored) {
+		return fmt.Errorf("%w: expect %d files, got %d", selferror.ErrBackupCorrupted, len(expected), len(restored))
+	}
+	for _, file := range expected {
+		got, ok := restored[file.Name]
+		if !ok || got.Size != file.Size || got.CRC != file.CRC {
+			return fmt.Errorf("%w: %s", selferror.ErrBackupCorrupted, file.Name)
+		}
+	}
+	for _, file := range info.DataFiles {
+		if err := verifyDataFile(dir, dataFileId(file.Name), fs.IoType()); err != nil {
+			return fmt.Errorf("%w: %s: %v", selferror.ErrBackupCorrupted, file.Name, err)
+		}
+	}
+	return nil
+}
+
+// 把r中的数据写入到文件中，同时计算大小和crc
+func writeFileWithCRC(ioType fio.FileIOType, fileName string, r io.Reader) (int64, uint32, error) {
+	return writeFileFrom(ioType, fileName, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// 通过writeTo写入文件的内容，同时计算大小和crc，文件已经存在时会被覆盖
+func writeFileFrom(ioType fio.FileIOType, fileName string, writeTo func(w io.Writer) error) (int64, uint32, error) {
+	file, err := fio.NewIoManager(fileName, ioType)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	if err := file.Truncate(0); err != nil {
+		return 0, 0, err
+	}
+	cw := &crcWriter{w: file}
+	if err := writeTo(cw); err != nil {
+		return 0, 0, err
+	}
+	return cw.size, cw.crc, file.Sync()
+}
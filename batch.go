@@ -2,10 +2,11 @@ package bitcast_go
 
 import (
 	"bitcast-go/data"
+	"bitcast-go/index"
 	"bitcast-go/selferror"
-	"encoding/binary"
+	"context"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 const nonTransactionSeqNo uint64 = 0
@@ -22,7 +23,7 @@ type WriteBatch struct {
 
 //初始化WriteBatch方法
 func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	if db.option.IndexerType == BPlusTree && !db.seqNoFileExists && !db.isInitial { //如果是b+树，且事务序列号不存在，且不是第一次进入实例，则禁用掉事务功能，因为无法获取到事务序列号
+	if isPersistentIndexer(db.option.IndexerType) && !db.seqNoFileExists && !db.isInitial { //如果是b+树，且事务序列号不存在，且不是第一次进入实例，则禁用掉事务功能，因为无法获取到事务序列号
 		panic("cannot use write batch ,seq no file not exists")
 	}
 
@@ -86,55 +87,54 @@ func (wb *WriteBatch) Commit() error {
 	if uint(len(wb.pendingWrites)) > wb.options.MaxBatchNum {
 		return selferror.ErrExceedMaxBatchNum
 	}
-	//加锁保证事务提交的串行化
-	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
-	//获取到当前最新的事务序列号
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
-
-	//开始写数据到数据文件中
-	positions := make(map[string]*data.LogRecordPos)
+	//构造需要写入数据文件的数据，同一个事务的数据会连续写入
+	keys := make([][]byte, 0, len(wb.pendingWrites))
+	records := make([]*data.LogRecord, 0, len(wb.pendingWrites)+1)
 	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
+		keys = append(keys, record.Key)
+		records = append(records, &data.LogRecord{
 			Value: record.Value,
 			Type:  record.Type,
 		})
-
-		if err != nil {
-			return err
-		}
-		positions[string(record.Key)] = logRecordPos
 	}
 
-	//写一条标识事务完成的数据
-	finisedRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
+	//写一条标识事务完成的数据，事务提交的时间记录在这条数据中
+	records = append(records, &data.LogRecord{
 		Type: data.LogRecordTnxFinished,
-	}
-	if _, err := wb.db.appendLogRecord(finisedRecord); err != nil {
-		return err
-	}
+	})
 
-	//根据配置决定是否进行持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
-			return err
+	//在追加记录的时候分配事务序列号，保证日志中事务完成的记录按照序列号递增
+	prepare := func() {
+		wb.db.seqNo++
+		for i, key := range keys {
+			records[i].Key = logRecordKeyWithSeq(key, wb.db.seqNo)
 		}
+		finRecord := records[len(records)-1]
+		finRecord.Key = logRecordKeyWithSeq(txnFinKey, wb.db.seqNo)
+		finRecord.Timestamp = time.Now().UnixNano()
 	}
-	//更新对应的内存索引
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
-		var oldPos *data.LogRecordPos
-		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
-		}
-		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
-		}
-		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+
+	//根据配置决定是否进行持久化，需要持久化时通过组提交写入
+	needSync := wb.options.SyncWrites || wb.db.option.SyncWrites
+	err := wb.db.writeLogRecords(context.Background(), records, prepare, needSync, func(w index.Writer, positions []*data.LogRecordPos) error {
+		//更新对应的内存索引
+		for i, key := range keys {
+			record := wb.pendingWrites[string(key)]
+			var oldPos *data.LogRecordPos
+			if record.Type == data.LogRecordNormal {
+				oldPos = w.Put(key, positions[i])
+			}
+			if record.Type == data.LogRecordDeleted {
+				oldPos, _ = w.Delete(key)
+			}
+			if oldPos != nil {
+				wb.db.reclaimSize += int64(oldPos.Size)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	//清空暂存的数据，方便下次commit
@@ -145,17 +145,10 @@ func (wb *WriteBatch) Commit() error {
 
 //key+seq Number编码
 func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
-	seq := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(seq[:], seqNo)
-	encKey := make([]byte, n+len(key))
-	copy(encKey[:n], seq[:n])
-	copy(encKey[n:], key)
-	return encKey
+	return data.LogRecordKeyWithSeq(key, seqNo)
 }
 
 //解析LogRecord的key，获取实际的key和事务序列号
 func parseLogRecordKey(key []byte) ([]byte, uint64) {
-	seqNo, n := binary.Uvarint(key)
-	realKey := key[n:]
-	return realKey, seqNo
+	return data.ParseLogRecordKey(key)
 }
@@ -1,9 +1,16 @@
 package bitcast_go
 
 import (
+	"bitcast-go/data"
+	"bitcast-go/fio"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDB_WriteBatch(t *testing.T) {
@@ -30,3 +37,93 @@ func TestDB_WriteBatch(t *testing.T) {
 	t.Log(get)
 	t.Log(err)
 }
+
+// Sync比较慢的文件，用于放大组提交在Sync期间和其他写入交错的情况
+type slowSyncIO struct {
+	fio.IOManager
+}
+
+func (s slowSyncIO) Sync() error {
+	time.Sleep(time.Millisecond)
+	return s.IOManager.Sync()
+}
+
+// 同步提交的批量写入和不需要持久化的写入并发修改同一个key，内存索引和日志中的顺序保持一致
+func TestDB_WriteBatchConcurrentWithPut(t *testing.T) {
+	fio.SetIoManagerHook(func(fileName string, ioManager fio.IOManager) fio.IOManager {
+		return slowSyncIO{ioManager}
+	})
+	defer fio.SetIoManagerHook(nil)
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-concurrent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+				assert.Nil(t, wb.Put(testKey(i), []byte(fmt.Sprintf("batch-%d", g))))
+				assert.Nil(t, wb.Commit())
+			}
+		}(g)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("put-%d", g))))
+			}
+		}(g)
+	}
+	wg.Wait()
+	expected := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		expected[i], err = db.Get(testKey(i))
+		assert.Nil(t, err)
+	}
+
+	//日志中事务完成的记录按照序列号递增
+	var lastSeqNo uint64
+	fileIds := []uint32{db.activeFile.FileId}
+	for fileId := range db.olderFiles {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+	for _, fileId := range fileIds {
+		dataFile := db.activeFile
+		if fileId != db.activeFile.FileId {
+			dataFile = db.olderFiles[fileId]
+		}
+		var offset int64
+		for {
+			record, size, err := dataFile.ReadLogRecord(offset)
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			if record.Type == data.LogRecordTnxFinished {
+				_, seqNo := parseLogRecordKey(record.Key)
+				assert.Equal(t, lastSeqNo+1, seqNo)
+				lastSeqNo = seqNo
+			}
+			offset += size
+		}
+	}
+	assert.Equal(t, uint64(800), lastSeqNo)
+
+	//重启之后从日志中加载的值和内存索引中的一致
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		actual, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected[i], actual)
+	}
+}
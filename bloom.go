@@ -0,0 +1,125 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/index"
+	"os"
+	"path/filepath"
+)
+
+const bloomFilterKey = "bloom-filter"
+
+// 初始化布隆过滤器，并包装在内存索引的前面
+// B+树等持久化的索引不会在启动时重新加载，所以需要读取持久化的过滤器，不存在的话则遍历索引重建
+// 其他的索引在启动加载的时候会把所有的key重新put一遍，直接使用新的过滤器即可
+func (db *DB) initBloomFilter() error {
+	if !db.option.EnableBloomFilter {
+		return nil
+	}
+	var filter *index.BloomFilter
+	if isPersistentIndexer(db.option.IndexerType) {
+		var err error
+		if filter, err = db.loadBloomFilter(); err != nil {
+			return err
+		}
+		if filter == nil {
+			filter = db.newBloomFilter()
+			iterator := db.index.Iterator(false)
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				filter.Add(iterator.Key())
+			}
+			iterator.Close()
+		}
+	} else {
+		filter = db.newBloomFilter()
+	}
+
+	//读取之后就删除掉持久化的文件，避免异常退出之后使用了过期的过滤器
+	bloomFileName := filepath.Join(db.option.DirPath, data.BloomFilterFileName)
+	if err := db.fs.Remove(bloomFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db.bloom = index.NewBloomIndexer(db.index, filter)
+	db.index = db.bloom
+	return nil
+}
+
+// 根据配置和当前key的数量创建新的布隆过滤器
+func (db *DB) newBloomFilter() *index.BloomFilter {
+	expectedKeys := db.option.BloomFilterExpectedKeys
+	if size := uint64(db.index.Size()) * 2; size > expectedKeys {
+		expectedKeys = size
+	}
+	return index.NewBloomFilter(expectedKeys, db.option.BloomFilterFalsePositiveRate)
+}
+
+// 过滤器中的key太多，估算的误判率超过配置的误判率一定倍数之后，按照当前key的数量在后台重建
+// 调用时需要持有writeLock和db.mu，或者还没有开始使用，这样开始重建和创建索引的迭代器之间不会有写入被遗漏，遍历索引时不持有锁
+func (db *DB) maybeRebuildBloomFilter() {
+	if db.bloom == nil || !db.bloom.Filter().Overloaded(db.option.BloomFilterFalsePositiveRate) {
+		return
+	}
+	filter := db.newBloomFilter()
+	//merge正在重建时，由merge完成重建
+	if !db.bloom.StartRebuild(filter) {
+		return
+	}
+	iterator := db.index.Iterator(false)
+	db.bloomWg.Add(1)
+	go func() {
+		defer db.bloomWg.Done()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			filter.Add(iterator.Key())
+		}
+		iterator.Close()
+		db.bloom.FinishRebuild(filter)
+	}()
+}
+
+// 读取持久化的布隆过滤器，文件不存在或者已经损坏时返回nil
+func (db *DB) loadBloomFilter() (*index.BloomFilter, error) {
+	bloomFileName := filepath.Join(db.option.DirPath, data.BloomFilterFileName)
+	if _, err := db.fs.Stat(bloomFileName); os.IsNotExist(err) {
+		return nil, nil
+	}
+	bloomFile, err := data.OpenBloomFilterFile(db.option.DirPath, db.fs.IoType())
+	if err != nil {
+		return nil, err
+	}
+	defer bloomFile.Close()
+	record, _, err := bloomFile.ReadLogRecord(0)
+	if err != nil {
+		return nil, nil
+	}
+	filter, err := index.DecodeBloomFilter(record.Value)
+	if err != nil {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// 持久化布隆过滤器，只有B+树等持久化的索引需要
+func (db *DB) saveBloomFilter() error {
+	if db.bloom == nil || !isPersistentIndexer(db.option.IndexerType) {
+		return nil
+	}
+	bloomFileName := filepath.Join(db.option.DirPath, data.BloomFilterFileName)
+	if err := db.fs.Remove(bloomFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	bloomFile, err := data.OpenBloomFilterFile(db.option.DirPath, db.fs.IoType())
+	if err != nil {
+		return err
+	}
+	defer bloomFile.Close()
+	record := &data.LogRecord{
+		Key:   []byte(bloomFilterKey),
+		Value: db.bloom.Filter().Encode(),
+	}
+	encRecord, _ := data.EncodeLogRecord(record)
+	if err := bloomFile.Write(encRecord); err != nil {
+		return err
+	}
+	return bloomFile.Sync()
+}
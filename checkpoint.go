@@ -0,0 +1,210 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/index"
+	"bitcast-go/selferror"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Checkpoint 在dir中创建数据库当前状态的检查点，dir必须不存在，可以直接作为数据目录打开
+// 先把活跃文件转换为旧的数据文件，旧的数据文件不会再被修改，使用硬链接放到检查点中，其他的文件在释放db.mu之后再拷贝
+// 硬链接失败时（例如dir和数据目录不在同一个文件系统中）退化为流式拷贝，其他数据文件目录中的数据文件也放到dir中
+// 只在封存活跃文件和获取持久化索引的快照时持有db.mu，链接和拷贝文件期间只会推迟merge切换数据文件
+func (db *DB) Checkpoint(dir string) (err error) {
+	if _, err := db.fs.Stat(dir); err == nil {
+		return selferror.ErrCheckpointDirExists
+	}
+
+	//链接和拷贝期间，merge不能替换或者删除数据文件以及hint索引文件
+	db.fileRemoveLock.RLock()
+	defer db.fileRemoveLock.RUnlock()
+
+	if err := db.fs.MkdirAll(dir); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = db.fs.RemoveAll(dir)
+		}
+	}()
+
+	snap, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.release()
+	for _, file := range snap.files {
+		destPath := filepath.Join(dir, file.name)
+		if file.dataFile || file.hintFile {
+			if err := db.fs.Link(file.path, destPath); err == nil {
+				continue
+			}
+		}
+		if err := db.copySnapshotFile(file, destPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 数据库某一时刻的一致性快照，检查点和各种备份共用
+type dbSnapshot struct {
+	files      []*snapshotFile
+	position   WatchPosition   //快照包含了这个位置之前的所有写入
+	mergeEpoch uint32          //最近一次merge的批次，0表示没有经过merge，和BackupFile中的MergeEpoch相同
+	index      *index.Snapshot //持久化索引的快照，为nil表示索引没有需要拷贝的文件
+}
+
+// 快照中的一个文件，path不为空时从数据目录中读取，否则通过writeTo写出
+type snapshotFile struct {
+	name     string
+	path     string
+	size     int64
+	writeTo  func(w io.Writer) error
+	dataFile bool //不会再被修改的旧数据文件
+	hintFile bool //旧数据文件对应的hint文件
+}
+
+func (snap *dbSnapshot) release() {
+	if snap.index != nil {
+		snap.index.Release()
+	}
+}
+
+// 封存活跃文件，获取数据库当前的一致性快照，调用时需要持有fileRemoveLock的读锁，直到快照中的文件写出完成，之后需要调用release
+// 只在封存活跃文件、确定文件列表和获取持久化索引的快照时持有db.mu，文件的内容在释放锁之后再读取
+// 旧的数据文件、hint索引和merge完成文件只有merge会修改，持久化索引通过快照写出，不会受到之后写入的影响
+func (db *DB) snapshot() (snap *dbSnapshot, err error) {
+	//组提交中已经追加但还没有更新索引的写入完成之后再封存
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	//活跃文件中有数据时，将其转换为旧的数据文件
+	if db.activeFile != nil && db.activeFile.WriteOff > 0 {
+		if err := db.rotateActiveDataFile(); err != nil {
+			return nil, err
+		}
+	}
+	snap = &dbSnapshot{}
+	//活跃文件封存之后，快照包含了当前活跃文件之前的所有数据
+	if db.activeFile != nil {
+		snap.position = WatchPosition{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff}
+	}
+	if _, err := db.fs.Stat(filepath.Join(db.option.DirPath, data.MergeFinishedFileName)); err == nil {
+		if snap.mergeEpoch, err = db.getNonMergeFileId(db.option.DirPath); err != nil {
+			return nil, err
+		}
+	}
+	if snap.index, err = index.TakeSnapshot(db.index); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			snap.release()
+		}
+	}()
+
+	names, err := db.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if name == fileLockName || name == data.SeqNoFileName {
+			continue
+		}
+		if snap.index != nil && index.IsIndexFile(name) {
+			continue
+		}
+		//活跃文件是空的，在快照中创建一个新的空文件，快照打开之后写入的数据不能影响当前的数据库
+		if db.activeFile != nil && name == filepath.Base(data.GetDataFileName("", db.activeFile.FileId)) {
+			snap.files = append(snap.files, contentSnapshotFile(name, []byte{}))
+			continue
+		}
+		file := &snapshotFile{name: name, path: db.filePath(name)}
+		stat, err := db.fs.Stat(file.path)
+		if err != nil {
+			return nil, err
+		}
+		file.size = stat.Size()
+		if db.isImmutableFile(name) {
+			file.dataFile = filepath.Ext(name) == data.DataFileNameSuffix
+			file.hintFile = !file.dataFile
+		}
+		snap.files = append(snap.files, file)
+	}
+	if snap.index != nil {
+		for _, indexFile := range snap.index.Files {
+			snap.files = append(snap.files, &snapshotFile{name: indexFile.Name, size: indexFile.Size, writeTo: indexFile.WriteTo})
+		}
+	}
+	//事务序列号只在关闭的时候才会保存，这里写入当前的值
+	snap.files = append(snap.files, contentSnapshotFile(data.SeqNoFileName, db.encodeSeqNo()))
+	return snap, nil
+}
+
+func contentSnapshotFile(name string, content []byte) *snapshotFile {
+	return &snapshotFile{
+		name: name,
+		size: int64(len(content)),
+		writeTo: func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		},
+	}
+}
+
+// 把快照中的一个文件写入到w中，同时计算大小和crc
+func (db *DB) writeSnapshotFile(file *snapshotFile, w io.Writer) (int64, uint32, error) {
+	if file.path != "" {
+		return readFileWithCRC(db.fs.IoType(), file.path, w)
+	}
+	cw := &crcWriter{w: w}
+	if err := file.writeTo(cw); err != nil {
+		return 0, 0, err
+	}
+	return cw.size, cw.crc, nil
+}
+
+// 把快照中的一个文件拷贝到destPath
+func (db *DB) copySnapshotFile(file *snapshotFile, destPath string) error {
+	if file.path != "" {
+		return db.fs.CopyFile(file.path, destPath)
+	}
+	_, _, err := writeFileFrom(db.fs.IoType(), destPath, file.writeTo)
+	return err
+}
+
+// 写入的同时计算大小和crc
+type crcWriter struct {
+	w    io.Writer
+	size int64
+	crc  uint32
+}
+
+func (cw *crcWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.size += int64(n)
+	cw.crc = crc32.Update(cw.crc, crc32.IEEETable, p[:n])
+	return n, err
+}
+
+// 判断数据目录中的文件是否为不会再被修改的旧数据文件或者对应的hint文件
+func (db *DB) isImmutableFile(name string) bool {
+	ext := filepath.Ext(name)
+	if ext != data.DataFileNameSuffix && ext != data.DataHintFileNameSuffix {
+		return false
+	}
+	fileId, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 32)
+	if err != nil {
+		return false
+	}
+	_, ok := db.olderFiles[uint32(fileId)]
+	return ok
+}
@@ -0,0 +1,220 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/index"
+	"context"
+	"sync"
+)
+
+//组提交：需要持久化的写入（Put、Delete、WriteBatch.Commit）先进入队列
+//队列中第一个写入者成为leader，持有db.mu把当前排队的所有写入追加到活跃文件中，释放db.mu之后只调用一次Sync
+//Sync成功之后再持有db.mu按顺序更新索引，需要单独持久化的索引在释放db.mu之后持久化，之后再通知订阅者，最后通知每个写入者
+//索引（包括持久化的索引）和订阅者只会看到已经持久化的数据
+//leader从追加到更新索引的整个过程中持有db.writeLock，其他的写入不能插在中间，索引的更新顺序和日志中记录的顺序保持一致
+//leader在Sync的时候不持有db.mu，读取不会被阻塞，这段时间新到达的写入会继续排队，组成下一组，由下一个leader提交
+//排队中的写入的ctx被取消时直接离开队列；已经被leader取走的写入在追加之前检查ctx，被取消的不会写入
+
+// 一次写入请求，包含一条或多条需要连续写入的记录
+type commitRequest struct {
+	ctx     context.Context
+	records []*data.LogRecord
+	prepare func()                                                     //追加记录之前调用，例如分配事务序列号，可以为nil，调用时持有db.mu
+	apply   func(w index.Writer, positions []*data.LogRecordPos) error //记录持久化之后通过w更新索引，调用时持有db.mu
+	err     error
+	wake    chan bool //true表示已经提交完成，false表示成为了新的leader
+	leading bool      //已经被选为下一个leader，不能再离开队列，由commitQueue.mu保护
+}
+
+// 组提交的队列
+type commitQueue struct {
+	mu         *sync.Mutex
+	requests   []*commitRequest
+	committing bool //是否有leader正在提交
+}
+
+func newCommitQueue() *commitQueue {
+	return &commitQueue{mu: new(sync.Mutex)}
+}
+
+// 写入记录并更新内存索引，needSync为true时通过组提交保证返回前数据已经持久化
+// 追加之前ctx已经被取消时不会写入，返回ctx的错误
+func (db *DB) writeLogRecords(ctx context.Context, records []*data.LogRecord, prepare func(), needSync bool, apply func(w index.Writer, positions []*data.LogRecordPos) error) error {
+	//索引在后台写入磁盘失败之后，磁盘上的索引已经不完整了，不再接受新的写入
+	if err := db.indexErr(); err != nil {
+		return err
+	}
+	if needSync {
+		return db.groupCommit(&commitRequest{
+			ctx:     ctx,
+			records: records,
+			prepare: prepare,
+			apply:   apply,
+			wake:    make(chan bool, 1),
+		})
+	}
+
+	//等待writeLock和db.mu期间ctx被取消时不会写入
+	if err := lockCtx(ctx, db.writeLock.Lock, db.writeLock.TryLock, db.writeLock.Unlock); err != nil {
+		return err
+	}
+	defer db.writeLock.Unlock()
+	if err := lockCtx(ctx, db.mu.Lock, db.mu.TryLock, db.mu.Unlock); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	if prepare != nil {
+		prepare()
+	}
+	positions := make([]*data.LogRecordPos, len(records))
+	for i, record := range records {
+		pos, err := db.appendLogRecord(record)
+		if err != nil {
+			return err
+		}
+		positions[i] = pos
+	}
+	//同一批写入在持久化的索引中作为一个整体提交
+	if err := index.WriteBatch(db.index, func(w index.Writer) error {
+		return apply(w, positions)
+	}); err != nil {
+		return err
+	}
+	db.maybeRebuildBloomFilter()
+	db.notifyWatchers(records, positions)
+	return nil
+}
+
+// 加入组提交的队列，等待自己的写入持久化完成
+func (db *DB) groupCommit(req *commitRequest) error {
+	queue := db.commitQueue
+	queue.mu.Lock()
+	queue.requests = append(queue.requests, req)
+	if queue.committing {
+		queue.mu.Unlock()
+		var done bool
+		select {
+		case done = <-req.wake:
+		case <-req.ctx.Done():
+			if queue.cancel(req) {
+				return req.ctx.Err()
+			}
+			done = <-req.wake
+		}
+		if done {
+			return req.err
+		}
+		//上一个leader把提交的任务交给了当前请求
+		queue.mu.Lock()
+	}
+	queue.committing = true
+	group := queue.requests
+	queue.requests = nil
+	queue.mu.Unlock()
+
+	db.commitGroup(group)
+
+	for _, r := range group {
+		if r != req {
+			r.wake <- true
+		}
+	}
+
+	//如果还有在排队的写入，交给队列中的第一个作为下一个leader
+	queue.mu.Lock()
+	if len(queue.requests) > 0 {
+		next := queue.requests[0]
+		next.leading = true
+		queue.mu.Unlock()
+		next.wake <- false
+	} else {
+		queue.committing = false
+		queue.mu.Unlock()
+	}
+	return req.err
+}
+
+// 把还在排队的请求从队列中移除，请求已经被leader取走或者成为了下一个leader时返回false
+func (queue *commitQueue) cancel(req *commitRequest) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if req.leading {
+		return false
+	}
+	for i, r := range queue.requests {
+		if r == req {
+			queue.requests = append(queue.requests[:i], queue.requests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 提交一组写入：按顺序追加记录，释放锁之后Sync一次，持久化成功之后再按顺序更新索引并通知订阅者
+// Sync失败时不会更新索引，也不会通知订阅者，写入返回错误；已经追加的记录和没有持久化的写入一样，重启之后可能会被加载
+func (db *DB) commitGroup(group []*commitRequest) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	db.mu.Lock()
+	positions := make([][]*data.LogRecordPos, len(group))
+	for i, req := range group {
+		if err := req.ctx.Err(); err != nil {
+			req.err = err
+			continue
+		}
+		if req.prepare != nil {
+			req.prepare()
+		}
+		for _, record := range req.records {
+			pos, err := db.writeLogRecord(record)
+			if err != nil {
+				req.err = err
+				break
+			}
+			positions[i] = append(positions[i], pos)
+		}
+	}
+	activeFile := db.activeFile
+	db.mu.Unlock()
+
+	//切换活跃文件的时候，旧的文件已经持久化过了，只需要持久化当前的活跃文件
+	var syncErr error
+	if activeFile != nil {
+		syncErr = activeFile.Sync()
+	}
+
+	//一组写入在持久化的索引中作为一个整体提交，索引的事务或者预写日志写入失败时，这一组写入在重启之后可能丢失，不能返回成功
+	var indexErr error
+	if syncErr == nil {
+		db.mu.Lock()
+		indexErr = index.WriteBatch(db.index, func(w index.Writer) error {
+			for i, req := range group {
+				if req.err == nil {
+					req.err = req.apply(w, positions[i])
+				}
+			}
+			return nil
+		})
+		db.maybeRebuildBloomFilter()
+		db.mu.Unlock()
+		//需要单独持久化的索引（分层索引的预写日志）在释放db.mu之后持久化，一组写入只需要一次
+		if indexErr == nil {
+			indexErr = index.Sync(db.index)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, req := range group {
+		if req.err == nil && syncErr != nil {
+			req.err = syncErr
+		}
+		if req.err == nil && indexErr != nil {
+			req.err = indexErr
+		}
+		if req.err == nil {
+			db.notifyWatchers(req.records, positions[i])
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package bitcast_go
+
+import (
+	"bitcast-go/fio"
+	"bitcast-go/selferror"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//崩溃恢复测试：在随机的位置注入写入或者持久化失败，然后模拟掉电，重新打开之后检查
+//1. 已经成功返回的持久化写入不会丢失
+//2. 没有提交成功的WriteBatch要么全部生效，要么全部不生效
+
+const crashTestKeyNum = 50
+
+// 崩溃前最后一个失败的操作，value为nil表示删除
+type crashTestOp struct {
+	writes map[string][]byte
+	batch  bool
+}
+
+func TestDB_CrashRecovery(t *testing.T) {
+	//持久化的索引在崩溃之后不会从数据文件中重建，索引中不能有没有持久化的数据的位置
+	indexerTypes := []IndexerType{BTree, BPlusTree, Hybrid}
+	names := []string{"btree", "bptree", "hybrid"}
+	for i, indexerType := range indexerTypes {
+		if isPersistentIndexer(indexerType) && DefaultOptions.InMemory {
+			continue
+		}
+		for seed := int64(0); seed < 60; seed++ {
+			t.Run(fmt.Sprintf("%s-seed-%d", names[i], seed), func(t *testing.T) {
+				runCrashRecovery(t, indexerType, rand.New(rand.NewSource(seed)))
+			})
+		}
+	}
+}
+
+func runCrashRecovery(t *testing.T, indexerType IndexerType, r *rand.Rand) {
+	opts := DefaultOptions
+	//持久化的索引只有在新创建的目录中才可以使用WriteBatch
+	dir, _ := os.MkdirTemp("", "bitcask-go-crash")
+	defer os.RemoveAll(dir)
+	opts.DirPath = filepath.Join(dir, "db")
+	opts.IndexerType = indexerType
+	opts.DataFileSize = 16 * 1024
+	opts.SyncWrites = true
+
+	injector := fio.NewFaultInjector()
+	switch r.Intn(3) {
+	case 0:
+		injector.FailWriteAfterBytes(r.Int63n(64*1024), r.Intn(2) == 0)
+	case 1:
+		injector.FailWriteAfterCalls(r.Intn(500))
+	case 2:
+		injector.FailSyncAfterCalls(r.Intn(200))
+	}
+	fio.SetIoManagerHook(injector.Wrap)
+	defer fio.SetIoManagerHook(nil)
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	//已经成功返回的写入
+	acked := make(map[string][]byte)
+	var failed *crashTestOp
+	for i := 0; i < 400 && failed == nil; i++ {
+		op := &crashTestOp{writes: make(map[string][]byte)}
+		var err error
+		switch n := r.Intn(100); {
+		case n < 60:
+			key, value := testKey(r.Intn(crashTestKeyNum)), testValue(r.Int())
+			op.writes[string(key)] = value
+			err = db.Put(key, value)
+		case n < 75:
+			key := testKey(r.Intn(crashTestKeyNum))
+			op.writes[string(key)] = nil
+			err = db.Delete(key)
+			if err == selferror.ErrKeyNotFound {
+				err = nil
+			}
+		default:
+			op.batch = true
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			for j := 0; j < 2+r.Intn(5); j++ {
+				key := testKey(r.Intn(crashTestKeyNum))
+				if r.Intn(4) == 0 {
+					op.writes[string(key)] = nil
+					assert.Nil(t, wb.Delete(key))
+				} else {
+					value := testValue(r.Int())
+					op.writes[string(key)] = value
+					assert.Nil(t, wb.Put(key, value))
+				}
+			}
+			err = wb.Commit()
+		}
+		if err != nil {
+			failed = op
+			break
+		}
+		for key, value := range op.writes {
+			acked[key] = value
+		}
+	}
+
+	//模拟掉电，随机保留一部分没有持久化的数据
+	var torn *rand.Rand
+	if r.Intn(2) == 0 {
+		torn = r
+	}
+	assert.Nil(t, injector.PowerLoss(torn))
+	db.hintWg.Wait()
+	//释放持久化的索引的文件锁，索引中只有数据已经持久化的位置，关闭时写入索引文件和崩溃之前写入是一样的
+	_ = db.index.Close()
+	assert.Nil(t, db.fileLock.Unlock())
+	fio.SetIoManagerHook(nil)
+
+	db2, err := Open(opts)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer destroyDB(db2)
+
+	get := func(key string) []byte {
+		value, err := db2.Get([]byte(key))
+		if err == selferror.ErrKeyNotFound {
+			return nil
+		}
+		assert.Nil(t, err)
+		return value
+	}
+	for i := 0; i < crashTestKeyNum; i++ {
+		key := string(testKey(i))
+		if failed != nil {
+			if _, ok := failed.writes[key]; ok {
+				continue
+			}
+		}
+		assert.Equal(t, acked[key], get(key), key)
+	}
+	if failed == nil {
+		return
+	}
+
+	//失败的操作要么全部生效，要么全部不生效
+	allOld, allNew := true, true
+	for key, value := range failed.writes {
+		current := get(key)
+		allOld = allOld && assert.ObjectsAreEqual(acked[key], current)
+		allNew = allNew && assert.ObjectsAreEqual(value, current)
+	}
+	assert.True(t, allOld || allNew, "batch=%v partially applied", failed.batch)
+}
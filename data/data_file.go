@@ -10,10 +10,18 @@ import (
 )
 
 const DataFileNameSuffix = ".data"
+const DataHintFileNameSuffix = ".hint"
 const HintFileName = "hint-index"
 const MergeFinishedFileName = "merge-finished"
 const SeqNoFileName = "seq-no"
 
+// MergeDirNameSuffix merge目录的名称是数据目录的名称加上这个后缀
+const MergeDirNameSuffix = "-merge"
+const BloomFilterFileName = "bloom-filter"
+
+// DataFileDirsFileName 记录不在数据目录中的数据文件所在目录的映射文件，内容是文件id到目录的JSON
+const DataFileDirsFileName = "data-file-dirs"
+
 // DataFile 数据文件
 type DataFile struct {
 	FileId    uint32        //文件id
@@ -27,29 +35,77 @@ func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFi
 	return newDataFile(fileName, fileId, ioType)
 }
 
+// OpenPreallocDataFile 打开预分配空间的数据文件，用作活跃文件
+func OpenPreallocDataFile(dirPath string, fileId uint32, preallocSize int64, directIO bool) (*DataFile, error) {
+	ioManager, err := fio.NewPreallocIoManager(GetDataFileName(dirPath, fileId), preallocSize, directIO)
+	if err != nil {
+		return nil, err
+	}
+	return &DataFile{
+		FileId:    fileId,
+		WriteOff:  0,
+		IoManager: ioManager,
+	}, nil
+}
+
 //打开Hint索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(dirPath string, ioType fio.FileIOType) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
-	return newDataFile(fileName, 0, fio.StandardFio)
+	return newDataFile(fileName, 0, ioType)
+}
+
+// OpenDataHintFile 打开单个数据文件对应的hint索引文件
+func OpenDataHintFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	fileName := GetDataHintFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, ioType)
 }
 
 //OpenMergeFinishedFile 打开标识Merge完成的文件
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
+func OpenMergeFinishedFile(dirPath string, ioType fio.FileIOType) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedFileName)
-	return newDataFile(fileName, 0, fio.StandardFio)
+	return newDataFile(fileName, 0, ioType)
 }
 
 // OpenSeqNoFile 打开事务序列号的文件
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
+func OpenSeqNoFile(dirPath string, ioType fio.FileIOType) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, SeqNoFileName)
+	return newDataFile(fileName, 0, ioType)
+}
+
+// OpenBloomFilterFile 打开持久化布隆过滤器的文件
+func OpenBloomFilterFile(dirPath string, ioType fio.FileIOType) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, BloomFilterFileName)
+	return newDataFile(fileName, 0, ioType)
+}
+
+// OpenLogFile 打开指定路径的、和数据文件格式相同的日志文件，例如索引的预写日志
+func OpenLogFile(fileName string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.StandardFio)
 }
 
+// OpenReadOnlyFile 以只读的方式打开已经存在的、和数据文件格式相同的文件，用于在其他进程中读取数据目录
+func OpenReadOnlyFile(fileName string, fileId uint32) (*DataFile, error) {
+	ioManager, err := fio.NewReadOnlyFileIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &DataFile{
+		FileId:    fileId,
+		WriteOff:  0,
+		IoManager: ioManager,
+	}, nil
+}
+
 func GetDataFileName(dirPath string, fileId uint32) string {
 	fileName := filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 	return fileName
 }
 
+// GetDataHintFileName 数据文件对应的hint索引文件名称，如 000000001.hint
+func GetDataHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataHintFileNameSuffix)
+}
+
 func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	//初始化IOManager 管理器接口
 	ioManager, err := fio.NewIoManager(fileName, ioType)
@@ -98,7 +154,8 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	var recordSize = headerSize + keySize + valueSize
 
 	logRecord := &LogRecord{
-		Type: header.recordType,
+		Type:      header.recordType,
+		Timestamp: header.timestamp,
 	}
 
 	//开始读取用户实际存储的key/value数据
@@ -144,19 +201,33 @@ func (df *DataFile) SetIoManager(dirPath string, ioType fio.FileIOType) error {
 }
 
 func (df *DataFile) Write(buf []byte) error {
-	_, err := df.IoManager.Write(buf)
-	return err
+	n, err := df.IoManager.Write(buf)
+	if err != nil {
+		//丢弃只写入了一部分的数据，避免之后的写入接在不完整的数据后面
+		if n > 0 {
+			_ = df.IoManager.Truncate(df.WriteOff)
+		}
+		return err
+	}
+	df.WriteOff += int64(n)
+	return nil
 }
 
 //写入索引信息到hint文件中
 func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
+	return df.Write(EncodeHintRecord(key, LogRecordNormal, pos))
+}
+
+// EncodeHintRecord 对hint文件中的一条索引记录进行编码，value为编码后的位置信息
+func EncodeHintRecord(key []byte, typ LogRecordType, pos *LogRecordPos) []byte {
 	record := &LogRecord{
 		Key:   key,
 		Value: EncodeLogRecordPos(pos), //对pos进行编码
+		Type:  typ,
 	}
-	//再对record进行编码，然后写入
+	//再对record进行编码
 	encRecord, _ := EncodeLogRecord(record)
-	return df.Write(encRecord)
+	return encRecord
 }
 
 //指定读xx个字节，并指定使用IoManager，返回该字节数组
@@ -172,6 +243,7 @@ type logRecordHeader struct {
 	recordType LogRecordType //标识LogRecord的类型
 	keySize    uint32        //key的长度
 	vauleSize  uint32        //value的长度
+	timestamp  int64         //写入时的时间，0表示没有时间戳
 }
 
 //对字节数组中个Header进行解码，并拿到header信息
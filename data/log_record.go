@@ -11,12 +11,17 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTnxFinished
+	//标识数据文件的hint文件写入完成，只会出现在hint文件的最后
+	LogRecordHintFinished
 )
 
-//crc type keySize valueSize
+//type的最高位标识header中是否带有时间戳，没有时间戳的记录和之前的格式保持一致
+const logRecordTimestampFlag byte = 0x80
 
-//4 + 1 + 5 + 5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+//crc type keySize valueSize timestamp
+
+//4 + 1 + 5 + 5 + 10 = 25
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5
 
 //LogRecordPos 数据存储索引，主要是描述数据在磁盘上的位置
 type LogRecordPos struct {
@@ -31,17 +36,23 @@ type LogRecord struct {
 	Key   []byte
 	Value []byte
 	Type  LogRecordType //枚举，用于记录数据的状态
+
+	Timestamp int64 //写入时的时间（纳秒），只有非事务的写入和事务完成的记录才有，0表示没有时间戳
 }
 
 // EncodeLogRecord 对LogRecord进行编码，返回字节数组以及长度（需要对header信息编码为字节数组，因为key和value本身就是字节数组，无需编解码）
-// crc校验值 / type类型 / key size / value size / key / value
-//    4字节      1字节      变长（最大5）           变长
+// crc校验值 / type类型 / key size / value size / timestamp / key / value
+//
+//	4字节      1字节      变长（最大5）    变长（最大10，可选） 变长
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	//初始化一个头部信息的header字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
 
 	//从第五个字节存储type
 	header[4] = logRecord.Type
+	if logRecord.Timestamp != 0 {
+		header[4] |= logRecordTimestampFlag
+	}
 	var index = 5
 	//5字节之后，存储的是key和value的长度信息
 	//使用变长类型，节省空间
@@ -49,6 +60,9 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	//binary.PutVarint函数是用于将整数编码为可变长度字节序列的函数，可变长度字节序列是一种用于压缩整数的编码方式，它使用更少的字节来表示较小的整数，从而节省存储空间
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	if logRecord.Timestamp != 0 {
+		index += binary.PutVarint(header[index:], logRecord.Timestamp)
+	}
 
 	var size = index + len(logRecord.Key) + len(logRecord.Value) //编码之后的长度就是header的长度+key长度+value长度
 	encBytes := make([]byte, size)
@@ -83,22 +97,55 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	}
 	header := &logRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		recordType: buf[4] &^ logRecordTimestampFlag,
 	}
 	var index = 5
 
 	//Varint进行解码，返回长度和解码值，取出实际的 key size
 	keySize, n := binary.Varint(buf[index:])
+	//header只写入了一部分，当作读取到了文件末尾
+	if n <= 0 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 
 	//取出实际的value size
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.vauleSize = uint32(valueSize)
 	index += n
+
+	if buf[4]&logRecordTimestampFlag != 0 {
+		timestamp, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.timestamp = timestamp
+		index += n
+	}
 	return header, int64(index)
 }
 
+// LogRecordKeyWithSeq 在key前面加上事务序列号，非事务的写入序列号为0
+func LogRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
+	seq := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(seq[:], seqNo)
+	encKey := make([]byte, n+len(key))
+	copy(encKey[:n], seq[:n])
+	copy(encKey[n:], key)
+	return encKey
+}
+
+// ParseLogRecordKey 解析LogRecord的key，获取实际的key和事务序列号
+func ParseLogRecordKey(key []byte) ([]byte, uint64) {
+	seqNo, n := binary.Uvarint(key)
+	realKey := key[n:]
+	return realKey, seqNo
+}
+
 //暂存的事务相关的数据
 type TransactionRecord struct {
 	Record *LogRecord
@@ -30,10 +30,16 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 	t.Log(size1)
 	assert.NotNil(t, h1)
 	assert.Equal(t, int64(7), size1)
-	assert.Equal(t, uint32(2532332136), 2532332136)
+	assert.Equal(t, uint32(2532332136), h1.crc)
 	assert.Equal(t, LogRecordNormal, h1.recordType)
 	assert.Equal(t, uint32(4), h1.keySize)
 	assert.Equal(t, uint32(10), h1.vauleSize)
+
+	//只写入了一部分的header
+	h2, _ := decodeLogRecordHeader([]byte{104, 82, 240, 150, 0, 8})
+	assert.Nil(t, h2)
+	h3, _ := decodeLogRecordHeader([]byte{104, 82, 240, 150, 0, 0x80})
+	assert.Nil(t, h3)
 }
 
 func TestGetLogRecordCRC(t *testing.T) {
@@ -47,3 +53,28 @@ func TestGetLogRecordCRC(t *testing.T) {
 	t.Log(crc1)
 	assert.Equal(t, uint32(2532332136), crc1)
 }
+
+func TestEncodeLogRecord_Timestamp(t *testing.T) {
+	rec := &LogRecord{
+		Key:       []byte("name"),
+		Value:     []byte("bitcask-go"),
+		Type:      LogRecordDeleted,
+		Timestamp: 1700000000123456789,
+	}
+	res, n := EncodeLogRecord(rec)
+	withoutTimestamp, n2 := EncodeLogRecord(&LogRecord{Key: rec.Key, Value: rec.Value, Type: rec.Type})
+	assert.Greater(t, n, n2)
+	//没有时间戳的记录和之前的格式相同
+	assert.Equal(t, LogRecordDeleted, withoutTimestamp[4])
+
+	header, headerSize := decodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, LogRecordDeleted, header.recordType)
+	assert.Equal(t, rec.Timestamp, header.timestamp)
+	assert.Equal(t, n, headerSize+int64(len(rec.Key)+len(rec.Value)))
+	assert.Equal(t, header.crc, getLogRecordCRC(rec, res[crc32.Size:headerSize]))
+
+	//时间戳只写入了一部分
+	h, _ := decodeLogRecordHeader(res[:headerSize-1])
+	assert.Nil(t, h)
+}
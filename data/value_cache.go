@@ -0,0 +1,138 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+//每个缓存项除了value之外额外占用的内存，用于估算缓存的大小
+const valueCacheEntryOverhead = 64
+
+// ValueCache 数据文件中value的LRU缓存，key为数据在磁盘上的位置(Fid, Offset)
+// 数据文件是追加写入的，同一个位置的数据不会被修改，只有数据文件被删除或者替换的时候才需要失效
+type ValueCache struct {
+	lock     *sync.Mutex
+	capacity int64 //缓存的最大字节数
+	size     int64 //当前缓存的字节数
+	lru      *list.List
+	items    map[valueCacheKey]*list.Element
+	files    map[uint32]map[int64]struct{} //每个数据文件中被缓存的位置，用于按照文件失效
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type valueCacheKey struct {
+	fid    uint32
+	offset int64
+}
+
+type valueCacheEntry struct {
+	key   valueCacheKey
+	value []byte
+}
+
+// NewValueCache 初始化缓存，capacity为缓存的最大字节数
+func NewValueCache(capacity int64) *ValueCache {
+	return &ValueCache{
+		lock:     new(sync.Mutex),
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[valueCacheKey]*list.Element),
+		files:    make(map[uint32]map[int64]struct{}),
+	}
+}
+
+// Get 获取缓存的value，返回的是一份拷贝，调用方可以随意修改
+func (vc *ValueCache) Get(pos *LogRecordPos) ([]byte, bool) {
+	vc.lock.Lock()
+	elem, ok := vc.items[valueCacheKey{fid: pos.Fid, offset: pos.Offset}]
+	if !ok {
+		vc.lock.Unlock()
+		vc.misses.Add(1)
+		return nil, false
+	}
+	vc.lru.MoveToFront(elem)
+	value := elem.Value.(*valueCacheEntry).value
+	vc.lock.Unlock()
+
+	vc.hits.Add(1)
+	return append([]byte(nil), value...), true
+}
+
+// Put 缓存一个位置上的value，value会被拷贝，超过缓存大小的value不会被缓存
+func (vc *ValueCache) Put(pos *LogRecordPos, value []byte) {
+	entrySize := int64(len(value)) + valueCacheEntryOverhead
+	if entrySize > vc.capacity {
+		return
+	}
+	key := valueCacheKey{fid: pos.Fid, offset: pos.Offset}
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+	if elem, ok := vc.items[key]; ok {
+		vc.lru.MoveToFront(elem)
+		return
+	}
+	vc.items[key] = vc.lru.PushFront(&valueCacheEntry{key: key, value: append([]byte(nil), value...)})
+	offsets, ok := vc.files[key.fid]
+	if !ok {
+		offsets = make(map[int64]struct{})
+		vc.files[key.fid] = offsets
+	}
+	offsets[key.offset] = struct{}{}
+	vc.size += entrySize
+
+	//淘汰最久没有使用的value
+	for vc.size > vc.capacity {
+		vc.remove(vc.lru.Back())
+	}
+}
+
+// RemoveFile 删除一个数据文件中所有被缓存的value，在数据文件被删除或者替换时调用
+func (vc *ValueCache) RemoveFile(fid uint32) {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+	for offset := range vc.files[fid] {
+		vc.remove(vc.items[valueCacheKey{fid: fid, offset: offset}])
+	}
+}
+
+// Clear 清空缓存，命中和未命中的计数不会被清空
+func (vc *ValueCache) Clear() {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+	vc.lru.Init()
+	vc.items = make(map[valueCacheKey]*list.Element)
+	vc.files = make(map[uint32]map[int64]struct{})
+	vc.size = 0
+}
+
+// Size 当前缓存的字节数
+func (vc *ValueCache) Size() int64 {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+	return vc.size
+}
+
+// Hits 缓存命中的次数
+func (vc *ValueCache) Hits() uint64 {
+	return vc.hits.Load()
+}
+
+// Misses 缓存没有命中的次数
+func (vc *ValueCache) Misses() uint64 {
+	return vc.misses.Load()
+}
+
+//删除一个缓存项，调用前必须持有锁
+func (vc *ValueCache) remove(elem *list.Element) {
+	entry := vc.lru.Remove(elem).(*valueCacheEntry)
+	delete(vc.items, entry.key)
+	offsets := vc.files[entry.key.fid]
+	delete(offsets, entry.key.offset)
+	if len(offsets) == 0 {
+		delete(vc.files, entry.key.fid)
+	}
+	vc.size -= int64(len(entry.value)) + valueCacheEntryOverhead
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValueCache_GetPut(t *testing.T) {
+	vc := NewValueCache(3 * (valueCacheEntryOverhead + 10))
+	pos := func(fid uint32, offset int64) *LogRecordPos {
+		return &LogRecordPos{Fid: fid, Offset: offset}
+	}
+	value := []byte("0123456789")
+
+	_, ok := vc.Get(pos(1, 0))
+	assert.False(t, ok)
+	vc.Put(pos(1, 0), value)
+	vc.Put(pos(1, 20), value)
+	vc.Put(pos(2, 0), value)
+
+	//返回的是拷贝，修改之后不影响缓存
+	got, ok := vc.Get(pos(1, 0))
+	assert.True(t, ok)
+	assert.Equal(t, value, got)
+	got[0] = 'x'
+	got, _ = vc.Get(pos(1, 0))
+	assert.Equal(t, value, got)
+
+	//超过大小之后淘汰最久没有使用的
+	vc.Put(pos(3, 0), value)
+	_, ok = vc.Get(pos(1, 20))
+	assert.False(t, ok)
+	_, ok = vc.Get(pos(1, 0))
+	assert.True(t, ok)
+	assert.Equal(t, int64(3*(valueCacheEntryOverhead+10)), vc.Size())
+
+	//超过缓存大小的value不会被缓存
+	vc.Put(pos(4, 0), make([]byte, 1024))
+	_, ok = vc.Get(pos(4, 0))
+	assert.False(t, ok)
+
+	assert.Equal(t, uint64(3), vc.Hits())
+	assert.Equal(t, uint64(3), vc.Misses())
+}
+
+func TestValueCache_RemoveFile(t *testing.T) {
+	vc := NewValueCache(1024 * 1024)
+	for i := 0; i < 10; i++ {
+		vc.Put(&LogRecordPos{Fid: uint32(i % 2), Offset: int64(i)}, []byte("value"))
+	}
+	vc.RemoveFile(0)
+	for i := 0; i < 10; i++ {
+		_, ok := vc.Get(&LogRecordPos{Fid: uint32(i % 2), Offset: int64(i)})
+		assert.Equal(t, i%2 == 1, ok)
+	}
+	assert.Equal(t, int64(5*(valueCacheEntryOverhead+5)), vc.Size())
+
+	vc.Clear()
+	assert.Equal(t, int64(0), vc.Size())
+	_, ok := vc.Get(&LogRecordPos{Fid: 1, Offset: 1})
+	assert.False(t, ok)
+}
@@ -0,0 +1,247 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/fio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//数据文件分布在多个目录中：DataDirs中的目录可以位于不同的磁盘上，新的数据文件按照DataDirPolicy选择目录
+//不在DirPath中的数据文件所在的目录记录在DirPath中的映射文件里，映射文件在创建数据文件之前写入
+//merge时每个数据文件目录都有对应的merge目录，merge之后的数据文件通过重命名安装，不会跨磁盘移动
+
+const dataFileDirsName = data.DataFileDirsFileName
+
+// 数据文件所在的目录
+func (db *DB) dataFileDir(fileId uint32) string {
+	db.dataFileDirsLock.RLock()
+	defer db.dataFileDirsLock.RUnlock()
+	if dir, ok := db.dataFileDirs[fileId]; ok {
+		return dir
+	}
+	return db.option.DirPath
+}
+
+// 启动时加载映射文件，并创建不存在的数据文件目录
+func (db *DB) loadDataFileDirs() error {
+	dirs, err := readDataFileDirs(db.fs, db.option.DirPath)
+	if err != nil {
+		return err
+	}
+	db.dataFileDirs = dirs
+	for _, dir := range db.option.DataDirs {
+		if err := db.fs.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取数据目录中的映射文件，文件不存在时返回空的映射
+func readDataFileDirs(fs fio.FileSystem, dirPath string) (map[uint32]string, error) {
+	dirs := make(map[uint32]string)
+	err := readJSONFile(fs, filepath.Join(dirPath, dataFileDirsName), &dirs)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// 调用时持有dataFileDirsLock
+func (db *DB) writeDataFileDirs() error {
+	return writeJSONFile(db.fs, filepath.Join(db.option.DirPath, dataFileDirsName), db.dataFileDirs)
+}
+
+// 为新的数据文件选择目录，并在创建文件之前持久化映射，调用时持有db.mu
+func (db *DB) assignDataFileDir(fileId uint32) error {
+	dir, err := db.chooseDataFileDir(fileId)
+	if err != nil {
+		return err
+	}
+
+	db.dataFileDirsLock.Lock()
+	defer db.dataFileDirsLock.Unlock()
+	oldDir, ok := db.dataFileDirs[fileId]
+	switch {
+	case dir == db.option.DirPath && !ok:
+		return nil
+	case dir == db.option.DirPath:
+		delete(db.dataFileDirs, fileId)
+	case dir != oldDir:
+		db.dataFileDirs[fileId] = dir
+	}
+	if err := db.writeDataFileDirs(); err != nil {
+		return err
+	}
+	//新的文件id比已有的都大，目录中同名的文件是之前遗留下来的（例如从快照恢复了DirPath），不能接着写入
+	if dir != db.option.DirPath {
+		if err := db.fs.Remove(data.GetDataFileName(dir, fileId)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) chooseDataFileDir(fileId uint32) (string, error) {
+	dirs := db.option.DataDirs
+	if len(dirs) == 0 {
+		return db.option.DirPath, nil
+	}
+	if db.option.DataDirPolicy == RoundRobin {
+		return dirs[int(fileId)%len(dirs)], nil
+	}
+	var dir string
+	var maxSize uint64
+	for _, d := range dirs {
+		size, err := db.fs.AvailableSize(d)
+		if err != nil {
+			return "", err
+		}
+		if dir == "" || size > maxSize {
+			dir, maxSize = d, size
+		}
+	}
+	return dir, nil
+}
+
+// merge之后更新映射：参与merge的文件被替换，merge之后的文件位于mergedDirs中记录的目录，调用时持有db.mu
+func (db *DB) installMergedDataFileDirs(nonMergeFileId uint32, mergedDirs map[uint32]string) error {
+	db.dataFileDirsLock.Lock()
+	defer db.dataFileDirsLock.Unlock()
+	var changed bool
+	for fileId := range db.dataFileDirs {
+		if fileId < nonMergeFileId {
+			delete(db.dataFileDirs, fileId)
+			changed = true
+		}
+	}
+	for fileId, dir := range mergedDirs {
+		if dir != db.option.DirPath {
+			db.dataFileDirs[fileId] = dir
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return db.writeDataFileDirs()
+}
+
+// 所有可能存放数据文件的目录，包括映射文件中记录的已经不在DataDirs中的目录，DirPath在最前面
+func (db *DB) dataFileDirList() []string {
+	dirs := []string{db.option.DirPath}
+	seen := map[string]bool{filepath.Clean(db.option.DirPath): true}
+	add := func(dir string) {
+		if !seen[filepath.Clean(dir)] {
+			seen[filepath.Clean(dir)] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range db.option.DataDirs {
+		add(dir)
+	}
+	db.dataFileDirsLock.RLock()
+	defer db.dataFileDirsLock.RUnlock()
+	for _, dir := range db.dataFileDirs {
+		add(dir)
+	}
+	return dirs
+}
+
+// 数据目录和所有数据文件目录占用的磁盘空间
+func (db *DB) diskSize() (int64, error) {
+	var total int64
+	for _, dir := range db.dataFileDirList() {
+		size, err := db.fs.DirSize(dir)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// 新的数据文件可以使用的剩余空间
+// 轮流使用目录时，每个目录都要容纳同样多的数据，所以是剩余空间最少的目录的倍数
+func (db *DB) availableDataFileSize() (uint64, error) {
+	dirs := db.option.DataDirs
+	if len(dirs) == 0 {
+		return db.fs.AvailableSize(db.option.DirPath)
+	}
+	var total, minSize uint64
+	for i, dir := range dirs {
+		size, err := db.fs.AvailableSize(dir)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+		if i == 0 || size < minSize {
+			minSize = size
+		}
+	}
+	if db.option.DataDirPolicy == RoundRobin {
+		return minSize * uint64(len(dirs)), nil
+	}
+	return total, nil
+}
+
+// 数据文件目录对应的merge目录，和数据文件目录在同一个磁盘上
+func mergeDirOf(dir string) string {
+	return filepath.Clean(dir) + mergeDirName
+}
+
+// 删除所有的merge目录，DirPath对应的merge目录最后删除，只要它还存在就需要再次清理
+func (db *DB) removeMergeDirs() error {
+	for _, dir := range db.option.DataDirs {
+		if mergeDir := mergeDirOf(dir); mergeDir != db.getMergePath() {
+			if err := db.fs.RemoveAll(mergeDir); err != nil {
+				return err
+			}
+		}
+	}
+	return db.fs.RemoveAll(db.getMergePath())
+}
+
+// 数据目录中的文件名称，加上其他目录中的数据文件，不包括子目录和映射文件，按照名称排序
+// 备份和检查点中所有的数据文件都放在同一个目录中，不需要映射文件
+func (db *DB) listFiles() ([]string, error) {
+	entries, err := db.fs.ReadDir(db.option.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == dataFileDirsName {
+			continue
+		}
+		seen[entry.Name()] = true
+		names = append(names, entry.Name())
+	}
+	db.dataFileDirsLock.RLock()
+	defer db.dataFileDirsLock.RUnlock()
+	for fileId, dir := range db.dataFileDirs {
+		fileName := data.GetDataFileName(dir, fileId)
+		if _, err := db.fs.Stat(fileName); err != nil {
+			continue
+		}
+		if name := filepath.Base(fileName); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// listFiles返回的文件的路径
+func (db *DB) filePath(name string) string {
+	if strings.HasSuffix(name, data.DataFileNameSuffix) {
+		fileId := dataFileId(name)
+		return data.GetDataFileName(db.dataFileDir(fileId), fileId)
+	}
+	return filepath.Join(db.option.DirPath, name)
+}
@@ -5,17 +5,19 @@ import (
 	"bitcast-go/fio"
 	"bitcast-go/index"
 	"bitcast-go/selferror"
-	"bitcast-go/utils"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/gofrs/flock"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const seqNoKey = "seq.no"
@@ -23,19 +25,36 @@ const fileLockName = "flock"
 
 // DB bitcast存储引擎实例
 type DB struct {
-	option          Options                   //配置信息
-	mu              *sync.RWMutex             //锁
-	fileIds         []int                     //仅用于加载索引的时候使用（因为在加载磁盘文件的时候，已经将文件Id取出，但是在olderFiles的map里面是无序的，所以这里需要复用一下这个ids）
-	activeFile      *data.DataFile            //当前活跃数据文件，可以用于写入
-	olderFiles      map[uint32]*data.DataFile //旧的数据文件，只能用于读
-	index           index.Indexer             //内存索引
-	seqNo           uint64                    //事务序列号，全局递增
-	isMerging       bool                      //是否正在Merge
-	seqNoFileExists bool                      //存储事务序列号文件是否存在
-	isInitial       bool                      //是否是第一次初始化此数据目录
-	fileLock        *flock.Flock              //文件锁，保证多进程之间互斥
-	bytesWrite      uint                      //当前写了多少字节的累计值
-	reclaimSize     int64                     //表示有多少数据是无效的
+	option           Options                   //配置信息
+	mu               *sync.RWMutex             //锁
+	writeLock        *sync.Mutex               //串行化追加记录和更新索引，组提交在Sync期间也持有，需要在db.mu之前获取
+	fileIds          []int                     //仅用于加载索引的时候使用（因为在加载磁盘文件的时候，已经将文件Id取出，但是在olderFiles的map里面是无序的，所以这里需要复用一下这个ids）
+	activeFile       *data.DataFile            //当前活跃数据文件，可以用于写入
+	olderFiles       map[uint32]*data.DataFile //旧的数据文件，只能用于读
+	index            index.Indexer             //内存索引
+	seqNo            uint64                    //事务序列号，全局递增
+	isMerging        bool                      //是否正在Merge
+	mergeGeneration  uint64                    //运行中完成merge的次数，merge之后数据文件被替换，之前获取的位置会失效
+	mergeStatus      MergeStatus               //merge的进度
+	mergeStatusLock  *sync.Mutex               //保护mergeStatus
+	fileRemoveLock   *sync.RWMutex             //增量备份拷贝旧的数据文件期间，merge不能替换或者删除数据文件
+	watchers         map[*Watcher]struct{}     //数据变更的订阅者
+	seqNoFileExists  bool                      //存储事务序列号文件是否存在
+	isInitial        bool                      //是否是第一次初始化此数据目录
+	fileLock         fio.FileLock              //文件锁，保证多进程之间互斥
+	fs               fio.FileSystem            //数据目录所在的文件系统，磁盘或者内存
+	bytesWrite       uint                      //当前写了多少字节的累计值
+	reclaimSize      int64                     //表示有多少数据是无效的
+	hintWg           *sync.WaitGroup           //等待异步写入hint文件的协程结束
+	hintErrors       atomic.Uint64             //异步写入hint文件失败的次数
+	lastHintErr      atomic.Pointer[error]     //最近一次异步写入hint文件失败的错误
+	bloomWg          *sync.WaitGroup           //等待后台重建布隆过滤器的协程结束
+	bloom            *index.BloomIndexer       //索引前的布隆过滤器，没有开启时为nil
+	commitQueue      *commitQueue              //需要持久化的写入的组提交队列
+	fileCache        *fio.IoManagerCache       //打开的数据文件的缓存，没有限制打开的文件数量时为nil
+	valueCache       *data.ValueCache          //value的缓存，没有开启时为nil
+	dataFileDirs     map[uint32]string         //不在DirPath中的数据文件所在的目录
+	dataFileDirsLock *sync.RWMutex             //保护dataFileDirs
 }
 
 // 存储引擎统计信息
@@ -43,7 +62,20 @@ type Stat struct {
 	KeyNum          uint  //key的总数量
 	DataFileNum     uint  //数据文件的数量
 	ReclaimableSize int64 //可以进行merge回收的数据量，以字节为单位
-	DiskSize        int64 //数据目录所占磁盘空间的大小
+	DiskSize        int64 //数据目录以及所有数据文件目录所占磁盘空间的大小
+	OpenFileNum     int   //限制了打开的文件数量时，当前打开的数据文件的数量
+
+	ValueCacheHits   uint64 //value缓存命中的次数
+	ValueCacheMisses uint64 //value缓存没有命中的次数
+	ValueCacheSize   int64  //value缓存当前占用的字节数
+
+	Merge MergeStatus //merge的进度
+
+	BloomFilterFalsePositiveRate          float64 //布隆过滤器实际观测到的误判率
+	BloomFilterEstimatedFalsePositiveRate float64 //根据key的数量估算的布隆过滤器误判率
+
+	HintFileErrors    uint64 //异步写入hint文件失败的次数，对应的数据文件在下次启动时需要完整读取
+	LastHintFileError string //最近一次写入hint文件失败的原因
 }
 
 // 返回数据库的相关统计信息
@@ -55,20 +87,43 @@ func (db *DB) Stat() *Stat {
 	if db.activeFile != nil {
 		dataFiles += 1
 	}
-	size, err := utils.DirSize(db.option.DirPath)
+	size, err := db.diskSize()
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size:%v", err))
 	}
-	return &Stat{
+	stat := &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        size,
 	}
+	if db.fileCache != nil {
+		stat.OpenFileNum = db.fileCache.OpenCount()
+	}
+	stat.HintFileErrors = db.hintErrors.Load()
+	if err := db.lastHintErr.Load(); err != nil {
+		stat.LastHintFileError = (*err).Error()
+	}
+	if db.valueCache != nil {
+		stat.ValueCacheHits = db.valueCache.Hits()
+		stat.ValueCacheMisses = db.valueCache.Misses()
+		stat.ValueCacheSize = db.valueCache.Size()
+	}
+	stat.Merge = db.MergeStatus()
+	if db.bloom != nil {
+		stat.BloomFilterFalsePositiveRate = db.bloom.FalsePositiveRate()
+		stat.BloomFilterEstimatedFalsePositiveRate = db.bloom.Filter().EstimatedFalsePositiveRate()
+	}
+	return stat
 }
 
 // Open 打开bitcask存储引擎实例
 func Open(options Options) (*DB, error) {
+	return OpenCtx(context.Background(), options)
+}
+
+// OpenCtx 和Open相同，加载索引的过程中ctx被取消时，关闭已经打开的文件并返回ctx的错误
+func OpenCtx(ctx context.Context, options Options) (*DB, error) {
 	//对用户传入的配置项进行校验
 	if err := checkOptions(options); err != nil {
 		return nil, err
@@ -76,16 +131,22 @@ func Open(options Options) (*DB, error) {
 
 	var isInitial bool
 
+	//内存模式下所有的文件都保存在内存的文件系统中
+	var fs fio.FileSystem = fio.OSFileSystem{}
+	if options.InMemory {
+		fs = fio.MemFS
+	}
+
 	//判断数据目录是否存在，如果不存在的话，则创建这个目录
-	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
+	if _, err := fs.Stat(options.DirPath); os.IsNotExist(err) {
 		isInitial = true
-		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		if err := fs.MkdirAll(options.DirPath); err != nil {
 			return nil, err
 		}
 	}
 
 	//判断当前数据目录是否正在使用
-	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName)) //拿到文件锁
+	fileLock := fs.NewFileLock(filepath.Join(options.DirPath, fileLockName)) //拿到文件锁
 	hold, err := fileLock.TryLock()
 	if err != nil {
 		return nil, err
@@ -94,7 +155,7 @@ func Open(options Options) (*DB, error) {
 		return nil, selferror.ErrDatabaseIsUsing
 	}
 
-	entries, err := os.ReadDir(options.DirPath)
+	entries, err := fs.ReadDir(options.DirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -104,63 +165,109 @@ func Open(options Options) (*DB, error) {
 
 	//初始化DB实例结构体
 	db := &DB{
-		option:     options,
-		mu:         new(sync.RWMutex),
-		activeFile: nil,
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexerType, options.DirPath, options.SyncWrites),
-		isInitial:  isInitial,
-		fileLock:   fileLock,
+		option:           options,
+		mu:               new(sync.RWMutex),
+		writeLock:        new(sync.Mutex),
+		activeFile:       nil,
+		olderFiles:       make(map[uint32]*data.DataFile),
+		index:            index.NewIndexer(options.IndexerType, options.DirPath, options.SyncWrites, options.HybridIndexCacheSize),
+		isInitial:        isInitial,
+		fileLock:         fileLock,
+		fs:               fs,
+		hintWg:           new(sync.WaitGroup),
+		bloomWg:          new(sync.WaitGroup),
+		commitQueue:      newCommitQueue(),
+		mergeStatusLock:  new(sync.Mutex),
+		fileRemoveLock:   new(sync.RWMutex),
+		watchers:         make(map[*Watcher]struct{}),
+		dataFileDirsLock: new(sync.RWMutex),
+	}
+	if options.MaxOpenFiles > 0 {
+		db.fileCache = fio.NewIoManagerCache(options.MaxOpenFiles)
+	}
+	if options.ValueCacheSize > 0 {
+		db.valueCache = data.NewValueCache(options.ValueCacheSize)
+	}
+
+	if err := db.load(ctx); err != nil {
+		db.abortOpen()
+		return nil, err
+	}
+	return db, nil
+}
+
+// 加载数据文件和索引
+func (db *DB) load(ctx context.Context) error {
+	options := db.option
+	//加载数据文件所在目录的映射，merge安装数据文件时需要使用
+	if err := db.loadDataFileDirs(); err != nil {
+		return err
 	}
 
 	//加载merge目录
-	err = db.loadMergeFiles()
-	if err != nil {
-		return nil, err
+	if err := db.loadMergeFiles(); err != nil {
+		return err
+	}
+
+	//初始化布隆过滤器
+	if err := db.initBloomFilter(); err != nil {
+		return err
 	}
 
 	//加载数据文件
 	if err := db.loadDataFiles(); err != nil {
-		return nil, err
+		return err
 	}
 
-	//B+树索引不需要从数据文件中加载索引
-	if options.IndexerType != BPlusTree {
-		//从Hint索引文件中加载索引
-		err = db.loadIndexFromHintFile()
-		if err != nil {
-			return nil, err
+	//B+树等持久化的索引不需要从数据文件中加载索引
+	if !isPersistentIndexer(options.IndexerType) {
+		//从Hint索引文件和数据文件中加载索引
+		if err := db.loadIndexFromDataFiles(ctx); err != nil {
+			return err
 		}
+	}
+	//布隆过滤器在加载索引之前按照配置的key数量创建，加载之后key太多时按照实际的数量重建
+	db.maybeRebuildBloomFilter()
 
-		//从数据文件中加载索引
-		if err := db.loadIndexFromDataFiles(); err != nil {
-			return nil, err
-		}
-		//重置IO类型为标准文件IO
-		if db.option.MMapAtStartup {
-			err := db.resetIoType()
-			if err != nil {
-				return nil, err
-			}
-		}
+	//确定活跃文件实际写入的位置
+	if err := db.recoverActiveFileWriteOff(ctx); err != nil {
+		return err
 	}
 
-	//如果是B+树，取出当前事务序列号
-	if options.IndexerType == BPlusTree {
-		err := db.loadSeqNo()
-		if err != nil {
-			return nil, err
+	//重置IO类型为标准文件IO
+	if db.option.MMapAtStartup && !db.option.MMapIO && !db.option.InMemory && db.fileCache == nil {
+		if err := db.resetIoType(); err != nil {
+			return err
 		}
-		if db.activeFile != nil {
-			size, err := db.activeFile.IoManager.Size()
-			if err != nil {
-				return nil, err
-			}
-			db.activeFile.WriteOff = size
+	}
+
+	//为还没有hint文件的旧数据文件补充写入hint文件
+	if err := db.writeMissingDataHintFiles(ctx); err != nil {
+		return err
+	}
+
+	//如果是B+树等持久化的索引，取出当前事务序列号
+	if isPersistentIndexer(options.IndexerType) {
+		if err := db.loadSeqNo(); err != nil {
+			return err
 		}
 	}
 
-	return db, nil
+	return nil
+}
+
+// 启动失败时，关闭已经打开的文件并释放文件锁
+func (db *DB) abortOpen() {
+	db.hintWg.Wait()
+	db.bloomWg.Wait()
+	_ = db.index.Close()
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, dataFile := range db.olderFiles {
+		_ = dataFile.Close()
+	}
+	_ = db.fileLock.Unlock()
 }
 
 func checkOptions(options Options) error {
@@ -173,41 +280,109 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio,must between 0 and 1")
 	}
+	if options.MMapIO && !fio.MMapWritable {
+		return errors.New("mmap io is not supported on this platform")
+	}
+	if options.MMapIO && options.PreallocateDataFiles {
+		return errors.New("mmap io and preallocated data files cannot be used together")
+	}
+	if options.InMemory && (options.MMapIO || options.PreallocateDataFiles) {
+		return errors.New("in-memory mode cannot use mmap io or preallocated data files")
+	}
+	if options.InMemory && isPersistentIndexer(options.IndexerType) {
+		return errors.New("in-memory mode does not support persistent indexers")
+	}
+	if len(options.DataDirs) > 0 && options.DataDirPolicy != RoundRobin && options.DataDirPolicy != MostFreeSpace {
+		return errors.New("invalid data dir policy")
+	}
+	for _, dir := range options.DataDirs {
+		if dir == "" {
+			return errors.New("data dir path is empty")
+		}
+	}
+	return nil
+}
+
+// 索引在后台写入文件失败的错误
+func (db *DB) indexErr() error {
+	if flusher, ok := db.index.(index.BackgroundFlusher); ok {
+		return flusher.Err()
+	}
 	return nil
 }
 
 func (db *DB) BackUp(dir string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.BackUpCtx(context.Background(), dir)
+}
+
+// BackUpCtx 和BackUp相同，ctx被取消时停止拷贝，如果备份目录是新创建的，则将其删除
+// 和检查点一样只在封存活跃文件和获取持久化索引的快照时持有db.mu，拷贝文件期间只会推迟merge切换数据文件
+func (db *DB) BackUpCtx(ctx context.Context, dir string) error {
+	//拷贝期间，merge不能替换或者删除数据文件以及hint索引文件
+	db.fileRemoveLock.RLock()
+	defer db.fileRemoveLock.RUnlock()
+
+	_, err := db.fs.Stat(dir)
+	dirExists := err == nil
+	err = db.backUpSnapshot(ctx, dir)
+	if err != nil && ctx.Err() != nil && !dirExists {
+		_ = db.fs.RemoveAll(dir)
+	}
+	return err
+}
 
-	return utils.CopyDir(db.option.DirPath, dir, []string{fileLockName})
+// 把封存之后的文件拷贝到备份目录中，备份中所有的数据文件都在同一个目录中
+func (db *DB) backUpSnapshot(ctx context.Context, dir string) error {
+	if err := db.fs.MkdirAll(dir); err != nil {
+		return err
+	}
+	snap, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.release()
+	for _, file := range snap.files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.copySnapshotFile(file, filepath.Join(dir, file.name)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // 写入Key/Value 数据 key不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.PutCtx(context.Background(), key, value)
+}
+
+// PutCtx 和Put相同，在组提交的队列中等待或者等待writeLock、db.mu期间ctx被取消时不会写入
+// 写入开始之后不会再被取消，返回ctx的错误时数据一定没有写入
+func (db *DB) PutCtx(ctx context.Context, key []byte, value []byte) error {
 	//判断key 是否有效
 	if len(key) == 0 {
 		return selferror.ErrKeyIsEmpty
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	//构造LogRecord结构体
 	log_record := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
+		Key:       logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:     value,
+		Type:      data.LogRecordNormal,
+		Timestamp: time.Now().UnixNano(),
 	}
 
-	//追加写入到当前活跃数据文件中
-	pos, err := db.appendLogRecordWithLock(log_record)
-	if err != nil {
-		return err
-	}
-	//更新内存索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(pos.Size)
-		return selferror.ErrIndexUpdateFailed
-	}
-	return nil
+	//追加写入到当前活跃数据文件中，并更新内存索引
+	return db.writeLogRecords(ctx, []*data.LogRecord{log_record}, nil, db.option.SyncWrites, func(w index.Writer, positions []*data.LogRecordPos) error {
+		if oldPos := w.Put(key, positions[0]); oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+		return nil
+	})
 }
 
 // Delete 根据Key删除对应的数据
@@ -224,30 +399,43 @@ func (db *DB) Delete(key []byte) error {
 
 	//构造logRecord，标识其是被删除的
 	logRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Type: data.LogRecordDeleted,
+		Key:       logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Type:      data.LogRecordDeleted,
+		Timestamp: time.Now().UnixNano(),
 	}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
-	}
-	db.reclaimSize += int64(pos.Size) //本身这条数据也是可以merge清理的，所以这里可以直接添加
+	return db.writeLogRecords(context.Background(), []*data.LogRecord{logRecord}, nil, db.option.SyncWrites, func(w index.Writer, positions []*data.LogRecordPos) error {
+		db.reclaimSize += int64(positions[0].Size) //本身这条数据也是可以merge清理的，所以这里可以直接添加
 
-	//从内存索引当中将对应的key删除
-	pos, ok := db.index.Delete(key)
-	if !ok {
-		return selferror.ErrIndexUpdateFailed
-	}
-	if pos != nil {
-		db.reclaimSize += int64(pos.Size)
-	}
-	return nil
+		//从内存索引当中将对应的key删除
+		pos, ok := w.Delete(key)
+		if !ok {
+			return selferror.ErrIndexUpdateFailed
+		}
+		if pos != nil {
+			db.reclaimSize += int64(pos.Size)
+		}
+		return nil
+	})
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.get(key)
+}
+
+// GetCtx 和Get相同，ctx被取消时不再等待db.mu，直接返回ctx的错误
+func (db *DB) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if err := lockCtx(ctx, db.mu.RLock, db.mu.TryRLock, db.mu.RUnlock); err != nil {
+		return nil, err
+	}
+	defer db.mu.RUnlock()
+	return db.get(key)
+}
+
+// 根据key读取数据，调用时需要持有db.mu
+func (db *DB) get(key []byte) ([]byte, error) {
 	//判断key的有效性
 	if len(key) == 0 {
 		return nil, selferror.ErrKeyIsEmpty
@@ -263,7 +451,44 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	return db.getVauleByPosition(logRecordPos)
 }
 
+// 获取锁，ctx被取消时不再等待，返回ctx的错误
+// 没有竞争或者ctx不会被取消时直接获取，只有需要等待的时候才在单独的goroutine中获取，取消之后它会在拿到锁之后立即释放
+func lockCtx(ctx context.Context, lock func(), tryLock func() bool, unlock func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tryLock() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		select {
+		case acquired <- struct{}{}:
+		case <-ctx.Done():
+			unlock()
+		}
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (db *DB) getVauleByPosition(pos *data.LogRecordPos) ([]byte, error) {
+	//先从缓存中查找，同一个位置上的数据不会被修改
+	if db.valueCache != nil {
+		if value, ok := db.valueCache.Get(pos); ok {
+			return value, nil
+		}
+	}
+
 	//根据文件id找到对应的数据文件
 	var dataFile *data.DataFile
 	if db.activeFile.FileId == pos.Fid {
@@ -286,18 +511,36 @@ func (db *DB) getVauleByPosition(pos *data.LogRecordPos) ([]byte, error) {
 	if logRecord.Type == data.LogRecordDeleted {
 		return nil, selferror.ErrKeyNotFound
 	}
+	if db.valueCache != nil {
+		db.valueCache.Put(pos, logRecord.Value)
+	}
 	return logRecord.Value, nil
 }
 
-// 追加写数据到活跃文件中,带锁
-func (db *DB) appendLogRecordWithLock(record *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(record)
-}
-
 // 追加写数据到活跃文件中
 func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error) {
+	pos, err := db.writeLogRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	db.bytesWrite += uint(pos.Size)
+	//根据用户配置决定是否持久化
+	var needSync = db.option.SyncWrites
+	if !needSync && db.option.BytesPerSync > 0 && db.bytesWrite >= db.option.BytesPerSync { //如果该开关没有打开，再判断累计的字节是否超过
+		needSync = true
+	}
+	if needSync {
+		if err := db.activeFile.Sync(); err != nil {
+			return nil, err
+		}
+		db.bytesWrite = 0
+	}
+	return pos, nil
+}
+
+// 追加写数据到活跃文件中，不进行持久化
+func (db *DB) writeLogRecord(record *data.LogRecord) (*data.LogRecordPos, error) {
 	//判断当前活跃数据文件是否存在，因为数据库在没有写入的时候是没有文件生成的
 	//如果为空，则初始化数据文件
 	if db.activeFile == nil {
@@ -309,15 +552,7 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	enRecord, size := data.EncodeLogRecord(record)
 	//如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并打开新的文件
 	if db.activeFile.WriteOff+size > db.option.DataFileSize {
-		//先持久化数据文件，保证已有的数据持久化到磁盘当中
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-		//当前活跃文件转换为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-		//打开新的数据文件
-		if err := db.setActiveDataFile(); err != nil {
+		if err := db.rotateActiveDataFile(); err != nil {
 			return nil, err
 		}
 	}
@@ -326,21 +561,6 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 		return nil, err
 	}
 
-	db.bytesWrite += uint(size)
-	//根据用户配置决定是否持久化
-	var needSync = db.option.SyncWrites
-	if !needSync && db.option.BytesPerSync > 0 && db.bytesWrite >= db.option.BytesPerSync { //如果该开关没有打开，再判断累计的字节是否超过
-		needSync = true
-	}
-	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
-			if db.bytesWrite > 0 {
-				db.bytesWrite = 0
-			}
-			return nil, err
-		}
-	}
-
 	//构造内存索引信息
 	pos := &data.LogRecordPos{
 		Fid:    db.activeFile.FileId,
@@ -350,6 +570,25 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	return pos, nil
 }
 
+// 关闭当前活跃文件，将其转换为旧的数据文件，并打开新的活跃文件
+// 在访问此方法前，必须持有互斥锁
+func (db *DB) rotateActiveDataFile() error {
+	//先持久化数据文件，保证已有的数据持久化到磁盘当中
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	//当前活跃文件转换为旧的数据文件，之后可以被缓存关闭
+	if cachedIO, ok := db.activeFile.IoManager.(*fio.CachedIO); ok {
+		cachedIO.Unpin()
+	}
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	//旧的数据文件不会再写入了，为其生成hint文件
+	db.writeDataHintFileAsync(db.activeFile)
+
+	//打开新的数据文件
+	return db.setActiveDataFile()
+}
+
 // 设置当前活跃文件
 // 在访问此方法前，必须持有互斥锁
 func (db *DB) setActiveDataFile() error {
@@ -357,8 +596,12 @@ func (db *DB) setActiveDataFile() error {
 	if db.activeFile != nil {
 		initialFileId = db.activeFile.FileId + 1
 	}
+	//选择新的数据文件的目录
+	if err := db.assignDataFileDir(initialFileId); err != nil {
+		return err
+	}
 	//打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.option.DirPath, initialFileId, fio.StandardFio)
+	dataFile, err := db.openActiveDataFile(initialFileId)
 	if err != nil {
 		return err
 	}
@@ -366,9 +609,58 @@ func (db *DB) setActiveDataFile() error {
 	return nil
 }
 
+// 打开可以写入的活跃文件
+func (db *DB) openActiveDataFile(fileId uint32) (*data.DataFile, error) {
+	var dataFile *data.DataFile
+	var err error
+	dirPath := db.dataFileDir(fileId)
+	if db.option.PreallocateDataFiles && !db.option.InMemory {
+		dataFile, err = data.OpenPreallocDataFile(dirPath, fileId, db.option.DataFileSize, db.option.DirectIO)
+	} else {
+		dataFile, err = data.OpenDataFile(dirPath, fileId, db.dataFileIoType())
+	}
+	if err != nil {
+		return nil, err
+	}
+	//活跃文件固定打开，切换为旧的数据文件之后才可以被关闭
+	if db.fileCache != nil {
+		dataFile.IoManager = db.fileCache.Wrap(dataFile.IoManager, db.reopenDataFile(fileId), true)
+	}
+	return dataFile, nil
+}
+
+// 打开旧的数据文件，限制了打开的文件数量时，只有在读取的时候才会真正打开
+func (db *DB) openOlderDataFile(fileId uint32, ioType fio.FileIOType) (*data.DataFile, error) {
+	if db.fileCache == nil {
+		return data.OpenDataFile(db.dataFileDir(fileId), fileId, ioType)
+	}
+	return &data.DataFile{
+		FileId:    fileId,
+		IoManager: db.fileCache.Wrap(nil, db.reopenDataFile(fileId), false),
+	}, nil
+}
+
+// 重新打开被缓存关闭的数据文件
+func (db *DB) reopenDataFile(fileId uint32) func() (fio.IOManager, error) {
+	return func() (fio.IOManager, error) {
+		return fio.NewIoManager(data.GetDataFileName(db.dataFileDir(fileId), fileId), db.dataFileIoType())
+	}
+}
+
+// 运行期间读写数据文件使用的IO类型
+func (db *DB) dataFileIoType() fio.FileIOType {
+	if db.option.InMemory {
+		return fio.MemoryFio
+	}
+	if db.option.MMapIO {
+		return fio.MemoryMap
+	}
+	return fio.StandardFio
+}
+
 // 从磁盘中加载数据文件
 func (db *DB) loadDataFiles() error {
-	dirEntries, err := os.ReadDir(db.option.DirPath)
+	dirEntries, err := db.fs.ReadDir(db.option.DirPath)
 	if err != nil {
 		return err
 	}
@@ -388,6 +680,17 @@ func (db *DB) loadDataFiles() error {
 		}
 	}
 
+	//其他目录中的数据文件，映射文件在创建数据文件之前写入，所以记录的文件可能不存在
+	for fileId, dir := range db.dataFileDirs {
+		if _, err := db.fs.Stat(data.GetDataFileName(dir, fileId)); err != nil {
+			delete(db.dataFileDirs, fileId)
+			continue
+		}
+		if _, err := db.fs.Stat(data.GetDataFileName(db.option.DirPath, fileId)); err != nil {
+			fileIds = append(fileIds, int(fileId))
+		}
+	}
+
 	//对文件ID进行排序，从小到大依次加载
 	sort.Ints(fileIds)
 
@@ -396,11 +699,16 @@ func (db *DB) loadDataFiles() error {
 
 	//遍历每个文件Id，打开对应的数据文件
 	for i, fid := range fileIds {
-		ioType := fio.StandardFio
-		if db.option.MMapAtStartup {
+		ioType := db.dataFileIoType()
+		if db.option.MMapAtStartup && !db.option.InMemory {
 			ioType = fio.MemoryMap
 		}
-		dataFile, err := data.OpenDataFile(db.option.DirPath, uint32(fid), ioType)
+		var dataFile *data.DataFile
+		if i == len(fileIds)-1 && (db.option.PreallocateDataFiles || db.fileCache != nil) {
+			dataFile, err = db.openActiveDataFile(uint32(fid))
+		} else {
+			dataFile, err = db.openOlderDataFile(uint32(fid), ioType)
+		}
 		if err != nil {
 			return err
 		}
@@ -413,9 +721,25 @@ func (db *DB) loadDataFiles() error {
 	return nil
 }
 
+// 启动加载索引时，从单个文件中解析出来的一条索引记录
+type indexLoadRecord struct {
+	key   []byte             //实际的key（已经去掉事务序列号）
+	typ   data.LogRecordType //记录类型
+	seqNo uint64             //事务序列号
+	pos   *data.LogRecordPos //记录在数据文件中的位置
+}
+
+// 单个文件的解析结果
+type indexLoadResult struct {
+	records []*indexLoadRecord
+	offset  int64 //文件解析结束的位置，活跃文件需要用来更新writeOff
+	err     error
+}
+
 // 从数据文件中加载索引
-// 遍历文件中的所有记录，并更新到内存索引中
-func (db *DB) loadIndexFromDataFiles() error {
+// 多个协程并发解析hint文件和数据文件，再按照文件id从小到大的顺序依次更新到内存索引中
+// ctx被取消时，停止解析并返回ctx的错误
+func (db *DB) loadIndexFromDataFiles(ctx context.Context) error {
 	//没有文件，说明数据库为空，直接返回
 	if len(db.fileIds) == 0 {
 		return nil
@@ -423,8 +747,9 @@ func (db *DB) loadIndexFromDataFiles() error {
 
 	//查看是否发生过Merge
 	hasMerge, nonMergeFileId := false, uint32(0)
+	var currentSeqNo uint64 = nonTransactionSeqNo
 	mergeFinFileName := filepath.Join(db.option.DirPath, data.MergeFinishedFileName)
-	_, err := os.Stat(mergeFinFileName)
+	_, err := db.fs.Stat(mergeFinFileName)
 	if err == nil {
 		fid, err := db.getNonMergeFileId(db.option.DirPath)
 		if err != nil {
@@ -432,6 +757,43 @@ func (db *DB) loadIndexFromDataFiles() error {
 		}
 		hasMerge = true
 		nonMergeFileId = fid
+		//merge之后的数据文件中没有事务序列号，新的事务需要从参与merge的最大的序列号之后继续分配
+		record, err := readMergeFinishedRecord(db.option.DirPath, db.fs.IoType())
+		if err != nil {
+			return err
+		}
+		if seqNo, ok := mergedSeqNoOf(record); ok {
+			currentSeqNo = seqNo
+		}
+	}
+
+	//收集需要解析的任务，hint文件中的索引对应的都是最早的文件，所以放在最前面
+	var parseJobs []func() indexLoadResult
+	var activeJob = -1
+	hintFileName := filepath.Join(db.option.DirPath, data.HintFileName)
+	if _, err := db.fs.Stat(hintFileName); err == nil {
+		parseJobs = append(parseJobs, func() indexLoadResult {
+			return db.parseHintFile(ctx, db.option.DirPath)
+		})
+	}
+	for _, fid := range db.fileIds {
+		var fileId = uint32(fid)
+		//如果比最近未参与merge的文件id更小，则说明已经从hint文件中加载过了，直接跳过即可
+		if hasMerge && fileId < nonMergeFileId {
+			continue
+		}
+		//活跃文件需要完整读取，旧的数据文件优先从对应的hint文件中读取
+		if fileId == db.activeFile.FileId {
+			activeJob = len(parseJobs)
+			parseJobs = append(parseJobs, func() indexLoadResult {
+				return parseDataFile(ctx, db.activeFile)
+			})
+		} else {
+			dataFile := db.olderFiles[fileId]
+			parseJobs = append(parseJobs, func() indexLoadResult {
+				return db.parseDataHintFile(ctx, dataFile)
+			})
+		}
 	}
 
 	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
@@ -449,72 +811,45 @@ func (db *DB) loadIndexFromDataFiles() error {
 
 	//暂存事务数据
 	transactionRecords := make(map[uint64][]*data.TransactionRecord) //这是一个以seqNo为key的list,value对应的是事务的记录
-	var currentSeqNo uint64 = nonTransactionSeqNo
-
-	//遍历所有文件的id，处理文件中的记录
-	for i, fid := range db.fileIds {
-		var fileId = uint32(fid)
 
-		//如果比最近未参与merge的文件id更小，则说明已经从hint文件中加载过了，直接跳过即可
-		if hasMerge && fileId < nonMergeFileId {
-			continue
-		}
+	results := db.parseFilesConcurrently(parseJobs)
+	defer results.stop()
 
-		var dataFile *data.DataFile
-		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
-		} else {
-			dataFile = db.olderFiles[fileId]
+	//按照文件id的顺序，依次处理每个文件解析出来的记录，保证事务和覆盖写的顺序正确
+	for i := range parseJobs {
+		result := results.wait(i)
+		if result.err != nil {
+			return result.err
 		}
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				//如果是读完的情况，跳出循环，其他错误则直接返回
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			//构造内存索引，并保存
-			logRecordPos := &data.LogRecordPos{
-				Fid:    fileId,
-				Offset: offset,
-			}
-
-			//解析 key，拿到事务序列号
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo { //如果是非事务提交的，则可以直接更新内存索引
-				updateIndex(realKey, logRecord.Type, logRecordPos)
+		for _, record := range result.records {
+			if record.seqNo == nonTransactionSeqNo { //如果是非事务提交的，则可以直接更新内存索引
+				updateIndex(record.key, record.typ, record.pos)
 			} else {
 				//如果是事务完成提交的，则可以更新至内存索引
-				if logRecord.Type == data.LogRecordTnxFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
+				if record.typ == data.LogRecordTnxFinished {
+					for _, txnRecord := range transactionRecords[record.seqNo] {
 						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
 					}
-					delete(transactionRecords, seqNo)
+					delete(transactionRecords, record.seqNo)
 				} else {
 					//如果事务还没完成提交 or 没有提交成功，则先暂存起来
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
+					transactionRecords[record.seqNo] = append(transactionRecords[record.seqNo], &data.TransactionRecord{
+						Record: &data.LogRecord{Key: record.key, Type: record.typ},
+						Pos:    record.pos,
 					})
 				}
 			}
 
 			//更新事务序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
+			if record.seqNo > currentSeqNo {
+				currentSeqNo = record.seqNo
 			}
-
-			//递增offset，下一次从新的位置获取
-			offset += size
 		}
+		results.done()
 
-		//如果最后一个文件是当前活跃文件，更新这个文件的writeoff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+		//如果是当前活跃文件，更新这个文件的writeoff
+		if i == activeJob {
+			db.activeFile.WriteOff = result.offset
 		}
 	}
 
@@ -524,6 +859,98 @@ func (db *DB) loadIndexFromDataFiles() error {
 	return nil
 }
 
+// 并发解析文件的结果集合，按照任务的下标顺序取出
+type indexLoadResults struct {
+	results []chan indexLoadResult
+	sem     chan struct{} //限制同时在解析中（或者解析完还没被消费）的文件数量
+	stopped chan struct{}
+	wg      *sync.WaitGroup //正在运行的解析任务
+}
+
+// 启动协程并发执行解析任务，并发度由 LoadIndexParallelism 控制
+func (db *DB) parseFilesConcurrently(jobs []func() indexLoadResult) *indexLoadResults {
+	parallelism := db.option.LoadIndexParallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	r := &indexLoadResults{
+		results: make([]chan indexLoadResult, len(jobs)),
+		sem:     make(chan struct{}, parallelism),
+		stopped: make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+	}
+	for i := range r.results {
+		r.results[i] = make(chan indexLoadResult, 1)
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for i, job := range jobs {
+			select {
+			case r.sem <- struct{}{}:
+			case <-r.stopped:
+				return
+			}
+			r.wg.Add(1)
+			go func(i int, job func() indexLoadResult) {
+				defer r.wg.Done()
+				r.results[i] <- job()
+			}(i, job)
+		}
+	}()
+	return r
+}
+
+// 等待第i个任务的解析结果
+func (r *indexLoadResults) wait(i int) indexLoadResult {
+	return <-r.results[i]
+}
+
+// 一个文件的结果处理完成，释放并发名额
+func (r *indexLoadResults) done() {
+	<-r.sem
+}
+
+// 停止派发剩余的解析任务，并等待正在运行的任务结束，之后才可以关闭数据文件
+func (r *indexLoadResults) stop() {
+	close(r.stopped)
+	r.wg.Wait()
+}
+
+// 遍历数据文件中的所有记录，解析出索引信息
+func parseDataFile(ctx context.Context, dataFile *data.DataFile) indexLoadResult {
+	var records []*indexLoadRecord
+	var offset int64 = 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return indexLoadResult{err: err}
+		}
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			//如果是读完的情况，跳出循环，其他错误则直接返回
+			if err == io.EOF {
+				break
+			}
+			return indexLoadResult{err: err}
+		}
+		//解析 key，拿到事务序列号
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		records = append(records, &indexLoadRecord{
+			key:   realKey,
+			typ:   logRecord.Type,
+			seqNo: seqNo,
+			pos: &data.LogRecordPos{
+				Fid:    dataFile.FileId,
+				Offset: offset,
+				Size:   uint32(size),
+			},
+		})
+		//递增offset，下一次从新的位置获取
+		offset += size
+	}
+	return indexLoadResult{records: records, offset: offset}
+}
+
 // 获取到所有的key
 func (db *DB) ListKeys() [][]byte {
 	iterator := db.index.Iterator(false)
@@ -539,11 +966,19 @@ func (db *DB) ListKeys() [][]byte {
 
 // 获取所有数据，并执行用户指定的操作,函数返回false,则终止遍历
 func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
+	return db.FoldCtx(context.Background(), fn)
+}
+
+// FoldCtx 和Fold相同，ctx被取消时终止遍历并返回ctx的错误
+func (db *DB) FoldCtx(ctx context.Context, fn func(key []byte, value []byte) bool) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		value, err := db.getVauleByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -557,40 +992,47 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 func (db *DB) Close() error {
 	defer func() {
+		//内存模式下的文件在关闭之后没有其他途径访问，需要在释放文件锁之前删除，避免一直占用进程的内存
+		if db.option.InMemory && !db.option.InMemoryRetain {
+			for _, dir := range db.dataFileDirList() {
+				_ = db.fs.RemoveAll(dir)
+			}
+		}
 		err := db.fileLock.Unlock()
 		if err != nil {
 			panic(fmt.Sprintf("failed to unlock the directory,%v", err))
 		}
 	}()
 
-	if db.activeFile == nil {
-		return nil
-	}
+	//关闭所有的订阅者
+	db.closeWatchers()
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	err := db.index.Close()
-	if err != nil {
-		return err
+	//等待hint文件写入以及布隆过滤器重建完成
+	db.hintWg.Wait()
+	db.bloomWg.Wait()
+
+	//没有写入过数据时也需要关闭索引，释放B+树的文件锁以及后台写入的协程
+	if db.activeFile == nil {
+		return db.index.Close()
 	}
 
-	//保存当前事务的序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.option.DirPath)
-	if err != nil {
+	//持久化布隆过滤器
+	if err := db.saveBloomFilter(); err != nil {
 		return err
 	}
-	record := &data.LogRecord{
-		Key:   []byte(seqNoKey),
-		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
-	}
-	encRecord, _ := data.EncodeLogRecord(record)
-	err = seqNoFile.Write(encRecord)
+
+	err := db.index.Close()
 	if err != nil {
 		return err
 	}
 
-	err = seqNoFile.Sync()
-	if err != nil {
+	//保存当前事务的序列号
+	if err := db.writeSeqNoFile(db.option.DirPath); err != nil {
 		return err
 	}
 
@@ -620,13 +1062,36 @@ func (db *DB) Sync() error {
 	return db.activeFile.Sync()
 }
 
+// 保存当前事务的序列号到dirPath目录中
+func (db *DB) writeSeqNoFile(dirPath string) error {
+	seqNoFile, err := data.OpenSeqNoFile(dirPath, db.fs.IoType())
+	if err != nil {
+		return err
+	}
+	defer seqNoFile.Close()
+	if err := seqNoFile.Write(db.encodeSeqNo()); err != nil {
+		return err
+	}
+	return seqNoFile.Sync()
+}
+
+// 编码事务序列号文件中的记录
+func (db *DB) encodeSeqNo() []byte {
+	record := &data.LogRecord{
+		Key:   []byte(seqNoKey),
+		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
+	}
+	encRecord, _ := data.EncodeLogRecord(record)
+	return encRecord
+}
+
 func (db *DB) loadSeqNo() error {
 	fileName := filepath.Join(db.option.DirPath, data.SeqNoFileName)
-	_, err := os.Stat(fileName)
+	_, err := db.fs.Stat(fileName)
 	if os.IsNotExist(err) {
 		return nil
 	}
-	seqNoFile, err := data.OpenSeqNoFile(db.option.DirPath)
+	seqNoFile, err := data.OpenSeqNoFile(db.option.DirPath, db.fs.IoType())
 	if err != nil {
 		return err
 	}
@@ -640,17 +1105,44 @@ func (db *DB) loadSeqNo() error {
 	return nil
 }
 
-// 重置数据文件的IO类型为标准文件IO,将活跃文件，旧的数据文件都进行一次重置
-func (db *DB) resetIoType() error {
+// 确定活跃文件实际写入到的位置，并截断掉之后的数据
+// 使用mmap写入或者预分配空间时，文件的大小会大于实际写入的大小，异常退出之后文件的末尾可能会留下没有使用的空间，不能直接使用文件的大小
+func (db *DB) recoverActiveFileWriteOff(ctx context.Context) error {
 	if db.activeFile == nil {
 		return nil
 	}
-	err := db.activeFile.SetIoManager(db.option.DirPath, fio.StandardFio)
+	//持久化的索引启动时没有读取数据文件，需要解析一遍活跃文件
+	if isPersistentIndexer(db.option.IndexerType) {
+		result := parseDataFile(ctx, db.activeFile)
+		if result.err != nil {
+			return result.err
+		}
+		db.activeFile.WriteOff = result.offset
+	}
+	size, err := db.activeFile.IoManager.Size()
 	if err != nil {
 		return err
 	}
+	if size > db.activeFile.WriteOff {
+		return db.activeFile.IoManager.Truncate(db.activeFile.WriteOff)
+	}
+	return nil
+}
+
+// 重置数据文件的IO类型为标准文件IO,将活跃文件，旧的数据文件都进行一次重置
+func (db *DB) resetIoType() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	//预分配空间的活跃文件在打开时已经使用了最终的IO类型
+	if !db.option.PreallocateDataFiles {
+		err := db.activeFile.SetIoManager(db.dataFileDir(db.activeFile.FileId), fio.StandardFio)
+		if err != nil {
+			return err
+		}
+	}
 	for _, dataFile := range db.olderFiles {
-		err := dataFile.SetIoManager(db.option.DirPath, fio.StandardFio)
+		err := dataFile.SetIoManager(db.dataFileDir(dataFile.FileId), fio.StandardFio)
 		if err != nil {
 			return err
 		}
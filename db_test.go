@@ -0,0 +1,1878 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/fio"
+	"bitcast-go/index"
+	"bitcast-go/selferror"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//设置环境变量 BITCASK_GO_IN_MEMORY 之后，所有的测试都使用内存模式运行
+func init() {
+	if os.Getenv("BITCASK_GO_IN_MEMORY") != "" {
+		DefaultOptions.InMemory = true
+		DefaultOptions.InMemoryRetain = true
+	}
+}
+
+//依赖磁盘上的文件的测试，在内存模式下跳过
+func skipInMemory(t testing.TB) {
+	if DefaultOptions.InMemory {
+		t.Skip("depends on files on disk")
+	}
+}
+
+func destroyDB(db *DB) {
+	if db != nil {
+		_ = db.Close()
+		_ = db.fs.RemoveAll(db.option.DirPath)
+		_ = os.RemoveAll(db.option.DirPath)
+	}
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("bitcask-go-key-%09d", i))
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("bitcask-go-value-%09d-%0128d", i, i))
+}
+
+func TestOpen_LoadIndexParallel(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-load-index")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	//事务数据会跨越多个数据文件
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, wb.Put(testKey(i), []byte("in-batch")))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+
+	indexerTypes := []IndexerType{BTree, ART, Compact}
+	for i, parallelism := range []int{1, 4, 32} {
+		opts.LoadIndexParallelism = parallelism
+		opts.IndexerType = indexerTypes[i]
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 900, db2.index.Size())
+		_, err = db2.Get(testKey(50))
+		assert.Equal(t, selferror.ErrKeyNotFound, err)
+		val, err := db2.Get(testKey(150))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("in-batch"), val)
+		val, err = db2.Get(testKey(999))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(999), val)
+		assert.Nil(t, db2.Close())
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bench-open")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 200000; i++ {
+		if err := db.Put(testKey(i), testValue(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	_ = db.Close()
+	defer os.RemoveAll(dir)
+
+	for _, mmap := range []bool{false, true} {
+		for _, parallelism := range []int{1, 4, 8} {
+			b.Run(fmt.Sprintf("mmap=%v/parallelism=%d", mmap, parallelism), func(b *testing.B) {
+				opts.MMapAtStartup = mmap
+				opts.LoadIndexParallelism = parallelism
+				for i := 0; i < b.N; i++ {
+					db, err := Open(opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+					_ = db.Close()
+				}
+			})
+		}
+	}
+}
+
+func TestOpen_DataHintFiles(t *testing.T) {
+	skipInMemory(t)
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-hint")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 50; i < 100; i++ {
+		assert.Nil(t, wb.Put(testKey(i), []byte("in-batch")))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+
+	//每个旧的数据文件都有对应的hint文件，活跃文件没有
+	assert.True(t, len(db.olderFiles) > 1)
+	for fileId := range db.olderFiles {
+		_, err := os.Stat(data.GetDataHintFileName(dir, fileId))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(data.GetDataHintFileName(dir, db.activeFile.FileId))
+	assert.True(t, os.IsNotExist(err))
+
+	//hint文件不完整时，直接从数据文件中加载
+	hintFileName := data.GetDataHintFileName(dir, 1)
+	stat, err := os.Stat(hintFileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(hintFileName, stat.Size()-10))
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 450, db2.index.Size())
+	_, err = db2.Get(testKey(10))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+	val, err := db2.Get(testKey(60))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("in-batch"), val)
+	val, err = db2.Get(testKey(499))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(499), val)
+	assert.Nil(t, db2.Close())
+
+	//损坏的hint文件会被重新写入
+	stat2, err := os.Stat(hintFileName)
+	assert.Nil(t, err)
+	assert.Equal(t, stat.Size(), stat2.Size())
+}
+
+func TestDB_BloomFilter(t *testing.T) {
+	for _, indexerType := range []IndexerType{BTree, BPlusTree} {
+		if indexerType == BPlusTree && DefaultOptions.InMemory {
+			continue
+		}
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+		opts.DirPath = dir
+		opts.IndexerType = indexerType
+		opts.EnableBloomFilter = true
+		opts.BloomFilterExpectedKeys = 1000
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+		for i := 1000; i < 2000; i++ {
+			_, err := db.Get(testKey(i))
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+		}
+		stat := db.Stat()
+		assert.Less(t, stat.BloomFilterFalsePositiveRate, 0.05)
+		assert.Greater(t, stat.BloomFilterEstimatedFalsePositiveRate, float64(0))
+		assert.Nil(t, db.Close())
+
+		//重新打开之后，过滤器中依然包含所有的key
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 500; i++ {
+			val, err := db2.Get(testKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(i), val)
+		}
+		destroyDB(db2)
+	}
+}
+
+func TestDB_BloomFilterRebuild(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom-rebuild")
+	opts.DirPath = dir
+	opts.EnableBloomFilter = true
+	opts.BloomFilterExpectedKeys = 100
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	//写入的key超过预计的数量之后，过滤器按照实际的数量重建
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	db.bloomWg.Wait()
+	assert.Less(t, db.Stat().BloomFilterEstimatedFalsePositiveRate, 0.02)
+	for i := 0; i < 5000; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+	assert.Nil(t, db.Close())
+
+	//启动时按照加载之后的key数量重建
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	db2.bloomWg.Wait()
+	assert.Less(t, db2.Stat().BloomFilterEstimatedFalsePositiveRate, 0.02)
+	for i := 0; i < 5000; i++ {
+		val, err := db2.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+}
+
+// 写入hint文件失败的IO
+type failingHintIO struct {
+	fio.IOManager
+}
+
+func (f failingHintIO) Write(b []byte) (int, error) {
+	return 0, selferror.ErrInjectedFault
+}
+
+func TestDB_HintFileWriteError(t *testing.T) {
+	skipInMemory(t)
+	fio.SetIoManagerHook(func(fileName string, ioManager fio.IOManager) fio.IOManager {
+		if filepath.Ext(fileName) == data.DataHintFileNameSuffix {
+			return failingHintIO{IOManager: ioManager}
+		}
+		return ioManager
+	})
+	defer fio.SetIoManagerHook(nil)
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hint-error")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	db.hintWg.Wait()
+
+	//写入失败的次数和原因通过Stat返回，写了一半的hint文件被删除
+	stat := db.Stat()
+	assert.Greater(t, stat.HintFileErrors, uint64(0))
+	assert.Equal(t, selferror.ErrInjectedFault.Error(), stat.LastHintFileError)
+	hintFiles, err := filepath.Glob(filepath.Join(dir, "*"+data.DataHintFileNameSuffix))
+	assert.Nil(t, err)
+	assert.Empty(t, hintFiles)
+}
+
+func TestDB_CloseWithoutWrites(t *testing.T) {
+	skipInMemory(t)
+	for _, indexerType := range []IndexerType{BPlusTree, Hybrid} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-close-empty")
+		opts.DirPath = dir
+		opts.IndexerType = indexerType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+
+		//索引已经关闭，B+树的文件锁被释放，可以重新打开
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db2.Put(testKey(1), testValue(1)))
+		destroyDB(db2)
+	}
+}
+
+func TestDB_HybridIndex(t *testing.T) {
+	skipInMemory(t)
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hybrid")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexerType = Hybrid
+	opts.HybridIndexCacheSize = 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for r := 0; r < 3; r++ {
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i+r)))
+		}
+	}
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	//merge之后的写入
+	assert.Nil(t, db.Put(testKey(100), []byte("after-merge")))
+	assert.Nil(t, db.Delete(testKey(101)))
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 179, db2.index.Size())
+	val, err := db2.Get(testKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-merge"), val)
+	_, err = db2.Get(testKey(101))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+	_, err = db2.Get(testKey(10))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+	for i := 20; i < 200; i++ {
+		if i == 100 || i == 101 {
+			continue
+		}
+		val, err := db2.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i+2), val)
+	}
+
+	//后台批量写入B+树的同时创建检查点，拷贝的B+树和预写日志是一致的
+	for i := 200; i < 3000; i++ {
+		assert.Nil(t, db2.Put(testKey(i), testValue(i)))
+	}
+	checkpointDir := dir + "-checkpoint"
+	assert.Nil(t, db2.Checkpoint(checkpointDir))
+	checkpointOpts := opts
+	checkpointOpts.DirPath = checkpointDir
+	checkpoint, err := Open(checkpointOpts)
+	assert.Nil(t, err)
+	defer destroyDB(checkpoint)
+	assert.Equal(t, 2979, checkpoint.index.Size())
+	for i := 200; i < 3000; i++ {
+		val, err := checkpoint.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+}
+
+// 后台写入失败的索引
+type failedFlushIndexer struct {
+	index.Indexer
+	err error
+}
+
+func (f *failedFlushIndexer) Pause() func() {
+	return func() {}
+}
+
+func (f *failedFlushIndexer) Err() error {
+	return f.err
+}
+
+// 索引在后台写入磁盘失败之后，不再接受新的写入
+func TestDB_IndexFlushError(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-flush-error")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(testKey(0), testValue(0)))
+
+	flushErr := errors.New("flush failed")
+	db.index = &failedFlushIndexer{Indexer: db.index, err: flushErr}
+	assert.Equal(t, flushErr, db.Put(testKey(1), testValue(1)))
+	assert.Equal(t, flushErr, db.Delete(testKey(0)))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(2), testValue(2)))
+	assert.Equal(t, flushErr, wb.Commit())
+	val, err := db.Get(testKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(0), val)
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.Nil(t, db.Put(testKey(w*1000+i), testValue(w*1000+i)))
+			}
+			assert.Nil(t, db.Delete(testKey(w*1000)))
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			assert.Nil(t, wb.Put(testKey(w*1000+1), []byte("in-batch")))
+			assert.Nil(t, wb.Delete(testKey(w*1000+2)))
+			assert.Nil(t, wb.Commit())
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, 16*48, db.index.Size())
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 16*48, db2.index.Size())
+	assert.Equal(t, uint64(16), db2.seqNo)
+	for w := 0; w < 16; w++ {
+		_, err := db2.Get(testKey(w * 1000))
+		assert.Equal(t, selferror.ErrKeyNotFound, err)
+		val, err := db2.Get(testKey(w*1000 + 1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("in-batch"), val)
+		val, err = db2.Get(testKey(w*1000 + 49))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(w*1000+49), val)
+	}
+}
+
+func BenchmarkPut_SyncWrites(b *testing.B) {
+	for _, writers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-bench-sync")
+			opts.DirPath = dir
+			opts.SyncWrites = true
+			db, err := Open(opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer destroyDB(db)
+
+			var next int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						i := atomic.AddInt64(&next, 1)
+						if i > int64(b.N) {
+							return
+						}
+						if err := db.Put(testKey(int(i)), testValue(int(i))); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestDB_MMapIO(t *testing.T) {
+	skipInMemory(t)
+	for _, indexerType := range []IndexerType{BTree, BPlusTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-mmap-io")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.DataFileMergeRatio = 0
+		opts.IndexerType = indexerType
+		opts.MMapIO = true
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Delete(testKey(i)))
+		}
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Sync())
+		activeFileId := db.activeFile.FileId
+		assert.Nil(t, db.Close())
+
+		//模拟异常退出：活跃文件的末尾留下预先扩展出来的空间
+		activeFileName := data.GetDataFileName(dir, activeFileId)
+		f, err := os.OpenFile(activeFileName, os.O_WRONLY|os.O_APPEND, 0644)
+		assert.Nil(t, err)
+		_, err = f.Write(make([]byte, 8192))
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 1000; i < 1100; i++ {
+			assert.Nil(t, db2.Put(testKey(i), testValue(i)))
+		}
+		assert.Nil(t, db2.Close())
+
+		//不使用mmap也可以正常读取
+		opts.MMapIO = false
+		db3, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, db3.index.Size())
+		for i := 0; i < 1100; i++ {
+			val, err := db3.Get(testKey(i))
+			if i < 100 {
+				assert.Equal(t, selferror.ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(i), val)
+		}
+		destroyDB(db3)
+	}
+}
+
+func TestDB_PreallocateDataFiles(t *testing.T) {
+	skipInMemory(t)
+	for _, directIO := range []bool{false, true} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-prealloc")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.DataFileMergeRatio = 0
+		opts.PreallocateDataFiles = true
+		opts.DirectIO = directIO
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i)))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Delete(testKey(i)))
+		}
+		assert.Nil(t, db.Sync())
+		db.hintWg.Wait()
+
+		//活跃文件和旧的数据文件都已经预分配了空间
+		stat, err := os.Stat(data.GetDataFileName(dir, db.activeFile.FileId))
+		assert.Nil(t, err)
+		assert.Equal(t, opts.DataFileSize, stat.Size())
+
+		//运行中的备份相当于异常退出之后的状态，文件都没有被截断
+		backupDir, _ := os.MkdirTemp("", "bitcask-go-prealloc-backup")
+		assert.Nil(t, db.BackUp(backupDir))
+		destroyDB(db)
+
+		backupOpts := opts
+		backupOpts.DirPath = backupDir
+		db2, err := Open(backupOpts)
+		assert.Nil(t, err)
+		for i := 1000; i < 1100; i++ {
+			assert.Nil(t, db2.Put(testKey(i), testValue(i)))
+		}
+		assert.Nil(t, db2.Merge())
+		assert.Nil(t, db2.Close())
+
+		//不使用预分配也可以正常读取
+		backupOpts.PreallocateDataFiles = false
+		db3, err := Open(backupOpts)
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, db3.index.Size())
+		for i := 0; i < 1100; i++ {
+			val, err := db3.Get(testKey(i))
+			if i < 100 {
+				assert.Equal(t, selferror.ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(i), val)
+		}
+		destroyDB(db3)
+	}
+}
+
+func TestDB_InMemory(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-in-memory"
+	opts.DataFileSize = 8 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.InMemory = true
+	opts.InMemoryRetain = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	//同一个目录不能同时打开两次
+	_, err = Open(opts)
+	assert.Equal(t, selferror.ErrDatabaseIsUsing, err)
+
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i+r)))
+		}
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(1000), testValue(1000)))
+	assert.Nil(t, wb.Delete(testKey(50)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put(testKey(1001), testValue(1001)))
+	assert.Nil(t, db.Close())
+
+	//磁盘上没有创建任何文件
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+
+	//同一个进程中重新打开，数据仍然存在
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 451, db2.index.Size())
+	for i := 0; i < 500; i++ {
+		val, err := db2.Get(testKey(i))
+		if i <= 50 {
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i+1), val)
+	}
+	val, err := db2.Get(testKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(1000), val)
+}
+
+func TestDB_InMemoryRelease(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = "/bitcask-go-in-memory-release"
+	opts.DataDirs = []string{"/bitcask-go-in-memory-release-data"}
+	opts.DataFileSize = 8 * 1024
+	opts.InMemory = true
+	opts.InMemoryRetain = false
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	size, err := fio.MemFS.DirSize(opts.DataDirs[0])
+	assert.Nil(t, err)
+	assert.Greater(t, size, int64(0))
+	assert.Nil(t, db.Close())
+
+	//没有开启InMemoryRetain时，关闭之后数据目录和数据文件目录中的文件都被释放
+	for _, dir := range []string{opts.DirPath, opts.DataDirs[0]} {
+		_, err = fio.MemFS.Stat(dir)
+		assert.True(t, os.IsNotExist(err))
+	}
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, db.index.Size())
+}
+
+func TestDB_MaxOpenFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-max-open-files")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.MaxOpenFiles = 3
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	stat := db.Stat()
+	assert.True(t, stat.DataFileNum > 10)
+	assert.True(t, stat.OpenFileNum <= opts.MaxOpenFiles)
+
+	//并发读取不同的数据文件
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 1000; i += 8 {
+				val, err := db.Get(testKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, testValue(i), val)
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.True(t, db.Stat().OpenFileNum <= opts.MaxOpenFiles)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	//重新打开之后，旧的数据文件在读取时才会打开
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, db2.Stat().OpenFileNum <= opts.MaxOpenFiles)
+	for i := 0; i < 1000; i++ {
+		val, err := db2.Get(testKey(i))
+		if i < 500 {
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(i), val)
+		}
+	}
+	assert.True(t, db2.Stat().OpenFileNum <= opts.MaxOpenFiles)
+	db = db2
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	for _, mmapIO := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap-%v", mmapIO), func(t *testing.T) {
+			if mmapIO {
+				skipInMemory(t)
+			}
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-value-cache")
+			opts.DirPath = dir
+			opts.DataFileSize = 8 * 1024
+			opts.DataFileMergeRatio = 0
+			opts.MMapIO = mmapIO
+			opts.ValueCacheSize = 64 * 1024
+			db, err := Open(opts)
+			defer func() {
+				destroyDB(db)
+			}()
+			assert.Nil(t, err)
+
+			for i := 0; i < 200; i++ {
+				assert.Nil(t, db.Put(testKey(i), testValue(i)))
+			}
+			for r := 0; r < 3; r++ {
+				for i := 0; i < 200; i++ {
+					val, err := db.Get(testKey(i))
+					assert.Nil(t, err)
+					assert.Equal(t, testValue(i), val)
+				}
+			}
+			stat := db.Stat()
+			assert.Equal(t, uint64(200), stat.ValueCacheMisses)
+			assert.Equal(t, uint64(400), stat.ValueCacheHits)
+			assert.True(t, stat.ValueCacheSize > 0 && stat.ValueCacheSize <= opts.ValueCacheSize)
+
+			//修改返回的value不影响缓存
+			val, _ := db.Get(testKey(0))
+			val[0] = 'x'
+			val, _ = db.Get(testKey(0))
+			assert.Equal(t, testValue(0), val)
+
+			//更新和删除之后读取到的是新的数据
+			assert.Nil(t, db.Put(testKey(1), testValue(1001)))
+			assert.Nil(t, db.Delete(testKey(2)))
+			val, err = db.Get(testKey(1))
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(1001), val)
+			_, err = db.Get(testKey(2))
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+
+			//merge之后重新打开，数据文件被替换，读取到的仍然是正确的数据
+			assert.Nil(t, db.Merge())
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			for i := 0; i < 200; i++ {
+				val, err := db.Get(testKey(i))
+				switch i {
+				case 1:
+					assert.Equal(t, testValue(1001), val)
+				case 2:
+					assert.Equal(t, selferror.ErrKeyNotFound, err)
+				default:
+					assert.Nil(t, err)
+					assert.Equal(t, testValue(i), val)
+				}
+			}
+		})
+	}
+}
+
+// 调用n次Err之后被取消的context，用于在固定的位置取消
+type cancelAfterContext struct {
+	context.Context
+	n atomic.Int64
+}
+
+func newCancelAfterContext(n int64) *cancelAfterContext {
+	ctx := &cancelAfterContext{Context: context.Background()}
+	ctx.n.Store(n)
+	return ctx
+}
+
+func (ctx *cancelAfterContext) Err() error {
+	if ctx.n.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDB_Context(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-context")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.PutCtx(cancelled, testKey(1000), testValue(1000)))
+	_, err = db.GetCtx(cancelled, testKey(100))
+	assert.Equal(t, context.Canceled, err)
+	val, err := db.GetCtx(context.Background(), testKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(100), val)
+
+	//不需要持久化的写入等待db.mu期间被取消，不会写入
+	db.mu.Lock()
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err = db.PutCtx(timeout, testKey(1001), testValue(1001))
+	cancelTimeout()
+	db.mu.Unlock()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = db.Get(testKey(1001))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+
+	//遍历到一半被取消
+	var count int
+	err = db.FoldCtx(newCancelAfterContext(10), func(key []byte, value []byte) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 10, count)
+
+	//备份被取消之后，新创建的备份目录会被删除
+	backupDir := dir + "-backup"
+	assert.Equal(t, context.Canceled, db.BackUpCtx(newCancelAfterContext(3), backupDir))
+	_, err = db.fs.Stat(backupDir)
+	assert.True(t, os.IsNotExist(err))
+
+	//merge到一半被取消，merge目录被删除，数据库可以继续使用
+	assert.Equal(t, context.Canceled, db.MergeCtx(newCancelAfterContext(50)))
+	_, err = db.fs.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.False(t, db.isMerging)
+	assert.Nil(t, db.Put(testKey(1000), testValue(1000)))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	//启动被取消之后，文件锁被释放，可以重新打开
+	_, err = OpenCtx(cancelled, opts)
+	assert.Equal(t, context.Canceled, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, db.index.Size())
+	for i := 100; i < 500; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+}
+
+// block为true时，第一次Sync通知started，等待release之后再Sync
+type blockingSyncIO struct {
+	fio.IOManager
+	block   *atomic.Bool
+	started chan struct{}
+	release chan struct{}
+	once    *sync.Once
+}
+
+func (b blockingSyncIO) Sync() error {
+	if b.block.Load() {
+		b.once.Do(func() {
+			close(b.started)
+			<-b.release
+		})
+	}
+	return b.IOManager.Sync()
+}
+
+func TestDB_ContextWhileWaiting(t *testing.T) {
+	skipInMemory(t)
+	block := new(atomic.Bool)
+	started, release := make(chan struct{}), make(chan struct{})
+	once := new(sync.Once)
+	fio.SetIoManagerHook(func(fileName string, ioManager fio.IOManager) fio.IOManager {
+		return blockingSyncIO{IOManager: ioManager, block: block, started: started, release: release, once: once}
+	})
+	defer fio.SetIoManagerHook(nil)
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-context-waiting")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	//leader阻塞在Sync上，排在后面的写入被取消之后直接返回，不会写入
+	block.Store(true)
+	leaderDone := make(chan error, 1)
+	go func() {
+		leaderDone <- db.Put(testKey(0), testValue(0))
+	}()
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	queuedDone := make(chan error, 1)
+	go func() {
+		queuedDone <- db.PutCtx(ctx, testKey(1), testValue(1))
+	}()
+	waitQueued := func() bool {
+		db.commitQueue.mu.Lock()
+		defer db.commitQueue.mu.Unlock()
+		return len(db.commitQueue.requests) == 1
+	}
+	for !waitQueued() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-queuedDone)
+	close(release)
+	assert.Nil(t, <-leaderDone)
+
+	_, err = db.Get(testKey(1))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+	assert.Nil(t, db.Put(testKey(2), testValue(2)))
+	val, err := db.Get(testKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(0), val)
+
+	//读取等待db.mu期间被取消
+	db.mu.Lock()
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = db.GetCtx(timeout, testKey(0))
+	cancelTimeout()
+	db.mu.Unlock()
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDB_MergeStatus(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-status")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.MergeRateLimit = 256 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.False(t, db.MergeStatus().Running)
+
+	mergeErr := make(chan error)
+	go func() {
+		mergeErr <- db.Merge()
+	}()
+	//限速之后，merge需要一段时间才能完成，期间可以看到进度
+	time.Sleep(100 * time.Millisecond)
+	status := db.Stat().Merge
+	assert.True(t, status.Running)
+	assert.True(t, status.BytesRead > 0 && status.BytesRead < status.TotalBytes)
+
+	assert.Nil(t, <-mergeErr)
+	status = db.MergeStatus()
+	assert.False(t, status.Running)
+	assert.Equal(t, status.TotalFiles, status.FilesProcessed)
+	assert.Equal(t, status.TotalBytes, status.BytesRead)
+	assert.Equal(t, int64(500), status.KeysRewritten)
+	assert.True(t, status.BytesWritten > 0 && status.BytesWritten < status.BytesRead)
+	assert.Empty(t, status.Error)
+
+	//按照限制的速率，读写的数据量需要的时间
+	elapsed := status.FinishTime.Sub(status.StartTime)
+	expected := time.Duration(float64(status.BytesRead+status.BytesWritten) / float64(opts.MergeRateLimit) * float64(time.Second))
+	assert.True(t, elapsed >= expected*9/10, "elapsed %v, expected %v", elapsed, expected)
+}
+
+func TestDB_OnlineMerge(t *testing.T) {
+	for _, opts := range []Options{DefaultOptions, func() Options {
+		opts := DefaultOptions
+		opts.MaxOpenFiles = 2
+		opts.ValueCacheSize = 64 * 1024
+		return opts
+	}()} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-online-merge")
+		opts.DirPath = dir
+		opts.DataFileSize = 16 * 1024
+		opts.DataFileMergeRatio = 0
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for r := 0; r < 3; r++ {
+			for i := 0; i < 1000; i++ {
+				assert.Nil(t, db.Put(testKey(i), testValue(i+r)))
+			}
+		}
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Delete(testKey(i)))
+		}
+		for i := 500; i < 1000; i++ {
+			_, err := db.Get(testKey(i))
+			assert.Nil(t, err)
+		}
+		sizeBefore := db.Stat().DiskSize
+		fileNumBefore := db.Stat().DataFileNum
+		iterator := db.NewIterator(DefaultIteratorOptions)
+
+		//merge的同时进行读写
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 500 + g; ; i = 500 + (i+4-500)%500 {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					val, err := db.Get(testKey(i))
+					assert.Nil(t, err)
+					assert.Equal(t, testValue(i+2), val)
+				}
+			}(g)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1000; i < 1200; i++ {
+				assert.Nil(t, db.Put(testKey(i), testValue(i)))
+			}
+		}()
+		assert.Nil(t, db.Merge())
+		close(stop)
+		wg.Wait()
+
+		//不需要重启，旧的数据文件已经被删除，merge目录也不存在了
+		_, err = db.fs.Stat(db.getMergePath())
+		assert.True(t, os.IsNotExist(err))
+		stat := db.Stat()
+		assert.True(t, stat.DiskSize < sizeBefore/2, "before %d, after %d", sizeBefore, stat.DiskSize)
+		assert.True(t, stat.DataFileNum < fileNumBefore)
+		entries, err := db.fs.ReadDir(dir)
+		assert.Nil(t, err)
+		var dataFiles uint
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+				dataFiles++
+			}
+		}
+		assert.Equal(t, stat.DataFileNum, dataFiles)
+
+		check := func(db *DB) {
+			assert.Equal(t, 700, db.index.Size())
+			for i := 0; i < 1200; i++ {
+				val, err := db.Get(testKey(i))
+				switch {
+				case i < 500:
+					assert.Equal(t, selferror.ErrKeyNotFound, err)
+				case i < 1000:
+					assert.Nil(t, err)
+					assert.Equal(t, testValue(i+2), val)
+				default:
+					assert.Nil(t, err)
+					assert.Equal(t, testValue(i), val)
+				}
+			}
+		}
+		check(db)
+
+		//merge之前创建的迭代器仍然可以读取到正确的数据
+		var count int
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			val, err := iterator.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(500+count+2), val)
+			count++
+		}
+		assert.Equal(t, 500, count)
+		iterator.Close()
+
+		//再次merge，然后重新打开
+		assert.Nil(t, db.Put(testKey(0), testValue(0)))
+		assert.Nil(t, db.Delete(testKey(0)))
+		assert.Nil(t, db.Merge())
+		check(db)
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		check(db)
+		destroyDB(db)
+	}
+}
+
+func TestDB_Checkpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(1000), testValue(1000)))
+	assert.Nil(t, wb.Commit())
+
+	checkpointDir := dir + "-checkpoint"
+	assert.Nil(t, db.Checkpoint(checkpointDir))
+	assert.Equal(t, selferror.ErrCheckpointDirExists, db.Checkpoint(checkpointDir))
+
+	//旧的数据文件是硬链接
+	if !DefaultOptions.InMemory {
+		for fileId := range db.olderFiles {
+			src, err := os.Stat(data.GetDataFileName(dir, fileId))
+			assert.Nil(t, err)
+			dest, err := os.Stat(data.GetDataFileName(checkpointDir, fileId))
+			assert.Nil(t, err)
+			assert.True(t, os.SameFile(src, dest))
+		}
+	}
+
+	//检查点之后的修改不会影响检查点
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i+1)))
+	}
+
+	checkpointOpts := opts
+	checkpointOpts.DirPath = checkpointDir
+	checkpoint, err := Open(checkpointOpts)
+	assert.Nil(t, err)
+	defer destroyDB(checkpoint)
+	assert.Equal(t, 901, checkpoint.index.Size())
+	for i := 0; i <= 1000; i++ {
+		val, err := checkpoint.Get(testKey(i))
+		if i < 100 {
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+
+	//检查点中的写入和merge也不会影响当前的数据库
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, checkpoint.Put(testKey(i), testValue(i+2)))
+	}
+	assert.Nil(t, checkpoint.Merge())
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		if i < 200 {
+			assert.Equal(t, testValue(i+1), val)
+		} else {
+			assert.Equal(t, testValue(i), val)
+		}
+	}
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, db.index.Size())
+	val, err := db.Get(testKey(500))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(500), val)
+}
+
+// 第一次写入时通知started，等待release之后再写入
+type blockingWriteIO struct {
+	fio.IOManager
+	started chan struct{}
+	release chan struct{}
+	once    *sync.Once
+}
+
+func (b blockingWriteIO) Write(buf []byte) (int, error) {
+	b.once.Do(func() {
+		close(b.started)
+		<-b.release
+	})
+	return b.IOManager.Write(buf)
+}
+
+// 创建检查点和备份写入文件期间不持有db.mu，不会阻塞写入
+func TestDB_CheckpointConcurrentWrites(t *testing.T) {
+	testSnapshotConcurrentWrites(t, "checkpoint", (*DB).Checkpoint)
+}
+
+func TestDB_BackUpConcurrentWrites(t *testing.T) {
+	testSnapshotConcurrentWrites(t, "backup", (*DB).BackUp)
+}
+
+func TestDB_BackupToConcurrentWrites(t *testing.T) {
+	testSnapshotConcurrentWrites(t, "stream", func(db *DB, dir string) error {
+		//tar流写入到目标目录旁边的文件中，写入时同样会被阻塞
+		tarFile := dir + ".tar"
+		defer db.fs.Remove(tarFile)
+		w, err := fio.NewIoManager(tarFile, db.fs.IoType())
+		if err != nil {
+			return err
+		}
+		err = db.BackupTo(w)
+		_ = w.Close()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if _, _, err := readFileWithCRC(db.fs.IoType(), tarFile, &buf); err != nil {
+			return err
+		}
+		return restoreFromStream(db.fs, &buf, dir)
+	})
+}
+
+// 拷贝文件期间阻塞在目标目录的写入上，数据库仍然可以写入，结果只包含开始时的数据
+// 持久化的索引通过开始时的快照写出，不会包含之后的写入
+func testSnapshotConcurrentWrites(t *testing.T, name string, snapshot func(*DB, string) error) {
+	indexerTypes := []IndexerType{BTree, BPlusTree, Hybrid}
+	names := []string{"btree", "bptree", "hybrid"}
+	for i, indexerType := range indexerTypes {
+		if isPersistentIndexer(indexerType) && DefaultOptions.InMemory {
+			continue
+		}
+		t.Run(names[i], func(t *testing.T) {
+			testSnapshotConcurrentWritesWithIndexer(t, name, indexerType, snapshot)
+		})
+	}
+}
+
+func testSnapshotConcurrentWritesWithIndexer(t *testing.T, name string, indexerType IndexerType, snapshot func(*DB, string) error) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-"+name+"-concurrent")
+	opts.DirPath = dir
+	opts.IndexerType = indexerType
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+
+	snapshotDir := dir + "-" + name
+	started, release := make(chan struct{}), make(chan struct{})
+	once := new(sync.Once)
+	fio.SetIoManagerHook(func(fileName string, ioManager fio.IOManager) fio.IOManager {
+		if strings.HasPrefix(fileName, snapshotDir) {
+			return blockingWriteIO{IOManager: ioManager, started: started, release: release, once: once}
+		}
+		return ioManager
+	})
+	defer fio.SetIoManagerHook(nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- snapshot(db, snapshotDir)
+	}()
+	<-started
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	close(release)
+	assert.Nil(t, <-done)
+	fio.SetIoManagerHook(nil)
+
+	snapshotOpts := opts
+	snapshotOpts.DirPath = snapshotDir
+	snapshotDB, err := Open(snapshotOpts)
+	assert.Nil(t, err)
+	defer destroyDB(snapshotDB)
+	assert.Equal(t, 100, snapshotDB.index.Size())
+}
+
+func TestDB_IncrementalBackup(t *testing.T) {
+	skipInMemory(t)
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-incremental-backup")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+	backupDir := dir + "-backup"
+	defer os.RemoveAll(backupDir)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	first, err := db.BackUpIncremental(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), first.Id)
+	assert.Equal(t, len(db.olderFiles), len(first.DataFiles))
+
+	//第二次备份只拷贝新生成的数据文件
+	for i := 1000; i < 1200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	second, err := db.BackUpIncremental(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), second.Id)
+	assert.Equal(t, len(db.olderFiles), len(second.DataFiles))
+	var shipped int
+	for _, file := range second.DataFiles {
+		if file.BackupId == second.Id {
+			shipped++
+		}
+	}
+	assert.Equal(t, len(second.DataFiles)-len(first.DataFiles), shipped)
+
+	//merge之后复用了文件id的数据文件需要重新拷贝
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	third, err := db.BackUpIncremental(backupDir)
+	assert.Nil(t, err)
+	for _, file := range third.DataFiles {
+		if file.MergeEpoch > 0 {
+			assert.Equal(t, third.Id, file.BackupId)
+		}
+	}
+
+	//merge的批次没有变化时，hint索引文件和数据文件一样引用之前备份中的文件
+	fourth, err := db.BackUpIncremental(backupDir)
+	assert.Nil(t, err)
+	for _, backup := range []*BackupInfo{third, fourth} {
+		var hintFile *BackupFile
+		for _, file := range backup.MetaFiles {
+			if file.Name == data.HintFileName {
+				hintFile = file
+			}
+		}
+		if assert.NotNil(t, hintFile) {
+			assert.Equal(t, third.Id, hintFile.BackupId)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i+1)))
+	}
+
+	restoreDir := dir + "-restore"
+	defer os.RemoveAll(restoreDir)
+	assert.Nil(t, Restore(backupDir, restoreDir))
+	assert.Equal(t, selferror.ErrRestoreDirExists, Restore(backupDir, restoreDir))
+	restoreOpts := opts
+	restoreOpts.DirPath = restoreDir
+	restored, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 700, restored.index.Size())
+	for i := 0; i < 1200; i++ {
+		val, err := restored.Get(testKey(i))
+		if i < 500 {
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+	assert.Nil(t, restored.Close())
+
+	//恢复更早的备份
+	earlierDir := dir + "-restore-earlier"
+	defer os.RemoveAll(earlierDir)
+	assert.Nil(t, restoreBackup(db.fs, backupDir, first.Id, earlierDir))
+	restoreOpts.DirPath = earlierDir
+	restored, err = Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, restored.index.Size())
+	assert.Nil(t, restored.Close())
+
+	//损坏的备份无法恢复，也不会留下恢复了一半的目录
+	corrupted := second.DataFiles[len(second.DataFiles)-1]
+	corruptedFile := backupSubDir(backupDir, corrupted.BackupId) + "/" + corrupted.Name
+	assert.Nil(t, os.Truncate(corruptedFile, corrupted.Size-1))
+	corruptedDir := dir + "-restore-corrupted"
+	err = restoreBackup(db.fs, backupDir, second.Id, corruptedDir)
+	assert.ErrorIs(t, err, selferror.ErrBackupCorrupted)
+	_, err = os.Stat(corruptedDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreToPoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-restore-point")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	time.Sleep(time.Millisecond)
+	beforeTxn := time.Now()
+	time.Sleep(time.Millisecond)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 100; i < 110; i++ {
+		assert.Nil(t, wb.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, wb.Delete(testKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	firstSeqNo := db.seqNo
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i+1)))
+	}
+	wb = db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 50; i < 60; i++ {
+		assert.Nil(t, wb.Delete(testKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	secondSeqNo := db.seqNo
+
+	restoreOpts := opts
+	restoreOpts.DirPath = dir + "-restore"
+	//数据库正在使用时不能恢复
+	assert.Equal(t, selferror.ErrDatabaseIsUsing, RestoreToPoint(dir, restoreOpts, RestorePoint{SeqNo: firstSeqNo}))
+	assert.Nil(t, db.Close())
+	assert.Equal(t, selferror.ErrInvalidRestorePoint, RestoreToPoint(dir, restoreOpts, RestorePoint{}))
+
+	restore := func(point RestorePoint, check func(restored *DB)) {
+		assert.Nil(t, RestoreToPoint(dir, restoreOpts, point))
+		restored, err := Open(restoreOpts)
+		assert.Nil(t, err)
+		check(restored)
+		destroyDB(restored)
+	}
+	restore(RestorePoint{Time: beforeTxn}, func(restored *DB) {
+		assert.Equal(t, 100, restored.index.Size())
+		for i := 0; i < 100; i++ {
+			val, err := restored.Get(testKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(i), val)
+		}
+	})
+	//非事务的写入保留到下一个事务提交之前
+	restore(RestorePoint{SeqNo: firstSeqNo}, func(restored *DB) {
+		assert.Equal(t, 110, restored.index.Size())
+		for i := 0; i < 110; i++ {
+			val, err := restored.Get(testKey(i))
+			assert.Nil(t, err)
+			if i < 50 {
+				assert.Equal(t, testValue(i+1), val)
+			} else {
+				assert.Equal(t, testValue(i), val)
+			}
+		}
+	})
+	restore(RestorePoint{SeqNo: secondSeqNo}, func(restored *DB) {
+		assert.Equal(t, 100, restored.index.Size())
+		_, err := restored.Get(testKey(55))
+		assert.Equal(t, selferror.ErrKeyNotFound, err)
+	})
+
+	//merge之前的历史数据已经被清理了
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	assert.Equal(t, selferror.ErrRestorePointUnavailable, RestoreToPoint(dir, restoreOpts, RestorePoint{Time: beforeTxn}))
+	assert.Equal(t, selferror.ErrRestorePointUnavailable, RestoreToPoint(dir, restoreOpts, RestorePoint{SeqNo: firstSeqNo}))
+	restore(RestorePoint{Time: time.Now()}, func(restored *DB) {
+		assert.Equal(t, 100, restored.index.Size())
+	})
+	restore(RestorePoint{SeqNo: secondSeqNo}, func(restored *DB) {
+		assert.Equal(t, 100, restored.index.Size())
+	})
+	//重启之后新的事务从merge之前的序列号之后继续分配
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, secondSeqNo, db.seqNo)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.fs.MkdirAll(restoreOpts.DirPath))
+	defer db.fs.RemoveAll(restoreOpts.DirPath)
+	assert.Equal(t, selferror.ErrRestoreDirExists, RestoreToPoint(dir, restoreOpts, RestorePoint{Time: time.Now()}))
+}
+
+// 事务提交的记录不按照序列号的顺序出现时，截止位置之前的事务仍然会被恢复
+func TestRestoreToPoint_OutOfOrderTxn(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-restore-point-order")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	records := []*data.LogRecord{
+		{Key: logRecordKeyWithSeq(testKey(2), 2), Value: testValue(2), Type: data.LogRecordNormal},
+		{Key: logRecordKeyWithSeq(txnFinKey, 2), Type: data.LogRecordTnxFinished},
+		{Key: logRecordKeyWithSeq(testKey(1), 1), Value: testValue(1), Type: data.LogRecordNormal},
+		{Key: logRecordKeyWithSeq(txnFinKey, 1), Type: data.LogRecordTnxFinished},
+		{Key: logRecordKeyWithSeq(testKey(3), nonTransactionSeqNo), Value: testValue(3), Type: data.LogRecordNormal},
+	}
+	for _, record := range records {
+		_, err := db.appendLogRecord(record)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	restoreOpts := opts
+	restoreOpts.DirPath = dir + "-restore"
+	assert.Nil(t, RestoreToPoint(dir, restoreOpts, RestorePoint{SeqNo: 1}))
+	restored, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	defer destroyDB(restored)
+	assert.Equal(t, 1, restored.index.Size())
+	val, err := restored.Get(testKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(1), val)
+}
+
+//第一次写入的时候执行回调，用来检查写入tar流的期间没有阻塞写入
+type callbackWriter struct {
+	w        io.Writer
+	callback func()
+}
+
+func (cw *callbackWriter) Write(p []byte) (int, error) {
+	if cw.callback != nil {
+		cw.callback()
+		cw.callback = nil
+	}
+	return cw.w.Write(p)
+}
+
+func TestDB_BackupTo(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-to")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(1000), testValue(1000)))
+	assert.Nil(t, wb.Commit())
+
+	//写入tar流期间的写入不会出现在备份中
+	var buf bytes.Buffer
+	assert.Nil(t, db.BackupTo(&callbackWriter{w: &buf, callback: func() {
+		assert.Nil(t, db.Put(testKey(1001), testValue(1001)))
+	}}))
+
+	restoreDir := dir + "-restore"
+	defer db.fs.RemoveAll(restoreDir)
+	stream := buf.Bytes()
+	assert.Nil(t, restoreFromStream(db.fs, bytes.NewReader(stream), restoreDir))
+	assert.Equal(t, selferror.ErrRestoreDirExists, restoreFromStream(db.fs, bytes.NewReader(stream), restoreDir))
+	restoreOpts := opts
+	restoreOpts.DirPath = restoreDir
+	restored, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 901, restored.index.Size())
+	assert.Equal(t, db.seqNo, restored.seqNo)
+	for i := 0; i <= 1001; i++ {
+		val, err := restored.Get(testKey(i))
+		if i < 100 || i == 1001 {
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+	assert.Nil(t, restored.Close())
+
+	//损坏或者不完整的tar流无法恢复，也不会留下恢复了一半的目录
+	corruptedDir := dir + "-restore-corrupted"
+	corrupted := append([]byte{}, stream...)
+	corrupted[512+100] ^= 0xff
+	err = restoreFromStream(db.fs, bytes.NewReader(corrupted), corruptedDir)
+	assert.ErrorIs(t, err, selferror.ErrBackupCorrupted)
+	_, err = db.fs.Stat(corruptedDir)
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, restoreFromStream(db.fs, bytes.NewReader(stream[:len(stream)/2]), corruptedDir))
+	_, err = db.fs.Stat(corruptedDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func receiveWatchEvents(t *testing.T, w *Watcher, n int) []*WatchEvent {
+	var events []*WatchEvent
+	for len(events) < n {
+		select {
+		case event, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("watcher closed after %d events: %v", len(events), w.Err())
+			}
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout after %d events", len(events))
+		}
+	}
+	return events
+}
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+	}()
+	assert.Nil(t, err)
+
+	_, err = db.Watch(WatchOptions{})
+	assert.Equal(t, selferror.ErrInvalidWatchBufferSize, err)
+	watchOpts := DefaultWatchOptions
+	watchOpts.Prefix = []byte("bitcask-go-key-00000000")
+	w, err := db.Watch(watchOpts)
+	assert.Nil(t, err)
+	slowOpts := DefaultWatchOptions
+	slowOpts.BufferSize = 5
+	slow, err := db.Watch(slowOpts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.Nil(t, db.Delete(testKey(5)))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(1), testValue(100)))
+	assert.Nil(t, wb.Delete(testKey(2)))
+	assert.Nil(t, wb.Put(testKey(15), testValue(15)))
+	assert.Nil(t, wb.Commit())
+
+	events := receiveWatchEvents(t, w, 14)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, WatchPut, events[i].Type)
+		assert.Equal(t, testKey(i), events[i].Key)
+		assert.Equal(t, testValue(i), events[i].Value)
+		assert.Equal(t, nonTransactionSeqNo, events[i].SeqNo)
+	}
+	assert.Equal(t, WatchDelete, events[10].Type)
+	assert.Equal(t, testKey(5), events[10].Key)
+	batchEvents := events[11:]
+	sort.Slice(batchEvents[:2], func(i, j int) bool {
+		return bytes.Compare(batchEvents[i].Key, batchEvents[j].Key) < 0
+	})
+	assert.Equal(t, WatchPut, batchEvents[0].Type)
+	assert.Equal(t, testValue(100), batchEvents[0].Value)
+	assert.Equal(t, WatchDelete, batchEvents[1].Type)
+	assert.Equal(t, WatchBatchCommit, batchEvents[2].Type)
+	assert.Equal(t, db.seqNo, batchEvents[2].SeqNo)
+	assert.Equal(t, batchEvents[0].Position, batchEvents[1].Position)
+
+	//消费太慢的订阅者会被关闭
+	for range slow.Events() {
+	}
+	assert.Equal(t, selferror.ErrWatcherTooSlow, slow.Err())
+
+	//从删除事件的位置重新订阅，先收到数据文件中之后的事务，再收到新的写入
+	resumeOpts := watchOpts
+	resumeOpts.From = &events[10].Position
+	resumed, err := db.Watch(resumeOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(testKey(3), testValue(3)))
+	resumedEvents := receiveWatchEvents(t, resumed, 4)
+	assert.Equal(t, WatchBatchCommit, resumedEvents[2].Type)
+	assert.Equal(t, testKey(3), resumedEvents[3].Key)
+	assert.Equal(t, testKey(3), receiveWatchEvents(t, w, 1)[0].Key)
+	resumed.Close()
+	_, ok := <-resumed.Events()
+	assert.False(t, ok)
+	assert.Nil(t, resumed.Err())
+
+	//merge之后之前的历史数据已经被清理了
+	assert.Nil(t, db.Merge())
+	_, err = db.Watch(resumeOpts)
+	assert.Equal(t, selferror.ErrWatchPositionUnavailable, err)
+
+	//关闭数据库的时候关闭所有的订阅者
+	assert.Nil(t, db.Close())
+	_, ok = <-w.Events()
+	assert.False(t, ok)
+	assert.Nil(t, w.Err())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
+
+// 目录中数据文件的数量
+func countDataFiles(t *testing.T, db *DB, dir string) int {
+	entries, err := db.fs.ReadDir(dir)
+	assert.Nil(t, err)
+	var count int
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDB_DataDirs(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-dirs")
+	opts.DirPath = dir
+	opts.DataDirs = []string{dir + "-disk-0", dir + "-disk-1"}
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer func() {
+		destroyDB(db)
+		for _, path := range append(opts.DataDirs, dir+"-backup", dir+"-checkpoint") {
+			_ = db.fs.RemoveAll(path)
+			_ = os.RemoveAll(path)
+		}
+	}()
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+
+	//数据文件轮流写入到每个目录中，元数据文件在数据目录中
+	assert.Equal(t, 0, countDataFiles(t, db, dir))
+	disk0, disk1 := countDataFiles(t, db, opts.DataDirs[0]), countDataFiles(t, db, opts.DataDirs[1])
+	assert.Greater(t, disk0, 1)
+	assert.LessOrEqual(t, disk0-disk1, 1)
+	dirSize, err := db.fs.DirSize(dir)
+	assert.Nil(t, err)
+	assert.Greater(t, db.Stat().DiskSize, dirSize+opts.DataFileSize)
+
+	//重启之后根据映射文件加载其他目录中的数据文件
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, db.index.Size())
+
+	//merge之后的数据文件仍然分布在每个目录中
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	for _, dataDir := range opts.DataDirs {
+		assert.Greater(t, countDataFiles(t, db, dataDir), 0)
+		_, err := db.fs.Stat(mergeDirOf(dataDir))
+		assert.True(t, os.IsNotExist(err))
+	}
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(testKey(i))
+		if i < 500 {
+			assert.Equal(t, selferror.ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), val)
+	}
+
+	//备份和检查点中所有的数据文件都在同一个目录中
+	assert.Nil(t, db.BackUp(dir+"-backup"))
+	assert.Nil(t, db.Checkpoint(dir+"-checkpoint"))
+	for _, copyDir := range []string{dir + "-backup", dir + "-checkpoint"} {
+		copyOpts := DefaultOptions
+		copyOpts.DirPath = copyDir
+		copyDB, err := Open(copyOpts)
+		assert.Nil(t, err)
+		assert.Equal(t, 500, copyDB.index.Size())
+		val, err := copyDB.Get(testKey(999))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(999), val)
+		assert.Nil(t, copyDB.Close())
+	}
+
+	//修改策略之后，merge之前的文件仍然可以读取
+	assert.Nil(t, db.Close())
+	opts.DataDirPolicy = MostFreeSpace
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, db.index.Size())
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i)))
+	}
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, db.index.Size())
+	val, err := db.Get(testKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(0), val)
+}
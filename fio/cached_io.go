@@ -0,0 +1,241 @@
+package fio
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// IoManagerCache 打开的文件的LRU缓存，用于限制同时打开的文件数量
+// 通过缓存包装的文件在读写时才会真正打开，超过数量限制时关闭最久没有使用的文件
+// 正在读写中的文件不会被关闭，所以在并发读写很多的时候，打开的文件数量可能会暂时超过限制
+type IoManagerCache struct {
+	lock      *sync.Mutex
+	capacity  int
+	lru       *list.List //已经打开、并且可以被关闭的文件，最近使用的在最前面
+	openCount int        //当前打开的文件数量
+}
+
+// NewIoManagerCache 初始化缓存，capacity为同时打开的文件的最大数量
+func NewIoManagerCache(capacity int) *IoManagerCache {
+	return &IoManagerCache{
+		lock:     new(sync.Mutex),
+		capacity: capacity,
+		lru:      list.New(),
+	}
+}
+
+// Wrap 包装一个文件，ioManager为已经打开的IOManager，为nil时在第一次读写时才打开
+// open用于在文件被关闭之后重新打开；pinned为true时文件不会被关闭，直到调用Unpin
+func (c *IoManagerCache) Wrap(ioManager IOManager, open func() (IOManager, error), pinned bool) *CachedIO {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cio := &CachedIO{cache: c, open: open, inner: ioManager, pinned: pinned}
+	if ioManager != nil {
+		c.openCount++
+		if !pinned {
+			cio.elem = c.lru.PushFront(cio)
+		}
+		c.evict()
+	}
+	return cio
+}
+
+// OpenCount 当前打开的文件数量
+func (c *IoManagerCache) OpenCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.openCount
+}
+
+//关闭最久没有使用的文件，直到打开的文件数量不超过限制，调用前必须持有锁
+func (c *IoManagerCache) evict() {
+	elem := c.lru.Back()
+	for c.openCount > c.capacity && elem != nil {
+		prev := elem.Prev()
+		if cio := elem.Value.(*CachedIO); cio.refs == 0 {
+			cio.closeInner()
+		}
+		elem = prev
+	}
+}
+
+// CachedIO 通过缓存打开的IOManager
+type CachedIO struct {
+	cache  *IoManagerCache
+	open   func() (IOManager, error)
+	inner  IOManager     //打开的文件，为nil表示已经关闭
+	refs   int           //正在进行中的读写操作的数量
+	pinned bool          //是否固定打开
+	elem   *list.Element //在LRU中的位置
+	closed bool
+	//正在打开文件时不为nil，打开结束之后关闭，同一个文件的其他读写等待打开结束
+	opening chan struct{}
+}
+
+//获取打开的文件，如果已经被关闭，则重新打开
+//打开文件时不持有缓存的锁，不会阻塞其他文件的读写，缓存的锁只用于维护LRU和计数
+func (cio *CachedIO) acquire() (IOManager, error) {
+	c := cio.cache
+	c.lock.Lock()
+	for cio.opening != nil && !cio.closed {
+		opening := cio.opening
+		c.lock.Unlock()
+		<-opening
+		c.lock.Lock()
+	}
+	if cio.closed {
+		c.lock.Unlock()
+		return nil, os.ErrClosed
+	}
+	if cio.inner != nil {
+		if cio.elem != nil {
+			c.lru.MoveToFront(cio.elem)
+		}
+		return cio.acquireLocked(), nil
+	}
+
+	opening := make(chan struct{})
+	cio.opening = opening
+	c.lock.Unlock()
+	inner, err := cio.open()
+	c.lock.Lock()
+	cio.opening = nil
+	close(opening)
+	if err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+	//打开期间文件被关闭了
+	if cio.closed {
+		c.lock.Unlock()
+		_ = inner.Close()
+		return nil, os.ErrClosed
+	}
+	cio.inner = inner
+	c.openCount++
+	if !cio.pinned {
+		cio.elem = c.lru.PushFront(cio)
+	}
+	return cio.acquireLocked(), nil
+}
+
+//增加引用计数并释放缓存的锁，调用前必须持有锁
+func (cio *CachedIO) acquireLocked() IOManager {
+	c := cio.cache
+	defer c.lock.Unlock()
+	cio.refs++
+	c.evict()
+	return cio.inner
+}
+
+func (cio *CachedIO) release() {
+	c := cio.cache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cio.refs--
+	if cio.refs > 0 {
+		return
+	}
+	if cio.closed {
+		cio.closeInner()
+		return
+	}
+	c.evict()
+}
+
+//关闭打开的文件，调用前必须持有缓存的锁
+func (cio *CachedIO) closeInner() {
+	if cio.inner == nil {
+		return
+	}
+	_ = cio.inner.Close()
+	cio.inner = nil
+	cio.cache.openCount--
+	if cio.elem != nil {
+		cio.cache.lru.Remove(cio.elem)
+		cio.elem = nil
+	}
+}
+
+// Unpin 取消固定，之后文件可以被关闭
+func (cio *CachedIO) Unpin() {
+	c := cio.cache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !cio.pinned {
+		return
+	}
+	cio.pinned = false
+	if cio.inner != nil && !cio.closed {
+		cio.elem = c.lru.PushFront(cio)
+		c.evict()
+	}
+}
+
+func (cio *CachedIO) Read(b []byte, offset int64) (int, error) {
+	inner, err := cio.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer cio.release()
+	return inner.Read(b, offset)
+}
+
+func (cio *CachedIO) Write(b []byte) (int, error) {
+	inner, err := cio.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer cio.release()
+	return inner.Write(b)
+}
+
+func (cio *CachedIO) Sync() error {
+	inner, err := cio.acquire()
+	if err != nil {
+		return err
+	}
+	defer cio.release()
+	return inner.Sync()
+}
+
+func (cio *CachedIO) Size() (int64, error) {
+	inner, err := cio.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer cio.release()
+	return inner.Size()
+}
+
+func (cio *CachedIO) Truncate(size int64) error {
+	inner, err := cio.acquire()
+	if err != nil {
+		return err
+	}
+	defer cio.release()
+	return inner.Truncate(size)
+}
+
+// Close 关闭文件，如果还有进行中的读写，则在读写结束之后关闭
+func (cio *CachedIO) Close() error {
+	c := cio.cache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cio.closed {
+		return nil
+	}
+	cio.closed = true
+	if cio.inner == nil || cio.refs > 0 {
+		return nil
+	}
+	err := cio.inner.Close()
+	cio.inner = nil
+	c.openCount--
+	if cio.elem != nil {
+		c.lru.Remove(cio.elem)
+		cio.elem = nil
+	}
+	return err
+}
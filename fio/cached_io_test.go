@@ -0,0 +1,170 @@
+package fio
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIoManagerCache(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "cached-io-test")
+	defer os.RemoveAll(dir)
+
+	opened := 0
+	cache := NewIoManagerCache(2)
+	var files []*CachedIO
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.data", i))
+		fio, err := NewFileIOManager(path)
+		assert.Nil(t, err)
+		_, err = fio.Write([]byte(fmt.Sprintf("file-%d", i)))
+		assert.Nil(t, err)
+		assert.Nil(t, fio.Close())
+		files = append(files, cache.Wrap(nil, func() (IOManager, error) {
+			opened++
+			return NewFileIOManager(path)
+		}, false))
+	}
+	//没有读写之前不会打开
+	assert.Equal(t, 0, cache.OpenCount())
+
+	read := func(cio *CachedIO) string {
+		b := make([]byte, 6)
+		_, err := cio.Read(b, 0)
+		assert.Nil(t, err)
+		return string(b)
+	}
+	for i, cio := range files {
+		assert.Equal(t, fmt.Sprintf("file-%d", i), read(cio))
+	}
+	assert.Equal(t, 2, cache.OpenCount())
+	assert.Equal(t, 4, opened)
+
+	//最近使用的文件不会被关闭，最久没有使用的文件会被重新打开
+	assert.Equal(t, "file-3", read(files[3]))
+	assert.Equal(t, 4, opened)
+	assert.Equal(t, "file-0", read(files[0]))
+	assert.Equal(t, 5, opened)
+	assert.Equal(t, 2, cache.OpenCount())
+
+	for _, cio := range files {
+		assert.Nil(t, cio.Close())
+	}
+	assert.Equal(t, 0, cache.OpenCount())
+	_, err := files[0].Read(make([]byte, 1), 0)
+	assert.Equal(t, os.ErrClosed, err)
+}
+
+func TestIoManagerCache_Pinned(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "cached-io-test")
+	defer os.RemoveAll(dir)
+
+	cache := NewIoManagerCache(1)
+	open := func(i int) func() (IOManager, error) {
+		return func() (IOManager, error) {
+			return NewFileIOManager(filepath.Join(dir, fmt.Sprintf("%d.data", i)))
+		}
+	}
+	active, err := open(0)()
+	assert.Nil(t, err)
+	pinned := cache.Wrap(active, open(0), true)
+	_, err = pinned.Write([]byte("active"))
+	assert.Nil(t, err)
+
+	//固定打开的文件不会被关闭，其他文件读写结束之后马上被关闭
+	older := cache.Wrap(nil, open(1), false)
+	_, err = older.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cache.OpenCount())
+
+	//取消固定之后可以被关闭
+	pinned.Unpin()
+	_, err = older.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cache.OpenCount())
+	assert.Nil(t, pinned.inner)
+
+	size, err := pinned.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), size)
+	assert.Nil(t, older.inner)
+}
+
+func TestCachedIO_CloseWhileReading(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "cached-io-test")
+	defer os.RemoveAll(dir)
+
+	cache := NewIoManagerCache(1)
+	path := filepath.Join(dir, "0.data")
+	cio := cache.Wrap(nil, func() (IOManager, error) {
+		return NewFileIOManager(path)
+	}, false)
+	inner, err := cio.acquire()
+	assert.Nil(t, err)
+
+	//还有进行中的读写，关闭会推迟到读写结束
+	assert.Nil(t, cio.Close())
+	_, err = inner.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cache.OpenCount())
+	cio.release()
+	assert.Equal(t, 0, cache.OpenCount())
+}
+
+func TestCachedIO_OpenOutsideLock(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "cached-io-test")
+	defer os.RemoveAll(dir)
+
+	cache := NewIoManagerCache(2)
+	var opened int32
+	unblock := make(chan struct{})
+	slow := cache.Wrap(nil, func() (IOManager, error) {
+		atomic.AddInt32(&opened, 1)
+		<-unblock
+		return NewFileIOManager(filepath.Join(dir, "0.data"))
+	}, false)
+	fast := cache.Wrap(nil, func() (IOManager, error) {
+		return NewFileIOManager(filepath.Join(dir, "1.data"))
+	}, false)
+
+	//一个文件打开得很慢时，不会阻塞其他文件的读写，同一个文件的读写等待打开结束，只打开一次
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := slow.Write([]byte("a"))
+			assert.Nil(t, err)
+		}()
+	}
+	_, err := fast.Write([]byte("b"))
+	assert.Nil(t, err)
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&opened))
+	size, err := slow.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), size)
+
+	//打开期间被关闭时，打开的文件会被关闭
+	closing := cache.Wrap(nil, func() (IOManager, error) {
+		time.Sleep(20 * time.Millisecond)
+		return NewFileIOManager(filepath.Join(dir, "2.data"))
+	}, false)
+	done := make(chan error, 1)
+	go func() {
+		_, err := closing.Write([]byte("c"))
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, closing.Close())
+	assert.Equal(t, os.ErrClosed, <-done)
+	assert.Nil(t, slow.Close())
+	assert.Nil(t, fast.Close())
+	assert.Equal(t, 0, cache.OpenCount())
+}
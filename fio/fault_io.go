@@ -0,0 +1,264 @@
+package fio
+
+import (
+	"bitcast-go/selferror"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+//故障注入：用于测试中模拟IO出错和掉电
+//FaultInjector 保存故障的配置和所有被包装的文件，同一个注入器包装的文件共享写入字节数和调用次数的计数
+
+var ioManagerHook atomic.Pointer[func(fileName string, ioManager IOManager) IOManager]
+
+// SetIoManagerHook 设置之后，NewIoManager创建的每一个IOManager都会经过hook包装，传入nil取消
+// 仅用于测试，例如 SetIoManagerHook(injector.Wrap)
+func SetIoManagerHook(hook func(fileName string, ioManager IOManager) IOManager) {
+	if hook == nil {
+		ioManagerHook.Store(nil)
+		return
+	}
+	ioManagerHook.Store(&hook)
+}
+
+func wrapIoManager(fileName string, ioManager IOManager) IOManager {
+	if hook := ioManagerHook.Load(); hook != nil {
+		return (*hook)(fileName, ioManager)
+	}
+	return ioManager
+}
+
+// FaultInjector 故障注入器，各项阈值小于0表示不启用
+type FaultInjector struct {
+	lock *sync.Mutex
+
+	writeFailBytes int64 //累计写入的字节数超过该值之后，Write失败
+	shortWrite     bool  //Write失败时，是否先写入不超过阈值的那一部分数据
+	writeFailCalls int   //Write调用次数超过该值之后失败
+	syncFailCalls  int   //Sync调用次数超过该值之后失败
+	readFailCalls  int   //Read调用次数超过该值之后失败
+	flipBitCalls   int   //Read调用次数超过该值之后，读到的数据中翻转一个bit
+
+	writtenBytes int64
+	writeCalls   int
+	syncCalls    int
+	readCalls    int
+
+	files     []*FaultIO
+	powerLost bool
+}
+
+func NewFaultInjector() *FaultInjector {
+	fi := &FaultInjector{lock: new(sync.Mutex)}
+	fi.Reset()
+	return fi
+}
+
+// Reset 取消所有的故障，并清空计数
+func (fi *FaultInjector) Reset() {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.writeFailBytes, fi.shortWrite = -1, false
+	fi.writeFailCalls, fi.syncFailCalls, fi.readFailCalls, fi.flipBitCalls = -1, -1, -1, -1
+	fi.writtenBytes, fi.writeCalls, fi.syncCalls, fi.readCalls = 0, 0, 0, 0
+}
+
+// FailWriteAfterBytes 累计写入n个字节之后Write失败，shortWrite为true时失败的那次写入会先写入前面的一部分数据
+func (fi *FaultInjector) FailWriteAfterBytes(n int64, shortWrite bool) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.writeFailBytes, fi.shortWrite = n, shortWrite
+}
+
+// FailWriteAfterCalls 成功调用n次Write之后失败
+func (fi *FaultInjector) FailWriteAfterCalls(n int) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.writeFailCalls = n
+}
+
+// FailSyncAfterCalls 成功调用n次Sync之后失败
+func (fi *FaultInjector) FailSyncAfterCalls(n int) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.syncFailCalls = n
+}
+
+// FailReadAfterCalls 成功调用n次Read之后失败
+func (fi *FaultInjector) FailReadAfterCalls(n int) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.readFailCalls = n
+}
+
+// FlipBitsOnReadAfterCalls 调用n次Read之后，每次读到的数据中都会有一个bit被翻转
+func (fi *FaultInjector) FlipBitsOnReadAfterCalls(n int) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.flipBitCalls = n
+}
+
+// Wrap 包装一个IOManager，可以直接作为 SetIoManagerHook 的参数
+func (fi *FaultInjector) Wrap(fileName string, ioManager IOManager) IOManager {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	size, _ := ioManager.Size()
+	fio := &FaultIO{
+		injector: fi,
+		inner:    ioManager,
+		written:  size,
+		synced:   size,
+	}
+	fi.files = append(fi.files, fio)
+	return fio
+}
+
+// PowerLoss 模拟掉电：每个还没有关闭的文件中，没有持久化的数据都会丢失，之后所有被包装的文件的操作都会失败
+// r不为nil时，每个文件会随机保留一部分没有持久化的数据，模拟写了一半的情况
+func (fi *FaultInjector) PowerLoss(r *rand.Rand) error {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.powerLost {
+		return nil
+	}
+	fi.powerLost = true
+	for _, file := range fi.files {
+		if file.closed {
+			continue
+		}
+		keep := file.synced
+		if r != nil && file.written > file.synced {
+			keep += r.Int63n(file.written - file.synced + 1)
+		}
+		if err := file.inner.Truncate(keep); err != nil {
+			return err
+		}
+		if err := file.inner.Close(); err != nil {
+			return err
+		}
+		file.closed = true
+	}
+	return nil
+}
+
+// FaultIO 可以注入故障的IOManager
+type FaultIO struct {
+	injector *FaultInjector
+	inner    IOManager
+	written  int64 //已经写入的数据大小
+	synced   int64 //已经持久化的数据大小
+	closed   bool
+}
+
+func (fio *FaultIO) Read(b []byte, offset int64) (int, error) {
+	fi := fio.injector
+	fi.lock.Lock()
+	if fi.powerLost {
+		fi.lock.Unlock()
+		return 0, selferror.ErrPowerLoss
+	}
+	fi.readCalls++
+	if fi.readFailCalls >= 0 && fi.readCalls > fi.readFailCalls {
+		fi.lock.Unlock()
+		return 0, selferror.ErrInjectedFault
+	}
+	flipBit := fi.flipBitCalls >= 0 && fi.readCalls > fi.flipBitCalls
+	fi.lock.Unlock()
+
+	n, err := fio.inner.Read(b, offset)
+	if flipBit && n > 0 {
+		i := rand.Intn(n * 8)
+		b[i/8] ^= 1 << (i % 8)
+	}
+	return n, err
+}
+
+func (fio *FaultIO) Write(b []byte) (int, error) {
+	fi := fio.injector
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.powerLost {
+		return 0, selferror.ErrPowerLoss
+	}
+	fi.writeCalls++
+	if fi.writeFailCalls >= 0 && fi.writeCalls > fi.writeFailCalls {
+		return 0, selferror.ErrInjectedFault
+	}
+	if fi.writeFailBytes >= 0 && fi.writtenBytes+int64(len(b)) > fi.writeFailBytes {
+		if !fi.shortWrite {
+			return 0, selferror.ErrInjectedFault
+		}
+		//只写入阈值之内的部分
+		n, err := fio.inner.Write(b[:fi.writeFailBytes-fi.writtenBytes])
+		fi.writtenBytes += int64(n)
+		fio.written += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, selferror.ErrInjectedFault
+	}
+	n, err := fio.inner.Write(b)
+	fi.writtenBytes += int64(n)
+	fio.written += int64(n)
+	return n, err
+}
+
+func (fio *FaultIO) Sync() error {
+	fi := fio.injector
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.powerLost {
+		return selferror.ErrPowerLoss
+	}
+	fi.syncCalls++
+	if fi.syncFailCalls >= 0 && fi.syncCalls > fi.syncFailCalls {
+		return selferror.ErrInjectedFault
+	}
+	if err := fio.inner.Sync(); err != nil {
+		return err
+	}
+	fio.synced = fio.written
+	return nil
+}
+
+func (fio *FaultIO) Close() error {
+	fi := fio.injector
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.powerLost || fio.closed {
+		return nil
+	}
+	fio.closed = true
+	return fio.inner.Close()
+}
+
+func (fio *FaultIO) Size() (int64, error) {
+	fi := fio.injector
+	fi.lock.Lock()
+	powerLost := fi.powerLost
+	fi.lock.Unlock()
+	if powerLost {
+		return 0, selferror.ErrPowerLoss
+	}
+	return fio.inner.Size()
+}
+
+func (fio *FaultIO) Truncate(size int64) error {
+	fi := fio.injector
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.powerLost {
+		return selferror.ErrPowerLoss
+	}
+	if err := fio.inner.Truncate(size); err != nil {
+		return err
+	}
+	if fio.written > size {
+		fio.written = size
+	}
+	if fio.synced > size {
+		fio.synced = size
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package fio
+
+import (
+	"bitcast-go/selferror"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestFaultIO_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "fault-a.data")
+	defer destoryFile(path)
+	injector := NewFaultInjector()
+	fileIO, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	fio := injector.Wrap(path, fileIO)
+	defer fio.Close()
+
+	injector.FailWriteAfterBytes(8, true)
+	n, err := fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	//只写入了阈值之内的3个字节
+	n, err = fio.Write([]byte("key-b"))
+	assert.Equal(t, selferror.ErrInjectedFault, err)
+	assert.Equal(t, 3, n)
+	size, _ := fio.Size()
+	assert.Equal(t, int64(8), size)
+
+	injector.Reset()
+	injector.FailWriteAfterCalls(1)
+	_, err = fio.Write([]byte("a"))
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("b"))
+	assert.Equal(t, selferror.ErrInjectedFault, err)
+
+	injector.Reset()
+	injector.FailSyncAfterCalls(1)
+	assert.Nil(t, fio.Sync())
+	assert.Equal(t, selferror.ErrInjectedFault, fio.Sync())
+}
+
+func TestFaultIO_Read(t *testing.T) {
+	path := filepath.Join("/tmp", "fault-b.data")
+	defer destoryFile(path)
+	injector := NewFaultInjector()
+	fileIO, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	fio := injector.Wrap(path, fileIO)
+	defer fio.Close()
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	injector.FlipBitsOnReadAfterCalls(1)
+	b := make([]byte, 5)
+	_, err = fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	_, err = fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, []byte("key-a"), b)
+
+	injector.Reset()
+	injector.FailReadAfterCalls(0)
+	_, err = fio.Read(b, 0)
+	assert.Equal(t, selferror.ErrInjectedFault, err)
+}
+
+func TestFaultInjector_PowerLoss(t *testing.T) {
+	path := filepath.Join("/tmp", "fault-c.data")
+	defer destoryFile(path)
+	injector := NewFaultInjector()
+	SetIoManagerHook(injector.Wrap)
+	defer SetIoManagerHook(nil)
+
+	fio, err := NewIoManager(path, StandardFio)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, fio.Sync())
+	_, err = fio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	//没有持久化的数据丢失，之后的操作都会失败
+	assert.Nil(t, injector.PowerLoss(nil))
+	_, err = fio.Write([]byte("key-c"))
+	assert.Equal(t, selferror.ErrPowerLoss, err)
+
+	SetIoManagerHook(nil)
+	fileIO, err := NewIoManager(path, StandardFio)
+	assert.Nil(t, err)
+	defer fileIO.Close()
+	size, err := fileIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+}
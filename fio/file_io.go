@@ -16,6 +16,15 @@ func NewFileIOManager(fileName string) (*FileIO, error) {
 	return &FileIO{fd}, nil
 }
 
+//以只读的方式打开已经存在的文件，文件不存在时返回错误，写入会失败
+func NewReadOnlyFileIOManager(fileName string) (*FileIO, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &FileIO{fd}, nil
+}
+
 //从文件的给定位置读取对应的数据
 func (fio *FileIO) Read(b []byte, offset int64) (int, error) {
 	return fio.fd.ReadAt(b, offset)
@@ -44,3 +53,8 @@ func (fio *FileIO) Size() (int64, error) {
 	}
 	return stat.Size(), nil
 }
+
+//截断文件，丢弃size之后的数据
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
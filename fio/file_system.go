@@ -0,0 +1,111 @@
+package fio
+
+import (
+	"bitcast-go/utils"
+	"context"
+	"github.com/gofrs/flock"
+	"os"
+)
+
+// FileSystem 数据目录中文件和目录的操作，可以是磁盘上的文件系统，也可以是内存中的文件系统
+type FileSystem interface {
+	//获取文件或者目录的信息，不存在时返回的错误满足os.IsNotExist
+	Stat(name string) (os.FileInfo, error)
+
+	//读取目录中的文件和子目录，按照名称排序
+	ReadDir(name string) ([]os.DirEntry, error)
+
+	//创建目录，包括不存在的上级目录
+	MkdirAll(path string) error
+
+	//删除文件
+	Remove(name string) error
+
+	//删除目录及其中所有的文件
+	RemoveAll(path string) error
+
+	//重命名文件或者目录
+	Rename(oldPath, newPath string) error
+
+	//获取目录中所有文件的大小
+	DirSize(path string) (int64, error)
+
+	//获取目录所在磁盘剩余的可用空间大小
+	AvailableSize(path string) (uint64, error)
+
+	//拷贝目录，名称匹配exclude的文件不会拷贝，ctx被取消时停止拷贝
+	CopyDir(ctx context.Context, src, dest string, exclude []string) error
+
+	//拷贝文件，目标文件存在时会被覆盖
+	CopyFile(src, dest string) error
+
+	//创建硬链接，两个文件不在同一个文件系统中时会失败
+	Link(oldPath, newPath string) error
+
+	//创建文件锁
+	NewFileLock(path string) FileLock
+
+	//文件系统中的文件使用的IO类型
+	IoType() FileIOType
+}
+
+// FileLock 文件锁，保证多个进程（或者同一个进程中多个DB实例）之间互斥
+type FileLock interface {
+	TryLock() (bool, error)
+	Unlock() error
+}
+
+// OSFileSystem 磁盘上的文件系统
+type OSFileSystem struct{}
+
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFileSystem) MkdirAll(path string) error {
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (OSFileSystem) DirSize(path string) (int64, error) {
+	return utils.DirSize(path)
+}
+
+func (OSFileSystem) AvailableSize(path string) (uint64, error) {
+	return utils.AvailableDiskSize(path)
+}
+
+func (OSFileSystem) CopyDir(ctx context.Context, src, dest string, exclude []string) error {
+	return utils.CopyDirCtx(ctx, src, dest, exclude)
+}
+
+func (OSFileSystem) CopyFile(src, dest string) error {
+	return utils.CopyFile(src, dest, DataFilePerm)
+}
+
+func (OSFileSystem) Link(oldPath, newPath string) error {
+	return os.Link(oldPath, newPath)
+}
+
+func (OSFileSystem) NewFileLock(path string) FileLock {
+	return flock.New(path)
+}
+
+func (OSFileSystem) IoType() FileIOType {
+	return StandardFio
+}
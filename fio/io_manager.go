@@ -7,6 +7,7 @@ type FileIOType = byte
 const (
 	StandardFio FileIOType = iota
 	MemoryMap
+	MemoryFio
 )
 
 //抽象IO管理接口，可以接入不同的IO类型，目前支持标准文件IO
@@ -25,17 +26,27 @@ type IOManager interface {
 
 	//获取到对应文件大小
 	Size() (int64, error)
+
+	//截断文件，丢弃size之后的数据
+	Truncate(size int64) error
 }
 
 // NewIoManager 初始化IOManager 目前只支持FileIO
 func NewIoManager(fileName string, ioType FileIOType) (IOManager, error) {
+	var ioManager IOManager
+	var err error
 	switch ioType {
 	case StandardFio:
-		return NewFileIOManager(fileName)
+		ioManager, err = NewFileIOManager(fileName)
 	case MemoryMap:
-		return NewMMapIoManager(fileName)
+		ioManager, err = NewMMapIoManager(fileName)
+	case MemoryFio:
+		ioManager, err = NewMemoryIoManager(fileName)
 	default:
 		panic("unsupported io type")
 	}
-	return NewFileIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return wrapIoManager(fileName, ioManager), nil
 }
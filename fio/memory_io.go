@@ -0,0 +1,413 @@
+package fio
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS 进程内共享的内存文件系统，内存模式下DB所有的文件都保存在这里
+// 文件在被删除之前一直占用内存，DB默认在关闭时删除自己的文件，开启Options.InMemoryRetain之后才会保留
+var MemFS = NewMemoryFileSystem()
+
+//内存中的文件
+type memFile struct {
+	data []byte
+	lock *sync.RWMutex
+}
+
+// MemoryIO 内存文件IO
+type MemoryIO struct {
+	file *memFile
+}
+
+// NewMemoryIoManager 打开内存文件系统中的文件，不存在则创建
+func NewMemoryIoManager(fileName string) (*MemoryIO, error) {
+	return &MemoryIO{file: MemFS.openFile(fileName)}, nil
+}
+
+//从文件的给定位置读取对应的数据
+func (mio *MemoryIO) Read(b []byte, offset int64) (int, error) {
+	mio.file.lock.RLock()
+	defer mio.file.lock.RUnlock()
+	if offset < 0 || offset >= int64(len(mio.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mio.file.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+//写入字节数组到文件中
+func (mio *MemoryIO) Write(b []byte) (int, error) {
+	mio.file.lock.Lock()
+	defer mio.file.lock.Unlock()
+	mio.file.data = append(mio.file.data, b...)
+	return len(b), nil
+}
+
+//内存文件不需要持久化
+func (mio *MemoryIO) Sync() error {
+	return nil
+}
+
+//关闭文件，数据仍然保留在内存文件系统中
+func (mio *MemoryIO) Close() error {
+	return nil
+}
+
+//获取到对应文件大小
+func (mio *MemoryIO) Size() (int64, error) {
+	mio.file.lock.RLock()
+	defer mio.file.lock.RUnlock()
+	return int64(len(mio.file.data)), nil
+}
+
+//截断文件，丢弃size之后的数据
+func (mio *MemoryIO) Truncate(size int64) error {
+	mio.file.lock.Lock()
+	defer mio.file.lock.Unlock()
+	if size >= 0 && size < int64(len(mio.file.data)) {
+		mio.file.data = mio.file.data[:size:size]
+	}
+	return nil
+}
+
+// MemoryFileSystem 内存中的文件系统
+type MemoryFileSystem struct {
+	lock  *sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]struct{}
+	locks map[string]struct{} //已经加锁的文件锁
+}
+
+func NewMemoryFileSystem() *MemoryFileSystem {
+	return &MemoryFileSystem{
+		lock:  new(sync.Mutex),
+		files: make(map[string]*memFile),
+		dirs:  make(map[string]struct{}),
+		locks: make(map[string]struct{}),
+	}
+}
+
+//打开文件，不存在则创建，同时创建上级目录
+func (mfs *MemoryFileSystem) openFile(name string) *memFile {
+	name = filepath.Clean(name)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	file, ok := mfs.files[name]
+	if !ok {
+		file = &memFile{lock: new(sync.RWMutex)}
+		mfs.files[name] = file
+		mfs.mkdirAll(filepath.Dir(name))
+	}
+	return file
+}
+
+func (mfs *MemoryFileSystem) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if file, ok := mfs.files[name]; ok {
+		return newMemFileInfo(name, file), nil
+	}
+	if _, ok := mfs.dirs[name]; ok {
+		return newMemFileInfo(name, nil), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemoryFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	name = filepath.Clean(name)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if _, ok := mfs.dirs[name]; !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for fileName, file := range mfs.files {
+		if filepath.Dir(fileName) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(newMemFileInfo(fileName, file)))
+		}
+	}
+	for dirName := range mfs.dirs {
+		if dirName != name && filepath.Dir(dirName) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(newMemFileInfo(dirName, nil)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (mfs *MemoryFileSystem) MkdirAll(path string) error {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	mfs.mkdirAll(filepath.Clean(path))
+	return nil
+}
+
+func (mfs *MemoryFileSystem) mkdirAll(path string) {
+	for {
+		if _, ok := mfs.dirs[path]; ok {
+			return
+		}
+		mfs.dirs[path] = struct{}{}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return
+		}
+		path = parent
+	}
+}
+
+func (mfs *MemoryFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if _, ok := mfs.files[name]; ok {
+		delete(mfs.files, name)
+		return nil
+	}
+	if _, ok := mfs.dirs[name]; ok {
+		for _, children := range [][]string{mfs.filesUnder(name), mfs.dirsUnder(name)} {
+			if len(children) > 0 {
+				return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+			}
+		}
+		delete(mfs.dirs, name)
+		return nil
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemoryFileSystem) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	for _, name := range mfs.filesUnder(path) {
+		delete(mfs.files, name)
+	}
+	for _, name := range mfs.dirsUnder(path) {
+		delete(mfs.dirs, name)
+	}
+	delete(mfs.files, path)
+	delete(mfs.dirs, path)
+	return nil
+}
+
+func (mfs *MemoryFileSystem) Rename(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if file, ok := mfs.files[oldPath]; ok {
+		delete(mfs.files, oldPath)
+		mfs.files[newPath] = file
+		mfs.mkdirAll(filepath.Dir(newPath))
+		return nil
+	}
+	if _, ok := mfs.dirs[oldPath]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	for _, name := range mfs.filesUnder(oldPath) {
+		mfs.files[newPath+name[len(oldPath):]] = mfs.files[name]
+		delete(mfs.files, name)
+	}
+	for _, name := range append(mfs.dirsUnder(oldPath), oldPath) {
+		delete(mfs.dirs, name)
+		mfs.dirs[newPath+name[len(oldPath):]] = struct{}{}
+	}
+	mfs.mkdirAll(filepath.Dir(newPath))
+	return nil
+}
+
+func (mfs *MemoryFileSystem) DirSize(path string) (int64, error) {
+	path = filepath.Clean(path)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	var size int64
+	for _, name := range mfs.filesUnder(path) {
+		file := mfs.files[name]
+		file.lock.RLock()
+		size += int64(len(file.data))
+		file.lock.RUnlock()
+	}
+	return size, nil
+}
+
+//内存文件系统的空间不做限制
+func (mfs *MemoryFileSystem) AvailableSize(path string) (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+func (mfs *MemoryFileSystem) CopyDir(ctx context.Context, src, dest string, exclude []string) error {
+	src, dest = filepath.Clean(src), filepath.Clean(dest)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	mfs.mkdirAll(dest)
+	for _, name := range mfs.dirsUnder(src) {
+		mfs.mkdirAll(dest + name[len(src):])
+	}
+	for _, name := range mfs.filesUnder(src) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		matched, err := matchAny(exclude, filepath.Base(name))
+		if err != nil {
+			return err
+		}
+		if matched {
+			continue
+		}
+		file := mfs.files[name]
+		file.lock.RLock()
+		copied := &memFile{data: append([]byte(nil), file.data...), lock: new(sync.RWMutex)}
+		file.lock.RUnlock()
+		destName := dest + name[len(src):]
+		mfs.files[destName] = copied
+		mfs.mkdirAll(filepath.Dir(destName))
+	}
+	return nil
+}
+
+func (mfs *MemoryFileSystem) CopyFile(src, dest string) error {
+	src, dest = filepath.Clean(src), filepath.Clean(dest)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	file, ok := mfs.files[src]
+	if !ok {
+		return &os.PathError{Op: "open", Path: src, Err: fs.ErrNotExist}
+	}
+	file.lock.RLock()
+	mfs.files[dest] = &memFile{data: append([]byte(nil), file.data...), lock: new(sync.RWMutex)}
+	file.lock.RUnlock()
+	mfs.mkdirAll(filepath.Dir(dest))
+	return nil
+}
+
+//两个路径共享同一个内存文件
+func (mfs *MemoryFileSystem) Link(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	file, ok := mfs.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if _, ok := mfs.files[newPath]; ok {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: fs.ErrExist}
+	}
+	mfs.files[newPath] = file
+	mfs.mkdirAll(filepath.Dir(newPath))
+	return nil
+}
+
+func (mfs *MemoryFileSystem) NewFileLock(path string) FileLock {
+	return &memFileLock{fs: mfs, path: filepath.Clean(path)}
+}
+
+func (mfs *MemoryFileSystem) IoType() FileIOType {
+	return MemoryFio
+}
+
+//目录下（包括子目录中）所有的文件
+func (mfs *MemoryFileSystem) filesUnder(dir string) []string {
+	var names []string
+	for name := range mfs.files {
+		if strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//目录下所有的子目录
+func (mfs *MemoryFileSystem) dirsUnder(dir string) []string {
+	var names []string
+	for name := range mfs.dirs {
+		if strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func matchAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+//内存文件系统中的文件锁，只在同一个进程中互斥
+type memFileLock struct {
+	fs     *MemoryFileSystem
+	path   string
+	locked bool
+}
+
+func (l *memFileLock) TryLock() (bool, error) {
+	l.fs.lock.Lock()
+	defer l.fs.lock.Unlock()
+	if l.locked {
+		return true, nil
+	}
+	if _, ok := l.fs.locks[l.path]; ok {
+		return false, nil
+	}
+	l.fs.locks[l.path] = struct{}{}
+	l.locked = true
+	return true, nil
+}
+
+func (l *memFileLock) Unlock() error {
+	l.fs.lock.Lock()
+	defer l.fs.lock.Unlock()
+	if l.locked {
+		delete(l.fs.locks, l.path)
+		l.locked = false
+	}
+	return nil
+}
+
+//内存文件的信息，file为nil表示目录
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func newMemFileInfo(name string, file *memFile) *memFileInfo {
+	info := &memFileInfo{name: filepath.Base(name), dir: file == nil}
+	if file != nil {
+		file.lock.RLock()
+		info.size = int64(len(file.data))
+		file.lock.RUnlock()
+	}
+	return info
+}
+
+func (info *memFileInfo) Name() string { return info.name }
+func (info *memFileInfo) Size() int64  { return info.size }
+func (info *memFileInfo) Mode() fs.FileMode {
+	if info.dir {
+		return fs.ModeDir | os.ModePerm
+	}
+	return DataFilePerm
+}
+func (info *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (info *memFileInfo) IsDir() bool        { return info.dir }
+func (info *memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,108 @@
+package fio
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemoryIO_ReadWrite(t *testing.T) {
+	path := "/memory-io-test/a.data"
+	defer MemFS.RemoveAll("/memory-io-test")
+
+	mio, err := NewMemoryIoManager(path)
+	assert.Nil(t, err)
+	_, err = mio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = mio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, mio.Close())
+
+	//重新打开之后可以读到之前写入的数据
+	mio, err = NewMemoryIoManager(path)
+	assert.Nil(t, err)
+	size, err := mio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+	b := make([]byte, 5)
+	_, err = mio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+	n, err := mio.Read(make([]byte, 10), 5)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+
+	assert.Nil(t, mio.Truncate(5))
+	size, err = mio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+}
+
+func TestMemoryFileSystem(t *testing.T) {
+	mfs := NewMemoryFileSystem()
+	assert.Nil(t, mfs.MkdirAll("/db/merge"))
+	a, b := mfs.openFile("/db/merge/a.data"), mfs.openFile("/db/b.data")
+	a.data, b.data = []byte("aaa"), []byte("bb")
+
+	entries, err := mfs.ReadDir("/db")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "b.data", entries[0].Name())
+	assert.Equal(t, "merge", entries[1].Name())
+	assert.True(t, entries[1].IsDir())
+
+	size, err := mfs.DirSize("/db")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+
+	assert.Nil(t, mfs.Rename("/db/merge/a.data", "/db/a.data"))
+	stat, err := mfs.Stat("/db/a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), stat.Size())
+	_, err = mfs.Stat("/db/merge/a.data")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, mfs.CopyDir(context.Background(), "/db", "/backup", []string{"b.data"}))
+	entries, err = mfs.ReadDir("/backup")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	assert.Nil(t, mfs.RemoveAll("/db"))
+	_, err = mfs.Stat("/db")
+	assert.True(t, os.IsNotExist(err))
+	_, err = mfs.Stat("/backup/a.data")
+	assert.Nil(t, err)
+
+	lock1, lock2 := mfs.NewFileLock("/db/flock"), mfs.NewFileLock("/db/flock")
+	hold, err := lock1.TryLock()
+	assert.True(t, hold)
+	hold, err = lock2.TryLock()
+	assert.Nil(t, err)
+	assert.False(t, hold)
+	assert.Nil(t, lock1.Unlock())
+	hold, err = lock2.TryLock()
+	assert.True(t, hold)
+}
+
+func TestMemoryFileSystem_LinkAndCopyFile(t *testing.T) {
+	mfs := NewMemoryFileSystem()
+	mio := &MemoryIO{file: mfs.openFile("/db/a.data")}
+	_, err := mio.Write([]byte("abc"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, mfs.Link("/db/a.data", "/checkpoint/a.data"))
+	assert.NotNil(t, mfs.Link("/db/a.data", "/checkpoint/a.data"))
+	assert.Nil(t, mfs.CopyFile("/db/a.data", "/checkpoint/b.data"))
+
+	//硬链接共享同一个文件，拷贝的文件是独立的
+	_, err = mio.Write([]byte("def"))
+	assert.Nil(t, err)
+	linked, err := mfs.Stat("/checkpoint/a.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), linked.Size())
+	copied, err := mfs.Stat("/checkpoint/b.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), copied.Size())
+}
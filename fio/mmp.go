@@ -1,47 +1,161 @@
+//go:build unix
+
 package fio
 
 import (
-	"golang.org/x/exp/mmap"
+	"golang.org/x/sys/unix"
+	"io"
 	"os"
+	"sync"
+)
+
+// MMapWritable 当前平台是否支持通过内存映射写入，不支持时不能开启MMapIO
+const MMapWritable = true
+
+const (
+	mmapMinGrowSize = 1 << 20  //每次扩展映射的最小大小
+	mmapMaxGrowSize = 64 << 20 //每次扩展映射的最大大小
 )
 
-//io 内存文件映射,这里仅仅用来读数据，用来加速启动
+//io 内存文件映射，支持读写
+//写入时会预先扩展文件和映射的大小，直接写入映射的内存中；关闭时再把文件截断到实际写入的大小
 type MMap struct {
-	readerAt *mmap.ReaderAt
+	fd   *os.File
+	data []byte //映射的内存，长度为文件当前的物理大小
+	size int64  //实际写入的数据大小
+	lock *sync.RWMutex
 }
 
 func NewMMapIoManager(fileName string) (*MMap, error) {
-	_, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
 	if err != nil {
 		return nil, err
 	}
-	readerAt, err := mmap.Open(fileName)
+	stat, err := fd.Stat()
 	if err != nil {
+		_ = fd.Close()
 		return nil, err
 	}
-	return &MMap{readerAt: readerAt}, nil
+	mmap := &MMap{fd: fd, size: stat.Size(), lock: new(sync.RWMutex)}
+	//打开时只映射已有的数据，只有写入的时候才会扩展
+	if mmap.size > 0 {
+		if mmap.data, err = unix.Mmap(int(fd.Fd()), 0, int(mmap.size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+	return mmap, nil
 }
 
 func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
-	return mmap.readerAt.ReadAt(b, offset)
+	mmap.lock.RLock()
+	defer mmap.lock.RUnlock()
+	if offset < 0 || offset >= mmap.size {
+		return 0, io.EOF
+	}
+	n := copy(b, mmap.data[offset:mmap.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 //写入字节数组到文件中
-func (mmap *MMap) Write([]byte) (int, error) {
-	panic("not implemented")
+func (mmap *MMap) Write(b []byte) (int, error) {
+	mmap.lock.Lock()
+	defer mmap.lock.Unlock()
+	end := mmap.size + int64(len(b))
+	if end > int64(len(mmap.data)) {
+		if err := mmap.grow(end); err != nil {
+			return 0, err
+		}
+	}
+	copy(mmap.data[mmap.size:end], b)
+	mmap.size = end
+	return len(b), nil
 }
 
 //持久化数据
 func (mmap *MMap) Sync() error {
-	panic("not implemented")
+	mmap.lock.RLock()
+	defer mmap.lock.RUnlock()
+	if len(mmap.data) > 0 {
+		if err := unix.Msync(mmap.data, unix.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	//扩展文件时修改了文件的大小，也需要持久化
+	return mmap.fd.Sync()
 }
 
-//关闭文件
+//关闭文件，并把文件截断到实际写入的大小
 func (mmap *MMap) Close() error {
-	return mmap.readerAt.Close()
+	mmap.lock.Lock()
+	defer mmap.lock.Unlock()
+	if mmap.data != nil {
+		if err := unix.Munmap(mmap.data); err != nil {
+			return err
+		}
+		if int64(len(mmap.data)) != mmap.size {
+			if err := mmap.fd.Truncate(mmap.size); err != nil {
+				return err
+			}
+		}
+		mmap.data = nil
+	}
+	return mmap.fd.Close()
 }
 
-//获取到对应文件大小
+//获取到对应文件大小，即实际写入的数据大小
 func (mmap *MMap) Size() (int64, error) {
-	return int64(mmap.readerAt.Len()), nil
+	mmap.lock.RLock()
+	defer mmap.lock.RUnlock()
+	return mmap.size, nil
+}
+
+//截断文件，丢弃size之后的数据，被丢弃的空间会清零，之后的写入从size开始
+func (mmap *MMap) Truncate(size int64) error {
+	mmap.lock.Lock()
+	defer mmap.lock.Unlock()
+	if size < 0 || size >= mmap.size {
+		return nil
+	}
+	clear(mmap.data[size:mmap.size])
+	mmap.size = size
+	return nil
+}
+
+//扩展文件和映射的大小，至少扩展到minSize
+func (mmap *MMap) grow(minSize int64) error {
+	current := int64(len(mmap.data))
+	growSize := current
+	if growSize < mmapMinGrowSize {
+		growSize = mmapMinGrowSize
+	}
+	if growSize > mmapMaxGrowSize {
+		growSize = mmapMaxGrowSize
+	}
+	newSize := current + growSize
+	if newSize < minSize {
+		newSize = minSize
+	}
+	pageSize := int64(os.Getpagesize())
+	newSize = (newSize + pageSize - 1) / pageSize * pageSize
+
+	//先扩展文件并建立新的映射，都成功之后再解除旧的映射，失败时旧的映射仍然可用
+	if err := mmap.fd.Truncate(newSize); err != nil {
+		return err
+	}
+	data, err := unix.Mmap(int(mmap.fd.Fd()), 0, int(newSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if mmap.data != nil {
+		if err := unix.Munmap(mmap.data); err != nil {
+			_ = unix.Munmap(data)
+			return err
+		}
+	}
+	mmap.data = data
+	return nil
 }
@@ -0,0 +1,63 @@
+//go:build !unix
+
+package fio
+
+import (
+	"errors"
+	"golang.org/x/exp/mmap"
+	"os"
+)
+
+// MMapWritable 当前平台是否支持通过内存映射写入，不支持时不能开启MMapIO
+const MMapWritable = false
+
+var errMMapReadOnly = errors.New("mmap io is read only on this platform")
+
+//io 内存文件映射，不支持读写映射的平台上仅仅用来读数据，用来加速启动
+type MMap struct {
+	readerAt *mmap.ReaderAt
+}
+
+func NewMMapIoManager(fileName string) (*MMap, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.Close(); err != nil {
+		return nil, err
+	}
+	readerAt, err := mmap.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &MMap{readerAt: readerAt}, nil
+}
+
+func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
+	return mmap.readerAt.ReadAt(b, offset)
+}
+
+//写入字节数组到文件中
+func (mmap *MMap) Write([]byte) (int, error) {
+	return 0, errMMapReadOnly
+}
+
+//持久化数据
+func (mmap *MMap) Sync() error {
+	return errMMapReadOnly
+}
+
+//关闭文件
+func (mmap *MMap) Close() error {
+	return mmap.readerAt.Close()
+}
+
+//获取到对应文件大小
+func (mmap *MMap) Size() (int64, error) {
+	return int64(mmap.readerAt.Len()), nil
+}
+
+//截断文件，只读的映射不支持
+func (mmap *MMap) Truncate(int64) error {
+	return errMMapReadOnly
+}
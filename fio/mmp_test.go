@@ -0,0 +1,115 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMMap_ReadWrite(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-a.data")
+	defer destoryFile(path)
+
+	mmapIO, err := NewMMapIoManager(path)
+	assert.Nil(t, err)
+
+	//空文件读取直接返回EOF
+	b := make([]byte, 5)
+	_, err = mmapIO.Read(b, 0)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = mmapIO.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = mmapIO.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	n, err := mmapIO.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-b"), b)
+
+	//超过写入大小的部分不可读
+	n, err = mmapIO.Read(make([]byte, 10), 5)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+
+	//写入时文件被预先扩展，但Size返回实际写入的大小
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.True(t, stat.Size() > 10)
+
+	assert.Nil(t, mmapIO.Sync())
+	assert.Nil(t, mmapIO.Close())
+
+	//关闭之后文件被截断到实际写入的大小
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+
+	mmapIO, err = NewMMapIoManager(path)
+	assert.Nil(t, err)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	assert.Nil(t, mmapIO.Close())
+}
+
+func TestMMap_Grow(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-b.data")
+	defer destoryFile(path)
+
+	mmapIO, err := NewMMapIoManager(path)
+	assert.Nil(t, err)
+
+	//写入超过多次扩展的数据量
+	buf := make([]byte, 256*1024)
+	for i := 0; i < 40; i++ {
+		for j := range buf {
+			buf[j] = byte(i)
+		}
+		n, err := mmapIO.Write(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, len(buf), n)
+	}
+	for i := 0; i < 40; i++ {
+		b := make([]byte, len(buf))
+		_, err := mmapIO.Read(b, int64(i*len(buf)))
+		assert.Nil(t, err)
+		assert.Equal(t, byte(i), b[0])
+		assert.Equal(t, byte(i), b[len(b)-1])
+	}
+	assert.Nil(t, mmapIO.Close())
+}
+
+func TestMMap_Truncate(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-c.data")
+	defer destoryFile(path)
+
+	mmapIO, err := NewMMapIoManager(path)
+	assert.Nil(t, err)
+	_, err = mmapIO.Write([]byte("key-a-key-b"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, mmapIO.Truncate(5))
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+
+	//截断之后从新的位置继续写入
+	_, err = mmapIO.Write([]byte("key-c"))
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-akey-c"), b)
+	assert.Nil(t, mmapIO.Close())
+
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+}
@@ -0,0 +1,207 @@
+//go:build linux
+
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+const directIOAlignSize = 4096 //O_DIRECT要求的缓冲区地址、偏移量和长度的对齐大小
+
+//PreallocIO 预分配的文件IO
+//打开文件时使用fallocate把文件扩展到预分配的大小，之后的写入都在已经分配好的空间内进行，避免文件碎片，持久化时也只需要fdatasync
+//文件的物理大小和实际写入的数据大小（逻辑大小）是分开记录的，关闭时再把文件截断到实际写入的大小
+//可选使用O_DIRECT绕过页缓存，此时所有的读写都会按照块大小对齐
+type PreallocIO struct {
+	fd           *os.File
+	directIO     bool
+	preallocSize int64  //预分配的大小
+	size         int64  //实际写入的数据大小
+	tail         []byte //O_DIRECT模式下，最后一个没有写满的块中已经写入的数据
+	lock         *sync.RWMutex
+}
+
+// NewPreallocIoManager 初始化预分配的文件IO
+// 打开时无法判断预分配的空间中实际写入了多少数据，逻辑大小先等于文件的物理大小，需要由调用方通过Truncate修正
+func NewPreallocIoManager(fileName string, preallocSize int64, directIO bool) (*PreallocIO, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if directIO {
+		flag |= unix.O_DIRECT
+	}
+	fd, err := os.OpenFile(fileName, flag, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	pio := &PreallocIO{
+		fd:           fd,
+		directIO:     directIO,
+		preallocSize: preallocSize,
+		size:         stat.Size(),
+		lock:         new(sync.RWMutex),
+	}
+	if err := pio.preallocate(); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	if err := pio.loadTail(); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return pio, nil
+}
+
+//从文件的给定位置读取对应的数据
+func (pio *PreallocIO) Read(b []byte, offset int64) (int, error) {
+	pio.lock.RLock()
+	defer pio.lock.RUnlock()
+	if offset < 0 || offset >= pio.size {
+		return 0, io.EOF
+	}
+	length := int64(len(b))
+	if offset+length > pio.size {
+		length = pio.size - offset
+	}
+	var n int
+	var err error
+	if pio.directIO {
+		n, err = pio.readAligned(b[:length], offset)
+	} else {
+		n, err = pio.fd.ReadAt(b[:length], offset)
+	}
+	if err != nil {
+		return n, err
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+//写入字节数组到文件中
+func (pio *PreallocIO) Write(b []byte) (int, error) {
+	pio.lock.Lock()
+	defer pio.lock.Unlock()
+	if !pio.directIO {
+		n, err := pio.fd.WriteAt(b, pio.size)
+		pio.size += int64(n)
+		return n, err
+	}
+
+	//O_DIRECT只能按块写入：从最后一个没有写满的块开始，连同新的数据一起补齐到块大小之后写入
+	blockStart := pio.size - int64(len(pio.tail))
+	length := len(pio.tail) + len(b)
+	buf := alignedBuffer(alignUp(int64(length)))
+	copy(buf, pio.tail)
+	copy(buf[len(pio.tail):], b)
+	if _, err := pio.fd.WriteAt(buf, blockStart); err != nil {
+		return 0, err
+	}
+	pio.size += int64(len(b))
+	tailSize := length % directIOAlignSize
+	pio.tail = append(pio.tail[:0], buf[length-tailSize:length]...)
+	return len(b), nil
+}
+
+//持久化数据，空间是预先分配好的，只需要持久化数据本身
+func (pio *PreallocIO) Sync() error {
+	return unix.Fdatasync(int(pio.fd.Fd()))
+}
+
+//关闭文件，并把文件截断到实际写入的大小
+func (pio *PreallocIO) Close() error {
+	pio.lock.Lock()
+	defer pio.lock.Unlock()
+	if err := pio.fd.Truncate(pio.size); err != nil {
+		return err
+	}
+	return pio.fd.Close()
+}
+
+//获取到实际写入的数据大小
+func (pio *PreallocIO) Size() (int64, error) {
+	pio.lock.RLock()
+	defer pio.lock.RUnlock()
+	return pio.size, nil
+}
+
+//截断文件，丢弃size之后的数据，并重新预分配被丢弃的空间
+func (pio *PreallocIO) Truncate(size int64) error {
+	pio.lock.Lock()
+	defer pio.lock.Unlock()
+	if size < 0 || size >= pio.size {
+		return nil
+	}
+	if err := pio.fd.Truncate(size); err != nil {
+		return err
+	}
+	pio.size = size
+	if err := pio.preallocate(); err != nil {
+		return err
+	}
+	return pio.loadTail()
+}
+
+//把文件扩展到预分配的大小，扩展出来的空间全部为0
+func (pio *PreallocIO) preallocate() error {
+	stat, err := pio.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() >= pio.preallocSize {
+		return nil
+	}
+	return unix.Fallocate(int(pio.fd.Fd()), 0, 0, pio.preallocSize)
+}
+
+//O_DIRECT模式下读取最后一个没有写满的块
+func (pio *PreallocIO) loadTail() error {
+	if !pio.directIO {
+		return nil
+	}
+	tailSize := pio.size % directIOAlignSize
+	pio.tail = make([]byte, tailSize)
+	if tailSize == 0 {
+		return nil
+	}
+	_, err := pio.readAligned(pio.tail, pio.size-tailSize)
+	return err
+}
+
+//O_DIRECT模式下读取数据，把读取的范围扩展到块对齐之后再读
+func (pio *PreallocIO) readAligned(b []byte, offset int64) (int, error) {
+	start := offset &^ (directIOAlignSize - 1)
+	end := alignUp(offset + int64(len(b)))
+	buf := alignedBuffer(end - start)
+	n, err := pio.fd.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if int64(n) < offset-start+int64(len(b)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(b, buf[offset-start:]), nil
+}
+
+//向上对齐到块大小
+func alignUp(n int64) int64 {
+	return (n + directIOAlignSize - 1) &^ (directIOAlignSize - 1)
+}
+
+//分配起始地址按照块大小对齐的缓冲区
+func alignedBuffer(size int64) []byte {
+	buf := make([]byte, size+directIOAlignSize)
+	shift := int64(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignSize - 1))
+	if shift != 0 {
+		shift = directIOAlignSize - shift
+	}
+	return buf[shift : shift+size : shift+size]
+}
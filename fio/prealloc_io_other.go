@@ -0,0 +1,15 @@
+//go:build !linux
+
+package fio
+
+import "errors"
+
+//PreallocIO 预分配的文件IO，依赖fallocate和O_DIRECT，只支持linux
+type PreallocIO struct {
+	*FileIO
+}
+
+// NewPreallocIoManager 初始化预分配的文件IO
+func NewPreallocIoManager(string, int64, bool) (*PreallocIO, error) {
+	return nil, errors.New("preallocated data files are only supported on linux")
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocIO_ReadWrite(t *testing.T) {
+	for _, directIO := range []bool{false, true} {
+		path := filepath.Join("/tmp", "prealloc-a.data")
+		pio, err := NewPreallocIoManager(path, 64*1024, directIO)
+		assert.Nil(t, err)
+
+		//打开之后文件被扩展到预分配的大小
+		stat, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(64*1024), stat.Size())
+		size, err := pio.Size()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), size)
+
+		_, err = pio.Write([]byte("key-a"))
+		assert.Nil(t, err)
+		//跨越块边界的写入
+		big := make([]byte, 5000)
+		for i := range big {
+			big[i] = byte(i)
+		}
+		_, err = pio.Write(big)
+		assert.Nil(t, err)
+		_, err = pio.Write([]byte("key-b"))
+		assert.Nil(t, err)
+		assert.Nil(t, pio.Sync())
+
+		b := make([]byte, 5)
+		_, err = pio.Read(b, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("key-a"), b)
+		b2 := make([]byte, len(big))
+		_, err = pio.Read(b2, 5)
+		assert.Nil(t, err)
+		assert.Equal(t, big, b2)
+		_, err = pio.Read(b, 5005)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("key-b"), b)
+
+		//超过写入大小的部分不可读
+		n, err := pio.Read(make([]byte, 10), 5005)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, 5, n)
+
+		//关闭之后文件被截断到实际写入的大小
+		assert.Nil(t, pio.Close())
+		stat, err = os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(5010), stat.Size())
+
+		//重新打开之后可以继续写入
+		pio, err = NewPreallocIoManager(path, 64*1024, directIO)
+		assert.Nil(t, err)
+		size, err = pio.Size()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(5010), size)
+		_, err = pio.Write([]byte("key-c"))
+		assert.Nil(t, err)
+		_, err = pio.Read(b, 5005)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("key-b"), b)
+		_, err = pio.Read(b, 5010)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("key-c"), b)
+		assert.Nil(t, pio.Close())
+		destoryFile(path)
+	}
+}
+
+func TestPreallocIO_Truncate(t *testing.T) {
+	for _, directIO := range []bool{false, true} {
+		path := filepath.Join("/tmp", "prealloc-b.data")
+		pio, err := NewPreallocIoManager(path, 64*1024, directIO)
+		assert.Nil(t, err)
+		_, err = pio.Write([]byte("key-a-key-b"))
+		assert.Nil(t, err)
+		assert.Nil(t, pio.Sync())
+
+		//模拟异常退出，没有截断文件，重新打开时逻辑大小等于物理大小
+		pio2, err := NewPreallocIoManager(path, 64*1024, directIO)
+		assert.Nil(t, err)
+		size, err := pio2.Size()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(64*1024), size)
+
+		assert.Nil(t, pio2.Truncate(5))
+		size, err = pio2.Size()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(5), size)
+		_, err = pio2.Write([]byte("key-c"))
+		assert.Nil(t, err)
+		b := make([]byte, 10)
+		_, err = pio2.Read(b, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("key-akey-c"), b)
+
+		//截断之后被丢弃的空间重新预分配，并且清零
+		stat, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(64*1024), stat.Size())
+		assert.Nil(t, pio2.Sync())
+		raw, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 64*1024-10), raw[10:])
+
+		assert.Nil(t, pio.fd.Close())
+		assert.Nil(t, pio2.Close())
+		destoryFile(path)
+	}
+}
@@ -0,0 +1,156 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+//数据文件不再活跃之后，为其写入一个同名的 .hint 索引文件
+//hint文件中保存了数据文件中每一条记录的key（包含事务序列号）、类型和位置，启动的时候只需要读取hint文件即可构建索引，而无需读取value
+//文件的最后一条记录为 LogRecordHintFinished 类型，其中记录了数据文件的大小，用于判断hint文件是否完整有效
+
+// 异步为已经不再活跃的数据文件写入hint文件
+func (db *DB) writeDataHintFileAsync(dataFile *data.DataFile) {
+	//持久化的索引不需要hint文件
+	if isPersistentIndexer(db.option.IndexerType) {
+		return
+	}
+	db.hintWg.Add(1)
+	go func() {
+		defer db.hintWg.Done()
+		//写入失败时下次启动会直接读取数据文件，错误通过Stat返回
+		if err := db.writeDataHintFile(dataFile); err != nil {
+			db.hintErrors.Add(1)
+			db.lastHintErr.Store(&err)
+		}
+	}()
+}
+
+// 为数据文件写入hint文件
+func (db *DB) writeDataHintFile(dataFile *data.DataFile) error {
+	result := parseDataFile(context.Background(), dataFile)
+	if result.err != nil {
+		return result.err
+	}
+
+	var buf bytes.Buffer
+	for _, record := range result.records {
+		buf.Write(data.EncodeHintRecord(logRecordKeyWithSeq(record.key, record.seqNo), record.typ, record.pos))
+	}
+	//最后写入标识完成的记录
+	buf.Write(data.EncodeHintRecord(nil, data.LogRecordHintFinished, &data.LogRecordPos{
+		Fid:    dataFile.FileId,
+		Offset: result.offset,
+	}))
+
+	//如果存在旧的hint文件，先删除掉
+	hintFileName := data.GetDataHintFileName(db.option.DirPath, dataFile.FileId)
+	if err := db.fs.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := data.OpenDataHintFile(db.option.DirPath, dataFile.FileId, db.fs.IoType())
+	if err != nil {
+		return err
+	}
+	err = hintFile.Write(buf.Bytes())
+	if err == nil {
+		err = hintFile.Sync()
+	}
+	if closeErr := hintFile.Close(); err == nil {
+		err = closeErr
+	}
+	//删除写了一半的hint文件，下次启动时直接读取数据文件并重新写入
+	if err != nil {
+		_ = db.fs.Remove(hintFileName)
+	}
+	return err
+}
+
+// 从数据文件对应的hint文件中解析出索引，如果hint文件不存在或者不完整，则直接解析数据文件
+func (db *DB) parseDataHintFile(ctx context.Context, dataFile *data.DataFile) indexLoadResult {
+	hintFileName := data.GetDataHintFileName(db.option.DirPath, dataFile.FileId)
+	if _, err := db.fs.Stat(hintFileName); err != nil {
+		return parseDataFile(ctx, dataFile)
+	}
+	result, ok := db.readDataHintFile(ctx, dataFile)
+	//被取消时hint文件可能是完整的，不能删除
+	if err := ctx.Err(); err != nil {
+		return indexLoadResult{err: err}
+	}
+	if !ok {
+		//删除掉无效的hint文件，启动完成之后会重新写入
+		_ = db.fs.Remove(hintFileName)
+		return parseDataFile(ctx, dataFile)
+	}
+	return result
+}
+
+// 读取hint文件，第二个返回值标识hint文件是否完整有效
+func (db *DB) readDataHintFile(ctx context.Context, dataFile *data.DataFile) (indexLoadResult, bool) {
+	hintFile, err := data.OpenDataHintFile(db.option.DirPath, dataFile.FileId, db.fs.IoType())
+	if err != nil {
+		return indexLoadResult{}, false
+	}
+	defer hintFile.Close()
+
+	dataFileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return indexLoadResult{}, false
+	}
+
+	var records []*indexLoadRecord
+	var offset int64 = 0
+	for {
+		if ctx.Err() != nil {
+			return indexLoadResult{}, false
+		}
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			//读取出错，或者没有读到完成标识就结束了，说明hint文件不完整
+			return indexLoadResult{}, false
+		}
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if logRecord.Type == data.LogRecordHintFinished {
+			//数据文件的大小必须和hint文件中记录的一致
+			//预分配空间的文件异常退出之后可能没有截断，这时记录的位置之后必须没有数据
+			if pos.Fid != dataFile.FileId || pos.Offset > dataFileSize {
+				return indexLoadResult{}, false
+			}
+			if pos.Offset < dataFileSize {
+				if _, _, err := dataFile.ReadLogRecord(pos.Offset); err != io.EOF {
+					return indexLoadResult{}, false
+				}
+			}
+			return indexLoadResult{records: records, offset: pos.Offset}, true
+		}
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		records = append(records, &indexLoadRecord{
+			key:   realKey,
+			typ:   logRecord.Type,
+			seqNo: seqNo,
+			pos:   pos,
+		})
+		offset += size
+	}
+}
+
+// 为所有还没有hint文件的旧数据文件写入hint文件
+func (db *DB) writeMissingDataHintFiles(ctx context.Context) error {
+	for fileId, dataFile := range db.olderFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := db.fs.Stat(data.GetDataHintFileName(db.option.DirPath, fileId))
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		db.writeDataHintFileAsync(dataFile)
+	}
+	return nil
+}
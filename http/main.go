@@ -2,21 +2,32 @@ package main
 
 import (
 	bitcast_go "bitcast-go"
+	"bitcast-go/raft"
 	"bitcast-go/selferror"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 )
 
 var db *bitcast_go.DB
 
-func init() {
+// 集群模式下的raft节点，写入通过raft日志复制，不是leader时转发给leader
+var node *raft.Node
+
+func initDB(dir string) {
 	//初始化db实例
 	var err error
 	options := bitcast_go.DefaultOptions
-	dir, _ := os.MkdirTemp("/Users/yijun.dyj/GolandProjects/bitcast-go", "bitcask-go-http")
+	if dir == "" {
+		dir, _ = os.MkdirTemp("/Users/yijun.dyj/GolandProjects/bitcast-go", "bitcask-go-http")
+	}
 	options.DirPath = dir
 	db, err = bitcast_go.Open(options)
 	if err != nil {
@@ -24,24 +35,97 @@ func init() {
 	}
 }
 
+// 初始化集群模式的raft节点，节点的id是http服务的地址
+func initNode(addr, dir string, peers []string) {
+	config := raft.DefaultConfig
+	config.ID = addr
+	config.Peers = peers
+	config.DirPath = dir
+	config.Transport = raft.NewHTTPTransport(&http.Client{Timeout: 3 * time.Second})
+	var err error
+	node, err = raft.NewNode(config)
+	if err != nil {
+		panic(fmt.Sprintf("failed to start raft node: %v", err))
+	}
+	raft.RegisterHTTPHandlers(http.DefaultServeMux, node)
+}
+
+// 一次请求中的所有写入作为一个事务，集群模式下放在同一个raft日志条目中
+func putAll(data map[string]string) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if node != nil {
+		ops := make([]raft.Op, 0, len(data))
+		for key, value := range data {
+			ops = append(ops, raft.Op{Key: []byte(key), Value: []byte(value)})
+		}
+		return node.Apply(ops)
+	}
+	opts := bitcast_go.DefaultWriteBatchOptions
+	opts.SyncWrites = bitcast_go.DefaultOptions.SyncWrites
+	if uint(len(data)) > opts.MaxBatchNum {
+		opts.MaxBatchNum = uint(len(data))
+	}
+	wb := db.NewWriteBatch(opts)
+	for key, value := range data {
+		if err := wb.Put([]byte(key), []byte(value)); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+func del(key []byte) error {
+	if node != nil {
+		return node.Delete(key)
+	}
+	return db.Delete(key)
+}
+
+// 在本地的数据库上执行读取
+func view(fn func(db *bitcast_go.DB) error) error {
+	if node != nil {
+		return node.View(fn)
+	}
+	return fn(db)
+}
+
+// 集群模式下不是leader时把写入请求转发给leader，已经处理时返回true
+func forwardToLeader(writer http.ResponseWriter, request *http.Request) bool {
+	if node == nil {
+		return false
+	}
+	leader := node.Leader()
+	if leader == "" {
+		http.Error(writer, "no leader in the cluster, try again later", http.StatusServiceUnavailable)
+		return true
+	}
+	if leader == node.Status().ID {
+		return false
+	}
+	httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: leader}).ServeHTTP(writer, request)
+	return true
+}
+
 func handlePut(writer http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodPost {
 		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if forwardToLeader(writer, request) {
+		return
+	}
 	var data map[string]string
 	if err := json.NewDecoder(request.Body).Decode(&data); err != nil {
 		http.Error(writer, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	for key, value := range data {
-		err := db.Put([]byte(key), []byte(value))
-		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
-			log.Println("failed to put value in db %v\n", err)
-			return
-		}
+	if err := putAll(data); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		log.Printf("failed to put value in db %v\n", err)
+		return
 	}
 }
 
@@ -51,10 +135,15 @@ func handleGet(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 	key := request.URL.Query().Get("key")
-	value, err := db.Get([]byte(key))
+	var value []byte
+	err := view(func(db *bitcast_go.DB) error {
+		var err error
+		value, err = db.Get([]byte(key))
+		return err
+	})
 	if err != nil && err != selferror.ErrKeyIsEmpty {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		log.Println("failed to get value in db: %v\n", err)
+		log.Printf("failed to get value in db: %v\n", err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -67,11 +156,14 @@ func handleDelete(writer http.ResponseWriter, request *http.Request) {
 		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if forwardToLeader(writer, request) {
+		return
+	}
 	key := request.URL.Query().Get("key")
-	err := db.Delete([]byte(key))
+	err := del([]byte(key))
 	if err != nil && err != selferror.ErrKeyIsEmpty {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		log.Println("failed to get value in db: %v\n", err)
+		log.Printf("failed to get value in db: %v\n", err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -83,10 +175,18 @@ func handleListKeys(writer http.ResponseWriter, request *http.Request) {
 		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	keys := db.ListKeys()
+	var keys [][]byte
+	_ = view(func(db *bitcast_go.DB) error {
+		keys = db.ListKeys()
+		return nil
+	})
 	writer.Header().Set("Content-Type", "application/json")
 	var result []string
 	for _, keys := range keys {
+		//集群模式下跳过raft保存内部状态的key
+		if node != nil && raft.IsInternalKey(keys) {
+			continue
+		}
 		result = append(result, string(keys))
 	}
 	_ = json.NewEncoder(writer).Encode(result)
@@ -97,12 +197,43 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
 		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	stat := db.Stat()
+	var stat *bitcast_go.Stat
+	_ = view(func(db *bitcast_go.DB) error {
+		stat = db.Stat()
+		return nil
+	})
 	writer.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(writer).Encode(stat)
 }
 
+func handleMergeStatus(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var status bitcast_go.MergeStatus
+	_ = view(func(db *bitcast_go.DB) error {
+		status = db.MergeStatus()
+		return nil
+	})
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(status)
+}
+
 func main() {
+	addr := flag.String("addr", "localhost:8080", "http listen address, also the raft node id in cluster mode")
+	dir := flag.String("dir", "", "data directory")
+	peers := flag.String("peers", "", "comma separated http addresses of all cluster nodes, empty for standalone mode")
+	flag.Parse()
+	if *peers == "" {
+		initDB(*dir)
+	} else {
+		if *dir == "" {
+			log.Fatal("dir is required in cluster mode")
+		}
+		initNode(*addr, *dir, strings.Split(*peers, ","))
+	}
+
 	//注册处理方法
 	http.HandleFunc("/bitcask/put", handlePut)
 
@@ -113,6 +244,8 @@ func main() {
 	http.HandleFunc("/bitcask/listKeys", handleListKeys)
 
 	http.HandleFunc("/bitcask/stat", handleStat)
+
+	http.HandleFunc("/bitcask/mergeStatus", handleMergeStatus)
 	//启动http服务
-	http.ListenAndServe("localhost:8080", nil)
+	http.ListenAndServe(*addr, nil)
 }
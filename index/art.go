@@ -27,7 +27,7 @@ func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogR
 	art.lock.Lock()
 	oldValue, _ := art.tree.Insert(key, pos)
 	art.lock.Unlock()
-	if oldValue != nil {
+	if oldValue == nil {
 		return nil
 	}
 	return oldValue.(*data.LogRecordPos)
@@ -59,7 +59,7 @@ func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 func (art *AdaptiveRadixTree) Size() int {
 	art.lock.RLock()
 	size := art.tree.Size()
-	art.lock.Unlock()
+	art.lock.RUnlock()
 	return size
 }
 
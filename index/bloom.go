@@ -0,0 +1,279 @@
+package index
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/selferror"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// BloomFilter 布隆过滤器，用来快速判断一个key一定不存在
+// 支持并发的Add和MayContain
+type BloomFilter struct {
+	bits []uint64 //位数组
+	m    uint64   //位数组的长度（bit）
+	k    uint32   //哈希函数的个数
+	n    uint64   //已经添加的key的数量
+}
+
+const bloomFilterHeaderSize = 4 + 8 + 8
+
+// 估算的误判率超过期望误判率的多少倍之后，认为过滤器中的key已经太多了
+const bloomFilterOverloadFactor = 2
+
+// NewBloomFilter 根据预计的key数量和期望的误判率初始化布隆过滤器
+func NewBloomFilter(expectedKeys uint64, fpRate float64) *BloomFilter {
+	if expectedKeys == 0 {
+		expectedKeys = 1
+	}
+	fpRate = normalizeFalsePositiveRate(fpRate)
+	//m = -n*ln(p)/(ln2)^2   k = m/n*ln2
+	m := uint64(math.Ceil(-float64(expectedKeys) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Round(float64(m) / float64(expectedKeys) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &BloomFilter{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// 无效的误判率使用默认的0.01
+func normalizeFalsePositiveRate(fpRate float64) float64 {
+	if fpRate <= 0 || fpRate >= 1 {
+		return 0.01
+	}
+	return fpRate
+}
+
+// 使用两个哈希值模拟k个哈希函数 (Kirsch-Mitzenmacher)
+func bloomHash(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31
+	return h1, h2 | 1
+}
+
+// Add 添加一个key
+func (bf *BloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.m
+		addr, mask := &bf.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(addr)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(addr, old, old|mask) {
+				break
+			}
+		}
+	}
+	atomic.AddUint64(&bf.n, 1)
+}
+
+// MayContain 判断key是否可能存在，返回false则说明key一定不存在
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.m
+		if atomic.LoadUint64(&bf.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// EstimatedFalsePositiveRate 根据已经添加的key的数量估算当前的误判率 (1-e^(-kn/m))^k
+func (bf *BloomFilter) EstimatedFalsePositiveRate() float64 {
+	n := float64(atomic.LoadUint64(&bf.n))
+	return math.Pow(1-math.Exp(-float64(bf.k)*n/float64(bf.m)), float64(bf.k))
+}
+
+// Overloaded 估算的误判率是否已经超过了期望误判率fpRate的bloomFilterOverloadFactor倍，超过之后需要按照当前key的数量重建
+func (bf *BloomFilter) Overloaded(fpRate float64) bool {
+	return bf.EstimatedFalsePositiveRate() > normalizeFalsePositiveRate(fpRate)*bloomFilterOverloadFactor
+}
+
+// Encode 将布隆过滤器编码为字节数组，用于持久化
+// k / m / n / bits
+func (bf *BloomFilter) Encode() []byte {
+	buf := make([]byte, bloomFilterHeaderSize+len(bf.bits)*8)
+	binary.LittleEndian.PutUint32(buf[0:4], bf.k)
+	binary.LittleEndian.PutUint64(buf[4:12], bf.m)
+	binary.LittleEndian.PutUint64(buf[12:20], atomic.LoadUint64(&bf.n))
+	for i := range bf.bits {
+		binary.LittleEndian.PutUint64(buf[bloomFilterHeaderSize+i*8:], atomic.LoadUint64(&bf.bits[i]))
+	}
+	return buf
+}
+
+// DecodeBloomFilter 从字节数组中解码出布隆过滤器
+func DecodeBloomFilter(buf []byte) (*BloomFilter, error) {
+	if len(buf) < bloomFilterHeaderSize {
+		return nil, selferror.ErrInvalidBloomFilter
+	}
+	bf := &BloomFilter{
+		k: binary.LittleEndian.Uint32(buf[0:4]),
+		m: binary.LittleEndian.Uint64(buf[4:12]),
+		n: binary.LittleEndian.Uint64(buf[12:20]),
+	}
+	if bf.k == 0 || bf.m == 0 || bf.m%64 != 0 || uint64(len(buf)-bloomFilterHeaderSize) != bf.m/8 {
+		return nil, selferror.ErrInvalidBloomFilter
+	}
+	bf.bits = make([]uint64, bf.m/64)
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(buf[bloomFilterHeaderSize+i*8:])
+	}
+	return bf, nil
+}
+
+// BloomIndexer 在索引前面加一层布隆过滤器，不存在的key不需要再访问实际的索引
+type BloomIndexer struct {
+	Indexer
+	filter     atomic.Pointer[BloomFilter]
+	rebuilding atomic.Pointer[BloomFilter] //merge时正在重建的过滤器，写入的key需要同时加入进去
+	lock       *sync.RWMutex               //保证替换过滤器的时候，不会漏掉正在写入的key
+
+	negatives      uint64 //过滤器判断不存在的次数
+	falsePositives uint64 //过滤器判断存在，但实际上不存在的次数
+}
+
+// NewBloomIndexer 使用布隆过滤器包装一个索引
+func NewBloomIndexer(indexer Indexer, filter *BloomFilter) *BloomIndexer {
+	bi := &BloomIndexer{Indexer: indexer, lock: new(sync.RWMutex)}
+	bi.filter.Store(filter)
+	return bi
+}
+
+func (bi *BloomIndexer) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	bi.add(key)
+	return bi.Indexer.Put(key, pos)
+}
+
+func (bi *BloomIndexer) Get(key []byte) *data.LogRecordPos {
+	if !bi.filter.Load().MayContain(key) {
+		atomic.AddUint64(&bi.negatives, 1)
+		return nil
+	}
+	pos := bi.Indexer.Get(key)
+	if pos == nil {
+		atomic.AddUint64(&bi.falsePositives, 1)
+	}
+	return pos
+}
+
+func (bi *BloomIndexer) Delete(key []byte) (*data.LogRecordPos, bool) {
+	if !bi.filter.Load().MayContain(key) {
+		return nil, false
+	}
+	return bi.Indexer.Delete(key)
+}
+
+// Batch 被包装的索引支持批量写入时，写入的key同样先加入到过滤器中
+func (bi *BloomIndexer) Batch(fn func(w Writer) error) error {
+	return WriteBatch(bi.Indexer, func(w Writer) error {
+		return fn(&bloomWriter{bi: bi, w: w})
+	})
+}
+
+// PrepareBatch 准备的时候就把写入的key加入到过滤器中，没有提交时只会增加误判
+func (bi *BloomIndexer) PrepareBatch(fn func(w Writer) error) (*PreparedBatch, error) {
+	return PrepareBatch(bi.Indexer, func(w Writer) error {
+		return fn(&bloomWriter{bi: bi, w: w})
+	})
+}
+
+//把key加入到当前的过滤器，以及正在重建的过滤器中
+func (bi *BloomIndexer) add(key []byte) {
+	bi.lock.RLock()
+	defer bi.lock.RUnlock()
+	bi.filter.Load().Add(key)
+	if rebuilding := bi.rebuilding.Load(); rebuilding != nil {
+		rebuilding.Add(key)
+	}
+}
+
+//批量写入时经过布隆过滤器的写入
+type bloomWriter struct {
+	bi *BloomIndexer
+	w  Writer
+}
+
+func (bw *bloomWriter) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	bw.bi.add(key)
+	return bw.w.Put(key, pos)
+}
+
+func (bw *bloomWriter) Delete(key []byte) (*data.LogRecordPos, bool) {
+	if !bw.bi.filter.Load().MayContain(key) {
+		return nil, false
+	}
+	return bw.w.Delete(key)
+}
+
+// Snapshot 获取被包装的索引的快照，不需要快照时返回nil
+func (bi *BloomIndexer) Snapshot() (*Snapshot, error) {
+	return TakeSnapshot(bi.Indexer)
+}
+
+// Sync 持久化被包装的索引中已经提交的写入
+func (bi *BloomIndexer) Sync() error {
+	return Sync(bi.Indexer)
+}
+
+// Pause 被包装的索引在后台写入磁盘时，暂停后台写入
+func (bi *BloomIndexer) Pause() func() {
+	if flusher, ok := bi.Indexer.(BackgroundFlusher); ok {
+		return flusher.Pause()
+	}
+	return func() {}
+}
+
+// Err 被包装的索引在后台写入失败的错误
+func (bi *BloomIndexer) Err() error {
+	if flusher, ok := bi.Indexer.(BackgroundFlusher); ok {
+		return flusher.Err()
+	}
+	return nil
+}
+
+// Filter 当前使用的布隆过滤器
+func (bi *BloomIndexer) Filter() *BloomFilter {
+	return bi.filter.Load()
+}
+
+// StartRebuild 开始重建布隆过滤器，在此之后写入的key会同时加入到新的过滤器中
+// 同一时间只能有一个重建，已经有正在进行的重建时返回false
+func (bi *BloomIndexer) StartRebuild(filter *BloomFilter) bool {
+	return bi.rebuilding.CompareAndSwap(nil, filter)
+}
+
+// FinishRebuild 使用重建好的过滤器替换当前的过滤器
+func (bi *BloomIndexer) FinishRebuild(filter *BloomFilter) {
+	bi.lock.Lock()
+	defer bi.lock.Unlock()
+	if bi.rebuilding.CompareAndSwap(filter, nil) {
+		bi.filter.Store(filter)
+	}
+}
+
+// AbortRebuild 放弃重建，已经完成的重建不受影响
+func (bi *BloomIndexer) AbortRebuild(filter *BloomFilter) {
+	bi.rebuilding.CompareAndSwap(filter, nil)
+}
+
+// FalsePositiveRate 实际观测到的误判率：误判次数 / 所有不存在的key的查询次数
+func (bi *BloomIndexer) FalsePositiveRate() float64 {
+	fp := atomic.LoadUint64(&bi.falsePositives)
+	total := fp + atomic.LoadUint64(&bi.negatives)
+	if total == 0 {
+		return 0
+	}
+	return float64(fp) / float64(total)
+}
@@ -0,0 +1,77 @@
+package index
+
+import (
+	"bitcast-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBloomFilter_MayContain(t *testing.T) {
+	bf := NewBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	//添加过的key一定存在
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bf.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	//误判率在期望值附近
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+	assert.InDelta(t, 0.01, bf.EstimatedFalsePositiveRate(), 0.005)
+}
+
+func TestBloomFilter_Encode(t *testing.T) {
+	bf := NewBloomFilter(100, 0.01)
+	bf.Add([]byte("aaa"))
+	bf.Add([]byte("bbb"))
+
+	bf2, err := DecodeBloomFilter(bf.Encode())
+	assert.Nil(t, err)
+	assert.True(t, bf2.MayContain([]byte("aaa")))
+	assert.True(t, bf2.MayContain([]byte("bbb")))
+	assert.Equal(t, bf.EstimatedFalsePositiveRate(), bf2.EstimatedFalsePositiveRate())
+
+	_, err = DecodeBloomFilter(bf.Encode()[:30])
+	assert.NotNil(t, err)
+}
+
+func TestBloomIndexer(t *testing.T) {
+	bi := NewBloomIndexer(NewBTree(), NewBloomFilter(100, 0.01))
+	assert.Nil(t, bi.Put([]byte("aaa"), &data.LogRecordPos{Fid: 1, Offset: 10}))
+	assert.NotNil(t, bi.Get([]byte("aaa")))
+	assert.Nil(t, bi.Get([]byte("bbb")))
+	assert.Equal(t, float64(0), bi.FalsePositiveRate())
+
+	//重建之后，被删除的key不再存在于过滤器中
+	_, ok := bi.Delete([]byte("aaa"))
+	assert.True(t, ok)
+	rebuilt := NewBloomFilter(100, 0.01)
+	assert.True(t, bi.StartRebuild(rebuilt))
+	//同一时间只能有一个重建，另一个重建放弃时不影响正在进行的重建
+	other := NewBloomFilter(100, 0.01)
+	assert.False(t, bi.StartRebuild(other))
+	bi.AbortRebuild(other)
+	assert.Nil(t, bi.Put([]byte("ccc"), &data.LogRecordPos{Fid: 1, Offset: 20}))
+	bi.FinishRebuild(rebuilt)
+	assert.False(t, bi.Filter().MayContain([]byte("aaa")))
+	assert.NotNil(t, bi.Get([]byte("ccc")))
+}
+
+func TestBloomFilter_Overloaded(t *testing.T) {
+	bf := NewBloomFilter(100, 0.01)
+	for i := 0; i < 100; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	assert.False(t, bf.Overloaded(0.01))
+	for i := 100; i < 300; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	assert.True(t, bf.Overloaded(0.01))
+}
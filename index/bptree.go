@@ -3,11 +3,16 @@ package index
 import (
 	"bitcast-go/data"
 	"go.etcd.io/bbolt"
+	"io"
 	"path/filepath"
 )
 
 const bptreeIndexFileName = "bptree-index"
 
+//B+树文件的初始mmap大小，只是预留地址空间
+//文件增长到超过mmap大小时需要重新映射，重新映射要等待所有的只读事务结束，快照期间的写入会被阻塞，预留得足够大可以避免
+const bptreeInitialMmapSize = 1 << 30
+
 var indexBucketName = []byte("bitcask-index")
 
 //B+树索引 主要封装了go.etcd.io/bbolt库
@@ -19,6 +24,7 @@ type BPlusTree struct {
 func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
+	opts.InitialMmapSize = bptreeInitialMmapSize
 
 	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
 	if err != nil {
@@ -38,18 +44,11 @@ func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
 
 //向索引中存储key 对应的数据位置信息
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	var oldValue []byte
-	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		oldValue = bucket.Get(key)
-		return bucket.Put(key, data.EncodeLogRecordPos(pos))
-	}); err != nil {
-		panic("failed to put value in bptree")
-	}
-	if len(oldValue) == 0 {
-		return nil
-	}
-	return data.DecodeLogRecordPos(oldValue)
+	var oldPos *data.LogRecordPos
+	bpt.update(func(w *bptreeWriter) {
+		oldPos = w.Put(key, pos)
+	})
+	return oldPos
 }
 
 //根据key 取出对应的索引位置信息
@@ -70,20 +69,77 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 
 //根据Key 删除对应的位置信息
 func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	var oldValue []byte
+	var oldPos *data.LogRecordPos
+	var ok bool
+	bpt.update(func(w *bptreeWriter) {
+		oldPos, ok = w.Delete(key)
+	})
+	return oldPos, ok
+}
+
+// Batch 在一个事务中完成所有的写入，开启持久化时只需要sync一次
+func (bpt *BPlusTree) Batch(fn func(w Writer) error) error {
+	var fnErr error
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		if value := bucket.Get(key); len(value) != 0 {
-			return bucket.Delete(key)
-		}
+		fnErr = fn(&bptreeWriter{bucket: tx.Bucket(indexBucketName)})
+		return nil
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// PrepareBatch 在写事务中写入，提交时再提交事务，提交之前读取看到的是事务开始之前的数据
+func (bpt *BPlusTree) PrepareBatch(fn func(w Writer) error) (*PreparedBatch, error) {
+	tx, err := bpt.tree.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(&bptreeWriter{bucket: tx.Bucket(indexBucketName)}); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return &PreparedBatch{
+		commit: tx.Commit,
+		abort:  func() { _ = tx.Rollback() },
+	}, nil
+}
+
+func (bpt *BPlusTree) update(fn func(w *bptreeWriter)) {
+	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		fn(&bptreeWriter{bucket: tx.Bucket(indexBucketName)})
 		return nil
 	}); err != nil {
 		panic("failed to put value in bptree")
 	}
+}
+
+//在写事务中修改B+树
+type bptreeWriter struct {
+	bucket *bbolt.Bucket
+}
+
+func (w *bptreeWriter) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	var oldPos *data.LogRecordPos
+	if oldValue := w.bucket.Get(key); len(oldValue) != 0 {
+		oldPos = data.DecodeLogRecordPos(oldValue)
+	}
+	if err := w.bucket.Put(key, data.EncodeLogRecordPos(pos)); err != nil {
+		panic("failed to put value in bptree")
+	}
+	return oldPos
+}
+
+func (w *bptreeWriter) Delete(key []byte) (*data.LogRecordPos, bool) {
+	oldValue := w.bucket.Get(key)
 	if len(oldValue) == 0 {
 		return nil, false
 	}
-	return data.DecodeLogRecordPos(oldValue), true
+	oldPos := data.DecodeLogRecordPos(oldValue)
+	if err := w.bucket.Delete(key); err != nil {
+		panic("failed to put value in bptree")
+	}
+	return oldPos, true
 }
 
 //索引中存在的数据量
@@ -99,7 +155,6 @@ func (bpt *BPlusTree) Size() int {
 	return size
 }
 
-//
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
 	return newBptreeIterator(bpt.tree, reverse)
 }
@@ -108,6 +163,32 @@ func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
+// Snapshot 在只读事务中写出B+树的文件，事务开始之后的写入不会出现在快照中
+func (bpt *BPlusTree) Snapshot() (*Snapshot, error) {
+	file, release, err := snapshotBptree(bpt.tree)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Files: []*SnapshotFile{file}, release: release}, nil
+}
+
+// 开启一个只读事务，返回B+树文件的快照以及结束事务的函数
+func snapshotBptree(tree *bbolt.DB) (*SnapshotFile, func(), error) {
+	tx, err := tree.Begin(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := &SnapshotFile{
+		Name: bptreeIndexFileName,
+		Size: tx.Size(),
+		WriteTo: func(w io.Writer) error {
+			_, err := tx.WriteTo(w)
+			return err
+		},
+	}
+	return file, func() { _ = tx.Rollback() }, nil
+}
+
 //B+树迭代器
 type bptreeIterator struct {
 	tx        *bbolt.Tx
@@ -42,7 +42,9 @@ func (bt *Btree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{
 		key: key,
 	}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -50,6 +52,8 @@ func (bt *Btree) Get(key []byte) *data.LogRecordPos {
 }
 
 func (bt *Btree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
@@ -70,6 +74,43 @@ func (bt *Btree) Close() error {
 	return nil
 }
 
+// PrepareBatch 在B树的副本上写入，副本和原来的B树共享没有修改的节点，提交时只需要替换B树
+func (bt *Btree) PrepareBatch(fn func(w Writer) error) (*PreparedBatch, error) {
+	bt.lock.Lock()
+	tree := bt.tree.Clone()
+	bt.lock.Unlock()
+	if err := fn(&btreeWriter{tree: tree}); err != nil {
+		return nil, err
+	}
+	return &PreparedBatch{commit: func() error {
+		bt.lock.Lock()
+		bt.tree = tree
+		bt.lock.Unlock()
+		return nil
+	}}, nil
+}
+
+//在B树的副本上写入，副本只有准备写入的协程可以访问，不需要加锁
+type btreeWriter struct {
+	tree *btree.BTree
+}
+
+func (w *btreeWriter) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	oldItem := w.tree.ReplaceOrInsert(&Item{key: key, pos: pos})
+	if oldItem == nil {
+		return nil
+	}
+	return oldItem.(*Item).pos
+}
+
+func (w *btreeWriter) Delete(key []byte) (*data.LogRecordPos, bool) {
+	oldItem := w.tree.Delete(&Item{key: key})
+	if oldItem == nil {
+		return nil, false
+	}
+	return oldItem.(*Item).pos, true
+}
+
 //BTree 索引迭代器
 type btreeIterator struct {
 	currIndex int     //当前遍历的下标位置
@@ -14,12 +14,13 @@ func TestBtree_Put(t *testing.T) {
 		Fid:    1,
 		Offset: 100,
 	})
-	assert.True(t, res1)
+	assert.Nil(t, res1)
 	res2 := bt.Put(nil, &data.LogRecordPos{
 		Fid:    1,
 		Offset: 200,
 	})
-	assert.True(t, res2)
+	assert.NotNil(t, res2)
+	assert.Equal(t, int64(100), res2.Offset)
 }
 
 func TestBtree_Get(t *testing.T) {
@@ -28,7 +29,7 @@ func TestBtree_Get(t *testing.T) {
 		Fid:    1,
 		Offset: 100,
 	})
-	assert.True(t, res1)
+	assert.Nil(t, res1)
 	pos1 := bt.Get(nil)
 	assert.Equal(t, uint32(1), pos1.Fid)
 	assert.Equal(t, int64(100), pos1.Offset)
@@ -40,15 +41,43 @@ func TestBtree_Delete(t *testing.T) {
 		Fid:    1,
 		Offset: 100,
 	})
-	assert.True(t, res1)
-	res2 := bt.Delete(nil)
+	assert.Nil(t, res1)
+	_, res2 := bt.Delete(nil)
 	assert.True(t, res2)
 
 	res3 := bt.Put([]byte("aaa"), &data.LogRecordPos{
 		Fid:    22,
 		Offset: 33,
 	})
-	assert.True(t, res3)
-	res4 := bt.Delete([]byte("aaa"))
+	assert.Nil(t, res3)
+	_, res4 := bt.Delete([]byte("aaa"))
 	assert.True(t, res4)
 }
+
+func TestBtree_PrepareBatch(t *testing.T) {
+	bt := NewBTree()
+	bt.Put([]byte("aaa"), &data.LogRecordPos{Fid: 1, Offset: 100})
+
+	//提交之前读取看到的仍然是之前的数据
+	batch, err := PrepareBatch(bt, func(w Writer) error {
+		w.Put([]byte("aaa"), &data.LogRecordPos{Fid: 2, Offset: 200})
+		w.Put([]byte("bbb"), &data.LogRecordPos{Fid: 2, Offset: 300})
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), bt.Get([]byte("aaa")).Offset)
+	assert.Nil(t, bt.Get([]byte("bbb")))
+
+	assert.Nil(t, batch.Commit())
+	assert.Equal(t, int64(200), bt.Get([]byte("aaa")).Offset)
+	assert.Equal(t, int64(300), bt.Get([]byte("bbb")).Offset)
+
+	//放弃的写入不会生效
+	batch, err = PrepareBatch(bt, func(w Writer) error {
+		w.Delete([]byte("aaa"))
+		return nil
+	})
+	assert.Nil(t, err)
+	batch.Abort()
+	assert.Equal(t, 2, bt.Size())
+}
@@ -0,0 +1,577 @@
+package index
+
+import (
+	"bitcast-go/data"
+	"bytes"
+	"encoding/binary"
+	"github.com/google/btree"
+	"sort"
+	"sync"
+)
+
+//紧凑型索引，用于key数量非常多的场景，尽量减少每个key占用的内存以及GC的压力
+//所有的key按顺序分成若干个块（block），每个块最多存储 compactBlockMaxEntries 个key，块按照第一个key保存在B树中
+//块内的key使用前缀压缩，每一项的格式为：
+// 共享前缀长度 / 非共享部分长度 / 非共享部分 / Fid / Size / Offset
+//    变长          变长                        4字节  4字节  8字节
+//位置信息直接以定长的方式内联在块中，而不是指针，块的内存从arena中按大块分配，整个索引中的指针数量只和块的数量相关
+//写入时直接在编码之后的块上查找和拼接，只重新编码插入或者删除位置之后的一项，不需要解码整个块
+
+const (
+	compactBlockMaxEntries = 64
+	compactPosSize         = 4 + 4 + 8
+	compactArenaChunkSize  = 1 << 20
+	compactBTreeDegree     = 32
+)
+
+// CompactIndex 紧凑型索引
+type CompactIndex struct {
+	tree  *btree.BTree //按照第一个key有序排列的块
+	size  int          //key的数量
+	arena *compactArena
+	lock  *sync.RWMutex
+}
+
+// 一个块，buf分配自arena，一旦写入就不会再修改，更新时会重新分配一个新的块
+type compactBlock struct {
+	buf   []byte
+	count int
+}
+
+// 从块中解码出来的一项
+type compactEntry struct {
+	key []byte
+	pos data.LogRecordPos
+}
+
+// 在B树中查找块时使用的key
+type compactKey []byte
+
+func (k compactKey) Less(than btree.Item) bool {
+	return bytes.Compare(k, compactItemKey(than)) < 0
+}
+
+func (block *compactBlock) Less(than btree.Item) bool {
+	return bytes.Compare(compactBlockFirstKey(block), compactItemKey(than)) < 0
+}
+
+func compactItemKey(item btree.Item) []byte {
+	if key, ok := item.(compactKey); ok {
+		return key
+	}
+	return compactBlockFirstKey(item.(*compactBlock))
+}
+
+// NewCompactIndex 初始化紧凑型索引
+func NewCompactIndex() *CompactIndex {
+	return &CompactIndex{
+		tree:  btree.New(compactBTreeDegree),
+		arena: newCompactArena(),
+		lock:  new(sync.RWMutex),
+	}
+}
+
+//向索引中存储key 对应的数据位置信息
+func (ci *CompactIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	//比所有的key都小，放到第一个块中
+	block := ci.findBlock(key)
+	if block == nil {
+		if min := ci.tree.Min(); min != nil {
+			block = min.(*compactBlock)
+		}
+	}
+	var posBuf [compactPosSize]byte
+	encodeCompactPos(posBuf[:], pos)
+	if block == nil {
+		newBlock := &compactBlock{buf: ci.arena.alloc(compactEntrySize(nil, key)), count: 1}
+		putCompactEntry(newBlock.buf, nil, key, posBuf[:])
+		ci.tree.ReplaceOrInsert(newBlock)
+		ci.size++
+		return nil
+	}
+
+	prev, at, _ := searchCompactBlock(block, key)
+	//key已经存在，只替换位置信息
+	if at.start >= 0 && bytes.Equal(at.key, key) {
+		oldPos := decodeCompactPos(block.buf[at.end-compactPosSize : at.end])
+		newBlock := &compactBlock{buf: ci.arena.alloc(len(block.buf)), count: block.count}
+		copy(newBlock.buf, block.buf)
+		copy(newBlock.buf[at.end-compactPosSize:], posBuf[:])
+		ci.replaceBlock(block, newBlock)
+		return &oldPos
+	}
+
+	//在at之前插入新的一项，at需要相对于新的key重新编码
+	insertAt, rest := len(block.buf), len(block.buf)
+	size := insertAt + compactEntrySize(prev.key, key)
+	if at.start >= 0 {
+		insertAt, rest = at.start, at.end
+		size = insertAt + compactEntrySize(prev.key, key) + compactEntrySize(key, at.key) + len(block.buf) - rest
+	}
+	newBlock := &compactBlock{buf: ci.arena.alloc(size), count: block.count + 1}
+	index := copy(newBlock.buf, block.buf[:insertAt])
+	index += putCompactEntry(newBlock.buf[index:], prev.key, key, posBuf[:])
+	if at.start >= 0 {
+		index += putCompactEntry(newBlock.buf[index:], key, at.key, block.buf[at.end-compactPosSize:at.end])
+		copy(newBlock.buf[index:], block.buf[rest:])
+	}
+	ci.size++
+
+	if newBlock.count > compactBlockMaxEntries {
+		//块满了，分裂为两个块
+		entries := decodeCompactBlock(newBlock)
+		half := len(entries) / 2
+		ci.arena.free(len(newBlock.buf))
+		ci.replaceBlock(block, ci.encodeBlock(entries[:half]))
+		ci.tree.ReplaceOrInsert(ci.encodeBlock(entries[half:]))
+	} else {
+		ci.replaceBlock(block, newBlock)
+	}
+	ci.compactIfNeeded()
+	return nil
+}
+
+//根据key 取出对应的索引位置信息
+func (ci *CompactIndex) Get(key []byte) *data.LogRecordPos {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	block := ci.findBlock(key)
+	if block == nil {
+		return nil
+	}
+	//在块中顺序查找，不需要解码整个块
+	var found *data.LogRecordPos
+	var currKey []byte
+	forEachCompactEntry(block, func(shared int, suffix []byte, pos []byte) bool {
+		currKey = append(currKey[:shared], suffix...)
+		cmp := bytes.Compare(currKey, key)
+		if cmp == 0 {
+			p := decodeCompactPos(pos)
+			found = &p
+		}
+		return cmp < 0
+	})
+	return found
+}
+
+//根据Key 删除对应的位置信息
+func (ci *CompactIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	block := ci.findBlock(key)
+	if block == nil {
+		return nil, false
+	}
+	prev, at, after := searchCompactBlock(block, key)
+	if at.start < 0 || !bytes.Equal(at.key, key) {
+		return nil, false
+	}
+	oldPos := decodeCompactPos(block.buf[at.end-compactPosSize : at.end])
+	ci.size--
+	if block.count == 1 {
+		ci.arena.free(len(block.buf))
+		ci.tree.Delete(block)
+		ci.compactIfNeeded()
+		return &oldPos, true
+	}
+
+	//去掉at，at之后的一项需要相对于at之前的一项重新编码
+	size := at.start
+	if after.start >= 0 {
+		size += compactEntrySize(prev.key, after.key) + len(block.buf) - after.end
+	}
+	newBlock := &compactBlock{buf: ci.arena.alloc(size), count: block.count - 1}
+	index := copy(newBlock.buf, block.buf[:at.start])
+	if after.start >= 0 {
+		index += putCompactEntry(newBlock.buf[index:], prev.key, after.key, block.buf[after.end-compactPosSize:after.end])
+		copy(newBlock.buf[index:], block.buf[after.end:])
+	}
+	ci.replaceBlock(block, newBlock)
+	ci.compactIfNeeded()
+	return &oldPos, true
+}
+
+//索引中存在的数据量
+func (ci *CompactIndex) Size() int {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.size
+}
+
+func (ci *CompactIndex) Iterator(reverse bool) Iterator {
+	//块一旦写入就不会被修改，只需要B树的一个快照即可，Clone需要互斥
+	ci.lock.Lock()
+	tree := ci.tree.Clone()
+	ci.lock.Unlock()
+	it := &compactIterator{
+		tree:    tree,
+		reverse: reverse,
+	}
+	it.Rewind()
+	return it
+}
+
+func (ci *CompactIndex) Close() error {
+	return nil
+}
+
+// 找到最后一个第一个key小于等于key的块，如果key比所有块的key都小，则返回nil
+func (ci *CompactIndex) findBlock(key []byte) *compactBlock {
+	return findCompactBlock(ci.tree, key)
+}
+
+func findCompactBlock(tree *btree.BTree, key []byte) *compactBlock {
+	var found *compactBlock
+	tree.DescendLessOrEqual(compactKey(key), func(item btree.Item) bool {
+		found = item.(*compactBlock)
+		return false
+	})
+	return found
+}
+
+// 用新的块替换旧的块，第一个key变化时需要先删除旧的块
+func (ci *CompactIndex) replaceBlock(oldBlock, newBlock *compactBlock) {
+	ci.arena.free(len(oldBlock.buf))
+	if !bytes.Equal(compactBlockFirstKey(oldBlock), compactBlockFirstKey(newBlock)) {
+		ci.tree.Delete(oldBlock)
+	}
+	ci.tree.ReplaceOrInsert(newBlock)
+}
+
+// 对有序的数据项进行前缀压缩编码，并从arena中分配内存
+func (ci *CompactIndex) encodeBlock(entries []compactEntry) *compactBlock {
+	var size int
+	var prevKey []byte
+	for _, entry := range entries {
+		size += compactEntrySize(prevKey, entry.key)
+		prevKey = entry.key
+	}
+
+	buf := ci.arena.alloc(size)
+	var index int
+	var posBuf [compactPosSize]byte
+	prevKey = nil
+	for _, entry := range entries {
+		encodeCompactPos(posBuf[:], &entry.pos)
+		index += putCompactEntry(buf[index:], prevKey, entry.key, posBuf[:])
+		prevKey = entry.key
+	}
+	return &compactBlock{buf: buf, count: len(entries)}
+}
+
+// arena中浪费的空间过多时，将所有的块拷贝到新的arena中
+// 迭代器可能还在读取旧的块，所以拷贝到新的块中，而不是修改旧的块
+func (ci *CompactIndex) compactIfNeeded() {
+	if !ci.arena.needCompact() {
+		return
+	}
+	arena := newCompactArena()
+	tree := btree.New(compactBTreeDegree)
+	ci.tree.Ascend(func(item btree.Item) bool {
+		block := item.(*compactBlock)
+		buf := arena.alloc(len(block.buf))
+		copy(buf, block.buf)
+		tree.ReplaceOrInsert(&compactBlock{buf: buf, count: block.count})
+		return true
+	})
+	ci.tree = tree
+	ci.arena = arena
+}
+
+// 块中的一项：在块中的起止偏移以及完整的key，start为-1表示不存在
+type compactSlot struct {
+	start int
+	end   int
+	key   []byte
+}
+
+// 在块中查找key，返回第一个大于等于key的一项at，at之前的一项prev，以及at之后的一项after
+func searchCompactBlock(block *compactBlock, key []byte) (prev, at, after compactSlot) {
+	prev, at, after = compactSlot{start: -1}, compactSlot{start: -1}, compactSlot{start: -1}
+	buf := block.buf
+	//两个缓冲区交替保存前一项和当前项的key
+	var prevKey, currKey []byte
+	var index int
+	for i := 0; i < block.count; i++ {
+		start := index
+		shared, n := binary.Uvarint(buf[index:])
+		index += n
+		unshared, n := binary.Uvarint(buf[index:])
+		index += n
+		suffix := buf[index : index+int(unshared)]
+		index += int(unshared) + compactPosSize
+		currKey = append(append(currKey[:0], prevKey[:shared]...), suffix...)
+		slot := compactSlot{start: start, end: index, key: currKey}
+
+		switch {
+		case at.start >= 0:
+			after = slot
+			return
+		case bytes.Compare(currKey, key) < 0:
+			prev = slot
+		case bytes.Equal(currKey, key):
+			//还需要继续读取下一项，prev的缓冲区之后会被覆盖
+			at = slot
+			at.key = key
+			if prev.start >= 0 {
+				prev.key = append([]byte(nil), prev.key...)
+			}
+		default:
+			at = slot
+			return
+		}
+		prevKey, currKey = currKey, prevKey
+	}
+	return
+}
+
+// 编码一项需要的空间
+func compactEntrySize(prevKey, key []byte) int {
+	shared := sharedPrefixLen(prevKey, key)
+	return uvarintLen(uint64(shared)) + uvarintLen(uint64(len(key)-shared)) + len(key) - shared + compactPosSize
+}
+
+// 编码一项，key相对于prevKey进行前缀压缩，返回写入的字节数
+func putCompactEntry(buf []byte, prevKey, key []byte, pos []byte) int {
+	shared := sharedPrefixLen(prevKey, key)
+	index := binary.PutUvarint(buf, uint64(shared))
+	index += binary.PutUvarint(buf[index:], uint64(len(key)-shared))
+	index += copy(buf[index:], key[shared:])
+	index += copy(buf[index:], pos[:compactPosSize])
+	return index
+}
+
+// 顺序遍历块中的每一项，fn返回false时终止遍历
+func forEachCompactEntry(block *compactBlock, fn func(shared int, suffix []byte, pos []byte) bool) {
+	buf := block.buf
+	var index int
+	for i := 0; i < block.count; i++ {
+		shared, n := binary.Uvarint(buf[index:])
+		index += n
+		unshared, n := binary.Uvarint(buf[index:])
+		index += n
+		suffix := buf[index : index+int(unshared)]
+		index += int(unshared)
+		pos := buf[index : index+compactPosSize]
+		index += compactPosSize
+		if !fn(int(shared), suffix, pos) {
+			return
+		}
+	}
+}
+
+// 解码块中所有的数据项
+func decodeCompactBlock(block *compactBlock) []compactEntry {
+	entries := make([]compactEntry, 0, block.count+1)
+	var prevKey []byte
+	forEachCompactEntry(block, func(shared int, suffix []byte, pos []byte) bool {
+		key := make([]byte, shared+len(suffix))
+		copy(key, prevKey[:shared])
+		copy(key[shared:], suffix)
+		entries = append(entries, compactEntry{key: key, pos: decodeCompactPos(pos)})
+		prevKey = key
+		return true
+	})
+	return entries
+}
+
+// 块中的第一个key没有共享前缀，可以直接取出
+func compactBlockFirstKey(block *compactBlock) []byte {
+	//第一项没有共享前缀，非共享部分就是完整的key，B树比较时频繁调用，直接解码
+	if block.count == 0 {
+		return nil
+	}
+	index := 1
+	unshared, n := binary.Uvarint(block.buf[index:])
+	index += n
+	return block.buf[index : index+int(unshared)]
+}
+
+func encodeCompactPos(buf []byte, pos *data.LogRecordPos) {
+	binary.LittleEndian.PutUint32(buf[0:4], pos.Fid)
+	binary.LittleEndian.PutUint32(buf[4:8], pos.Size)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(pos.Offset))
+}
+
+func decodeCompactPos(buf []byte) data.LogRecordPos {
+	return data.LogRecordPos{
+		Fid:    binary.LittleEndian.Uint32(buf[0:4]),
+		Size:   binary.LittleEndian.Uint32(buf[4:8]),
+		Offset: int64(binary.LittleEndian.Uint64(buf[8:16])),
+	}
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// 按大块分配内存，减少小对象的数量
+// 已经分配出去的内存不会被复用，被释放的大小记录下来，浪费过多的时候由索引整体拷贝到新的arena中
+type compactArena struct {
+	chunk []byte //当前正在分配的大块内存
+	used  int    //所有已经分配出去的字节数
+	freed int    //已经不再使用的字节数
+}
+
+func newCompactArena() *compactArena {
+	return &compactArena{}
+}
+
+func (a *compactArena) alloc(n int) []byte {
+	if n > len(a.chunk) {
+		size := compactArenaChunkSize
+		if n > size {
+			size = n
+		}
+		a.chunk = make([]byte, size)
+	}
+	buf := a.chunk[:n:n]
+	a.chunk = a.chunk[n:]
+	a.used += n
+	return buf
+}
+
+func (a *compactArena) free(n int) {
+	a.freed += n
+}
+
+func (a *compactArena) needCompact() bool {
+	return a.freed > compactArenaChunkSize && a.freed > a.used-a.freed
+}
+
+// 紧凑型索引迭代器，遍历创建时B树的快照
+type compactIterator struct {
+	tree       *btree.BTree
+	reverse    bool
+	block      *compactBlock  //当前所在的块
+	entries    []compactEntry //当前块解码之后的数据项
+	entryIndex int            //当前块中的位置
+}
+
+func (cit *compactIterator) loadBlock(block *compactBlock) {
+	cit.block = block
+	cit.entries = nil
+	if block != nil {
+		cit.entries = decodeCompactBlock(block)
+	}
+}
+
+// 当前块的下一个（反向遍历时为上一个）块
+func (cit *compactIterator) adjacentBlock(reverse bool) *compactBlock {
+	if cit.block == nil {
+		return nil
+	}
+	var adjacent *compactBlock
+	iterator := func(item btree.Item) bool {
+		if item == cit.block {
+			return true
+		}
+		adjacent = item.(*compactBlock)
+		return false
+	}
+	if reverse {
+		cit.tree.DescendLessOrEqual(cit.block, iterator)
+	} else {
+		cit.tree.AscendGreaterOrEqual(cit.block, iterator)
+	}
+	return adjacent
+}
+
+//重新回到迭代器的起点，即第一个数据
+func (cit *compactIterator) Rewind() {
+	if cit.reverse {
+		max, _ := cit.tree.Max().(*compactBlock)
+		cit.loadBlock(max)
+		cit.entryIndex = len(cit.entries) - 1
+	} else {
+		min, _ := cit.tree.Min().(*compactBlock)
+		cit.loadBlock(min)
+		cit.entryIndex = 0
+	}
+}
+
+//根据传入的key查找到第一个大于（或小于）等于的目标Key,从这个key开始遍历
+func (cit *compactIterator) Seek(key []byte) {
+	block := findCompactBlock(cit.tree, key)
+	if cit.reverse {
+		cit.loadBlock(block)
+		cit.entryIndex = sort.Search(len(cit.entries), func(i int) bool {
+			return bytes.Compare(cit.entries[i].key, key) > 0
+		}) - 1
+		return
+	}
+	if block == nil {
+		block, _ = cit.tree.Min().(*compactBlock)
+	}
+	cit.loadBlock(block)
+	cit.entryIndex = sort.Search(len(cit.entries), func(i int) bool {
+		return bytes.Compare(cit.entries[i].key, key) >= 0
+	})
+	if cit.entryIndex == len(cit.entries) {
+		cit.loadBlock(cit.adjacentBlock(false))
+		cit.entryIndex = 0
+	}
+}
+
+//跳转到下一个key
+func (cit *compactIterator) Next() {
+	if cit.reverse {
+		cit.entryIndex--
+		if cit.entryIndex < 0 {
+			cit.loadBlock(cit.adjacentBlock(true))
+			cit.entryIndex = len(cit.entries) - 1
+		}
+		return
+	}
+	cit.entryIndex++
+	if cit.entryIndex >= len(cit.entries) {
+		cit.loadBlock(cit.adjacentBlock(false))
+		cit.entryIndex = 0
+	}
+}
+
+//Valid是否有效，即是否已经遍历完了所有的key，用于退出遍历
+func (cit *compactIterator) Valid() bool {
+	return cit.entryIndex >= 0 && cit.entryIndex < len(cit.entries)
+}
+
+//当前遍历位置key的数据
+func (cit *compactIterator) Key() []byte {
+	return cit.entries[cit.entryIndex].key
+}
+
+//当前遍历位置value的数据
+func (cit *compactIterator) Value() *data.LogRecordPos {
+	pos := cit.entries[cit.entryIndex].pos
+	return &pos
+}
+
+//关闭迭代器，释放资源
+func (cit *compactIterator) Close() {
+	cit.tree = nil
+	cit.block = nil
+	cit.entries = nil
+}
@@ -0,0 +1,173 @@
+package index
+
+import (
+	"bitcast-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestCompactIndex_Put(t *testing.T) {
+	ci := NewCompactIndex()
+	res1 := ci.Put(nil, &data.LogRecordPos{
+		Fid:    1,
+		Offset: 100,
+	})
+	assert.Nil(t, res1)
+	res2 := ci.Put(nil, &data.LogRecordPos{
+		Fid:    1,
+		Offset: 200,
+	})
+	assert.NotNil(t, res2)
+	assert.Equal(t, int64(100), res2.Offset)
+}
+
+func TestCompactIndex_Get(t *testing.T) {
+	ci := NewCompactIndex()
+	res1 := ci.Put(nil, &data.LogRecordPos{
+		Fid:    1,
+		Offset: 100,
+	})
+	assert.Nil(t, res1)
+	pos1 := ci.Get(nil)
+	assert.Equal(t, uint32(1), pos1.Fid)
+	assert.Equal(t, int64(100), pos1.Offset)
+
+	//大量key，跨越多个块
+	for i := 0; i < 10000; i++ {
+		ci.Put([]byte(fmt.Sprintf("key-%06d", i)), &data.LogRecordPos{Fid: uint32(i), Offset: int64(i) << 33, Size: 7})
+	}
+	assert.Equal(t, 10001, ci.Size())
+	for i := 0; i < 10000; i++ {
+		pos := ci.Get([]byte(fmt.Sprintf("key-%06d", i)))
+		assert.Equal(t, &data.LogRecordPos{Fid: uint32(i), Offset: int64(i) << 33, Size: 7}, pos)
+	}
+	assert.Nil(t, ci.Get([]byte("key-")))
+	assert.Nil(t, ci.Get([]byte("key-999999")))
+}
+
+func TestCompactIndex_Delete(t *testing.T) {
+	ci := NewCompactIndex()
+	res1 := ci.Put(nil, &data.LogRecordPos{
+		Fid:    1,
+		Offset: 100,
+	})
+	assert.Nil(t, res1)
+	_, res2 := ci.Delete(nil)
+	assert.True(t, res2)
+
+	res3 := ci.Put([]byte("aaa"), &data.LogRecordPos{
+		Fid:    22,
+		Offset: 33,
+	})
+	assert.Nil(t, res3)
+	pos, res4 := ci.Delete([]byte("aaa"))
+	assert.True(t, res4)
+	assert.Equal(t, int64(33), pos.Offset)
+	_, res5 := ci.Delete([]byte("aaa"))
+	assert.False(t, res5)
+
+	//反复写入和删除，触发arena的整理
+	for r := 0; r < 5; r++ {
+		for i := 0; i < 20000; i++ {
+			ci.Put([]byte(fmt.Sprintf("key-%06d", i)), &data.LogRecordPos{Fid: uint32(r)})
+		}
+		for i := 0; i < 20000; i += 2 {
+			ci.Delete([]byte(fmt.Sprintf("key-%06d", i)))
+		}
+	}
+	assert.Equal(t, 10000, ci.Size())
+	assert.Equal(t, uint32(4), ci.Get([]byte("key-000001")).Fid)
+	assert.Nil(t, ci.Get([]byte("key-000002")))
+}
+
+func TestCompactIndex_Iterator(t *testing.T) {
+	ci := NewCompactIndex()
+	iter := ci.Iterator(false)
+	assert.False(t, iter.Valid())
+
+	for i := 0; i < 1000; i++ {
+		ci.Put([]byte(fmt.Sprintf("key-%04d", i*2)), &data.LogRecordPos{Fid: uint32(i)})
+	}
+
+	iter = ci.Iterator(false)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%04d", count*2)), iter.Key())
+		assert.Equal(t, uint32(count), iter.Value().Fid)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iter.Seek([]byte("key-0501"))
+	assert.Equal(t, []byte("key-0502"), iter.Key())
+	iter.Seek([]byte("key-9999"))
+	assert.False(t, iter.Valid())
+
+	reverseIter := ci.Iterator(true)
+	assert.Equal(t, []byte("key-1998"), reverseIter.Key())
+	reverseIter.Seek([]byte("key-0501"))
+	assert.Equal(t, []byte("key-0500"), reverseIter.Key())
+	reverseIter.Next()
+	assert.Equal(t, []byte("key-0498"), reverseIter.Key())
+	reverseIter.Seek([]byte("a"))
+	assert.False(t, reverseIter.Valid())
+	count = 0
+	for reverseIter.Rewind(); reverseIter.Valid(); reverseIter.Next() {
+		count++
+	}
+	assert.Equal(t, 1000, count)
+}
+
+func TestCompactIndex_Random(t *testing.T) {
+	ci := NewCompactIndex()
+	expected := make(map[string]uint32)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		key := fmt.Sprintf("key-%05d", r.Intn(20000))
+		if r.Intn(3) == 0 {
+			_, ok := ci.Delete([]byte(key))
+			_, exists := expected[key]
+			assert.Equal(t, exists, ok)
+			delete(expected, key)
+			continue
+		}
+		ci.Put([]byte(key), &data.LogRecordPos{Fid: uint32(i)})
+		expected[key] = uint32(i)
+	}
+	assert.Equal(t, len(expected), ci.Size())
+
+	keys := make([]string, 0, len(expected))
+	for key, fid := range expected {
+		keys = append(keys, key)
+		assert.Equal(t, fid, ci.Get([]byte(key)).Fid)
+	}
+	sort.Strings(keys)
+	iter := ci.Iterator(false)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[count], string(iter.Key()))
+		count++
+	}
+	assert.Equal(t, len(keys), count)
+}
+
+//每个key的写入耗时不应该随着key的数量增加而明显增加
+func BenchmarkCompactIndex_Put(b *testing.B) {
+	for _, keyNum := range []int{1000000, 4000000, 16000000} {
+		b.Run(fmt.Sprintf("keys=%d", keyNum), func(b *testing.B) {
+			pos := &data.LogRecordPos{Fid: 1, Offset: 100}
+			for i := 0; i < b.N; i++ {
+				ci := NewCompactIndex()
+				r := rand.New(rand.NewSource(int64(i)))
+				key := make([]byte, 16)
+				for j := 0; j < keyNum; j++ {
+					r.Read(key)
+					ci.Put(key, pos)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*keyNum), "ns/key")
+		})
+	}
+}
@@ -0,0 +1,582 @@
+package index
+
+import (
+	"bitcast-go/data"
+	"bytes"
+	"container/list"
+	"go.etcd.io/bbolt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//分层索引：所有的key都保存在磁盘上的B+树（bbolt）中，内存中只用LRU缓存热点key的位置
+//写入先追加到索引的预写日志（wal）中并放入内存的待写入集合，由后台协程批量写入B+树
+//一批写入和一条结束标记一起追加到预写日志中，重放时只重放有结束标记的写入，崩溃之后一批写入要么全部生效，要么全部不生效
+//B+树事务提交并持久化之后，才会删除对应的预写日志，所以即使进程崩溃，重启时也可以通过重放预写日志恢复索引
+//提交一批写入时只在锁内追加预写日志，持久化由调用方在提交之后通过Sync完成，一次组提交只需要Sync一次，Sync期间不阻塞读取和其他的写入
+
+const (
+	hybridWalFileName      = "hybrid-index.wal"
+	hybridFlushingFileName = "hybrid-index.wal.flushing"
+	hybridFlushBatchSize   = 1024                   //待写入的数量达到该值时立即触发一次批量写入
+	hybridFlushInterval    = 100 * time.Millisecond //后台批量写入的时间间隔
+)
+
+// HybridIndex 分层索引
+type HybridIndex struct {
+	tree       *bbolt.DB
+	dirPath    string
+	syncWrites bool
+
+	lock     *sync.RWMutex
+	pending  map[string]*data.LogRecordPos //还没有写入B+树的数据，value为nil表示删除
+	flushing map[string]*data.LogRecordPos //正在写入B+树的数据
+	wal      *data.DataFile                //pending对应的预写日志
+	cache    *positionLRU                  //热点key的位置缓存
+	size     int                           //key的数量
+	version  uint64                        //每次写入都递增，用于判断读取B+树期间是否有并发写入
+	err      error                         //预写日志或者后台写入失败的错误，之后不再写入B+树
+	walLock  *sync.Mutex                   //保护Sync期间的wal不被切换，需要在lock之后获取
+
+	flushLock *sync.Mutex //保证同时只有一个批量写入
+	kick      chan struct{}
+	stop      chan struct{}
+	wg        *sync.WaitGroup
+	closeOnce *sync.Once
+	closeErr  error
+}
+
+// NewHybridIndex 初始化分层索引，cacheSize为内存中缓存的key的数量
+func NewHybridIndex(dirPath string, syncWrites bool, cacheSize int) *HybridIndex {
+	opts := bbolt.DefaultOptions
+	//是否持久化由预写日志保证，批量写入之后会手动sync
+	opts.NoSync = true
+	opts.InitialMmapSize = bptreeInitialMmapSize
+	tree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	if err != nil {
+		panic("failed to open bptree")
+	}
+	if err := tree.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		return err
+	}); err != nil {
+		panic("faild to create bucket in bptree")
+	}
+
+	hi := &HybridIndex{
+		tree:       tree,
+		dirPath:    dirPath,
+		syncWrites: syncWrites,
+		lock:       new(sync.RWMutex),
+		pending:    make(map[string]*data.LogRecordPos),
+		walLock:    new(sync.Mutex),
+		cache:      newPositionLRU(cacheSize),
+		flushLock:  new(sync.Mutex),
+		kick:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		wg:         new(sync.WaitGroup),
+		closeOnce:  new(sync.Once),
+	}
+
+	//重放上次没有写入B+树的预写日志
+	for _, name := range []string{hybridFlushingFileName, hybridWalFileName} {
+		if err := hi.replayWal(filepath.Join(dirPath, name)); err != nil {
+			panic("failed to replay hybrid index wal")
+		}
+	}
+	if err := hi.tree.View(func(tx *bbolt.Tx) error {
+		hi.size = tx.Bucket(indexBucketName).Stats().KeyN
+		return nil
+	}); err != nil {
+		panic("failed to get size in bptree")
+	}
+
+	hi.wal, err = data.OpenLogFile(filepath.Join(dirPath, hybridWalFileName))
+	if err != nil {
+		panic("failed to open hybrid index wal")
+	}
+
+	hi.wg.Add(1)
+	go hi.flushLoop()
+	return hi
+}
+
+//向索引中存储key 对应的数据位置信息
+func (hi *HybridIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	var oldPos *data.LogRecordPos
+	_ = hi.Batch(func(w Writer) error {
+		oldPos = w.Put(key, pos)
+		return nil
+	})
+	_ = hi.Sync()
+	return oldPos
+}
+
+//根据key 取出对应的索引位置信息
+func (hi *HybridIndex) Get(key []byte) *data.LogRecordPos {
+	//缓存命中时只需要读锁，LRU有自己的锁
+	hi.lock.RLock()
+	if pos, ok := hi.lookupLocked(key); ok {
+		hi.lock.RUnlock()
+		return pos
+	}
+	version := hi.version
+	hi.lock.RUnlock()
+
+	pos := hi.getFromTree(key)
+
+	//读取期间没有新的写入，才可以放入缓存，写入需要写锁，持有读锁时version不会变化
+	hi.lock.RLock()
+	if hi.version == version {
+		hi.cache.put(string(key), pos)
+	}
+	hi.lock.RUnlock()
+	return pos
+}
+
+//根据Key 删除对应的位置信息
+func (hi *HybridIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	var oldPos *data.LogRecordPos
+	var ok bool
+	_ = hi.Batch(func(w Writer) error {
+		oldPos, ok = w.Delete(key)
+		return nil
+	})
+	_ = hi.Sync()
+	return oldPos, ok
+}
+
+// Batch 批量写入，fn返回之后所有的写入和结束标记一起追加到预写日志中，再更新内存
+// 预写日志写入失败时仍然更新内存，保证当前进程中的索引和数据文件一致，返回的错误之后也会通过Err返回
+// 返回时预写日志还没有持久化，需要持久化时再调用Sync
+func (hi *HybridIndex) Batch(fn func(w Writer) error) error {
+	batch := &hybridBatch{hi: hi, writes: make(map[string]*data.LogRecordPos)}
+	fnErr := fn(batch)
+	if err := batch.commit(); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// PrepareBatch 准备时只在内存中记录写入，提交时追加并持久化预写日志，再更新内存
+func (hi *HybridIndex) PrepareBatch(fn func(w Writer) error) (*PreparedBatch, error) {
+	batch := &hybridBatch{hi: hi, writes: make(map[string]*data.LogRecordPos)}
+	if err := fn(batch); err != nil {
+		return nil, err
+	}
+	return &PreparedBatch{commit: func() error {
+		if err := batch.commit(); err != nil {
+			return err
+		}
+		return hi.Sync()
+	}}, nil
+}
+
+// Sync 持久化已经提交的写入对应的预写日志，syncWrites为false时什么都不做
+// 只持有walLock，不会阻塞读取和其他的写入
+func (hi *HybridIndex) Sync() error {
+	if !hi.syncWrites {
+		return nil
+	}
+	hi.walLock.Lock()
+	err := hi.wal.Sync()
+	hi.walLock.Unlock()
+
+	hi.lock.Lock()
+	defer hi.lock.Unlock()
+	if err != nil && hi.err == nil {
+		hi.err = err
+	}
+	return hi.err
+}
+
+//索引中存在的数据量
+func (hi *HybridIndex) Size() int {
+	hi.lock.RLock()
+	defer hi.lock.RUnlock()
+	return hi.size
+}
+
+// Iterator 先把所有待写入的数据写入B+树，再遍历B+树
+func (hi *HybridIndex) Iterator(reverse bool) Iterator {
+	hi.flush()
+	return newBptreeIterator(hi.tree, reverse)
+}
+
+// Snapshot B+树的只读事务加上还没有写入B+树的数据编码成的预写日志
+// 持有flushLock，保证只读事务和待写入的数据对应同一时刻，调用时不能有并发的写入
+func (hi *HybridIndex) Snapshot() (*Snapshot, error) {
+	hi.flushLock.Lock()
+	defer hi.flushLock.Unlock()
+	hi.lock.RLock()
+	defer hi.lock.RUnlock()
+
+	treeFile, release, err := snapshotBptree(hi.tree)
+	if err != nil {
+		return nil, err
+	}
+	//正在写入B+树的数据可能已经在事务中了，重放是幂等的，和待写入的数据作为一批写入，待写入的数据在后面覆盖
+	var buf bytes.Buffer
+	for _, writes := range []map[string]*data.LogRecordPos{hi.flushing, hi.pending} {
+		for key, pos := range writes {
+			buf.Write(encodeHybridWalRecord([]byte(key), pos))
+		}
+	}
+	if buf.Len() > 0 {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Type: data.LogRecordTnxFinished})
+		buf.Write(encRecord)
+	}
+	wal := buf.Bytes()
+	walFile := &SnapshotFile{
+		Name: hybridWalFileName,
+		Size: int64(len(wal)),
+		WriteTo: func(w io.Writer) error {
+			_, err := w.Write(wal)
+			return err
+		},
+	}
+	return &Snapshot{Files: []*SnapshotFile{treeFile, walFile}, release: release}, nil
+}
+
+// Pause 暂停后台写入，返回恢复的函数，暂停期间B+树和预写日志只会被前台的写入修改
+func (hi *HybridIndex) Pause() func() {
+	hi.flushLock.Lock()
+	return hi.flushLock.Unlock
+}
+
+// Err 预写日志或者后台写入B+树失败的错误
+func (hi *HybridIndex) Err() error {
+	hi.lock.RLock()
+	defer hi.lock.RUnlock()
+	return hi.err
+}
+
+func (hi *HybridIndex) Close() error {
+	hi.closeOnce.Do(func() {
+		hi.closeErr = hi.close()
+	})
+	return hi.closeErr
+}
+
+func (hi *HybridIndex) close() error {
+	close(hi.stop)
+	hi.wg.Wait()
+	hi.flush()
+	if err := hi.Err(); err != nil {
+		//还有没有写入B+树的数据，保留预写日志，下次打开时重放
+		_ = hi.wal.Close()
+		_ = hi.tree.Close()
+		return err
+	}
+	if err := hi.wal.Close(); err != nil {
+		return err
+	}
+	//所有数据都已经写入B+树，预写日志可以删除了
+	if err := os.Remove(filepath.Join(hi.dirPath, hybridWalFileName)); err != nil {
+		return err
+	}
+	return hi.tree.Close()
+}
+
+// 一批还没有提交的写入，提交之前其他的读取看不到
+type hybridBatch struct {
+	hi        *HybridIndex
+	writes    map[string]*data.LogRecordPos //value为nil表示删除
+	buf       bytes.Buffer                  //需要追加到预写日志中的记录
+	sizeDelta int                           //提交之后key的数量的变化
+}
+
+func (b *hybridBatch) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	return b.write(key, pos)
+}
+
+func (b *hybridBatch) Delete(key []byte) (*data.LogRecordPos, bool) {
+	oldPos := b.write(key, nil)
+	return oldPos, oldPos != nil
+}
+
+// 写入或者删除（pos为nil）一个key，返回旧的位置信息
+func (b *hybridBatch) write(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	oldPos, ok := b.writes[string(key)]
+	if !ok {
+		oldPos = b.hi.Get(key)
+	}
+	//删除不存在的key，无需处理
+	if pos == nil && oldPos == nil {
+		return nil
+	}
+
+	b.buf.Write(encodeHybridWalRecord(key, pos))
+	b.writes[string(key)] = pos
+	if oldPos == nil {
+		b.sizeDelta++
+	}
+	if pos == nil {
+		b.sizeDelta--
+	}
+	return oldPos
+}
+
+// 编码预写日志中的一条写入，pos为nil表示删除
+func encodeHybridWalRecord(key []byte, pos *data.LogRecordPos) []byte {
+	record := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	if pos != nil {
+		record = &data.LogRecord{Key: key, Value: data.EncodeLogRecordPos(pos), Type: data.LogRecordNormal}
+	}
+	encRecord, _ := data.EncodeLogRecord(record)
+	return encRecord
+}
+
+// 追加预写日志并更新内存，追加和更新待写入集合需要在同一个锁内，避免预写日志切换之后两者不一致
+func (b *hybridBatch) commit() error {
+	if len(b.writes) == 0 {
+		return nil
+	}
+	hi := b.hi
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Type: data.LogRecordTnxFinished})
+	b.buf.Write(encRecord)
+
+	hi.lock.Lock()
+	defer hi.lock.Unlock()
+	if err := hi.wal.Write(b.buf.Bytes()); err != nil && hi.err == nil {
+		hi.err = err
+	}
+
+	hi.version++
+	for key, pos := range b.writes {
+		hi.pending[key] = pos
+		hi.cache.put(key, pos)
+	}
+	hi.size += b.sizeDelta
+	if len(hi.pending) >= hybridFlushBatchSize {
+		select {
+		case hi.kick <- struct{}{}:
+		default:
+		}
+	}
+	return hi.err
+}
+
+// 依次从待写入集合、正在写入的集合以及缓存中查找，第二个返回值表示是否找到
+// 调用前必须持有锁，读锁即可
+func (hi *HybridIndex) lookupLocked(key []byte) (*data.LogRecordPos, bool) {
+	if pos, ok := hi.pending[string(key)]; ok {
+		return pos, true
+	}
+	if pos, ok := hi.flushing[string(key)]; ok {
+		return pos, true
+	}
+	return hi.cache.get(string(key))
+}
+
+func (hi *HybridIndex) getFromTree(key []byte) *data.LogRecordPos {
+	var pos *data.LogRecordPos
+	if err := hi.tree.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(indexBucketName).Get(key)
+		if len(value) != 0 {
+			pos = data.DecodeLogRecordPos(value)
+		}
+		return nil
+	}); err != nil {
+		panic("failed to get value in bptree")
+	}
+	return pos
+}
+
+// 后台定时批量写入B+树
+func (hi *HybridIndex) flushLoop() {
+	defer hi.wg.Done()
+	ticker := time.NewTicker(hybridFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hi.stop:
+			return
+		case <-ticker.C:
+		case <-hi.kick:
+		}
+		hi.flush()
+	}
+}
+
+// 将待写入的数据批量写入B+树
+// 交接的过程：当前的预写日志重命名为flushing，并打开新的预写日志；B+树提交并sync之后，再删除flushing日志
+// 失败时记录错误，不再继续写入B+树，没有写入的数据仍然保留在内存和预写日志中
+func (hi *HybridIndex) flush() {
+	hi.flushLock.Lock()
+	defer hi.flushLock.Unlock()
+
+	hi.lock.Lock()
+	if hi.err != nil || len(hi.pending) == 0 {
+		hi.lock.Unlock()
+		return
+	}
+	batch, err := hi.swapWalLocked()
+	if err != nil {
+		hi.err = err
+		hi.lock.Unlock()
+		return
+	}
+	hi.lock.Unlock()
+
+	err = hi.applyToTree(batch)
+	if err == nil {
+		err = os.Remove(filepath.Join(hi.dirPath, hybridFlushingFileName))
+	}
+
+	hi.lock.Lock()
+	defer hi.lock.Unlock()
+	if err != nil {
+		//正在写入的数据仍然可以读取
+		hi.err = err
+		return
+	}
+	hi.flushing = nil
+}
+
+// 把当前的预写日志重命名为flushing并打开新的预写日志，返回需要写入B+树的数据，调用时持有锁
+// 已经提交但是还没有Sync的写入在旧的预写日志中，之后的Sync只会持久化新的预写日志，所以关闭之前先持久化
+func (hi *HybridIndex) swapWalLocked() (map[string]*data.LogRecordPos, error) {
+	hi.walLock.Lock()
+	defer hi.walLock.Unlock()
+	walFileName := filepath.Join(hi.dirPath, hybridWalFileName)
+	if hi.syncWrites {
+		if err := hi.wal.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	if err := hi.wal.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(walFileName, filepath.Join(hi.dirPath, hybridFlushingFileName)); err != nil {
+		return nil, err
+	}
+	wal, err := data.OpenLogFile(walFileName)
+	if err != nil {
+		return nil, err
+	}
+	hi.wal = wal
+	hi.flushing = hi.pending
+	hi.pending = make(map[string]*data.LogRecordPos)
+	return hi.flushing, nil
+}
+
+// 在一个事务中写入B+树，并持久化
+func (hi *HybridIndex) applyToTree(batch map[string]*data.LogRecordPos) error {
+	if err := hi.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for key, pos := range batch {
+			var err error
+			if pos == nil {
+				err = bucket.Delete([]byte(key))
+			} else {
+				err = bucket.Put([]byte(key), data.EncodeLogRecordPos(pos))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return hi.tree.Sync()
+}
+
+// 重放预写日志，写入B+树之后删除
+func (hi *HybridIndex) replayWal(fileName string) error {
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	walFile, err := data.OpenLogFile(fileName)
+	if err != nil {
+		return err
+	}
+	batch := make(map[string]*data.LogRecordPos)
+	//还没有读到结束标记的一批写入
+	var writes []*data.LogRecord
+	var offset int64 = 0
+	for {
+		logRecord, size, err := walFile.ReadLogRecord(offset)
+		if err != nil {
+			//读到末尾，或者末尾有写了一半的记录，直接结束，没有结束标记的写入被丢弃
+			break
+		}
+		offset += size
+		if logRecord.Type != data.LogRecordTnxFinished {
+			writes = append(writes, logRecord)
+			continue
+		}
+		for _, record := range writes {
+			if record.Type == data.LogRecordDeleted {
+				batch[string(record.Key)] = nil
+			} else {
+				batch[string(record.Key)] = data.DecodeLogRecordPos(record.Value)
+			}
+		}
+		writes = nil
+	}
+	if err := walFile.Close(); err != nil {
+		return err
+	}
+	if err := hi.applyToTree(batch); err != nil {
+		return err
+	}
+	return os.Remove(fileName)
+}
+
+// 位置信息的LRU缓存，value为nil表示key不存在
+// 读取也会调整顺序，所以有自己的锁，索引只持有读锁时也可以访问
+type positionLRU struct {
+	mu       *sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type positionLRUEntry struct {
+	key string
+	pos *data.LogRecordPos
+}
+
+func newPositionLRU(capacity int) *positionLRU {
+	return &positionLRU{
+		mu:       new(sync.Mutex),
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (lru *positionLRU) get(key string) (*data.LogRecordPos, bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	elem, ok := lru.items[key]
+	if !ok {
+		return nil, false
+	}
+	lru.ll.MoveToFront(elem)
+	return elem.Value.(*positionLRUEntry).pos, true
+}
+
+func (lru *positionLRU) put(key string, pos *data.LogRecordPos) {
+	if lru.capacity <= 0 {
+		return
+	}
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	if elem, ok := lru.items[key]; ok {
+		elem.Value.(*positionLRUEntry).pos = pos
+		lru.ll.MoveToFront(elem)
+		return
+	}
+	lru.items[key] = lru.ll.PushFront(&positionLRUEntry{key: key, pos: pos})
+	if lru.ll.Len() > lru.capacity {
+		oldest := lru.ll.Back()
+		lru.ll.Remove(oldest)
+		delete(lru.items, oldest.Value.(*positionLRUEntry).key)
+	}
+}
@@ -0,0 +1,144 @@
+package index
+
+import (
+	"bitcast-go/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHybridIndex_PutGetDelete(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-hybrid")
+	defer os.RemoveAll(dir)
+	hi := NewHybridIndex(dir, false, 10)
+
+	res1 := hi.Put([]byte("aaa"), &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res1)
+	res2 := hi.Put([]byte("aaa"), &data.LogRecordPos{Fid: 1, Offset: 200})
+	assert.Equal(t, int64(100), res2.Offset)
+	assert.Equal(t, int64(200), hi.Get([]byte("aaa")).Offset)
+
+	//超过缓存容量的key需要从B+树中读取
+	for i := 0; i < 3000; i++ {
+		hi.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: uint32(i)})
+	}
+	hi.flush()
+	assert.Equal(t, 3001, hi.Size())
+	for i := 0; i < 3000; i++ {
+		assert.Equal(t, uint32(i), hi.Get([]byte(fmt.Sprintf("key-%04d", i))).Fid)
+	}
+	assert.Nil(t, hi.Get([]byte("not-exist")))
+
+	pos, ok := hi.Delete([]byte("aaa"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(200), pos.Offset)
+	_, ok = hi.Delete([]byte("aaa"))
+	assert.False(t, ok)
+	assert.Nil(t, hi.Get([]byte("aaa")))
+	assert.Equal(t, 3000, hi.Size())
+
+	iter := hi.Iterator(false)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 3000, count)
+	assert.Nil(t, hi.Close())
+}
+
+func TestHybridIndex_Recover(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-hybrid-recover")
+	defer os.RemoveAll(dir)
+	hi := NewHybridIndex(dir, true, 10)
+	for i := 0; i < 100; i++ {
+		hi.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: uint32(i)})
+	}
+	hi.flush()
+	for i := 100; i < 200; i++ {
+		hi.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: uint32(i)})
+	}
+	hi.Delete([]byte("key-0000"))
+	assert.Nil(t, hi.Batch(func(w Writer) error {
+		w.Put([]byte("batch-0"), &data.LogRecordPos{Fid: 1000})
+		w.Put([]byte("batch-1"), &data.LogRecordPos{Fid: 1001})
+		return nil
+	}))
+	//写了一半的一批写入没有结束标记，重放时被丢弃
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: data.EncodeLogRecordPos(&data.LogRecordPos{Fid: 1}), Type: data.LogRecordNormal})
+	assert.Nil(t, hi.wal.Write(encRecord))
+
+	//模拟进程崩溃：没有写入B+树的数据只存在于预写日志中
+	close(hi.stop)
+	hi.wg.Wait()
+	assert.Nil(t, hi.wal.Close())
+	assert.Nil(t, hi.tree.Close())
+
+	hi2 := NewHybridIndex(dir, true, 10)
+	assert.Equal(t, 201, hi2.Size())
+	assert.Nil(t, hi2.Get([]byte("key-0000")))
+	assert.Nil(t, hi2.Get([]byte("torn")))
+	assert.Equal(t, uint32(1001), hi2.Get([]byte("batch-1")).Fid)
+	for i := 1; i < 200; i++ {
+		assert.Equal(t, uint32(i), hi2.Get([]byte(fmt.Sprintf("key-%04d", i))).Fid)
+	}
+	assert.Nil(t, hi2.Close())
+}
+
+func TestHybridIndex_FlushError(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-hybrid-flush-error")
+	defer os.RemoveAll(dir)
+	hi := NewHybridIndex(dir, false, 10)
+	for i := 0; i < 100; i++ {
+		hi.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: uint32(i)})
+	}
+
+	//B+树写入失败时不会panic，错误通过Err返回，没有写入的数据仍然可以读取
+	assert.Nil(t, hi.tree.Close())
+	hi.flush()
+	assert.NotNil(t, hi.Err())
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, uint32(i), hi.Get([]byte(fmt.Sprintf("key-%04d", i))).Fid)
+	}
+
+	//关闭时返回错误并保留预写日志，重复关闭不会panic
+	assert.NotNil(t, hi.Close())
+	assert.NotNil(t, hi.Close())
+	_, err := os.Stat(filepath.Join(dir, hybridFlushingFileName))
+	assert.Nil(t, err)
+
+	hi2 := NewHybridIndex(dir, false, 10)
+	assert.Equal(t, 100, hi2.Size())
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, uint32(i), hi2.Get([]byte(fmt.Sprintf("key-%04d", i))).Fid)
+	}
+	assert.Nil(t, hi2.Close())
+	assert.Nil(t, hi2.Close())
+}
+
+func TestHybridIndex_Pause(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-hybrid-pause")
+	defer os.RemoveAll(dir)
+	hi := NewHybridIndex(dir, false, 10)
+	hi.Put([]byte("aaa"), &data.LogRecordPos{Fid: 1})
+
+	//暂停期间不会写入B+树
+	resume := hi.Pause()
+	flushed := make(chan struct{})
+	go func() {
+		hi.flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		t.Fatal("flush should wait until resumed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	resume()
+	<-flushed
+	assert.Equal(t, uint32(1), hi.getFromTree([]byte("aaa")).Fid)
+	assert.Nil(t, hi.Close())
+}
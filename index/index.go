@@ -4,6 +4,7 @@ import (
 	"bitcast-go/data"
 	"bytes"
 	"github.com/google/btree"
+	"io"
 )
 
 type Indexer interface {
@@ -24,6 +25,126 @@ type Indexer interface {
 	Close() error
 }
 
+// Writer 索引的写入操作
+type Writer interface {
+	//向索引中存储key 对应的数据位置信息，返回旧的位置信息
+	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
+	//根据Key 删除对应的位置信息
+	Delete(key []byte) (*data.LogRecordPos, bool)
+}
+
+// BatchWriter 可以把多个写入作为一个整体提交的索引
+// 持久化的索引只需要一次事务，崩溃之后一批写入要么全部生效，要么全部不生效
+type BatchWriter interface {
+	//fn中通过w的写入在fn返回之后一起提交，fn返回错误时已经写入的部分仍然会提交，返回提交失败的错误或者fn的错误
+	Batch(fn func(w Writer) error) error
+}
+
+// WriteBatch 在索引上批量写入，不支持批量写入的索引直接写入
+func WriteBatch(indexer Indexer, fn func(w Writer) error) error {
+	if batchWriter, ok := indexer.(BatchWriter); ok {
+		return batchWriter.Batch(fn)
+	}
+	return fn(indexer)
+}
+
+// BatchPreparer 可以先准备一批写入，之后再提交的索引
+// 准备期间读取看到的仍然是之前的数据，提交的开销由索引决定，例如内存中的B树只需要替换成写入之后的副本
+type BatchPreparer interface {
+	//通过w写入，返回准备好的一批写入，准备和提交之间不能有其他的写入；fn返回错误时不会提交任何写入
+	PrepareBatch(fn func(w Writer) error) (*PreparedBatch, error)
+}
+
+// PreparedBatch 准备好但是还没有提交的一批写入，需要调用Commit或者Abort
+type PreparedBatch struct {
+	commit func() error
+	abort  func()
+}
+
+// Commit 提交准备好的写入
+func (b *PreparedBatch) Commit() error {
+	return b.commit()
+}
+
+// Abort 放弃准备好的写入
+func (b *PreparedBatch) Abort() {
+	if b.abort != nil {
+		b.abort()
+	}
+}
+
+// PrepareBatch 在索引上准备一批写入，不支持准备的索引在提交的时候再批量写入
+func PrepareBatch(indexer Indexer, fn func(w Writer) error) (*PreparedBatch, error) {
+	if preparer, ok := indexer.(BatchPreparer); ok {
+		return preparer.PrepareBatch(fn)
+	}
+	return &PreparedBatch{commit: func() error {
+		return WriteBatch(indexer, fn)
+	}}, nil
+}
+
+// Syncer 提交写入时不会持久化，需要单独持久化的索引
+type Syncer interface {
+	//持久化所有已经提交的写入
+	Sync() error
+}
+
+// Sync 持久化索引中已经提交的写入，不需要单独持久化的索引直接返回
+func Sync(indexer Indexer) error {
+	if syncer, ok := indexer.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Snapshotter 文件会被写入修改的持久化索引，可以获取某一时刻的一致性快照
+// 获取快照之后再写出快照中的文件，写出期间不会阻塞索引的写入
+type Snapshotter interface {
+	//获取索引当前的快照，调用时不能有并发的写入，快照中的文件写出之后需要调用Release
+	Snapshot() (*Snapshot, error)
+}
+
+// Snapshot 持久化索引某一时刻的快照
+type Snapshot struct {
+	Files   []*SnapshotFile
+	release func()
+}
+
+// SnapshotFile 快照中的一个索引文件，通过WriteTo写出完整的内容
+type SnapshotFile struct {
+	Name    string
+	Size    int64
+	WriteTo func(w io.Writer) error
+}
+
+// Release 释放快照占用的资源，例如B+树的只读事务
+func (s *Snapshot) Release() {
+	if s.release != nil {
+		s.release()
+	}
+}
+
+// TakeSnapshot 获取持久化索引的快照，不需要快照的索引返回nil
+func TakeSnapshot(indexer Indexer) (*Snapshot, error) {
+	if snapshotter, ok := indexer.(Snapshotter); ok {
+		return snapshotter.Snapshot()
+	}
+	return nil, nil
+}
+
+// IsIndexFile 判断数据目录中的文件是否属于持久化的索引，这些文件通过索引的快照写出
+func IsIndexFile(name string) bool {
+	return name == bptreeIndexFileName || name == hybridWalFileName || name == hybridFlushingFileName
+}
+
+// BackgroundFlusher 在后台把数据写入磁盘文件的索引
+type BackgroundFlusher interface {
+	//暂停后台写入，调用返回的函数之后恢复，暂停期间索引的文件不会被后台写入修改，可以直接拷贝
+	Pause() (resume func())
+	//后台写入或者预写日志失败之后返回错误，磁盘上的索引不再完整，不能再接受新的写入
+	Err() error
+}
+
 type IndexType = int8
 
 const (
@@ -34,10 +155,16 @@ const (
 	ART
 
 	BPtree
+
+	// Compact 前缀压缩的紧凑型索引
+	Compact
+
+	// Hybrid 磁盘B+树 + 内存热点缓存的分层索引
+	Hybrid
 )
 
-// NewIndexer 根据类型初始化索引
-func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
+// NewIndexer 根据类型初始化索引，cacheSize 只对分层索引有效
+func NewIndexer(typ IndexType, dirPath string, sync bool, cacheSize int) Indexer {
 	switch typ {
 	case Btrees:
 		return NewBTree()
@@ -45,6 +172,10 @@ func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
 		return NewArt()
 	case BPtree:
 		return NewBPlusTree(dirPath, sync)
+	case Compact:
+		return NewCompactIndex()
+	case Hybrid:
+		return NewHybridIndex(dirPath, sync, cacheSize)
 	default:
 		panic("unsupported index type")
 	}
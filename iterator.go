@@ -2,22 +2,27 @@ package bitcast_go
 
 import (
 	"bitcast-go/index"
+	"bitcast-go/selferror"
 	"bytes"
 )
 
 //面向用户的迭代器对象
 type Iterator struct {
-	indexIter index.Iterator //索引迭代器
-	db        *DB
-	options   IteratorOptions
+	indexIter       index.Iterator //索引迭代器
+	db              *DB
+	options         IteratorOptions
+	mergeGeneration uint64 //创建迭代器时DB完成merge的次数
 }
 
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	iterator := db.index.Iterator(opts.Reverse)
 	return &Iterator{
-		indexIter: iterator,
-		db:        db,
-		options:   opts,
+		indexIter:       iterator,
+		db:              db,
+		options:         opts,
+		mergeGeneration: db.mergeGeneration,
 	}
 }
 
@@ -52,8 +57,15 @@ func (it *Iterator) Key() []byte {
 //当前遍历位置value的数据
 func (it *Iterator) Value() ([]byte, error) {
 	pos := it.indexIter.Value()
-	it.db.mu.Lock()
+	it.db.mu.RLock()
 	defer it.db.mu.RUnlock()
+	//创建迭代器之后数据文件被merge替换了，迭代器中的位置已经失效，重新从索引中获取
+	if it.mergeGeneration != it.db.mergeGeneration {
+		pos = it.db.index.Get(it.indexIter.Key())
+		if pos == nil {
+			return nil, selferror.ErrKeyNotFound
+		}
+	}
 	return it.db.getVauleByPosition(pos)
 }
 
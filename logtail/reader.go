@@ -0,0 +1,374 @@
+package logtail
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/selferror"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//在其他进程中以只读的方式读取数据目录，按照文件id的顺序追踪数据文件中新写入的数据
+//事务中的数据在读到事务完成的记录之后才会返回，没有完成的事务会被丢弃
+//merge会重写旧的数据文件，如果还有没有读完的旧数据文件被重写了，会返回一条Resync，之后从头读取merge之后的全量数据
+
+type MutationType = byte
+
+const (
+	MutationPut MutationType = iota
+	MutationDelete
+	//之前的数据已经被merge重写，之后会从头返回merge之后的全量数据，消费者需要丢弃之前的状态
+	MutationResync
+)
+
+// Cursor 读取的位置，可以保存下来用于之后恢复读取
+type Cursor struct {
+	MergeEpoch uint32 //读取时最近一次merge的批次，即merge完成时第一个没有参与merge的文件id
+	FileId     uint32
+	Offset     int64
+}
+
+// Mutation 一条已经提交的变更
+type Mutation struct {
+	Type      MutationType
+	Key       []byte
+	Value     []byte
+	SeqNo     uint64 //事务序列号，非事务的写入为0
+	Timestamp int64  //写入的时间（纳秒），没有记录时间时为0
+	//从这个位置恢复读取，可以读到这条变更之后的变更
+	//事务中的变更的位置是事务开始的位置，恢复时会重新读到整个事务
+	Cursor Cursor
+}
+
+// Options 读取的配置项
+type Options struct {
+	//读到最新的数据之后，等待新的写入时检查的间隔
+	PollInterval time.Duration
+}
+
+var DefaultOptions = Options{
+	PollInterval: 100 * time.Millisecond,
+}
+
+// Reader 数据目录的只读追踪者，不是并发安全的
+type Reader struct {
+	dirPath   string
+	mergePath string
+	options   Options
+	//数据文件分布在多个目录中时，不在数据目录中的数据文件所在的目录，每次列出文件时重新读取
+	dataFileDirs map[uint32]string
+
+	epoch     uint32         //当前读取的数据文件对应的merge批次
+	fileId    uint32         //当前读取或者接下来要读取的文件id
+	offset    int64          //当前文件中读取到的位置
+	file      *data.DataFile //当前读取的文件
+	sealed    bool           //当前文件之后已经有了新的文件，不会再有新的写入
+	cursor    Cursor         //最后返回的变更之后的位置
+	txn       *pendingTransaction
+	mutations []*Mutation //已经读取完成还没有返回的变更
+}
+
+// 还没有读到事务完成记录的事务
+type pendingTransaction struct {
+	seqNo     uint64
+	start     Cursor
+	mutations []*Mutation
+}
+
+// Open 从cursor的位置开始读取数据目录，零值表示从头读取
+func Open(dirPath string, cursor Cursor, options Options) (*Reader, error) {
+	if options.PollInterval <= 0 {
+		return nil, errors.New("poll interval must be greater than 0")
+	}
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	dir := path.Dir(path.Clean(dirPath))
+	return &Reader{
+		dirPath:   dirPath,
+		mergePath: filepath.Join(dir, path.Base(dirPath)+data.MergeDirNameSuffix),
+		options:   options,
+		epoch:     cursor.MergeEpoch,
+		fileId:    cursor.FileId,
+		offset:    cursor.Offset,
+		cursor:    cursor,
+	}, nil
+}
+
+// Cursor 最后返回的变更之后的位置
+func (r *Reader) Cursor() Cursor {
+	return r.cursor
+}
+
+// Next 返回下一条已经提交的变更，没有新的写入时等待，直到ctx被取消
+func (r *Reader) Next(ctx context.Context) (*Mutation, error) {
+	for {
+		if len(r.mutations) > 0 {
+			m := r.mutations[0]
+			r.mutations = r.mutations[1:]
+			r.cursor = m.Cursor
+			return m, nil
+		}
+		if r.file == nil {
+			opened, err := r.openFile()
+			if err != nil {
+				return nil, err
+			}
+			if !opened && len(r.mutations) == 0 {
+				if err := r.wait(ctx); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		logRecord, size, err := r.file.ReadLogRecord(r.offset)
+		if err == nil {
+			r.handleRecord(logRecord, size)
+			continue
+		}
+		//活跃文件的末尾可能有只写入了一部分的记录，等写入完成之后再读取
+		if err != io.EOF && !(errors.Is(err, selferror.ErrInvalidCRC) && !r.sealed) {
+			return nil, err
+		}
+		if r.sealed {
+			if err := r.Close(); err != nil {
+				return nil, err
+			}
+			r.fileId, r.offset = r.fileId+1, 0
+			continue
+		}
+		//发现了新的文件之后再读一次当前的文件，这时读到的就是这个文件中全部的数据
+		fileIds, err := r.listFileIds()
+		if err != nil {
+			return nil, err
+		}
+		if len(fileIds) > 0 && fileIds[len(fileIds)-1] > r.fileId {
+			r.sealed = true
+			continue
+		}
+		if err := r.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close 关闭当前读取的文件
+func (r *Reader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// 打开接下来要读取的文件，还没有可以读取的文件时返回false
+func (r *Reader) openFile() (bool, error) {
+	if ok, err := r.checkMerge(); err != nil || !ok {
+		return false, err
+	}
+	fileIds, err := r.listFileIds()
+	if err != nil {
+		return false, err
+	}
+	var found bool
+	for _, fileId := range fileIds {
+		if fileId >= r.fileId {
+			if fileId > r.fileId {
+				r.fileId, r.offset = fileId, 0
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	dataFile, err := data.OpenReadOnlyFile(data.GetDataFileName(r.fileDir(r.fileId), r.fileId), r.fileId)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	//打开文件的同时merge可能正在替换文件，再检查一次，打开之后文件被替换也不影响读取
+	epoch, fileId := r.epoch, r.fileId
+	if ok, err := r.checkMerge(); err != nil || !ok || epoch != r.epoch || fileId != r.fileId {
+		_ = dataFile.Close()
+		return false, err
+	}
+	r.file = dataFile
+	r.sealed = false
+	return true, nil
+}
+
+// 检查是否有新的merge，接下来要读取的文件会被merge替换时返回false，需要等待merge完成
+// 还没有读取完的旧数据文件已经被merge重写时，返回一条Resync，之后从头读取
+func (r *Reader) checkMerge() (bool, error) {
+	//merge已经完成，正在替换数据目录中的文件
+	pendingEpoch, pending, err := readMergeEpoch(r.mergePath)
+	if err != nil {
+		return false, err
+	}
+	if pending && r.fileId < pendingEpoch {
+		return false, nil
+	}
+
+	epoch, _, err := readMergeEpoch(r.dirPath)
+	if err != nil {
+		return false, err
+	}
+	if epoch == r.epoch {
+		return true, nil
+	}
+	r.epoch = epoch
+	//接下来要读取的文件没有参与merge，说明merge之前的数据都已经读取过了
+	if r.fileId >= epoch {
+		return true, nil
+	}
+	r.fileId, r.offset, r.txn = 0, 0, nil
+	r.mutations = append(r.mutations, &Mutation{Type: MutationResync, Cursor: Cursor{MergeEpoch: epoch}})
+	return true, nil
+}
+
+// 读取merge完成文件中记录的第一个没有参与merge的文件id，文件不存在时返回false
+func readMergeEpoch(dirPath string) (uint32, bool, error) {
+	mergeFinishedFile, err := data.OpenReadOnlyFile(filepath.Join(dirPath, data.MergeFinishedFileName), 0)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer mergeFinishedFile.Close()
+	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	if err != nil {
+		return 0, false, err
+	}
+	epoch, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, false, err
+	}
+	return uint32(epoch), true, nil
+}
+
+// 数据目录中所有数据文件的id，包括映射到其他目录中的数据文件，从小到大排序
+func (r *Reader) listFileIds() ([]uint32, error) {
+	dataFileDirs, err := readDataFileDirs(r.dirPath)
+	if err != nil {
+		return nil, err
+	}
+	r.dataFileDirs = dataFileDirs
+	entries, err := os.ReadDir(r.dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+		if err != nil {
+			return nil, selferror.ErrDataDirectoryCorrupte
+		}
+		//映射到其他目录的文件，数据目录中同名的文件是遗留下来的
+		if _, ok := dataFileDirs[uint32(fileId)]; !ok {
+			fileIds = append(fileIds, uint32(fileId))
+		}
+	}
+	//映射文件在创建数据文件之前写入，所以记录的文件可能还不存在
+	for fileId, dir := range dataFileDirs {
+		if _, err := os.Stat(data.GetDataFileName(dir, fileId)); err == nil {
+			fileIds = append(fileIds, fileId)
+		}
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+	return fileIds, nil
+}
+
+// 数据文件所在的目录
+func (r *Reader) fileDir(fileId uint32) string {
+	if dir, ok := r.dataFileDirs[fileId]; ok {
+		return dir
+	}
+	return r.dirPath
+}
+
+// 读取数据目录中的映射文件，文件不存在时返回空的映射
+func readDataFileDirs(dirPath string) (map[uint32]string, error) {
+	dirs := make(map[uint32]string)
+	buf, err := os.ReadFile(filepath.Join(dirPath, data.DataFileDirsFileName))
+	if os.IsNotExist(err) {
+		return dirs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &dirs); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+func (r *Reader) handleRecord(logRecord *data.LogRecord, size int64) {
+	start := Cursor{MergeEpoch: r.epoch, FileId: r.fileId, Offset: r.offset}
+	r.offset += size
+	end := Cursor{MergeEpoch: r.epoch, FileId: r.fileId, Offset: r.offset}
+
+	key, seqNo := data.ParseLogRecordKey(logRecord.Key)
+	if logRecord.Type == data.LogRecordTnxFinished {
+		if r.txn != nil && r.txn.seqNo == seqNo && len(r.txn.mutations) > 0 {
+			//事务的写入时间记录在事务完成的记录中
+			for _, mutation := range r.txn.mutations {
+				mutation.Timestamp = logRecord.Timestamp
+			}
+			//最后一条变更的位置是读完整个事务之后的位置
+			r.txn.mutations[len(r.txn.mutations)-1].Cursor = end
+			r.mutations = append(r.mutations, r.txn.mutations...)
+		}
+		r.txn = nil
+		return
+	}
+
+	mutation := &Mutation{Key: key, SeqNo: seqNo, Timestamp: logRecord.Timestamp, Cursor: end}
+	if logRecord.Type == data.LogRecordDeleted {
+		mutation.Type = MutationDelete
+	} else {
+		mutation.Type = MutationPut
+		mutation.Value = logRecord.Value
+	}
+	//非事务的写入
+	if seqNo == 0 {
+		//同一个事务的数据是连续写入的，之前没有完成的事务不会再完成了
+		r.txn = nil
+		r.mutations = append(r.mutations, mutation)
+		return
+	}
+	if r.txn == nil || r.txn.seqNo != seqNo {
+		r.txn = &pendingTransaction{seqNo: seqNo, start: start}
+	}
+	mutation.Cursor = r.txn.start
+	r.txn.mutations = append(r.txn.mutations, mutation)
+}
+
+func (r *Reader) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.options.PollInterval):
+		return nil
+	}
+}
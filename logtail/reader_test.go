@@ -0,0 +1,164 @@
+package logtail
+
+import (
+	bitcast_go "bitcast-go"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("logtail-key-%09d", i))
+}
+
+func readMutations(t *testing.T, r *Reader, n int) []*Mutation {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mutations []*Mutation
+	for len(mutations) < n {
+		m, err := r.Next(ctx)
+		if err != nil {
+			t.Fatalf("failed after %d mutations: %v", len(mutations), err)
+		}
+		mutations = append(mutations, m)
+	}
+	return mutations
+}
+
+func TestReader(t *testing.T) {
+	opts := bitcast_go.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-logtail")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := bitcast_go.Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(dir + "-merge")
+	}()
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.Nil(t, db.Delete(testKey(0)))
+	wb := db.NewWriteBatch(bitcast_go.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(1), []byte("batch")))
+	assert.Nil(t, wb.Commit())
+
+	options := DefaultOptions
+	options.PollInterval = 10 * time.Millisecond
+	r, err := Open(dir, Cursor{}, options)
+	assert.Nil(t, err)
+	defer r.Close()
+	mutations := readMutations(t, r, 502)
+	for i := 0; i < 500; i++ {
+		assert.Equal(t, MutationPut, mutations[i].Type)
+		assert.Equal(t, testKey(i), mutations[i].Key)
+		assert.Equal(t, uint64(0), mutations[i].SeqNo)
+		assert.NotZero(t, mutations[i].Timestamp)
+	}
+	assert.Greater(t, mutations[499].Cursor.FileId, uint32(0))
+	assert.Equal(t, MutationDelete, mutations[500].Type)
+	assert.Equal(t, testKey(1), mutations[501].Key)
+	assert.Equal(t, []byte("batch"), mutations[501].Value)
+	assert.NotZero(t, mutations[501].SeqNo)
+	assert.Equal(t, mutations[501].Cursor, r.Cursor())
+
+	//读到最新的数据之后继续等待新的写入
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = db.Put(testKey(500), []byte("value-500"))
+	}()
+	assert.Equal(t, testKey(500), readMutations(t, r, 1)[0].Key)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	_, err = r.Next(ctx)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	//从保存的位置恢复读取
+	resumed, err := Open(dir, mutations[99].Cursor, options)
+	assert.Nil(t, err)
+	assert.Equal(t, testKey(100), readMutations(t, resumed, 1)[0].Key)
+
+	//merge之后，已经读完旧数据的读取者继续读取新的写入，还没有读完的需要从头读取
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put(testKey(501), []byte("value-501")))
+	assert.Equal(t, testKey(501), readMutations(t, r, 1)[0].Key)
+
+	//已经打开的旧文件会继续读完，之后返回Resync
+	for m := readMutations(t, resumed, 1)[0]; m.Type != MutationResync; m = readMutations(t, resumed, 1)[0] {
+		assert.Equal(t, MutationPut, m.Type)
+	}
+	mutations = readMutations(t, resumed, 501)
+	keys := make(map[string]bool)
+	for _, m := range mutations[:500] {
+		assert.Equal(t, MutationPut, m.Type)
+		keys[string(m.Key)] = true
+	}
+	assert.Equal(t, 500, len(keys))
+	assert.False(t, keys[string(testKey(0))])
+	assert.Equal(t, testKey(501), mutations[500].Key)
+	assert.Nil(t, resumed.Close())
+
+	//只读，不会创建不存在的数据目录
+	_, err = Open(dir+"-not-exist", Cursor{}, options)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + "-not-exist")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReader_DataDirs(t *testing.T) {
+	opts := bitcast_go.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-logtail-data-dirs")
+	opts.DirPath = dir
+	opts.DataDirs = []string{dir + "-disk-0", dir + "-disk-1"}
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := bitcast_go.Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+		for _, path := range append(opts.DataDirs, dir, dir+"-merge") {
+			_ = os.RemoveAll(path)
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	//数据文件都在其他目录中，通过映射文件找到
+	options := DefaultOptions
+	options.PollInterval = 10 * time.Millisecond
+	r, err := Open(dir, Cursor{}, options)
+	assert.Nil(t, err)
+	defer r.Close()
+	mutations := readMutations(t, r, 500)
+	for i, m := range mutations {
+		assert.Equal(t, testKey(i), m.Key)
+		assert.Equal(t, []byte(fmt.Sprintf("value-%d", i)), m.Value)
+	}
+	assert.Greater(t, mutations[499].Cursor.FileId, uint32(0))
+
+	//merge之后继续读取新的写入，从头读取的读取者可以读到merge之后的全量数据
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put(testKey(500), []byte("value-500")))
+	assert.Equal(t, testKey(500), readMutations(t, r, 1)[0].Key)
+
+	fromStart, err := Open(dir, Cursor{}, options)
+	assert.Nil(t, err)
+	defer fromStart.Close()
+	mutations = readMutations(t, fromStart, 502)
+	assert.Equal(t, MutationResync, mutations[0].Type)
+	keys := make(map[string]bool)
+	for _, m := range mutations[1:] {
+		assert.Equal(t, MutationPut, m.Type)
+		keys[string(m.Key)] = true
+	}
+	assert.Equal(t, 501, len(keys))
+}
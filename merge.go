@@ -2,51 +2,95 @@ package bitcast_go
 
 import (
 	"bitcast-go/data"
+	"bitcast-go/fio"
+	"bitcast-go/index"
 	"bitcast-go/selferror"
 	"bitcast-go/utils"
+	"context"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
-const mergeDirName = "-merge"
+const mergeDirName = data.MergeDirNameSuffix
 const mergeFinishedKey = "merge-finished"
 
+// MergeStatus merge的进度，没有merge在进行中时，为最近一次merge的结果
+type MergeStatus struct {
+	Running        bool      //是否正在merge
+	StartTime      time.Time //开始的时间
+	FinishTime     time.Time //结束的时间，进行中时为零值
+	TotalFiles     int       //参与merge的数据文件的数量
+	FilesProcessed int       //已经处理完成的数据文件的数量
+	TotalBytes     int64     //参与merge的数据文件的总大小
+	BytesRead      int64     //已经读取的字节数
+	BytesWritten   int64     //已经重写的字节数
+	KeysRewritten  int64     //已经重写的key的数量
+	Error          string    //merge失败时的错误信息
+}
+
+// MergeStatus 返回当前merge的进度
+func (db *DB) MergeStatus() MergeStatus {
+	db.mergeStatusLock.Lock()
+	defer db.mergeStatusLock.Unlock()
+	return db.mergeStatus
+}
+
+func (db *DB) updateMergeStatus(fn func(status *MergeStatus)) {
+	db.mergeStatusLock.Lock()
+	defer db.mergeStatusLock.Unlock()
+	fn(&db.mergeStatus)
+}
+
 func (db *DB) Merge() error {
+	return db.MergeCtx(context.Background())
+}
+
+// MergeCtx 和Merge相同，ctx被取消时停止merge并删除merge目录，数据库可以继续正常使用
+func (db *DB) MergeCtx(ctx context.Context) (err error) {
 	//如果活跃文件是null，则直接返回
 	if db.activeFile == nil {
 		return nil
 	}
 
+	//组提交中已经追加但还没有更新索引的记录会被当作无效的数据清理掉，需要等待其完成之后再封存活跃文件
+	db.writeLock.Lock()
 	db.mu.Lock()
 	//如果Merge在进行中，则直接返回
 	if db.isMerging {
 		db.mu.Unlock()
+		db.writeLock.Unlock()
 		return selferror.ErrMergeIsProgress
 	}
 
 	//查看可以merge的数据量是否达到了阈值
-	totalSize, err := utils.DirSize(db.option.DirPath)
+	totalSize, err := db.diskSize()
 	if err != nil {
 		db.mu.Unlock()
+		db.writeLock.Unlock()
 		return err
 	}
 	if float32(db.reclaimSize)/float32(totalSize) < db.option.DataFileMergeRatio {
 		db.mu.Unlock()
+		db.writeLock.Unlock()
 		return selferror.ErrMergeRatioUnreached
 	}
 
 	//查看剩余的空间容量是否可以容纳merge之后的数据量
-	availableDiskSize, err := utils.AvailableDiskSize()
+	availableDiskSize, err := db.availableDataFileSize()
 	if err != nil {
 		db.mu.Unlock()
+		db.writeLock.Unlock()
 		return err
 	}
 	if uint64(totalSize-db.reclaimSize) >= availableDiskSize {
 		db.mu.Unlock()
+		db.writeLock.Unlock()
 		return selferror.ErrNoEnoughSpaceForMerge
 	}
 
@@ -57,19 +101,30 @@ func (db *DB) Merge() error {
 		db.isMerging = false
 	}()
 
-	//持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
-		return err
-	}
-	//将当前活跃文件转化为旧的活跃文件
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	//打开新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
+	//持久化当前活跃文件，将其转化为旧的数据文件，并打开新的活跃文件
+	if err := db.rotateActiveDataFile(); err != nil {
 		db.mu.Unlock()
+		db.writeLock.Unlock()
 		return err
 	}
 	//记录最近没有参与merge的文件id
 	nonMergeId := db.activeFile.FileId
+	//参与merge的文件中无效的数据量，merge完成之后会被清理掉
+	mergedReclaimSize := db.reclaimSize
+	//参与merge的文件中最大的事务序列号，merge之后这些事务的数据不再带有序列号
+	mergedSeqNo := db.seqNo
+
+	//重建布隆过滤器，去掉已经被删除的key，merge过程中新写入的key也会加入到新的过滤器中
+	var bloomFilter *index.BloomFilter
+	//正在根据key的数量重建时，等重建完成之后再在下一次merge中去掉删除的key
+	if db.bloom != nil {
+		bloomFilter = db.newBloomFilter()
+		if db.bloom.StartRebuild(bloomFilter) {
+			defer db.bloom.AbortRebuild(bloomFilter)
+		} else {
+			bloomFilter = nil
+		}
+	}
 
 	//取出所有需要merge的文件
 	var mergeFiles []*data.DataFile
@@ -77,41 +132,100 @@ func (db *DB) Merge() error {
 		mergeFiles = append(mergeFiles, file)
 	}
 	db.mu.Unlock()
+	db.writeLock.Unlock()
 
 	//待merge的文件，从小到大进行排序，依次merge
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
 
+	//记录merge的进度
+	var mergeFilesSize int64
+	for _, dataFile := range mergeFiles {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		mergeFilesSize += size
+	}
+	db.updateMergeStatus(func(status *MergeStatus) {
+		*status = MergeStatus{
+			Running:    true,
+			StartTime:  time.Now(),
+			TotalFiles: len(mergeFiles),
+			TotalBytes: mergeFilesSize,
+		}
+	})
+	defer func() {
+		db.updateMergeStatus(func(status *MergeStatus) {
+			status.Running = false
+			status.FinishTime = time.Now()
+			if err != nil {
+				status.Error = err.Error()
+			}
+		})
+	}()
+	//限制merge读写的速度
+	limiter := utils.NewRateLimiter(db.option.MergeRateLimit)
+
 	mergePath := db.getMergePath()
 	//如果目录存在，说明发生过merge，将其删掉
-	if _, err := os.Stat(mergePath); err == nil {
-		if err := os.RemoveAll(mergePath); err != nil {
+	if _, err := db.fs.Stat(mergePath); err == nil {
+		if err := db.removeMergeDirs(); err != nil {
 			return err
 		}
 	}
 	//新建一个 merge path 的目录
-	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
+	if err := db.fs.MkdirAll(mergePath); err != nil {
 		return err
 	}
+	//merge没有完成时删除merge目录，在关闭merge实例之后执行
+	var mergeFinished bool
+	defer func() {
+		if !mergeFinished {
+			_ = db.removeMergeDirs()
+		}
+	}()
 	//打开一个新的临时bitcask实例
 	mergeOptions := db.option
 	mergeOptions.DirPath = mergePath
+	//merge之后的数据文件写入到每个数据文件目录对应的merge目录中
+	mergeOptions.DataDirs = nil
+	for _, dir := range db.option.DataDirs {
+		mergeOptions.DataDirs = append(mergeOptions.DataDirs, mergeDirOf(dir))
+	}
 	mergeOptions.SyncWrites = false
-	mergeDB, err := Open(mergeOptions)
+	mergeOptions.EnableBloomFilter = false
+	mergeOptions.ValueCacheSize = 0
+	//merge实例不需要索引，持久化的索引会在merge目录中生成索引文件，所以使用内存索引即可
+	if isPersistentIndexer(mergeOptions.IndexerType) {
+		mergeOptions.IndexerType = BTree
+	}
+	mergeDB, err := OpenCtx(ctx, mergeOptions)
 	if err != nil {
 		return err
 	}
+	//merge实例需要在安装merge之后的文件之前关闭
+	mergeDBClosed := false
+	defer func() {
+		if !mergeDBClosed {
+			_ = mergeDB.Close()
+		}
+	}()
 	//打开hint文件，存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(mergePath, db.fs.IoType())
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 
 	//遍历处理每个数据文件
 	for _, dataFile := range mergeFiles {
 		var offset int64 = 0
 		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
 				if err == io.EOF {
@@ -119,6 +233,9 @@ func (db *DB) Merge() error {
 				}
 				return err
 			}
+			if err := limiter.WaitN(ctx, size); err != nil {
+				return err
+			}
 			//解析实际拿到的key
 			realKey, _ := parseLogRecordKey(logRecord.Key)
 			logRecordPos := db.index.Get(realKey)
@@ -135,10 +252,26 @@ func (db *DB) Merge() error {
 				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
 					return err
 				}
+				if bloomFilter != nil {
+					bloomFilter.Add(realKey)
+				}
+				if err := limiter.WaitN(ctx, int64(pos.Size)); err != nil {
+					return err
+				}
+				db.updateMergeStatus(func(status *MergeStatus) {
+					status.BytesWritten += int64(pos.Size)
+					status.KeysRewritten++
+				})
 			}
+			db.updateMergeStatus(func(status *MergeStatus) {
+				status.BytesRead += size
+			})
 			//增加offset
 			offset += size
 		}
+		db.updateMergeStatus(func(status *MergeStatus) {
+			status.FilesProcessed++
+		})
 	}
 	//sync 保证持久化
 	if err := hintFile.Sync(); err != nil {
@@ -147,14 +280,22 @@ func (db *DB) Merge() error {
 	if err := mergeDB.Sync(); err != nil {
 		return err
 	}
+	mergeDBClosed = true
+	if err := mergeDB.Close(); err != nil {
+		return err
+	}
 	//写标识merge完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath, db.fs.IoType())
 	if err != nil {
 		return err
 	}
+	defer mergeFinishedFile.Close()
 	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKey),
+		//key中带有参与merge的最大的事务序列号，更早的事务已经无法按序列号恢复
+		Key:   logRecordKeyWithSeq([]byte(mergeFinishedKey), mergedSeqNo),
 		Value: []byte(strconv.Itoa(int(nonMergeId))), //值为最后一个没有参与的文件，即最新的活跃文件,下次打开的时候，如果文件id比其小，则表示都参与过merge
+		//merge完成的时间，早于这个时间的历史数据已经被清理，无法按时间点恢复
+		Timestamp: time.Now().UnixNano(),
 	}
 	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
 	err = mergeFinishedFile.Write(encRecord)
@@ -165,7 +306,15 @@ func (db *DB) Merge() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	mergeFinished = true
+
+	//merge完成，使用新的布隆过滤器
+	if bloomFilter != nil {
+		db.bloom.FinishRebuild(bloomFilter)
+	}
+
+	//切换到merge之后的数据文件，失败时merge目录会保留下来，下次启动时继续安装
+	return db.switchToMergedFiles(mergePath, nonMergeId, mergedReclaimSize)
 }
 
 // /tmp/bitcask
@@ -175,76 +324,254 @@ func (db *DB) getMergePath() string {
 	return filepath.Join(dir, base+mergeDirName)
 }
 
-//加载merge数据目录
+//加载merge数据目录，上一次运行中的merge在安装到数据目录的过程中异常退出时，继续完成安装
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergePath()
 	//merge目标不存在的话直接返回
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	if _, err := db.fs.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
-	dirEntries, err := os.ReadDir(mergePath)
+	//查找标识merge完成的文件，如果没有merge处理完，则直接删除merge目录
+	if _, err := db.fs.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); err != nil {
+		return db.removeMergeDirs()
+	}
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
 	if err != nil {
+		return db.removeMergeDirs()
+	}
+
+	result := db.parseMergeHintFile(mergePath)
+	if result.err != nil {
+		return result.err
+	}
+	if err := db.installMergeFiles(mergePath, nonMergeFileId, result.records); err != nil {
 		return err
 	}
-	//查找标识merge完成的文件，判断Merge是否处理完了
-	var mergeFinished bool
-	var mergeFileNames []string //merge目录下所有的文件名
-	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true //merge处理完成的标识
-		}
-		if entry.Name() == data.SeqNoFileName { //如果是事务序列号文件，无需merge过去
+	//持久化的索引不会重新加载，需要把指向旧数据文件的位置更新为merge之后的位置
+	if isPersistentIndexer(db.option.IndexerType) {
+		delta := db.mergeHintDelta(nonMergeFileId, result.records)
+		return index.WriteBatch(db.index, func(w index.Writer) error {
+			return applyMergeHintDelta(w, delta)
+		})
+	}
+	return nil
+}
+
+// 读取merge之后的hint索引文件，安装过程中hint索引文件可能已经被移动到了数据目录中
+func (db *DB) parseMergeHintFile(mergePath string) indexLoadResult {
+	if _, err := db.fs.Stat(filepath.Join(mergePath, data.HintFileName)); err == nil {
+		return db.parseHintFile(context.Background(), mergePath)
+	}
+	return db.parseHintFile(context.Background(), db.option.DirPath)
+}
+
+// 将merge目录中的文件安装到数据目录中，中途异常退出之后可以重复执行
+// 1. 用merge之后的数据文件（以及对应的hint文件）原子地替换同名的旧文件
+// 2. 删除其余参与了merge的旧文件，更新数据文件所在目录的映射
+// 3. 依次移动hint索引文件和标识merge完成的文件，最后删除merge目录
+// hint索引文件在前两步完成之前一直保留在merge目录中，用于确定merge之后的数据文件的数量
+// 数据文件在其他目录中时，从对应的merge目录移动回这个目录，同名的旧文件可能在另一个目录中，需要删除
+func (db *DB) installMergeFiles(mergePath string, nonMergeFileId uint32, hintRecords []*indexLoadRecord) error {
+	mergedFileNum := mergedDataFileNum(hintRecords)
+	mergedDirs, err := readDataFileDirs(db.fs, mergePath)
+	if err != nil {
+		return err
+	}
+	dataFileDirs := db.dataFileDirList()
+	installedDirs := make(map[uint32]string)
+	for fileId := uint32(0); fileId < mergedFileNum; fileId++ {
+		srcDir, destDir := mergedFileDirs(mergePath, db.option.DirPath, mergedDirs, fileId)
+		installedDirs[fileId] = destDir
+		srcDataFile := data.GetDataFileName(srcDir, fileId)
+		if _, err := db.fs.Stat(srcDataFile); err != nil {
+			//已经移动过了
 			continue
 		}
-		if entry.Name() == fileLockName {
+		//先处理hint文件，merge之后的文件没有hint文件时，删除旧的hint文件
+		srcHintFile := data.GetDataHintFileName(mergePath, fileId)
+		destHintFile := data.GetDataHintFileName(db.option.DirPath, fileId)
+		if _, err := db.fs.Stat(srcHintFile); err == nil {
+			if err := db.fs.Rename(srcHintFile, destHintFile); err != nil {
+				return err
+			}
+		} else if err := db.fs.Remove(destHintFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, dir := range dataFileDirs {
+			if filepath.Clean(dir) == filepath.Clean(destDir) {
+				continue
+			}
+			if err := db.fs.Remove(data.GetDataFileName(dir, fileId)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := db.fs.Rename(srcDataFile, data.GetDataFileName(destDir, fileId)); err != nil {
+			return err
+		}
+	}
+
+	//删除没有被替换的旧的数据文件，以及对应的hint文件
+	for fileId := mergedFileNum; fileId < nonMergeFileId; fileId++ {
+		fileNames := []string{data.GetDataHintFileName(db.option.DirPath, fileId)}
+		for _, dir := range dataFileDirs {
+			fileNames = append(fileNames, data.GetDataFileName(dir, fileId))
+		}
+		for _, fileName := range fileNames {
+			if err := db.fs.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if err := db.installMergedDataFileDirs(nonMergeFileId, installedDirs); err != nil {
+		return err
+	}
+
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		srcPath := filepath.Join(mergePath, fileName)
+		if _, err := db.fs.Stat(srcPath); err != nil {
 			continue
 		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
+		if err := db.fs.Rename(srcPath, filepath.Join(db.option.DirPath, fileName)); err != nil {
+			return err
+		}
 	}
+	return db.removeMergeDirs()
+}
 
-	//如果没有merge处理完，则直接返回
-	if !mergeFinished {
-		return nil
+// merge之后的数据文件在安装之前所在的目录，以及安装之后所在的目录
+// 数据文件在其他目录中时，merge之后的文件在那个目录对应的merge目录中
+func mergedFileDirs(mergePath, dirPath string, mergedDirs map[uint32]string, fileId uint32) (string, string) {
+	if dir, ok := mergedDirs[fileId]; ok && filepath.Clean(dir) != filepath.Clean(mergePath) {
+		return dir, strings.TrimSuffix(filepath.Clean(dir), mergeDirName)
+	}
+	return mergePath, dirPath
+}
+
+// merge之后的数据文件的id从0开始连续分配，每个文件中都有被重写的数据，所以数量为hint索引中最大的文件id加1
+func mergedDataFileNum(hintRecords []*indexLoadRecord) uint32 {
+	var num uint32
+	for _, record := range hintRecords {
+		if record.pos.Fid+1 > num {
+			num = record.pos.Fid + 1
+		}
 	}
+	return num
+}
 
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+// 在运行中切换到merge之后的数据文件，不需要重启
+// 解析hint索引文件、打开merge之后的数据文件以及准备索引的更新都在加锁之前完成，持有db.mu的期间只重命名文件、替换文件并提交索引
+// 整个过程持有writeLock，准备好的索引更新和提交之间不会有新的写入
+func (db *DB) switchToMergedFiles(mergePath string, nonMergeFileId uint32, mergedReclaimSize int64) error {
+	result := db.parseHintFile(context.Background(), mergePath)
+	if result.err != nil {
+		return result.err
+	}
+	//旧的数据文件可能还在异步写入hint文件
+	db.hintWg.Wait()
+
+	//等待正在进行的增量备份拷贝完旧的数据文件
+	db.fileRemoveLock.Lock()
+	defer db.fileRemoveLock.Unlock()
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	mergedFiles, err := db.openMergedDataFiles(mergePath, result.records)
 	if err != nil {
-		return nil
+		return err
+	}
+	delta := db.mergeHintDelta(nonMergeFileId, result.records)
+	batch, err := index.PrepareBatch(db.index, func(w index.Writer) error {
+		return applyMergeHintDelta(w, delta)
+	})
+	if err != nil {
+		closeDataFiles(mergedFiles)
+		return err
 	}
 
-	//删除旧的数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(db.option.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			err := os.Remove(fileName)
-			if err != nil {
-				return err
-			}
+	db.mu.Lock()
+	if err := db.installMergeFiles(mergePath, nonMergeFileId, result.records); err != nil {
+		db.mu.Unlock()
+		batch.Abort()
+		closeDataFiles(mergedFiles)
+		return err
+	}
+	//替换旧的数据文件，关闭文件在释放锁之后进行
+	var replacedFiles []*data.DataFile
+	for fileId, dataFile := range db.olderFiles {
+		if fileId >= nonMergeFileId {
+			continue
 		}
+		replacedFiles = append(replacedFiles, dataFile)
+		delete(db.olderFiles, fileId)
+		if db.valueCache != nil {
+			db.valueCache.RemoveFile(fileId)
+		}
+	}
+	for _, dataFile := range mergedFiles {
+		db.olderFiles[dataFile.FileId] = dataFile
 	}
+	err = batch.Commit()
+	//参与merge的文件中的无效数据已经被清理掉了
+	db.reclaimSize -= mergedReclaimSize
+	db.mergeGeneration++
+	db.mu.Unlock()
 
-	//将新的数据文件移动到数据目录中
-	for _, fileName := range mergeFileNames {
-		srcPath := filepath.Join(mergePath, fileName)
-		destPath := filepath.Join(db.option.DirPath, fileName)
-		err := os.Rename(srcPath, destPath)
+	closeDataFiles(replacedFiles)
+	return err
+}
+
+// 打开merge之后的数据文件，这时文件还在merge目录中，安装时重命名之后打开的句柄仍然有效
+// 使用文件句柄缓存时只创建包装，第一次读取时才从安装之后的路径打开
+func (db *DB) openMergedDataFiles(mergePath string, hintRecords []*indexLoadRecord) ([]*data.DataFile, error) {
+	mergedDirs, err := readDataFileDirs(db.fs, mergePath)
+	if err != nil {
+		return nil, err
+	}
+	var dataFiles []*data.DataFile
+	for fileId := uint32(0); fileId < mergedDataFileNum(hintRecords); fileId++ {
+		var dataFile *data.DataFile
+		if db.fileCache != nil {
+			dataFile, err = db.openOlderDataFile(fileId, db.dataFileIoType())
+		} else {
+			srcDir, _ := mergedFileDirs(mergePath, db.option.DirPath, mergedDirs, fileId)
+			dataFile, err = data.OpenDataFile(srcDir, fileId, db.dataFileIoType())
+		}
 		if err != nil {
-			return err
+			closeDataFiles(dataFiles)
+			return nil, err
+		}
+		dataFiles = append(dataFiles, dataFile)
+	}
+	return dataFiles, nil
+}
+
+func closeDataFiles(dataFiles []*data.DataFile) {
+	for _, dataFile := range dataFiles {
+		_ = dataFile.Close()
+	}
+}
+
+// 索引中还指向已经被merge掉的数据文件的key，需要更新为merge之后的位置
+// merge之后又被更新或者删除的key，索引中的位置已经不在这些文件中了，保持不变
+func (db *DB) mergeHintDelta(nonMergeFileId uint32, hintRecords []*indexLoadRecord) []*indexLoadRecord {
+	var delta []*indexLoadRecord
+	for _, record := range hintRecords {
+		if oldPos := db.index.Get(record.key); oldPos != nil && oldPos.Fid < nonMergeFileId {
+			delta = append(delta, record)
 		}
 	}
+	return delta
+}
+
+func applyMergeHintDelta(w index.Writer, delta []*indexLoadRecord) error {
+	for _, record := range delta {
+		w.Put(record.key, record.pos)
+	}
 	return nil
 }
 
 func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
-	if err != nil {
-		return 0, err
-	}
-	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	record, err := readMergeFinishedRecord(dirPath, db.fs.IoType())
 	if err != nil {
 		return 0, err
 	}
@@ -255,34 +582,54 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 	return uint32(nonMergeFileId), nil
 }
 
-//从hint文件中加载索引
-func (db *DB) loadIndexFromHintFile() error {
-	//查看hint索引文件是否存在
-	hintFileName := filepath.Join(db.option.DirPath, data.HintFileName)
-	_, err := os.Stat(hintFileName)
+// merge完成的记录中保存的参与merge的最大的事务序列号，旧版本的记录中没有保存时返回false
+func mergedSeqNoOf(record *data.LogRecord) (uint64, bool) {
+	realKey, seqNo := parseLogRecordKey(record.Key)
+	return seqNo, string(realKey) == mergeFinishedKey
+}
+
+// 读取目录中的merge完成文件中的记录
+func readMergeFinishedRecord(dirPath string, ioType fio.FileIOType) (*data.LogRecord, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath, ioType)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer mergeFinishedFile.Close()
+	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	return record, err
+}
+
+//从hint文件中解析出索引
+func (db *DB) parseHintFile(ctx context.Context, dirPath string) indexLoadResult {
 	//打开hint索引文件
-	hintFile, err := data.OpenHintFile(hintFileName)
+	hintFile, err := data.OpenHintFile(dirPath, db.fs.IoType())
 	if err != nil {
-		return err
+		return indexLoadResult{err: err}
 	}
+	defer hintFile.Close()
 
 	//读取文件中的索引
+	var records []*indexLoadRecord
 	var offset int64 = 0
 	for {
+		if err := ctx.Err(); err != nil {
+			return indexLoadResult{err: err}
+		}
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return indexLoadResult{err: err}
 		}
 		//解码拿到实际的位置索引
-		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		records = append(records, &indexLoadRecord{
+			key:   logRecord.Key,
+			typ:   data.LogRecordNormal,
+			seqNo: nonTransactionSeqNo,
+			pos:   data.DecodeLogRecordPos(logRecord.Value),
+		})
 		offset += size
 	}
-	return nil
+	return indexLoadResult{records: records}
 }
@@ -1,10 +1,21 @@
 package bitcast_go
 
-import "os"
+import (
+	"os"
+	"runtime"
+)
 
 type Options struct {
 	DirPath string //数据库数据目录
 
+	//数据文件的目录，可以位于不同的磁盘上，新的数据文件按照DataDirPolicy分布到这些目录中
+	//为空时数据文件都保存在DirPath中，索引、hint等元数据文件始终保存在DirPath中
+	//每个目录只能被一个数据库使用
+	DataDirs []string
+
+	//新的数据文件选择目录的策略，只在DataDirs不为空时生效
+	DataDirPolicy DataDirPolicy
+
 	//数据文件的大小阈值
 	DataFileSize int64
 
@@ -20,8 +31,50 @@ type Options struct {
 	//启动时是否需要使用mmap内存映射
 	MMapAtStartup bool
 
+	//运行期间是否也使用mmap读写数据文件（包括活跃文件），开启后启动时同样会使用mmap
+	MMapIO bool
+
+	//创建活跃文件时是否按照DataFileSize预分配空间，不能和MMapIO同时开启
+	PreallocateDataFiles bool
+
+	//预分配空间的活跃文件是否使用O_DIRECT读写，只在PreallocateDataFiles开启时生效
+	DirectIO bool
+
 	//数据文件合并的阈值
 	DataFileMergeRatio float32
+
+	//merge时每秒读取和重写的最大字节数，用于减少merge对正常读写的影响，小于等于0表示不限制
+	MergeRateLimit int64
+
+	//启动时并发解析数据文件的协程数量，小于等于0时使用CPU核数
+	LoadIndexParallelism int
+
+	//是否在索引前使用布隆过滤器，快速判断key不存在
+	EnableBloomFilter bool
+
+	//布隆过滤器预计容纳的key的数量
+	BloomFilterExpectedKeys uint64
+
+	//布隆过滤器期望的误判率
+	BloomFilterFalsePositiveRate float64
+
+	//分层索引在内存中缓存的热点key的数量
+	HybridIndexCacheSize int
+
+	//同时打开的数据文件的最大数量，超过之后关闭最久没有读取的旧数据文件，小于等于0表示不限制
+	//开启之后，启动时不再使用mmap读取旧的数据文件
+	MaxOpenFiles int
+
+	//value缓存的最大字节数，缓存读取过的value，小于等于0表示不缓存
+	ValueCacheSize int64
+
+	//内存模式：数据文件、hint文件、事务序列号文件和文件锁都保存在进程内的内存文件系统中，进程退出之后数据丢失
+	//不支持B+树等持久化的索引
+	InMemory bool
+
+	//内存模式下关闭之后保留数据目录中的文件，同一个进程中重新打开时仍然可以读到之前的数据
+	//默认关闭时释放数据目录和数据文件目录中所有的文件，备份和检查点等写到其他目录中的文件需要自行删除
+	InMemoryRetain bool
 }
 
 type IndexerType = int8
@@ -35,6 +88,27 @@ const (
 
 	//B+树索引
 	BPlusTree
+
+	//前缀压缩的紧凑型索引，适用于key数量非常多的场景
+	Compact
+
+	//分层索引，所有key保存在磁盘B+树中，内存中只缓存热点key
+	Hybrid
+)
+
+// 索引是否持久化在磁盘上，持久化的索引启动时不需要从数据文件中加载
+func isPersistentIndexer(typ IndexerType) bool {
+	return typ == BPlusTree || typ == Hybrid
+}
+
+type DataDirPolicy = int8
+
+const (
+	//按照文件id轮流使用每个目录
+	RoundRobin DataDirPolicy = iota + 1
+
+	//使用剩余可用空间最多的目录
+	MostFreeSpace
 )
 
 //索引迭代器配置项
@@ -46,13 +120,28 @@ type IteratorOptions struct {
 }
 
 var DefaultOptions = Options{
-	DirPath:            os.TempDir(),
-	DataFileSize:       256 * 1024 * 1024,
-	SyncWrites:         false,
-	BytesPerSync:       0,
-	IndexerType:        BTree,
-	MMapAtStartup:      true,
-	DataFileMergeRatio: 0.5,
+	DirPath:                      os.TempDir(),
+	DataDirs:                     nil,
+	DataDirPolicy:                RoundRobin,
+	DataFileSize:                 256 * 1024 * 1024,
+	SyncWrites:                   false,
+	BytesPerSync:                 0,
+	IndexerType:                  BTree,
+	MMapAtStartup:                true,
+	MMapIO:                       false,
+	PreallocateDataFiles:         false,
+	DirectIO:                     false,
+	DataFileMergeRatio:           0.5,
+	MergeRateLimit:               0,
+	LoadIndexParallelism:         runtime.NumCPU(),
+	EnableBloomFilter:            false,
+	BloomFilterExpectedKeys:      1000000,
+	BloomFilterFalsePositiveRate: 0.01,
+	HybridIndexCacheSize:         100000,
+	MaxOpenFiles:                 0,
+	ValueCacheSize:               0,
+	InMemory:                     false,
+	InMemoryRetain:               false,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -71,3 +160,38 @@ var DefaultWriteBatchOptions = WriteBatchOptions{
 	MaxBatchNum: 10000,
 	SyncWrites:  true,
 }
+
+// WatchOptions 订阅数据变更的配置项
+type WatchOptions struct {
+	//只订阅前缀为指定值的key，默认为空表示订阅所有的key
+	Prefix []byte
+	//最多缓存多少条还没有被消费的事件，超过之后订阅会被关闭，并返回ErrWatcherTooSlow
+	BufferSize int
+	//从这个位置开始订阅，先读取数据文件中之后的数据，再接收新的写入，为空表示只接收新的写入
+	From *WatchPosition
+}
+
+var DefaultWatchOptions = WatchOptions{
+	Prefix:     nil,
+	BufferSize: 1024,
+	From:       nil,
+}
+
+// ShardedOptions 分片数据库的配置项
+type ShardedOptions struct {
+	//每个分片的数据目录，可以在不同的磁盘上
+	Dirs []string
+	//每个分片的配置项，DirPath会被忽略
+	Options Options
+	//每个分片在一致性哈希环上的虚拟节点数量
+	VirtualNodes int
+	//添加分片之后迁移数据时，每批迁移多少个key，迁移一批的期间会阻塞写入
+	RebalanceBatchSize int
+}
+
+var DefaultShardedOptions = ShardedOptions{
+	Dirs:               nil,
+	Options:            DefaultOptions,
+	VirtualNodes:       128,
+	RebalanceBatchSize: 1000,
+}
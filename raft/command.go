@@ -0,0 +1,113 @@
+package raft
+
+import (
+	bitcast_go "bitcast-go"
+	"bitcast-go/selferror"
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Op 一条写入操作，一个日志条目中的多条操作会作为一个事务应用到数据库
+type Op struct {
+	Delete bool
+	Key    []byte
+	Value  []byte
+}
+
+var errInvalidCommand = errors.New("invalid raft command")
+
+// 编码日志条目中的操作：是否删除(1字节) + key长度(变长) + key + value长度(变长) + value
+func encodeOps(ops []Op) []byte {
+	var buf []byte
+	for _, op := range ops {
+		if op.Delete {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(op.Key)))
+		buf = append(buf, op.Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(op.Value)))
+		buf = append(buf, op.Value...)
+	}
+	return buf
+}
+
+func decodeOps(buf []byte) ([]Op, error) {
+	var ops []Op
+	for len(buf) > 0 {
+		op := Op{Delete: buf[0] == 1}
+		buf = buf[1:]
+		var err error
+		if op.Key, buf, err = decodeBytes(buf); err != nil {
+			return nil, err
+		}
+		if op.Value, buf, err = decodeBytes(buf); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func decodeBytes(buf []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, errInvalidCommand
+	}
+	return buf[n : n+int(size)], buf[n+int(size):], nil
+}
+
+// 状态机数据库中记录已经应用到的日志位置的key，和日志条目中的写入在同一个事务中提交，不能被用户的写入使用
+var appliedIndexKey = []byte("\x00raft-applied-index")
+
+// IsInternalKey 判断key是否为raft在状态机数据库中保存内部状态使用的key，遍历数据库时可以用来过滤
+func IsInternalKey(key []byte) bool {
+	return bytes.Equal(key, appliedIndexKey)
+}
+
+// 把日志条目应用到数据库，同时记录已经应用到的位置，两者作为一个事务提交
+// 没有操作的条目是新的leader写入的空条目，只更新应用到的位置；syncWrites和状态机数据库的配置项相同
+func applyEntry(db *bitcast_go.DB, entry *LogEntry, syncWrites bool) error {
+	ops, err := decodeOps(entry.Data)
+	if err != nil {
+		return err
+	}
+
+	opts := bitcast_go.DefaultWriteBatchOptions
+	opts.SyncWrites = syncWrites
+	if uint(len(ops)+1) > opts.MaxBatchNum {
+		opts.MaxBatchNum = uint(len(ops) + 1)
+	}
+	wb := db.NewWriteBatch(opts)
+	for _, op := range ops {
+		if op.Delete {
+			err = wb.Delete(op.Key)
+		} else {
+			err = wb.Put(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := wb.Put(appliedIndexKey, binary.BigEndian.AppendUint64(nil, entry.Index)); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// 读取数据库中已经应用到的日志位置，没有应用过日志时返回0
+func loadAppliedIndex(db *bitcast_go.DB) (uint64, error) {
+	value, err := db.Get(appliedIndexKey)
+	if err == selferror.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, selferror.ErrDataDirectoryCorrupte
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
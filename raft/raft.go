@@ -0,0 +1,996 @@
+package raft
+
+import (
+	bitcast_go "bitcast-go"
+	"bitcast-go/selferror"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//基于raft的复制：写入先追加到raft日志，复制到多数节点之后按照日志的顺序应用到每个节点的bitcask实例
+//数据目录中 raft 保存任期、投票和日志，data 是状态机的数据库，snapshot-* 是数据库的检查点
+//应用的日志超过一定数量之后创建检查点并清理之前的日志，落后太多的节点直接接收leader的检查点
+
+type NodeState = byte
+
+const (
+	StateFollower NodeState = iota
+	StateCandidate
+	StateLeader
+)
+
+// Config raft节点的配置项
+type Config struct {
+	ID        string   //节点的id，使用HTTPTransport时是节点的http地址
+	Peers     []string //集群中所有节点的id，包括自己
+	DirPath   string
+	Transport Transport
+	//状态机数据库的配置项，DirPath会被忽略
+	DBOptions bitcast_go.Options
+	//超过这个时间没有收到leader的消息时发起选举，实际的超时时间在[ElectionTimeout, 2*ElectionTimeout)之间随机
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	//应用了多少条日志之后创建快照
+	SnapshotThreshold uint64
+	//一次最多复制多少条日志
+	MaxEntriesPerRequest int
+	//发送快照时每个请求中最多包含多少字节
+	SnapshotChunkSize int
+}
+
+var DefaultConfig = Config{
+	DBOptions:            bitcast_go.DefaultOptions,
+	ElectionTimeout:      500 * time.Millisecond,
+	HeartbeatInterval:    100 * time.Millisecond,
+	SnapshotThreshold:    10000,
+	MaxEntriesPerRequest: 1000,
+	SnapshotChunkSize:    1024 * 1024,
+}
+
+// Status 节点当前的状态
+type Status struct {
+	ID            string
+	State         NodeState
+	Term          uint64
+	Leader        string
+	CommitIndex   uint64
+	LastApplied   uint64
+	LastLogIndex  uint64
+	SnapshotIndex uint64
+	ApplyError    error //最近一次应用日志失败的错误，不为nil时节点停在LastApplied之后的日志上重试
+}
+
+var errInvalidSnapshot = errors.New("invalid raft snapshot")
+
+// 正在接收的快照的来源
+type snapshotTransfer struct {
+	leader string
+	term   uint64
+	meta   snapshotMeta
+}
+
+// Node raft集群中的一个节点
+type Node struct {
+	id        string
+	peers     []string //除了自己之外的节点
+	config    Config
+	transport Transport
+	logStore  *logStore
+
+	mu          *sync.Mutex
+	state       NodeState
+	term        uint64
+	vote        string
+	leader      string
+	log         []*LogEntry //快照之后的日志
+	snapshot    snapshotMeta
+	commitIndex uint64
+	lastApplied uint64
+	applyErr    error //最近一次应用日志失败的错误，成功应用之后清空
+	//leader记录的每个节点下一条要发送的日志和已经复制的日志
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool //是否正在向节点发送日志
+	//leader最近一次收到节点回复的时间，超过选举超时时间没有收到多数节点的回复时不再作为leader
+	lastContact map[string]time.Time
+	votes       int
+	//选举超时和下一次发送心跳的时间
+	electionDeadline time.Time
+	heartbeatDue     time.Time
+	proposals        map[uint64]*proposal //等待应用的写入
+	restoreSnapshot  bool                 //收到了新的快照，需要用快照替换数据库
+	transfer         snapshotTransfer     //正在接收的快照
+	transferOffset   int64                //已经收到的快照的大小
+	applyCond        *sync.Cond
+	closed           bool
+
+	dbLock *sync.RWMutex //替换数据库时加写锁
+	db     *bitcast_go.DB
+	wg     *sync.WaitGroup
+}
+
+type proposal struct {
+	term   uint64
+	result chan error
+}
+
+// NewNode 打开数据目录中的raft状态和数据库，启动节点
+func NewNode(config Config) (*Node, error) {
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	logOptions := bitcast_go.DefaultOptions
+	logOptions.DirPath = filepath.Join(config.DirPath, logDirName)
+	logOptions.SyncWrites = true
+	logDB, err := bitcast_go.Open(logOptions)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		id:          config.ID,
+		config:      config,
+		transport:   config.Transport,
+		logStore:    &logStore{db: logDB},
+		mu:          new(sync.Mutex),
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		inflight:    make(map[string]bool),
+		lastContact: make(map[string]time.Time),
+		proposals:   make(map[uint64]*proposal),
+		dbLock:      new(sync.RWMutex),
+		wg:          new(sync.WaitGroup),
+	}
+	n.applyCond = sync.NewCond(n.mu)
+	for _, peer := range config.Peers {
+		if peer != config.ID {
+			n.peers = append(n.peers, peer)
+		}
+	}
+	if err := n.load(); err != nil {
+		_ = logDB.Close()
+		return nil, err
+	}
+
+	n.resetElectionDeadline()
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+func checkConfig(config Config) error {
+	if config.ID == "" || config.DirPath == "" || config.Transport == nil {
+		return errors.New("raft node id, dir path and transport are required")
+	}
+	var found bool
+	for _, peer := range config.Peers {
+		found = found || peer == config.ID
+	}
+	if !found {
+		return errors.New("raft peers must contain the node itself")
+	}
+	if config.ElectionTimeout <= 0 || config.HeartbeatInterval <= 0 || config.HeartbeatInterval >= config.ElectionTimeout {
+		return errors.New("raft heartbeat interval must be greater than 0 and less than election timeout")
+	}
+	if config.SnapshotThreshold == 0 || config.MaxEntriesPerRequest <= 0 || config.SnapshotChunkSize <= 0 {
+		return errors.New("raft snapshot threshold, max entries per request and snapshot chunk size must be greater than 0")
+	}
+	//需要在磁盘上创建和替换检查点
+	if config.DBOptions.InMemory {
+		return errors.New("raft does not support in-memory database")
+	}
+	return nil
+}
+
+// 加载持久化的状态，数据库落后于快照时（例如替换数据库的过程中崩溃了）用快照恢复数据库
+func (n *Node) load() error {
+	state, err := n.logStore.load()
+	if err != nil {
+		return err
+	}
+	n.term, n.vote = state.term, state.vote
+	if n.snapshot, err = loadSnapshotMeta(n.config.DirPath); err != nil {
+		return err
+	}
+	//创建快照之后还没有来得及清理的日志
+	for _, entry := range state.entries {
+		if entry.Index > n.snapshot.index {
+			n.log = append(n.log, entry)
+		}
+	}
+	if len(n.log) < len(state.entries) {
+		if err := n.logStore.replace(state.entries[0].Index, n.snapshot.index, nil); err != nil {
+			return err
+		}
+	}
+
+	dataDir := filepath.Join(n.config.DirPath, dataDirName)
+	_, statErr := os.Stat(dataDir)
+	if n.snapshot.index > 0 && (state.dataIndex < n.snapshot.index || os.IsNotExist(statErr)) {
+		if err := restoreDataDir(n.config.DirPath, n.snapshot); err != nil {
+			return err
+		}
+		if err := n.logStore.setDataIndex(n.snapshot.index); err != nil {
+			return err
+		}
+	}
+	dbOptions := n.config.DBOptions
+	dbOptions.DirPath = dataDir
+	if n.db, err = bitcast_go.Open(dbOptions); err != nil {
+		return err
+	}
+	//数据库中记录的应用位置和应用的写入在同一个事务中提交，从这个位置之后继续应用，不会在更新的数据上重新应用旧的日志
+	//之前的版本创建的快照中没有记录应用位置，从快照的位置开始应用
+	applied, err := loadAppliedIndex(n.db)
+	if err != nil {
+		_ = n.db.Close()
+		return err
+	}
+	if applied < n.snapshot.index {
+		applied = n.snapshot.index
+	}
+	if applied > n.lastIndex() {
+		_ = n.db.Close()
+		return selferror.ErrDataDirectoryCorrupte
+	}
+	n.commitIndex, n.lastApplied = applied, applied
+	return nil
+}
+
+// Put 通过raft日志写入数据，应用到leader的数据库之后返回
+func (n *Node) Put(key []byte, value []byte) error {
+	return n.PutCtx(context.Background(), key, value)
+}
+
+// PutCtx 和Put相同，ctx被取消时不再等待，写入可能已经生效
+func (n *Node) PutCtx(ctx context.Context, key []byte, value []byte) error {
+	return n.ApplyCtx(ctx, []Op{{Key: key, Value: value}})
+}
+
+// Delete 通过raft日志删除数据
+func (n *Node) Delete(key []byte) error {
+	return n.DeleteCtx(context.Background(), key)
+}
+
+func (n *Node) DeleteCtx(ctx context.Context, key []byte) error {
+	return n.ApplyCtx(ctx, []Op{{Delete: true, Key: key}})
+}
+
+// Apply 把多条操作写入一个日志条目，作为一个事务应用
+func (n *Node) Apply(ops []Op) error {
+	return n.ApplyCtx(context.Background(), ops)
+}
+
+// ApplyCtx 和Apply相同，不是leader时返回ErrNotLeader
+// 应用之前失去了leader的身份时返回ErrLeadershipLost，这时写入可能已经生效，也可能被丢弃
+func (n *Node) ApplyCtx(ctx context.Context, ops []Op) error {
+	for _, op := range ops {
+		if len(op.Key) == 0 {
+			return selferror.ErrKeyIsEmpty
+		}
+		if IsInternalKey(op.Key) {
+			return selferror.ErrRaftReservedKey
+		}
+	}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return selferror.ErrRaftClosed
+	}
+	if n.state != StateLeader {
+		n.mu.Unlock()
+		return selferror.ErrNotLeader
+	}
+	entry, err := n.appendEntry(encodeOps(ops))
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	p := &proposal{term: entry.Term, result: make(chan error, 1)}
+	n.proposals[entry.Index] = p
+	n.broadcast()
+	n.mu.Unlock()
+
+	select {
+	case err := <-p.result:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.proposals, entry.Index)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Get 读取本节点数据库中的数据，follower上读到的数据可能不是最新的
+func (n *Node) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := n.View(func(db *bitcast_go.DB) error {
+		var err error
+		value, err = db.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// View 在本节点的数据库上执行只读的操作，执行期间数据库不会被快照替换
+func (n *Node) View(fn func(db *bitcast_go.DB) error) error {
+	n.dbLock.RLock()
+	defer n.dbLock.RUnlock()
+	if n.db == nil {
+		return selferror.ErrRaftClosed
+	}
+	return fn(n.db)
+}
+
+// Leader 当前已知的leader的id，不知道时为空
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Status 节点当前的状态
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastLogIndex:  n.lastIndex(),
+		SnapshotIndex: n.snapshot.index,
+		ApplyError:    n.applyErr,
+	}
+}
+
+// Close 停止节点，关闭数据库
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.failProposals(selferror.ErrRaftClosed)
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+
+	n.dbLock.Lock()
+	defer n.dbLock.Unlock()
+	var err error
+	if n.db != nil {
+		err = n.db.Close()
+		n.db = nil
+	}
+	if closeErr := n.logStore.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 定时检查选举超时，leader定时发送心跳
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		if n.state == StateLeader {
+			if !n.hasQuorumContact(now) {
+				//可能处于少数节点的分区中，让等待的写入尽快失败
+				_ = n.becomeFollower(n.term)
+				n.leader = ""
+				n.resetElectionDeadline()
+			} else if !now.Before(n.heartbeatDue) {
+				n.broadcast()
+			}
+		} else if !now.Before(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+//以下方法调用时都持有n.mu
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) hasQuorumContact(now time.Time) bool {
+	contacted := 1
+	for _, peer := range n.peers {
+		if now.Sub(n.lastContact[peer]) < n.config.ElectionTimeout {
+			contacted++
+		}
+	}
+	return contacted >= n.quorum()
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshot.index
+	}
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshot.term
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// 日志的任期，日志不存在或者已经被快照清理时返回0
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapshot.index {
+		return n.snapshot.term
+	}
+	if index < n.snapshot.index || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.snapshot.index-1].Term
+}
+
+// 从index开始的日志
+func (n *Node) entriesFrom(index uint64) []*LogEntry {
+	return n.log[index-n.snapshot.index-1:]
+}
+
+// 发现了更大的任期或者当前任期的leader时变为follower
+func (n *Node) becomeFollower(term uint64) error {
+	if n.state == StateLeader {
+		n.failProposals(selferror.ErrLeadershipLost)
+	}
+	n.state = StateFollower
+	if term > n.term {
+		n.term, n.vote, n.leader = term, "", ""
+		return n.logStore.setState(n.term, n.vote)
+	}
+	return nil
+}
+
+func (n *Node) failProposals(err error) {
+	for index, p := range n.proposals {
+		p.result <- err
+		delete(n.proposals, index)
+	}
+}
+
+func (n *Node) startElection() {
+	n.resetElectionDeadline()
+	if err := n.logStore.setState(n.term+1, n.id); err != nil {
+		return
+	}
+	n.state, n.term, n.vote, n.leader = StateCandidate, n.term+1, n.id, ""
+	n.votes = 1
+	if n.votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	args := &RequestVoteArgs{
+		Term:         n.term,
+		CandidateId:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go n.requestVote(peer, args)
+	}
+}
+
+func (n *Node) requestVote(peer string, args *RequestVoteArgs) {
+	defer n.wg.Done()
+	reply, err := n.transport.RequestVote(peer, args)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	if reply.Term > n.term {
+		_ = n.becomeFollower(reply.Term)
+		return
+	}
+	if n.state != StateCandidate || n.term != args.Term || !reply.VoteGranted {
+		return
+	}
+	n.votes++
+	if n.votes >= n.quorum() {
+		n.becomeLeader()
+	}
+}
+
+// 成为leader之后先写入一条空的日志，提交这条日志的同时提交之前任期的日志
+func (n *Node) becomeLeader() {
+	n.state, n.leader = StateLeader, n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.lastContact[peer] = time.Now()
+	}
+	if _, err := n.appendEntry(nil); err != nil {
+		_ = n.becomeFollower(n.term)
+		return
+	}
+	n.broadcast()
+}
+
+// leader追加一条日志
+func (n *Node) appendEntry(data []byte) (*LogEntry, error) {
+	entry := &LogEntry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	if err := n.logStore.replace(1, 0, []*LogEntry{entry}); err != nil {
+		return nil, err
+	}
+	n.log = append(n.log, entry)
+	//只有一个节点时直接提交
+	n.advanceCommitIndex()
+	return entry, nil
+}
+
+// 向所有没有正在发送的节点发送日志或者心跳
+func (n *Node) broadcast() {
+	n.heartbeatDue = time.Now().Add(n.config.HeartbeatInterval)
+	for _, peer := range n.peers {
+		if n.inflight[peer] {
+			continue
+		}
+		n.inflight[peer] = true
+		n.wg.Add(1)
+		go n.replicate(peer)
+	}
+}
+
+// 向节点发送日志，直到节点追上了leader或者发送失败
+func (n *Node) replicate(peer string) {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer func() { n.inflight[peer] = false }()
+	for !n.closed && n.state == StateLeader {
+		var more bool
+		if n.nextIndex[peer] <= n.snapshot.index {
+			more = n.sendSnapshot(peer)
+		} else {
+			more = n.sendEntries(peer)
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// 发送日志，还有需要发送的日志时返回true
+func (n *Node) sendEntries(peer string) bool {
+	prevIndex := n.nextIndex[peer] - 1
+	entries := n.entriesFrom(prevIndex + 1)
+	if len(entries) > n.config.MaxEntriesPerRequest {
+		entries = entries[:n.config.MaxEntriesPerRequest]
+	}
+	args := &AppendEntriesArgs{
+		Term:         n.term,
+		LeaderId:     n.id,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  n.termAt(prevIndex),
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+	reply, err := n.transport.AppendEntries(peer, args)
+	n.mu.Lock()
+	if err != nil || !n.checkReplyTerm(peer, reply.Term, args.Term) {
+		return false
+	}
+	if !reply.Success {
+		n.nextIndex[peer] = reply.ConflictIndex
+		if n.nextIndex[peer] < 1 {
+			n.nextIndex[peer] = 1
+		}
+		if n.nextIndex[peer] > n.lastIndex()+1 {
+			n.nextIndex[peer] = n.lastIndex() + 1
+		}
+		return true
+	}
+	n.updateMatchIndex(peer, prevIndex+uint64(len(entries)))
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// 发送快照，还有需要发送的日志时返回true
+func (n *Node) sendSnapshot(peer string) bool {
+	meta := n.snapshot
+	term := n.term
+	n.mu.Unlock()
+	//边打包边发送，打包期间快照可能被新的快照替换，下一次心跳时重试
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(packSnapshot(filepath.Join(n.config.DirPath, snapshotDirName(meta)), pw))
+	}()
+	defer pr.Close()
+
+	buf := make([]byte, n.config.SnapshotChunkSize)
+	var offset int64
+	for {
+		size, err := io.ReadFull(pr, buf)
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			n.mu.Lock()
+			return false
+		}
+		args := &InstallSnapshotArgs{
+			Term:              term,
+			LeaderId:          n.id,
+			LastIncludedIndex: meta.index,
+			LastIncludedTerm:  meta.term,
+			Offset:            offset,
+			Data:              buf[:size],
+			Done:              done,
+		}
+		reply, err := n.transport.InstallSnapshot(peer, args)
+		n.mu.Lock()
+		if err != nil || !n.checkReplyTerm(peer, reply.Term, args.Term) || !reply.Success {
+			return false
+		}
+		if done {
+			break
+		}
+		n.mu.Unlock()
+		offset += int64(size)
+	}
+	n.updateMatchIndex(peer, meta.index)
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// 回复中有更大的任期时变为follower，回复过期时返回false
+func (n *Node) checkReplyTerm(peer string, replyTerm, requestTerm uint64) bool {
+	if replyTerm > n.term {
+		_ = n.becomeFollower(replyTerm)
+		return false
+	}
+	if n.closed || n.state != StateLeader || n.term != requestTerm {
+		return false
+	}
+	n.lastContact[peer] = time.Now()
+	return true
+}
+
+func (n *Node) updateMatchIndex(peer string, index uint64) {
+	if index > n.matchIndex[peer] {
+		n.matchIndex[peer] = index
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommitIndex()
+}
+
+// 当前任期的日志复制到多数节点之后提交，之前的日志随之提交
+func (n *Node) advanceCommitIndex() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		replicas := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				replicas++
+			}
+		}
+		if replicas >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// HandleRequestVote 处理候选者的投票请求
+func (n *Node) HandleRequestVote(args *RequestVoteArgs) *RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := &RequestVoteReply{Term: n.term}
+	if n.closed || args.Term < n.term {
+		return reply
+	}
+	if args.Term > n.term {
+		if err := n.becomeFollower(args.Term); err != nil {
+			return reply
+		}
+		reply.Term = n.term
+	}
+	//候选者的日志至少和自己一样新时才投票
+	upToDate := args.LastLogTerm > n.lastTerm() || (args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if (n.vote == "" || n.vote == args.CandidateId) && upToDate {
+		if err := n.logStore.setState(n.term, args.CandidateId); err != nil {
+			return reply
+		}
+		n.vote = args.CandidateId
+		reply.VoteGranted = true
+		n.resetElectionDeadline()
+	}
+	return reply
+}
+
+// HandleAppendEntries 处理leader复制的日志和心跳
+func (n *Node) HandleAppendEntries(args *AppendEntriesArgs) *AppendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := &AppendEntriesReply{Term: n.term}
+	if n.closed || args.Term < n.term {
+		return reply
+	}
+	if err := n.becomeFollower(args.Term); err != nil {
+		return reply
+	}
+	reply.Term = n.term
+	n.leader = args.LeaderId
+	n.resetElectionDeadline()
+
+	//已经被快照包含的日志一定是已经提交的，跳过
+	prevIndex, prevTerm, entries := args.PrevLogIndex, args.PrevLogTerm, args.Entries
+	if prevIndex < n.snapshot.index {
+		skip := n.snapshot.index - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prevIndex, prevTerm, entries = n.snapshot.index, n.snapshot.term, entries[skip:]
+	}
+	if prevIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply
+	}
+	if term := n.termAt(prevIndex); term != prevTerm {
+		//跳过冲突的任期中的所有日志
+		index := prevIndex
+		for index-1 > n.snapshot.index && n.termAt(index-1) == term {
+			index--
+		}
+		reply.ConflictIndex = index
+		return reply
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() && n.termAt(entry.Index) == entry.Term {
+			continue
+		}
+		//删除冲突的日志，追加新的日志
+		if err := n.logStore.replace(entry.Index, n.lastIndex(), entries[i:]); err != nil {
+			reply.ConflictIndex = entry.Index
+			return reply
+		}
+		n.log = append(n.log[:entry.Index-n.snapshot.index-1], entries[i:]...)
+		break
+	}
+	reply.Success = true
+
+	lastNewIndex := args.PrevLogIndex + uint64(len(args.Entries))
+	if args.LeaderCommit > n.commitIndex && lastNewIndex > n.commitIndex {
+		n.commitIndex = args.LeaderCommit
+		if lastNewIndex < n.commitIndex {
+			n.commitIndex = lastNewIndex
+		}
+		n.applyCond.Broadcast()
+	}
+	return reply
+}
+
+// HandleInstallSnapshot 处理leader发送的快照
+func (n *Node) HandleInstallSnapshot(args *InstallSnapshotArgs) *InstallSnapshotReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := &InstallSnapshotReply{Term: n.term}
+	if n.closed || args.Term < n.term {
+		return reply
+	}
+	if err := n.becomeFollower(args.Term); err != nil {
+		return reply
+	}
+	reply.Term = n.term
+	n.leader = args.LeaderId
+	n.resetElectionDeadline()
+	if args.LastIncludedIndex <= n.snapshot.index {
+		reply.Success = true
+		return reply
+	}
+
+	//同一个leader在同一个任期中发送的同一个快照的块需要按照顺序收到，否则从头重新接收
+	meta := snapshotMeta{index: args.LastIncludedIndex, term: args.LastIncludedTerm}
+	transfer := snapshotTransfer{leader: args.LeaderId, term: args.Term, meta: meta}
+	tempFile := filepath.Join(n.config.DirPath, snapshotTempFile)
+	if args.Offset == 0 {
+		_ = os.Remove(tempFile)
+		n.transfer = transfer
+	} else if n.transfer != transfer || n.transferOffset != args.Offset {
+		return reply
+	}
+	if err := appendSnapshotChunk(tempFile, args.Data); err != nil {
+		n.transfer = snapshotTransfer{}
+		return reply
+	}
+	n.transferOffset = args.Offset + int64(len(args.Data))
+	if !args.Done {
+		reply.Success = true
+		return reply
+	}
+	n.transfer = snapshotTransfer{}
+
+	tempDir := filepath.Join(n.config.DirPath, snapshotTempDir)
+	_ = os.RemoveAll(tempDir)
+	if err := unpackSnapshotFile(tempFile, tempDir); err != nil {
+		return reply
+	}
+	if err := os.Rename(tempDir, filepath.Join(n.config.DirPath, snapshotDirName(meta))); err != nil {
+		return reply
+	}
+
+	//快照之后的日志和leader一致时保留，否则全部丢弃
+	var retained []*LogEntry
+	if n.termAt(meta.index) == meta.term {
+		retained = n.entriesFrom(meta.index + 1)
+	}
+	removeTo := n.lastIndex()
+	if len(retained) > 0 {
+		removeTo = meta.index
+	}
+	if err := n.logStore.replace(n.snapshot.index+1, removeTo, nil); err != nil {
+		return reply
+	}
+	n.log, n.snapshot = retained, meta
+	if n.commitIndex < meta.index {
+		n.commitIndex = meta.index
+	}
+	if n.lastApplied < meta.index {
+		n.restoreSnapshot = true
+		n.applyCond.Broadcast()
+	}
+	reply.Success = true
+	return reply
+}
+
+// 按照顺序把提交的日志应用到数据库，数据库的修改都在这里完成
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.closed && !n.restoreSnapshot && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.closed {
+			return
+		}
+
+		if n.restoreSnapshot {
+			meta := n.snapshot
+			n.restoreSnapshot = false
+			n.mu.Unlock()
+			err := n.installSnapshot(meta)
+			n.mu.Lock()
+			if err != nil {
+				//稍后重试
+				n.restoreSnapshot = true
+				n.mu.Unlock()
+				time.Sleep(n.config.HeartbeatInterval)
+				n.mu.Lock()
+				continue
+			}
+			if n.lastApplied < meta.index {
+				n.lastApplied = meta.index
+			}
+			continue
+		}
+
+		entries := n.log[n.lastApplied-n.snapshot.index : n.commitIndex-n.snapshot.index]
+		n.mu.Unlock()
+		//应用失败时停在失败的日志，之后的日志不能跳过它先应用，否则各个节点的数据会不一致
+		var applyErr error
+		n.dbLock.RLock()
+		for i, entry := range entries {
+			if applyErr = applyEntry(n.db, entry, n.config.DBOptions.SyncWrites); applyErr != nil {
+				entries = entries[:i]
+				break
+			}
+		}
+		n.dbLock.RUnlock()
+		n.mu.Lock()
+		n.applyErr = applyErr
+
+		for _, entry := range entries {
+			if p := n.proposals[entry.Index]; p != nil {
+				delete(n.proposals, entry.Index)
+				if p.term == entry.Term {
+					p.result <- nil
+				} else {
+					p.result <- selferror.ErrLeadershipLost
+				}
+			}
+		}
+		if len(entries) > 0 && entries[len(entries)-1].Index > n.lastApplied {
+			n.lastApplied = entries[len(entries)-1].Index
+		}
+		if applyErr != nil {
+			//稍后从失败的日志开始重试，对应的提议一直等待到应用成功
+			n.mu.Unlock()
+			time.Sleep(n.config.HeartbeatInterval)
+			n.mu.Lock()
+			continue
+		}
+		if !n.restoreSnapshot && n.lastApplied-n.snapshot.index >= n.config.SnapshotThreshold {
+			n.takeSnapshot()
+		}
+	}
+}
+
+// 用快照替换数据库，调用时没有持有n.mu
+func (n *Node) installSnapshot(meta snapshotMeta) error {
+	n.dbLock.Lock()
+	defer n.dbLock.Unlock()
+	if n.db != nil {
+		if err := n.db.Close(); err != nil {
+			return err
+		}
+		n.db = nil
+	}
+	if err := restoreDataDir(n.config.DirPath, meta); err != nil {
+		return err
+	}
+	dbOptions := n.config.DBOptions
+	dbOptions.DirPath = filepath.Join(n.config.DirPath, dataDirName)
+	db, err := bitcast_go.Open(dbOptions)
+	if err != nil {
+		return err
+	}
+	n.db = db
+	_ = removeOldSnapshots(n.config.DirPath, meta)
+	return n.logStore.setDataIndex(meta.index)
+}
+
+// 为已经应用的日志创建快照，并清理快照包含的日志
+func (n *Node) takeSnapshot() {
+	meta := snapshotMeta{index: n.lastApplied, term: n.termAt(n.lastApplied)}
+	tempDir := filepath.Join(n.config.DirPath, checkpointTempDir)
+	n.mu.Unlock()
+	_ = os.RemoveAll(tempDir)
+	n.dbLock.RLock()
+	err := n.db.Checkpoint(tempDir)
+	n.dbLock.RUnlock()
+	n.mu.Lock()
+	//创建期间收到了leader发送的更新的快照
+	if err != nil || meta.index <= n.snapshot.index {
+		_ = os.RemoveAll(tempDir)
+		return
+	}
+	if err := os.Rename(tempDir, filepath.Join(n.config.DirPath, snapshotDirName(meta))); err != nil {
+		return
+	}
+	if err := n.logStore.setDataIndex(meta.index); err != nil {
+		return
+	}
+	if err := n.logStore.replace(n.snapshot.index+1, meta.index, nil); err != nil {
+		return
+	}
+	n.log = append([]*LogEntry{}, n.entriesFrom(meta.index+1)...)
+	n.snapshot = meta
+	_ = removeOldSnapshots(n.config.DirPath, meta)
+}
@@ -0,0 +1,304 @@
+package raft
+
+import (
+	bitcast_go "bitcast-go"
+	"bitcast-go/fio"
+	"bitcast-go/selferror"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCluster struct {
+	t       *testing.T
+	network *InmemNetwork
+	ids     []string
+	dir     string
+	nodes   map[string]*Node
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	dir, _ := os.MkdirTemp("", "bitcask-go-raft")
+	c := &testCluster{t: t, network: NewInmemNetwork(), dir: dir, nodes: make(map[string]*Node)}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("node-%d", i))
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			_ = node.Close()
+		}
+		_ = os.RemoveAll(dir)
+	})
+	return c
+}
+
+func (c *testCluster) start(id string) {
+	config := DefaultConfig
+	config.ID = id
+	config.Peers = c.ids
+	config.DirPath = filepath.Join(c.dir, id)
+	config.Transport = c.network.Transport(id)
+	config.ElectionTimeout = 150 * time.Millisecond
+	config.HeartbeatInterval = 30 * time.Millisecond
+	config.SnapshotThreshold = 50
+	config.MaxEntriesPerRequest = 20
+	config.SnapshotChunkSize = 4096
+	node, err := NewNode(config)
+	assert.Nil(c.t, err)
+	c.network.Register(node)
+	c.nodes[id] = node
+}
+
+func (c *testCluster) stop(id string) {
+	c.network.Unregister(id)
+	assert.Nil(c.t, c.nodes[id].Close())
+	delete(c.nodes, id)
+}
+
+// 等待ids中的节点选出leader
+func (c *testCluster) waitLeader(ids ...string) *Node {
+	var leader *Node
+	waitFor(c.t, func() bool {
+		for _, id := range ids {
+			node := c.nodes[id]
+			if node.Status().State == StateLeader {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// 等待ids中的节点都应用了leader提交的日志，并且数据一致
+func (c *testCluster) waitConsistent(expected map[string]string, ids ...string) {
+	waitFor(c.t, func() bool {
+		for _, id := range ids {
+			actual := make(map[string]string)
+			_ = c.nodes[id].View(func(db *bitcast_go.DB) error {
+				return db.Fold(func(key []byte, value []byte) bool {
+					if IsInternalKey(key) {
+						return true
+					}
+					actual[string(key)] = string(value)
+					return true
+				})
+			})
+			if len(actual) != len(expected) {
+				return false
+			}
+			for key, value := range expected {
+				if actual[key] != value {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("raft-key-%09d", i))
+}
+
+func TestRaft_Replication(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.waitLeader(c.ids...)
+	expected := make(map[string]string)
+	for i := 0; i < 120; i++ {
+		value := fmt.Sprintf("value-%d", i)
+		assert.Nil(t, leader.Put(testKey(i), []byte(value)))
+		expected[string(testKey(i))] = value
+	}
+	assert.Nil(t, leader.Delete(testKey(0)))
+	delete(expected, string(testKey(0)))
+	assert.Nil(t, leader.Apply([]Op{
+		{Key: testKey(1), Value: []byte("batch")},
+		{Key: testKey(2), Delete: true},
+	}))
+	expected[string(testKey(1))] = "batch"
+	delete(expected, string(testKey(2)))
+	c.waitConsistent(expected, c.ids...)
+
+	//写入只能通过leader
+	for _, id := range c.ids {
+		node := c.nodes[id]
+		if node != leader {
+			assert.Equal(t, selferror.ErrNotLeader, node.Put(testKey(1000), []byte("value")))
+			assert.Equal(t, leader.id, node.Leader())
+		}
+	}
+	assert.Equal(t, selferror.ErrKeyIsEmpty, leader.Put(nil, []byte("value")))
+
+	//应用的日志超过阈值之后创建了快照并清理了日志
+	for _, id := range c.ids {
+		assert.Greater(t, c.nodes[id].Status().SnapshotIndex, uint64(0))
+	}
+
+	//重启之后从快照和日志中恢复
+	follower := c.ids[0]
+	if c.nodes[follower] == leader {
+		follower = c.ids[1]
+	}
+	status := c.nodes[follower].Status()
+	c.stop(follower)
+	assert.Nil(t, leader.Put(testKey(200), []byte("value-200")))
+	expected[string(testKey(200))] = "value-200"
+	c.start(follower)
+	//从数据库中记录的应用位置继续应用，不会回退到快照的位置
+	assert.GreaterOrEqual(t, c.nodes[follower].Status().LastApplied, status.LastApplied)
+	c.waitConsistent(expected, c.ids...)
+
+	//raft内部使用的key不能写入
+	assert.Equal(t, selferror.ErrRaftReservedKey, leader.Put(appliedIndexKey, []byte("value")))
+}
+
+func TestRaft_Partition(t *testing.T) {
+	c := newTestCluster(t, 3)
+	oldLeader := c.waitLeader(c.ids...)
+	expected := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		value := fmt.Sprintf("value-%d", i)
+		assert.Nil(t, oldLeader.Put(testKey(i), []byte(value)))
+		expected[string(testKey(i))] = value
+	}
+	c.waitConsistent(expected, c.ids...)
+
+	//leader被隔离在少数节点的分区中，多数节点选出新的leader
+	var majority []string
+	for _, id := range c.ids {
+		if id != oldLeader.id {
+			majority = append(majority, id)
+		}
+	}
+	c.network.Partition([]string{oldLeader.id}, majority)
+
+	//少数节点的分区中的写入不能提交
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := oldLeader.PutCtx(ctx, testKey(0), []byte("lost"))
+	cancel()
+	assert.Equal(t, selferror.ErrLeadershipLost, err)
+	assert.Equal(t, selferror.ErrNotLeader, oldLeader.Put(testKey(0), []byte("lost")))
+
+	newLeader := c.waitLeader(majority...)
+	assert.Greater(t, newLeader.Status().Term, uint64(1))
+	//足够多的写入，旧的leader恢复之后需要接收快照
+	for i := 10; i < 200; i++ {
+		value := fmt.Sprintf("value-%d", i)
+		assert.Nil(t, newLeader.Put(testKey(i), []byte(value)))
+		expected[string(testKey(i))] = value
+	}
+	c.waitConsistent(expected, majority...)
+	assert.Greater(t, newLeader.Status().SnapshotIndex, oldLeader.Status().LastLogIndex)
+
+	//恢复网络之后旧的leader丢弃没有提交的日志，追上新的leader
+	c.network.Heal()
+	c.waitConsistent(expected, c.ids...)
+	leader := c.waitLeader(c.ids...)
+	assert.Nil(t, leader.Put(testKey(200), []byte("value-200")))
+	expected[string(testKey(200))] = "value-200"
+	c.waitConsistent(expected, c.ids...)
+	value, err := oldLeader.Get(testKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-0"), value)
+}
+
+func TestRaft_SingleNode(t *testing.T) {
+	c := newTestCluster(t, 1)
+	leader := c.waitLeader(c.ids...)
+	assert.Nil(t, leader.Put(testKey(0), []byte("value-0")))
+	value, err := leader.Get(testKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-0"), value)
+
+	c.stop(leader.id)
+	c.start(leader.id)
+	leader = c.waitLeader(c.ids...)
+	value, err = leader.Get(testKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-0"), value)
+}
+
+// 数据目录中的文件在fail为true时写入失败
+type failingIO struct {
+	fio.IOManager
+	fail *atomic.Bool
+}
+
+func (f *failingIO) Write(b []byte) (int, error) {
+	if f.fail.Load() {
+		return 0, errors.New("injected write failure")
+	}
+	return f.IOManager.Write(b)
+}
+
+func TestRaft_ApplyRetry(t *testing.T) {
+	fail := new(atomic.Bool)
+	dir, _ := os.MkdirTemp("", "bitcask-go-raft-apply")
+	dataDir := filepath.Join(dir, "node-0", dataDirName)
+	fio.SetIoManagerHook(func(fileName string, ioManager fio.IOManager) fio.IOManager {
+		if strings.HasPrefix(fileName, dataDir) {
+			return &failingIO{IOManager: ioManager, fail: fail}
+		}
+		return ioManager
+	})
+	defer fio.SetIoManagerHook(nil)
+
+	c := &testCluster{t: t, network: NewInmemNetwork(), ids: []string{"node-0"}, dir: dir, nodes: make(map[string]*Node)}
+	c.start("node-0")
+	defer func() {
+		_ = c.nodes["node-0"].Close()
+		_ = os.RemoveAll(dir)
+	}()
+	leader := c.waitLeader(c.ids...)
+	assert.Nil(t, leader.Put(testKey(0), []byte("value-0")))
+
+	//应用失败时停在失败的日志上，之后的日志不会先被应用
+	fail.Store(true)
+	results := make(chan error, 2)
+	go func() {
+		results <- leader.Put(testKey(1), []byte("value-1"))
+	}()
+	waitFor(t, func() bool {
+		return leader.Status().ApplyError != nil
+	})
+	go func() {
+		results <- leader.Put(testKey(1), []byte("value-2"))
+	}()
+	waitFor(t, func() bool {
+		status := leader.Status()
+		return status.CommitIndex == status.LastApplied+2
+	})
+	_, err := leader.Get(testKey(1))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+
+	//恢复之后按照顺序应用
+	fail.Store(false)
+	assert.Nil(t, <-results)
+	assert.Nil(t, <-results)
+	assert.Nil(t, leader.Status().ApplyError)
+	value, err := leader.Get(testKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-2"), value)
+}
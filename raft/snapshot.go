@@ -0,0 +1,204 @@
+package raft
+
+import (
+	"archive/tar"
+	"bitcast-go/utils"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//快照是数据库的检查点，保存在 snapshot-<日志位置>-<任期> 目录中，目录可以直接作为数据目录打开
+//发送给其他节点时把目录打包成tar，分成多个块依次发送，接收方先把收到的块追加到临时文件中，收完之后再解压
+
+const (
+	snapshotDirPrefix = "snapshot-"
+	snapshotTempDir   = "snapshot-temp"     //接收其他节点发送的快照
+	snapshotTempFile  = "snapshot-temp.tar" //正在接收的快照的tar
+	checkpointTempDir = "checkpoint-temp"   //在本地创建快照
+	dataDirName       = "data"
+	restoreDirName    = "data-restore"
+	logDirName        = "raft"
+)
+
+type snapshotMeta struct {
+	index uint64
+	term  uint64
+}
+
+func snapshotDirName(meta snapshotMeta) string {
+	return fmt.Sprintf("%s%020d-%020d", snapshotDirPrefix, meta.index, meta.term)
+}
+
+// 找到最新的快照，删除之前的快照和没有完成的临时目录
+func loadSnapshotMeta(dirPath string) (snapshotMeta, error) {
+	_ = os.RemoveAll(filepath.Join(dirPath, snapshotTempDir))
+	_ = os.Remove(filepath.Join(dirPath, snapshotTempFile))
+	_ = os.RemoveAll(filepath.Join(dirPath, checkpointTempDir))
+	metas, err := listSnapshots(dirPath)
+	if err != nil {
+		return snapshotMeta{}, err
+	}
+	var latest snapshotMeta
+	for _, meta := range metas {
+		if meta.index > latest.index {
+			latest = meta
+		}
+	}
+	return latest, removeOldSnapshots(dirPath, latest)
+}
+
+func listSnapshots(dirPath string) ([]snapshotMeta, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var metas []snapshotMeta
+	for _, entry := range entries {
+		var meta snapshotMeta
+		if _, err := fmt.Sscanf(entry.Name(), snapshotDirPrefix+"%d-%d", &meta.index, &meta.term); err != nil {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// 删除latest之前的快照
+func removeOldSnapshots(dirPath string, latest snapshotMeta) error {
+	metas, err := listSnapshots(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		if meta.index < latest.index {
+			if err := os.RemoveAll(filepath.Join(dirPath, snapshotDirName(meta))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 把快照目录打包成tar写入w，文件的内容直接拷贝，不会全部读到内存中
+func packSnapshot(dir string, w io.Writer) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := packSnapshotFile(tw, filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func packSnapshotFile(tw *tar.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: filepath.Base(path), Mode: 0644, Size: info.Size()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// 把收到的快照解压到dir中
+func unpackSnapshot(r io.Reader, dir string) (err error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		//只能是快照目录中的文件，避免写到目录之外
+		if header.Name != filepath.Base(header.Name) || strings.HasPrefix(header.Name, ".") {
+			return errInvalidSnapshot
+		}
+		if err := writeSnapshotFile(filepath.Join(dir, header.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// 把收到的一块快照追加到临时文件中
+func appendSnapshotChunk(path string, chunk []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(chunk); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 解压临时文件中收完的快照，之后删除临时文件
+func unpackSnapshotFile(path string, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = unpackSnapshot(file, dir)
+	_ = file.Close()
+	_ = os.Remove(path)
+	return err
+}
+
+func writeSnapshotFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 用快照替换数据目录，先拷贝到临时目录再改名，中途失败时数据目录要么是旧的数据要么不存在
+// 快照目录中的文件不能被修改，所以拷贝而不是硬链接
+func restoreDataDir(dirPath string, meta snapshotMeta) error {
+	restoreDir := filepath.Join(dirPath, restoreDirName)
+	dataDir := filepath.Join(dirPath, dataDirName)
+	_ = os.RemoveAll(restoreDir)
+	if err := utils.CopyDir(filepath.Join(dirPath, snapshotDirName(meta)), restoreDir, []string{"flock"}); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dataDir); err != nil {
+		return err
+	}
+	return os.Rename(restoreDir, dataDir)
+}
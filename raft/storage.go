@@ -0,0 +1,150 @@
+package raft
+
+import (
+	bitcast_go "bitcast-go"
+	"bitcast-go/selferror"
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// LogEntry raft日志中的一个条目
+type LogEntry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte //编码之后的写入操作
+}
+
+//raft的持久化状态和日志保存在一个单独的bitcask实例中
+var (
+	termKey      = []byte("raft-term")
+	voteKey      = []byte("raft-vote")
+	dataIndexKey = []byte("raft-data-index") //数据库中至少已经应用到的日志位置
+	logKeyPrefix = []byte("raft-log-")
+)
+
+type logStore struct {
+	db *bitcast_go.DB
+}
+
+func logKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, logKeyPrefix...), index)
+}
+
+func encodeEntry(entry *LogEntry) []byte {
+	buf := binary.AppendUvarint(nil, entry.Term)
+	return append(buf, entry.Data...)
+}
+
+func decodeEntry(key, value []byte) (*LogEntry, error) {
+	term, n := binary.Uvarint(value)
+	if n <= 0 || len(key) != len(logKeyPrefix)+8 {
+		return nil, selferror.ErrDataDirectoryCorrupte
+	}
+	return &LogEntry{
+		Index: binary.BigEndian.Uint64(key[len(logKeyPrefix):]),
+		Term:  term,
+		Data:  value[n:],
+	}, nil
+}
+
+// 持久化的状态
+type persistentState struct {
+	term      uint64
+	vote      string
+	dataIndex uint64
+	entries   []*LogEntry //按照位置排序
+}
+
+func (s *logStore) load() (*persistentState, error) {
+	state := &persistentState{}
+	var err error
+	if state.term, err = s.getUint64(termKey); err != nil {
+		return nil, err
+	}
+	if state.dataIndex, err = s.getUint64(dataIndexKey); err != nil {
+		return nil, err
+	}
+	vote, err := s.db.Get(voteKey)
+	if err != nil && err != selferror.ErrKeyNotFound {
+		return nil, err
+	}
+	state.vote = string(vote)
+
+	var decodeErr error
+	err = s.db.Fold(func(key []byte, value []byte) bool {
+		if !bytes.HasPrefix(key, logKeyPrefix) {
+			return true
+		}
+		var entry *LogEntry
+		if entry, decodeErr = decodeEntry(key, value); decodeErr != nil {
+			return false
+		}
+		state.entries = append(state.entries, entry)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	sort.Slice(state.entries, func(i, j int) bool {
+		return state.entries[i].Index < state.entries[j].Index
+	})
+	return state, nil
+}
+
+func (s *logStore) getUint64(key []byte) (uint64, error) {
+	value, err := s.db.Get(key)
+	if err == selferror.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, selferror.ErrDataDirectoryCorrupte
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func (s *logStore) setState(term uint64, vote string) error {
+	wb := s.newWriteBatch(2)
+	_ = wb.Put(termKey, binary.BigEndian.AppendUint64(nil, term))
+	if vote == "" {
+		_ = wb.Delete(voteKey)
+	} else {
+		_ = wb.Put(voteKey, []byte(vote))
+	}
+	return wb.Commit()
+}
+
+func (s *logStore) setDataIndex(index uint64) error {
+	return s.db.Put(dataIndexKey, binary.BigEndian.AppendUint64(nil, index))
+}
+
+// 删除[from, to]之间的日志，再追加新的日志，在一个事务中完成
+func (s *logStore) replace(from, to uint64, entries []*LogEntry) error {
+	wb := s.newWriteBatch(int(to-from+1) + len(entries))
+	for index := from; index <= to && from > 0; index++ {
+		if err := wb.Delete(logKey(index)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := wb.Put(logKey(entry.Index), encodeEntry(entry)); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+func (s *logStore) newWriteBatch(size int) *bitcast_go.WriteBatch {
+	opts := bitcast_go.DefaultWriteBatchOptions
+	opts.SyncWrites = true
+	if uint(size) > opts.MaxBatchNum {
+		opts.MaxBatchNum = uint(size)
+	}
+	return s.db.NewWriteBatch(opts)
+}
@@ -0,0 +1,239 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// RequestVoteArgs 候选者请求投票
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateId  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesArgs leader复制日志，没有日志时作为心跳
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderId     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []*LogEntry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	//失败时leader下一次从这个位置开始发送
+	ConflictIndex uint64
+}
+
+// InstallSnapshotArgs 需要的日志已经被快照清理掉时，leader发送整个快照，快照分成多个块依次发送
+type InstallSnapshotArgs struct {
+	Term              uint64
+	LeaderId          string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Offset            int64  //这一块在tar中的位置，为0时重新开始接收
+	Data              []byte //打包成tar的快照目录中的一块
+	Done              bool   //是否是最后一块
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+	//这一块是否已经接收，为false时leader之后从头重新发送
+	Success bool
+}
+
+// Transport 节点之间的通信，target是节点的id
+type Transport interface {
+	RequestVote(target string, args *RequestVoteArgs) (*RequestVoteReply, error)
+	AppendEntries(target string, args *AppendEntriesArgs) (*AppendEntriesReply, error)
+	InstallSnapshot(target string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error)
+}
+
+var errUnreachable = errors.New("raft node is unreachable")
+
+// InmemNetwork 进程内的网络，用于测试，可以模拟网络分区
+type InmemNetwork struct {
+	mu    *sync.RWMutex
+	nodes map[string]*Node
+	//节点所在的分区，不在同一个分区的节点之间不能通信，为空时所有节点都可以通信
+	partitions map[string]int
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		mu:    new(sync.RWMutex),
+		nodes: make(map[string]*Node),
+	}
+}
+
+// Transport 返回节点id使用的通信方式
+func (n *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{network: n, from: id}
+}
+
+// Register 节点创建之后注册到网络中，之后才能收到请求
+func (n *InmemNetwork) Register(node *Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[node.id] = node
+}
+
+// Unregister 从网络中移除节点，例如节点关闭之后
+func (n *InmemNetwork) Unregister(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.nodes, id)
+}
+
+// Partition 把节点划分到不同的分区中，没有列出的节点和所有节点都不能通信
+func (n *InmemNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			n.partitions[id] = i + 1
+		}
+	}
+}
+
+// Heal 恢复所有节点之间的通信
+func (n *InmemNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = nil
+}
+
+func (n *InmemNetwork) connect(from, to string) (*Node, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.partitions != nil && (n.partitions[from] == 0 || n.partitions[from] != n.partitions[to]) {
+		return nil, errUnreachable
+	}
+	node, ok := n.nodes[to]
+	if !ok {
+		return nil, errUnreachable
+	}
+	return node, nil
+}
+
+type inmemTransport struct {
+	network *InmemNetwork
+	from    string
+}
+
+// 发送请求和收到回复时都检查网络是否连通
+func (t *inmemTransport) call(target string, handle func(node *Node)) error {
+	node, err := t.network.connect(t.from, target)
+	if err != nil {
+		return err
+	}
+	handle(node)
+	_, err = t.network.connect(target, t.from)
+	return err
+}
+
+func (t *inmemTransport) RequestVote(target string, args *RequestVoteArgs) (reply *RequestVoteReply, err error) {
+	err = t.call(target, func(node *Node) { reply = node.HandleRequestVote(args) })
+	return reply, err
+}
+
+func (t *inmemTransport) AppendEntries(target string, args *AppendEntriesArgs) (reply *AppendEntriesReply, err error) {
+	err = t.call(target, func(node *Node) { reply = node.HandleAppendEntries(args) })
+	return reply, err
+}
+
+func (t *inmemTransport) InstallSnapshot(target string, args *InstallSnapshotArgs) (reply *InstallSnapshotReply, err error) {
+	err = t.call(target, func(node *Node) { reply = node.HandleInstallSnapshot(args) })
+	return reply, err
+}
+
+//通过http通信时，节点的id是http服务的地址，请求和回复使用json编码
+
+const (
+	requestVotePath     = "/raft/requestVote"
+	appendEntriesPath   = "/raft/appendEntries"
+	installSnapshotPath = "/raft/installSnapshot"
+)
+
+// HTTPTransport 通过http和其他节点通信
+type HTTPTransport struct {
+	client *http.Client
+}
+
+func NewHTTPTransport(client *http.Client) *HTTPTransport {
+	return &HTTPTransport{client: client}
+}
+
+func (t *HTTPTransport) post(target, path string, args interface{}, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post("http://"+target+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errUnreachable
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (t *HTTPTransport) RequestVote(target string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	reply := &RequestVoteReply{}
+	return reply, t.post(target, requestVotePath, args, reply)
+}
+
+func (t *HTTPTransport) AppendEntries(target string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	reply := &AppendEntriesReply{}
+	return reply, t.post(target, appendEntriesPath, args, reply)
+}
+
+func (t *HTTPTransport) InstallSnapshot(target string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	reply := &InstallSnapshotReply{}
+	return reply, t.post(target, installSnapshotPath, args, reply)
+}
+
+// RegisterHTTPHandlers 在mux中注册处理其他节点请求的方法
+func RegisterHTTPHandlers(mux *http.ServeMux, node *Node) {
+	mux.HandleFunc(requestVotePath, func(writer http.ResponseWriter, request *http.Request) {
+		args := &RequestVoteArgs{}
+		serveRPC(writer, request, args, func() interface{} { return node.HandleRequestVote(args) })
+	})
+	mux.HandleFunc(appendEntriesPath, func(writer http.ResponseWriter, request *http.Request) {
+		args := &AppendEntriesArgs{}
+		serveRPC(writer, request, args, func() interface{} { return node.HandleAppendEntries(args) })
+	})
+	mux.HandleFunc(installSnapshotPath, func(writer http.ResponseWriter, request *http.Request) {
+		args := &InstallSnapshotArgs{}
+		serveRPC(writer, request, args, func() interface{} { return node.HandleInstallSnapshot(args) })
+	})
+}
+
+func serveRPC(writer http.ResponseWriter, request *http.Request, args interface{}, handle func() interface{}) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewDecoder(request.Body).Decode(args); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(handle())
+}
@@ -0,0 +1,401 @@
+package replication
+
+import (
+	bitcast_go "bitcast-go"
+	"bitcast-go/data"
+	"bitcast-go/selferror"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// FollowerOptions 从节点的配置项
+type FollowerOptions struct {
+	//和主节点的连接断开之后，等待多久重新连接
+	RetryInterval time.Duration
+	//本地的数据已经应用到的主节点的位置，本地的数据库中没有记录位置时使用，都为nil时先从主节点获取全量快照
+	Position *bitcast_go.WatchPosition
+}
+
+var DefaultFollowerOptions = FollowerOptions{
+	RetryInterval: time.Second,
+}
+
+// FollowerState 从节点当前的状态
+type FollowerState struct {
+	Connected bool
+	Snapshots int                       //从主节点获取全量快照的次数
+	Position  *bitcast_go.WatchPosition //已经应用到的主节点的位置
+	LastError error                     //最近一次连接断开的原因
+}
+
+var errFollowerClosed = errors.New("the follower is closed")
+
+// 本地的数据库中记录已经应用到的主节点位置的key，和应用的数据在同一次写入中提交，读取时会被过滤掉
+var positionKey = []byte("\x00replication-position")
+
+// Follower 从节点，从主节点接收数据并按照顺序应用到本地的数据库，只提供只读的访问
+type Follower struct {
+	leaderAddr string
+	options    bitcast_go.Options
+	fopts      FollowerOptions
+	mu         *sync.RWMutex //保护db，替换快照时加写锁
+	db         *bitcast_go.DB
+	stateLock  *sync.Mutex
+	state      FollowerState
+	conn       net.Conn
+	closed     bool
+	done       chan struct{}
+	exited     chan struct{}
+	//还没有提交的事务中的数据
+	pending map[uint64][]*bitcast_go.WatchEvent
+}
+
+// NewFollower 打开本地的数据库，并在后台连接主节点接收数据
+func NewFollower(leaderAddr string, options bitcast_go.Options, fopts FollowerOptions) (*Follower, error) {
+	//需要在磁盘上替换整个数据目录
+	if options.InMemory {
+		return nil, errors.New("replication follower does not support in-memory database")
+	}
+	if fopts.RetryInterval <= 0 {
+		return nil, errors.New("retry interval must be greater than 0")
+	}
+	db, err := bitcast_go.Open(options)
+	if err != nil {
+		return nil, err
+	}
+	//重启之后从数据库中记录的位置继续接收，这个位置之前的数据一定已经写入了数据库
+	position, err := loadPosition(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if position == nil {
+		position = fopts.Position
+	}
+	f := &Follower{
+		leaderAddr: leaderAddr,
+		options:    options,
+		fopts:      fopts,
+		mu:         new(sync.RWMutex),
+		db:         db,
+		stateLock:  new(sync.Mutex),
+		state:      FollowerState{Position: position},
+		done:       make(chan struct{}),
+		exited:     make(chan struct{}),
+		pending:    make(map[uint64][]*bitcast_go.WatchEvent),
+	}
+	go f.run()
+	return f, nil
+}
+
+// Get 读取本地的数据
+func (f *Follower) Get(key []byte) ([]byte, error) {
+	if bytes.Equal(key, positionKey) {
+		return nil, selferror.ErrKeyNotFound
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.db.Get(key)
+}
+
+// ListKeys 本地所有的key
+func (f *Follower) ListKeys() [][]byte {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	keys := f.db.ListKeys()
+	for i, key := range keys {
+		if bytes.Equal(key, positionKey) {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+	return keys
+}
+
+// Fold 遍历本地所有的数据
+func (f *Follower) Fold(fn func(key []byte, value []byte) bool) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.db.Fold(func(key []byte, value []byte) bool {
+		if bytes.Equal(key, positionKey) {
+			return true
+		}
+		return fn(key, value)
+	})
+}
+
+// Position 已经应用到的主节点的位置，这个位置同时记录在本地的数据库中，重新创建从节点时会从这里继续接收
+func (f *Follower) Position() *bitcast_go.WatchPosition {
+	return f.State().Position
+}
+
+// State 从节点当前的状态
+func (f *Follower) State() FollowerState {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+	return f.state
+}
+
+// Close 断开和主节点的连接并关闭本地的数据库
+func (f *Follower) Close() error {
+	f.stateLock.Lock()
+	if f.closed {
+		f.stateLock.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	f.stateLock.Unlock()
+	<-f.exited
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.db == nil {
+		return nil
+	}
+	return f.db.Close()
+}
+
+func (f *Follower) run() {
+	defer close(f.exited)
+	for {
+		err := f.replicate()
+		f.stateLock.Lock()
+		f.state.Connected = false
+		f.state.LastError = err
+		f.conn = nil
+		f.stateLock.Unlock()
+		//没有提交的事务在重新连接之后会被重新发送
+		f.pending = make(map[uint64][]*bitcast_go.WatchEvent)
+		select {
+		case <-f.done:
+			return
+		case <-time.After(f.fopts.RetryInterval):
+		}
+	}
+}
+
+// 连接主节点并应用收到的数据，直到连接断开
+func (f *Follower) replicate() error {
+	conn, err := net.Dial("tcp", f.leaderAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	f.stateLock.Lock()
+	if f.closed {
+		f.stateLock.Unlock()
+		return errFollowerClosed
+	}
+	f.conn = conn
+	f.state.Connected = true
+	position := f.state.Position
+	f.stateLock.Unlock()
+
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if err := writeMessage(writer, messageHello, encodePosition(position)); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	for {
+		typ, payload, err := readMessage(reader)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case messageSnapshotBegin:
+			if err := f.installSnapshot(reader); err != nil {
+				return err
+			}
+		case messageEvent:
+			event, err := decodeEvent(payload)
+			if err != nil {
+				return err
+			}
+			applied, err := f.apply(event)
+			if err != nil {
+				return err
+			}
+			//没有更多收到的数据时再回复，合并多条数据的回复
+			if applied && reader.Buffered() == 0 {
+				if err := writeMessage(writer, messageAck, encodePosition(f.Position())); err != nil {
+					return err
+				}
+				if err := writer.Flush(); err != nil {
+					return err
+				}
+			}
+		default:
+			return errUnexpectedMessage
+		}
+	}
+}
+
+// 把快照恢复到临时目录，完整接收之后再替换本地的数据目录
+func (f *Follower) installSnapshot(reader *bufio.Reader) error {
+	snapshotDir := f.options.DirPath + "-snapshot"
+	_ = os.RemoveAll(snapshotDir)
+	pr, pw := io.Pipe()
+	restored := make(chan error, 1)
+	go func() {
+		err := bitcast_go.RestoreFrom(pr, snapshotDir)
+		//恢复失败时让接收的一方停下来
+		_ = pr.CloseWithError(err)
+		restored <- err
+	}()
+
+	//快照结束的消息中是快照对应的主节点的位置
+	var position *bitcast_go.WatchPosition
+	for {
+		typ, payload, err := readMessage(reader)
+		if err == nil && typ != messageSnapshotData && typ != messageSnapshotEnd {
+			err = errUnexpectedMessage
+		}
+		if err == nil && typ == messageSnapshotEnd {
+			position, err = decodePosition(payload)
+		}
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			<-restored
+			return err
+		}
+		if typ == messageSnapshotEnd {
+			break
+		}
+		if _, err := pw.Write(payload); err != nil {
+			return <-restored
+		}
+	}
+	_ = pw.Close()
+	if err := <-restored; err != nil {
+		return err
+	}
+	//替换数据目录之前记录快照对应的位置，替换之后数据和位置同时生效
+	if err := f.savePosition(snapshotDir, position); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.db != nil {
+		if err := f.db.Close(); err != nil {
+			return err
+		}
+		f.db = nil
+	}
+	if err := os.RemoveAll(f.options.DirPath); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(f.options.DirPath + data.MergeDirNameSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(snapshotDir, f.options.DirPath); err != nil {
+		return err
+	}
+	db, err := bitcast_go.Open(f.options)
+	if err != nil {
+		return err
+	}
+	f.db = db
+
+	f.stateLock.Lock()
+	f.state.Snapshots++
+	f.state.Position = position
+	f.stateLock.Unlock()
+	return nil
+}
+
+// 应用一条变更，事务中的数据在收到提交事件之后一起应用，应用之后位置有变化时返回true
+func (f *Follower) apply(event *bitcast_go.WatchEvent) (bool, error) {
+	if event.SeqNo != 0 && event.Type != bitcast_go.WatchBatchCommit {
+		f.pending[event.SeqNo] = append(f.pending[event.SeqNo], event)
+		return false, nil
+	}
+
+	f.mu.RLock()
+	err := f.applyToDB(event, event.Position)
+	f.mu.RUnlock()
+	if err != nil {
+		return false, err
+	}
+	position := event.Position
+	f.stateLock.Lock()
+	f.state.Position = &position
+	f.stateLock.Unlock()
+	return true, nil
+}
+
+// 把变更和应用之后的位置在同一个事务中写入数据库，重启之后位置不会超过已经写入的数据
+func (f *Follower) applyToDB(event *bitcast_go.WatchEvent, position bitcast_go.WatchPosition) error {
+	if f.db == nil {
+		return errFollowerClosed
+	}
+	events := []*bitcast_go.WatchEvent{event}
+	if event.Type == bitcast_go.WatchBatchCommit {
+		events = f.pending[event.SeqNo]
+		delete(f.pending, event.SeqNo)
+	}
+	//主节点的事务大小可能超过默认的限制
+	batchOpts := bitcast_go.DefaultWriteBatchOptions
+	batchOpts.SyncWrites = f.options.SyncWrites
+	if uint(len(events)+1) > batchOpts.MaxBatchNum {
+		batchOpts.MaxBatchNum = uint(len(events) + 1)
+	}
+	wb := f.db.NewWriteBatch(batchOpts)
+	for _, e := range events {
+		var err error
+		if e.Type == bitcast_go.WatchDelete {
+			err = wb.Delete(e.Key)
+		} else {
+			err = wb.Put(e.Key, e.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := wb.Put(positionKey, encodePosition(&position)); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// 在数据目录中记录已经应用到的位置
+func (f *Follower) savePosition(dirPath string, position *bitcast_go.WatchPosition) error {
+	options := f.options
+	options.DirPath = dirPath
+	db, err := bitcast_go.Open(options)
+	if err != nil {
+		return err
+	}
+	if err := db.Put(positionKey, encodePosition(position)); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err := db.Sync(); err != nil {
+		_ = db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// 读取数据库中记录的已经应用到的位置，没有记录时返回nil
+func loadPosition(db *bitcast_go.DB) (*bitcast_go.WatchPosition, error) {
+	value, err := db.Get(positionKey)
+	if err == selferror.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodePosition(value)
+}
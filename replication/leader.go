@@ -0,0 +1,247 @@
+package replication
+
+import (
+	bitcast_go "bitcast-go"
+	"bitcast-go/selferror"
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// LeaderOptions 主节点的配置项
+type LeaderOptions struct {
+	//每个从节点最多缓存多少条还没有发送的变更事件，超过之后断开连接，从节点重连之后从数据文件中追赶
+	BufferSize int
+}
+
+var DefaultLeaderOptions = LeaderOptions{
+	BufferSize: 64 * 1024,
+}
+
+// FollowerStatus 主节点看到的从节点的状态
+type FollowerStatus struct {
+	Addr        string
+	ConnectTime time.Time
+	Snapshot    bool                      //这次连接是否发送了全量快照
+	Sent        *bitcast_go.WatchPosition //已经发送的位置
+	Acked       *bitcast_go.WatchPosition //从节点已经应用的位置
+	AckTime     time.Time
+}
+
+// Leader 主节点，把数据库中新写入的数据发送给连接上来的从节点
+type Leader struct {
+	db       *bitcast_go.DB
+	options  LeaderOptions
+	listener net.Listener
+	mu       *sync.Mutex
+	sessions map[*leaderSession]struct{}
+	wg       *sync.WaitGroup
+	closed   bool
+}
+
+// 和一个从节点的连接
+type leaderSession struct {
+	leader  *Leader
+	conn    net.Conn
+	watcher *bitcast_go.Watcher
+	mu      *sync.Mutex
+	status  FollowerStatus
+}
+
+// NewLeader 在addr上监听从节点的连接
+func NewLeader(db *bitcast_go.DB, addr string, options LeaderOptions) (*Leader, error) {
+	if options.BufferSize <= 0 {
+		return nil, selferror.ErrInvalidWatchBufferSize
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Leader{
+		db:       db,
+		options:  options,
+		listener: listener,
+		mu:       new(sync.Mutex),
+		sessions: make(map[*leaderSession]struct{}),
+		wg:       new(sync.WaitGroup),
+	}
+	l.wg.Add(1)
+	go l.accept()
+	return l, nil
+}
+
+// Addr 监听的地址
+func (l *Leader) Addr() string {
+	return l.listener.Addr().String()
+}
+
+// Followers 当前连接的从节点的状态
+func (l *Leader) Followers() []FollowerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	statuses := make([]FollowerStatus, 0, len(l.sessions))
+	for s := range l.sessions {
+		s.mu.Lock()
+		statuses = append(statuses, s.status)
+		s.mu.Unlock()
+	}
+	return statuses
+}
+
+// Close 停止监听并断开所有的从节点
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	err := l.listener.Close()
+	for s := range l.sessions {
+		_ = s.conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *Leader) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		s := &leaderSession{
+			leader: l,
+			conn:   conn,
+			mu:     new(sync.Mutex),
+			status: FollowerStatus{Addr: conn.RemoteAddr().String(), ConnectTime: time.Now()},
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		l.sessions[s] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go s.run()
+	}
+}
+
+func (s *leaderSession) run() {
+	defer s.leader.wg.Done()
+	defer func() {
+		_ = s.conn.Close()
+		if s.watcher != nil {
+			s.watcher.Close()
+		}
+		s.leader.mu.Lock()
+		delete(s.leader.sessions, s)
+		s.leader.mu.Unlock()
+	}()
+
+	reader, writer := bufio.NewReader(s.conn), bufio.NewWriter(s.conn)
+	typ, payload, err := readMessage(reader)
+	if err != nil || typ != messageHello {
+		return
+	}
+	from, err := decodePosition(payload)
+	if err != nil {
+		return
+	}
+	if err := s.start(writer, from); err != nil {
+		return
+	}
+
+	//读取从节点的回复，连接断开的时候关闭订阅，结束发送
+	go func() {
+		defer s.watcher.Close()
+		for {
+			typ, payload, err := readMessage(reader)
+			if err != nil || typ != messageAck {
+				return
+			}
+			pos, err := decodePosition(payload)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.status.Acked, s.status.AckTime = pos, time.Now()
+			s.mu.Unlock()
+		}
+	}()
+
+	events := s.watcher.Events()
+	for {
+		var event *bitcast_go.WatchEvent
+		var ok bool
+		select {
+		case event, ok = <-events:
+		default:
+			//没有更多的事件时再把缓冲的数据发送出去
+			if err := writer.Flush(); err != nil {
+				return
+			}
+			event, ok = <-events
+		}
+		if !ok {
+			return
+		}
+		if err := writeMessage(writer, messageEvent, encodeEvent(event)); err != nil {
+			return
+		}
+		position := event.Position
+		s.mu.Lock()
+		s.status.Sent = &position
+		s.mu.Unlock()
+	}
+}
+
+// 从节点的位置可用时从这个位置之后开始订阅，否则先发送全量快照，再从快照对应的位置开始订阅
+// 发送快照期间不订阅新的写入，新的写入保存在数据文件中，订阅之后再从数据文件中读取，不会因为快照太慢导致缓存的事件超过BufferSize
+func (s *leaderSession) start(writer *bufio.Writer, from *bitcast_go.WatchPosition) error {
+	opts := bitcast_go.DefaultWatchOptions
+	opts.BufferSize = s.leader.options.BufferSize
+	if from != nil {
+		opts.From = from
+		watcher, err := s.leader.db.Watch(opts)
+		if err == nil {
+			s.watcher = watcher
+			return nil
+		}
+		if !errors.Is(err, selferror.ErrWatchPositionUnavailable) {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.status.Snapshot = true
+	s.mu.Unlock()
+	if err := writeMessage(writer, messageSnapshotBegin, nil); err != nil {
+		return err
+	}
+	position, err := s.leader.db.BackupToWithPosition(&snapshotWriter{w: writer})
+	if err != nil {
+		return err
+	}
+	//从节点安装快照之后从这个位置继续，之后断开重连时不需要再发送快照
+	if err := writeMessage(writer, messageSnapshotEnd, encodePosition(&position)); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.status.Sent = &position
+	s.mu.Unlock()
+
+	//快照之后merge可能已经清理了这个位置，从节点重连之后会重新接收快照
+	opts.From = &position
+	watcher, err := s.leader.db.Watch(opts)
+	if err != nil {
+		return err
+	}
+	s.watcher = watcher
+	return nil
+}
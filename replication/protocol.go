@@ -0,0 +1,138 @@
+package replication
+
+import (
+	bitcast_go "bitcast-go"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+//主从复制的协议，每条消息是 类型(1字节) + 长度(4字节，大端) + 内容
+//从节点连接之后先发送Hello，带上已经应用到的位置，主节点从这个位置之后开始发送变更事件
+//没有位置或者位置之后的数据已经被merge清理掉的时候，主节点先发送全量快照，快照结束的消息中带上快照对应的位置，再从这个位置之后发送变更事件
+//从节点应用完变更之后回复Ack，带上已经应用到的位置
+
+type messageType = byte
+
+const (
+	messageHello messageType = iota + 1
+	messageAck
+	messageSnapshotBegin
+	messageSnapshotData
+	messageSnapshotEnd
+	messageEvent
+)
+
+//一条消息最大的长度，避免读到错误的长度时分配过大的内存
+const maxMessageSize = 64 * 1024 * 1024
+
+//快照数据每条消息的大小
+const snapshotChunkSize = 1024 * 1024
+
+var errMessageTooLarge = errors.New("replication message is too large")
+var errUnexpectedMessage = errors.New("unexpected replication message")
+
+func writeMessage(w *bufio.Writer, typ messageType, payload []byte) error {
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readMessage(r *bufio.Reader) (messageType, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return 0, nil, errMessageTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// Hello和Ack中的位置：是否有位置(1字节) + 文件id(4字节) + 偏移(8字节)
+func encodePosition(pos *bitcast_go.WatchPosition) []byte {
+	buf := make([]byte, 13)
+	if pos != nil {
+		buf[0] = 1
+		binary.BigEndian.PutUint32(buf[1:], pos.Fid)
+		binary.BigEndian.PutUint64(buf[5:], uint64(pos.Offset))
+	}
+	return buf
+}
+
+func decodePosition(buf []byte) (*bitcast_go.WatchPosition, error) {
+	if len(buf) != 13 {
+		return nil, errUnexpectedMessage
+	}
+	if buf[0] == 0 {
+		return nil, nil
+	}
+	return &bitcast_go.WatchPosition{
+		Fid:    binary.BigEndian.Uint32(buf[1:]),
+		Offset: int64(binary.BigEndian.Uint64(buf[5:])),
+	}, nil
+}
+
+// 变更事件：类型(1字节) + 事务序列号(8字节) + 位置(12字节) + key长度(变长) + key + value
+func encodeEvent(event *bitcast_go.WatchEvent) []byte {
+	buf := make([]byte, 21, 21+binary.MaxVarintLen64+len(event.Key)+len(event.Value))
+	buf[0] = event.Type
+	binary.BigEndian.PutUint64(buf[1:], event.SeqNo)
+	binary.BigEndian.PutUint32(buf[9:], event.Position.Fid)
+	binary.BigEndian.PutUint64(buf[13:], uint64(event.Position.Offset))
+	buf = binary.AppendUvarint(buf, uint64(len(event.Key)))
+	buf = append(buf, event.Key...)
+	return append(buf, event.Value...)
+}
+
+func decodeEvent(buf []byte) (*bitcast_go.WatchEvent, error) {
+	if len(buf) < 22 {
+		return nil, errUnexpectedMessage
+	}
+	event := &bitcast_go.WatchEvent{
+		Type:  buf[0],
+		SeqNo: binary.BigEndian.Uint64(buf[1:]),
+		Position: bitcast_go.WatchPosition{
+			Fid:    binary.BigEndian.Uint32(buf[9:]),
+			Offset: int64(binary.BigEndian.Uint64(buf[13:])),
+		},
+	}
+	keySize, n := binary.Uvarint(buf[21:])
+	if n <= 0 || uint64(len(buf)-21-n) < keySize {
+		return nil, errUnexpectedMessage
+	}
+	index := 21 + n
+	event.Key = buf[index : index+int(keySize)]
+	event.Value = buf[index+int(keySize):]
+	return event, nil
+}
+
+// 把快照的tar流切分成消息写入
+type snapshotWriter struct {
+	w *bufio.Writer
+}
+
+func (sw *snapshotWriter) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		n := len(p) - written
+		if n > snapshotChunkSize {
+			n = snapshotChunkSize
+		}
+		if err := writeMessage(sw.w, messageSnapshotData, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(p), nil
+}
@@ -0,0 +1,197 @@
+package replication
+
+import (
+	bitcast_go "bitcast-go"
+	"bitcast-go/selferror"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("replication-key-%09d", i))
+}
+
+func testOptions(t *testing.T, name string) bitcast_go.Options {
+	opts := bitcast_go.DefaultOptions
+	dir, _ := os.MkdirTemp("", name)
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(dir + "-merge")
+		_ = os.RemoveAll(dir + "-snapshot")
+	})
+	return opts
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 从节点的数据和主节点一致
+func assertReplicated(t *testing.T, db *bitcast_go.DB, f *Follower) {
+	waitFor(t, func() bool {
+		expected := make(map[string]string)
+		_ = db.Fold(func(key []byte, value []byte) bool {
+			expected[string(key)] = string(value)
+			return true
+		})
+		actual := make(map[string]string)
+		_ = f.Fold(func(key []byte, value []byte) bool {
+			actual[string(key)] = string(value)
+			return true
+		})
+		if len(expected) != len(actual) {
+			return false
+		}
+		for key, value := range expected {
+			if actual[key] != value {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestReplication(t *testing.T) {
+	leaderOpts := testOptions(t, "bitcask-go-leader")
+	db, err := bitcast_go.Open(leaderOpts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	leader, err := NewLeader(db, "127.0.0.1:0", DefaultLeaderOptions)
+	assert.Nil(t, err)
+	addr := leader.Addr()
+
+	//全量快照
+	fopts := DefaultFollowerOptions
+	fopts.RetryInterval = 20 * time.Millisecond
+	follower, err := NewFollower(addr, testOptions(t, "bitcask-go-follower"), fopts)
+	assert.Nil(t, err)
+	defer follower.Close()
+	assertReplicated(t, db, follower)
+	assert.Equal(t, 1, follower.State().Snapshots)
+	assert.True(t, follower.State().Connected)
+
+	//新的写入、删除和事务
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.Nil(t, db.Delete(testKey(0)))
+	wb := db.NewWriteBatch(bitcast_go.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(testKey(1), []byte("batch")))
+	assert.Nil(t, wb.Delete(testKey(2)))
+	assert.Nil(t, wb.Commit())
+	assertReplicated(t, db, follower)
+	_, err = follower.Get(testKey(0))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+	value, err := follower.Get(testKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), value)
+
+	//主节点记录从节点回复的位置
+	waitFor(t, func() bool {
+		followers := leader.Followers()
+		return len(followers) == 1 && followers[0].Acked != nil && *followers[0].Acked == *follower.Position()
+	})
+	assert.True(t, leader.Followers()[0].Snapshot)
+
+	//断开之后从已经应用的位置追赶，不需要重新获取快照
+	assert.Nil(t, leader.Close())
+	waitFor(t, func() bool { return !follower.State().Connected })
+	for i := 600; i < 700; i++ {
+		assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	leader, err = NewLeader(db, addr, DefaultLeaderOptions)
+	assert.Nil(t, err)
+	assertReplicated(t, db, follower)
+	assert.Equal(t, 1, follower.State().Snapshots)
+	waitFor(t, func() bool { return len(leader.Followers()) == 1 })
+	assert.False(t, leader.Followers()[0].Snapshot)
+
+	//断开期间merge清理了从节点需要的数据，重新获取快照
+	assert.Nil(t, leader.Close())
+	waitFor(t, func() bool { return !follower.State().Connected })
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put(testKey(700), []byte("value-700")))
+	leader, err = NewLeader(db, addr, DefaultLeaderOptions)
+	assert.Nil(t, err)
+	defer leader.Close()
+	assertReplicated(t, db, follower)
+	assert.Equal(t, 2, follower.State().Snapshots)
+
+	//快照之后继续接收新的写入
+	assert.Nil(t, db.Put(testKey(701), []byte("value-701")))
+	assertReplicated(t, db, follower)
+	position := follower.Position()
+	assert.Nil(t, follower.Close())
+	_, err = os.Stat(follower.options.DirPath + "-snapshot")
+	assert.True(t, os.IsNotExist(err))
+
+	//重启之后从数据库中记录的位置继续接收，不需要传入位置，也不需要重新获取快照
+	assert.Nil(t, db.Put(testKey(702), []byte("value-702")))
+	follower, err = NewFollower(addr, follower.options, fopts)
+	assert.Nil(t, err)
+	defer follower.Close()
+	assert.Equal(t, *position, *follower.Position())
+	assertReplicated(t, db, follower)
+	assert.Equal(t, 0, follower.State().Snapshots)
+	_, err = follower.Get(positionKey)
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+}
+
+// 发送快照期间的写入超过BufferSize时，不会反复发送快照
+func TestReplication_WritesDuringSnapshot(t *testing.T) {
+	leaderOpts := testOptions(t, "bitcask-go-leader-busy")
+	db, err := bitcast_go.Open(leaderOpts)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	lopts := DefaultLeaderOptions
+	lopts.BufferSize = 10
+	leader, err := NewLeader(db, "127.0.0.1:0", lopts)
+	assert.Nil(t, err)
+	defer leader.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2000; i < 4000; i++ {
+			_ = db.Put(testKey(i), []byte(fmt.Sprintf("value-%d", i)))
+		}
+	}()
+	fopts := DefaultFollowerOptions
+	fopts.RetryInterval = 20 * time.Millisecond
+	follower, err := NewFollower(leader.Addr(), testOptions(t, "bitcask-go-follower-busy"), fopts)
+	assert.Nil(t, err)
+	defer follower.Close()
+	<-done
+	assertReplicated(t, db, follower)
+	assert.Equal(t, 1, follower.State().Snapshots)
+}
+
+func TestNewFollower_InMemory(t *testing.T) {
+	opts := bitcast_go.DefaultOptions
+	opts.InMemory = true
+	_, err := NewFollower("127.0.0.1:0", opts, DefaultFollowerOptions)
+	assert.NotNil(t, err)
+}
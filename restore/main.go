@@ -0,0 +1,48 @@
+package main
+
+import (
+	bitcast_go "bitcast-go"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+//恢复数据目录的工具
+//从增量备份恢复：restore -backup <备份目录> -dest <目标目录>
+//按时间点恢复：restore -src <数据目录> -dest <目标目录> -seq <事务序列号> 或者 -time <RFC3339格式的时间>
+func main() {
+	backupDir := flag.String("backup", "", "restore the latest backup in this directory")
+	srcDir := flag.String("src", "", "replay the data files in this directory up to -seq or -time")
+	destDir := flag.String("dest", "", "the directory to restore into, must not exist")
+	seqNo := flag.Uint64("seq", 0, "restore to the state after this transaction is committed")
+	timeStr := flag.String("time", "", "restore to the state at this time, in RFC3339 format")
+	flag.Parse()
+
+	if err := run(*backupDir, *srcDir, *destDir, *seqNo, *timeStr); err != nil {
+		fmt.Fprintf(os.Stderr, "restore failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(backupDir, srcDir, destDir string, seqNo uint64, timeStr string) error {
+	if destDir == "" || (backupDir == "") == (srcDir == "") {
+		flag.Usage()
+		return fmt.Errorf("exactly one of -backup and -src should be set, and -dest is required")
+	}
+	if backupDir != "" {
+		return bitcast_go.Restore(backupDir, destDir)
+	}
+
+	point := bitcast_go.RestorePoint{SeqNo: seqNo}
+	if timeStr != "" {
+		t, err := time.Parse(time.RFC3339Nano, timeStr)
+		if err != nil {
+			return err
+		}
+		point.Time = t
+	}
+	options := bitcast_go.DefaultOptions
+	options.DirPath = destDir
+	return bitcast_go.RestoreToPoint(srcDir, options, point)
+}
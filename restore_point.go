@@ -0,0 +1,231 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/fio"
+	"bitcast-go/selferror"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RestorePoint 按时间点恢复的截止位置，SeqNo和Time只能设置一个
+type RestorePoint struct {
+	//恢复到这个事务提交之后的状态，之后的非事务写入会一直保留到下一个事务提交之前
+	//序列号更大的事务提交之后，只会继续重放序列号不超过SeqNo的事务
+	SeqNo uint64
+	//恢复到这个时间的状态，没有时间戳的记录（旧版本写入或者merge之后的事务数据）会被保留
+	Time time.Time
+}
+
+// 判断事务提交的记录是否超过了截止位置
+func (p RestorePoint) exceedTxn(seqNo uint64, timestamp int64) bool {
+	if p.SeqNo != 0 {
+		return seqNo > p.SeqNo
+	}
+	return p.exceedTime(timestamp)
+}
+
+// 判断非事务写入的记录是否超过了截止时间
+func (p RestorePoint) exceedTime(timestamp int64) bool {
+	return !p.Time.IsZero() && timestamp != 0 && timestamp > p.Time.UnixNano()
+}
+
+// RestoreToPoint 按照写入的顺序重放srcDir中的数据文件，直到截止位置，写入到options.DirPath中的新数据库
+// srcDir不能正在被使用，options.DirPath必须不存在，失败时会删除options.DirPath
+// merge会清理掉历史数据，截止时间早于最近一次merge时返回ErrRestorePointUnavailable
+func RestoreToPoint(srcDir string, options Options, point RestorePoint) (err error) {
+	if (point.SeqNo == 0) == point.Time.IsZero() {
+		return selferror.ErrInvalidRestorePoint
+	}
+
+	var fs fio.FileSystem = fio.OSFileSystem{}
+	if options.InMemory {
+		fs = fio.MemFS
+	}
+	fileLock := fs.NewFileLock(filepath.Join(srcDir, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !hold {
+		return selferror.ErrDatabaseIsUsing
+	}
+	defer fileLock.Unlock()
+
+	if _, err := fs.Stat(filepath.Join(srcDir, data.MergeFinishedFileName)); err == nil {
+		mergeFinRecord, err := readMergeFinishedRecord(srcDir, fs.IoType())
+		if err != nil {
+			return err
+		}
+		if !point.Time.IsZero() && point.exceedTime(mergeFinRecord.Timestamp) {
+			return selferror.ErrRestorePointUnavailable
+		}
+		//merge之后的数据文件中事务的数据没有序列号，无法区分截止位置之前和之后的事务
+		if point.SeqNo != 0 {
+			if mergedSeqNo, ok := mergedSeqNoOf(mergeFinRecord); !ok || point.SeqNo < mergedSeqNo {
+				return selferror.ErrRestorePointUnavailable
+			}
+		}
+	}
+	dataFileDirs, err := readDataFileDirs(fs, srcDir)
+	if err != nil {
+		return err
+	}
+	fileIds, err := listDataFileIds(fs, srcDir, dataFileDirs)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.Stat(options.DirPath); err == nil {
+		return selferror.ErrRestoreDirExists
+	}
+	db, err := Open(options)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = fs.RemoveAll(options.DirPath)
+		}
+	}()
+
+	replayer := &pointReplayer{db: db, point: point, transactionRecords: make(map[uint64][]*data.LogRecord)}
+	for _, fileId := range fileIds {
+		dirPath := srcDir
+		if dir, ok := dataFileDirs[fileId]; ok {
+			dirPath = dir
+		}
+		finished, err := replayer.replayDataFile(dirPath, fileId, fs.IoType())
+		if err != nil {
+			return err
+		}
+		if finished {
+			break
+		}
+	}
+	return nil
+}
+
+// 重放数据文件，暂存还没有提交的事务数据
+type pointReplayer struct {
+	db                 *DB
+	point              RestorePoint
+	transactionRecords map[uint64][]*data.LogRecord
+	passed             bool //按序列号恢复时，是否已经读到了超过截止位置的事务提交的记录
+}
+
+// 重放一个数据文件，到达截止位置时返回true
+func (r *pointReplayer) replayDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (bool, error) {
+	dataFile, err := data.OpenDataFile(dirPath, fileId, ioType)
+	if err != nil {
+		return false, err
+	}
+	defer dataFile.Close()
+
+	var offset int64
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		offset += size
+
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		switch {
+		case logRecord.Type == data.LogRecordTnxFinished:
+			if r.point.exceedTxn(seqNo, logRecord.Timestamp) {
+				if r.point.SeqNo == 0 {
+					return true, nil
+				}
+				//序列号更小的事务提交的记录可能在后面，继续读取，但是不再重放之后的非事务写入
+				r.passed = true
+				continue
+			}
+			if err := r.commitTransaction(seqNo); err != nil {
+				return false, err
+			}
+		case seqNo == nonTransactionSeqNo:
+			if r.passed {
+				continue
+			}
+			if r.point.exceedTime(logRecord.Timestamp) {
+				return true, nil
+			}
+			if err := r.apply(realKey, logRecord); err != nil {
+				return false, err
+			}
+		case r.point.SeqNo != 0 && seqNo > r.point.SeqNo:
+			//超过截止位置的事务不需要暂存
+		default:
+			logRecord.Key = realKey
+			r.transactionRecords[seqNo] = append(r.transactionRecords[seqNo], logRecord)
+		}
+	}
+}
+
+func (r *pointReplayer) apply(key []byte, logRecord *data.LogRecord) error {
+	if logRecord.Type == data.LogRecordDeleted {
+		return r.db.Delete(key)
+	}
+	return r.db.Put(key, logRecord.Value)
+}
+
+// 事务中的数据在新的数据库中也通过一个事务写入
+func (r *pointReplayer) commitTransaction(seqNo uint64) error {
+	records := r.transactionRecords[seqNo]
+	delete(r.transactionRecords, seqNo)
+	if len(records) == 0 {
+		return nil
+	}
+	wb := r.db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: uint(len(records)), SyncWrites: false})
+	for _, record := range records {
+		var err error
+		if record.Type == data.LogRecordDeleted {
+			err = wb.Delete(record.Key)
+		} else {
+			err = wb.Put(record.Key, record.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// 获取目录中所有数据文件的id，包括映射到其他目录中的数据文件，从小到大排序
+func listDataFileIds(fs fio.FileSystem, dirPath string, dataFileDirs map[uint32]string) ([]uint32, error) {
+	//映射文件在创建数据文件之前写入，所以记录的文件可能不存在
+	for fileId, dir := range dataFileDirs {
+		if _, err := fs.Stat(data.GetDataFileName(dir, fileId)); err != nil {
+			delete(dataFileDirs, fileId)
+		}
+	}
+	entries, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			if _, ok := dataFileDirs[dataFileId(entry.Name())]; !ok {
+				fileIds = append(fileIds, dataFileId(entry.Name()))
+			}
+		}
+	}
+	for fileId := range dataFileDirs {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+	return fileIds, nil
+}
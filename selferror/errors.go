@@ -3,15 +3,33 @@ package selferror
 import "errors"
 
 var (
-	ErrKeyIsEmpty            = errors.New("the key is empty")
-	ErrIndexUpdateFailed     = errors.New("failed to update index")
-	ErrKeyNotFound           = errors.New("key not found in database")
-	ErrDataFileNotFound      = errors.New("data file is not found")
-	ErrDataDirectoryCorrupte = errors.New("the database directory maybe corrupted")
-	ErrInvalidCRC            = errors.New("invalid crc value,log record maybe corrupted")
-	ErrExceedMaxBatchNum     = errors.New("exceed the max batch")
-	ErrMergeIsProgress       = errors.New("merge is in progress,try again later")
-	ErrDatabaseIsUsing       = errors.New("the database directory is used")
-	ErrMergeRatioUnreached   = errors.New("the merge ratio do not reach the ratio")
-	ErrNoEnoughSpaceForMerge = errors.New("no enougn space for merge")
+	ErrKeyIsEmpty               = errors.New("the key is empty")
+	ErrIndexUpdateFailed        = errors.New("failed to update index")
+	ErrKeyNotFound              = errors.New("key not found in database")
+	ErrDataFileNotFound         = errors.New("data file is not found")
+	ErrDataDirectoryCorrupte    = errors.New("the database directory maybe corrupted")
+	ErrInvalidCRC               = errors.New("invalid crc value,log record maybe corrupted")
+	ErrExceedMaxBatchNum        = errors.New("exceed the max batch")
+	ErrMergeIsProgress          = errors.New("merge is in progress,try again later")
+	ErrDatabaseIsUsing          = errors.New("the database directory is used")
+	ErrMergeRatioUnreached      = errors.New("the merge ratio do not reach the ratio")
+	ErrNoEnoughSpaceForMerge    = errors.New("no enougn space for merge")
+	ErrInvalidBloomFilter       = errors.New("invalid bloom filter data")
+	ErrInjectedFault            = errors.New("injected io fault")
+	ErrPowerLoss                = errors.New("simulated power loss")
+	ErrCheckpointDirExists      = errors.New("the checkpoint directory already exists")
+	ErrBackupNotFound           = errors.New("the backup is not found")
+	ErrRestoreDirExists         = errors.New("the restore directory already exists")
+	ErrBackupCorrupted          = errors.New("the backup maybe corrupted")
+	ErrInvalidRestorePoint      = errors.New("exactly one of seqNo and time should be set for restore point")
+	ErrRestorePointUnavailable  = errors.New("the history before the restore point has been merged")
+	ErrInvalidWatchBufferSize   = errors.New("watch buffer size must be greater than 0")
+	ErrWatcherTooSlow           = errors.New("the watcher is too slow to consume events")
+	ErrWatchPositionUnavailable = errors.New("the history after the watch position has been merged")
+	ErrNotLeader                = errors.New("the raft node is not the leader")
+	ErrLeadershipLost           = errors.New("leadership lost before the command was applied")
+	ErrRaftClosed               = errors.New("the raft node is closed")
+	ErrRaftReservedKey          = errors.New("the key is reserved by raft")
+	ErrNoShards                 = errors.New("at least one shard directory is required")
+	ErrShardExists              = errors.New("the directory already belongs to a sharded database")
 )
@@ -0,0 +1,674 @@
+package bitcast_go
+
+import (
+	"bitcast-go/fio"
+	"bitcast-go/selferror"
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//分片数据库：每个分片是一个独立的DB实例，按照key在一致性哈希环上的位置路由到分片
+//每个分片的数据目录中保存分片的id，哈希环只和分片的id有关，数据目录改变位置之后路由不变
+//添加分片之后，新分片负责的哈希区间中的key从原来的分片迁移过来，迁移完成之前新分片处于加入中的状态：
+//读取时先读新分片，没有的话再读原来的分片；写入新分片并删除原来的分片中的数据，避免迁移覆盖新的写入
+
+const shardMetaFileName = "shard-meta"
+
+type shardMeta struct {
+	Id      uint32
+	Joining bool //还在从其他分片迁移数据
+}
+
+type shard struct {
+	meta shardMeta
+	dir  string
+	db   *DB
+}
+
+// ShardedDB 由多个DB实例组成的分片数据库
+type ShardedDB struct {
+	options ShardedOptions
+	fs      fio.FileSystem
+	mu      *sync.RWMutex //迁移一批数据时加写锁
+	shards  []*shard
+	ring    *hashRing //所有的分片
+	oldRing *hashRing //加入中的分片之外的分片，没有加入中的分片时为nil
+	addLock *sync.Mutex
+}
+
+// OpenSharded 打开所有分片，新的数据目录作为新的分片加入，并迁移数据
+func OpenSharded(options ShardedOptions) (*ShardedDB, error) {
+	if len(options.Dirs) == 0 {
+		return nil, selferror.ErrNoShards
+	}
+	if options.VirtualNodes <= 0 || options.RebalanceBatchSize <= 0 {
+		return nil, errors.New("virtual nodes and rebalance batch size must be greater than 0")
+	}
+	//每个数据文件目录只能被一个数据库使用，分片之间不能共用
+	if len(options.Options.DataDirs) > 0 {
+		return nil, errors.New("sharded database does not support data dirs")
+	}
+	s := &ShardedDB{
+		options: options,
+		fs:      fio.OSFileSystem{},
+		mu:      new(sync.RWMutex),
+		addLock: new(sync.Mutex),
+	}
+	if options.Options.InMemory {
+		s.fs = fio.MemFS
+	}
+
+	var newShards []*shard
+	for _, dir := range options.Dirs {
+		sh, exists, err := s.openShard(dir)
+		if err != nil {
+			for _, sh := range newShards {
+				_ = sh.db.Close()
+			}
+			_ = s.Close()
+			return nil, err
+		}
+		if exists {
+			s.shards = append(s.shards, sh)
+		} else {
+			newShards = append(newShards, sh)
+		}
+	}
+	//第一次打开时所有的分片都是空的，不需要迁移
+	initial := len(s.shards) == 0
+	for _, sh := range newShards {
+		sh.meta = shardMeta{Id: s.nextShardId(), Joining: !initial}
+		s.shards = append(s.shards, sh)
+		if err := s.writeShardMeta(sh); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+	}
+	ids := make(map[uint32]bool)
+	for _, sh := range s.shards {
+		if ids[sh.meta.Id] {
+			_ = s.Close()
+			return nil, selferror.ErrShardExists
+		}
+		ids[sh.meta.Id] = true
+	}
+	s.buildRings()
+
+	//继续之前没有完成的迁移
+	if err := s.rebalance(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// 打开分片的数据库，分片的元数据不存在时返回false
+func (s *ShardedDB) openShard(dir string) (*shard, bool, error) {
+	options := s.options.Options
+	options.DirPath = dir
+	db, err := Open(options)
+	if err != nil {
+		return nil, false, err
+	}
+	sh := &shard{dir: dir, db: db}
+	err = readJSONFile(s.fs, filepath.Join(dir, shardMetaFileName), &sh.meta)
+	if err != nil && !os.IsNotExist(err) {
+		_ = db.Close()
+		return nil, false, err
+	}
+	return sh, err == nil, nil
+}
+
+func (s *ShardedDB) writeShardMeta(sh *shard) error {
+	return writeJSONFile(s.fs, filepath.Join(sh.dir, shardMetaFileName), &sh.meta)
+}
+
+func (s *ShardedDB) nextShardId() uint32 {
+	var id uint32
+	for _, sh := range s.shards {
+		if sh.meta.Id+1 > id {
+			id = sh.meta.Id + 1
+		}
+	}
+	return id
+}
+
+// 调用时持有s.mu的写锁，或者还没有开始使用
+func (s *ShardedDB) buildRings() {
+	s.ring = newHashRing(s.shards, s.options.VirtualNodes)
+	s.oldRing = nil
+	var active []*shard
+	for _, sh := range s.shards {
+		if !sh.meta.Joining {
+			active = append(active, sh)
+		}
+	}
+	if len(active) < len(s.shards) {
+		s.oldRing = newHashRing(active, s.options.VirtualNodes)
+	}
+}
+
+// AddShard 添加一个新的分片，迁移新分片负责的数据之后返回，迁移期间可以正常读写
+func (s *ShardedDB) AddShard(dir string) error {
+	s.addLock.Lock()
+	defer s.addLock.Unlock()
+	s.mu.RLock()
+	for _, sh := range s.shards {
+		if filepath.Clean(sh.dir) == filepath.Clean(dir) {
+			s.mu.RUnlock()
+			return selferror.ErrShardExists
+		}
+	}
+	s.mu.RUnlock()
+	sh, exists, err := s.openShard(dir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		_ = sh.db.Close()
+		return selferror.ErrShardExists
+	}
+
+	s.mu.Lock()
+	sh.meta = shardMeta{Id: s.nextShardId(), Joining: true}
+	if err := s.writeShardMeta(sh); err != nil {
+		s.mu.Unlock()
+		_ = sh.db.Close()
+		return err
+	}
+	s.shards = append(s.shards, sh)
+	s.buildRings()
+	s.mu.Unlock()
+	return s.rebalance()
+}
+
+// 把加入中的分片负责的数据从其他分片迁移过来，完成之后标记为已加入
+func (s *ShardedDB) rebalance() error {
+	s.mu.RLock()
+	var sources []*shard
+	for _, sh := range s.shards {
+		if !sh.meta.Joining {
+			sources = append(sources, sh)
+		}
+	}
+	joining := len(sources) < len(s.shards)
+	s.mu.RUnlock()
+	if !joining {
+		return nil
+	}
+
+	for _, src := range sources {
+		if err := s.rebalanceShard(src); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sh := range s.shards {
+		if sh.meta.Joining {
+			sh.meta.Joining = false
+			if err := s.writeShardMeta(sh); err != nil {
+				return err
+			}
+		}
+	}
+	s.buildRings()
+	return nil
+}
+
+// 遍历原来的分片，每次迁移RebalanceBatchSize个key，内存中只保存一批key
+func (s *ShardedDB) rebalanceShard(src *shard) error {
+	iter := src.db.NewIterator(DefaultIteratorOptions)
+	defer iter.Close()
+	keys := make([][]byte, 0, s.options.RebalanceBatchSize)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+		if len(keys) == s.options.RebalanceBatchSize {
+			if err := s.moveKeys(src, keys); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if len(keys) > 0 {
+		return s.moveKeys(src, keys)
+	}
+	return nil
+}
+
+// 迁移一批key，先写入新的分片并持久化，再从原来的分片删除，中途崩溃时重新打开会再次迁移
+func (s *ShardedDB) moveKeys(src *shard, keys [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var moved [][]byte
+	targets := make(map[*shard]struct{})
+	for _, key := range keys {
+		dst := s.ring.get(key)
+		if dst == src {
+			continue
+		}
+		value, err := src.db.Get(key)
+		if err == selferror.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := dst.db.Put(key, value); err != nil {
+			return err
+		}
+		moved = append(moved, key)
+		targets[dst] = struct{}{}
+	}
+	for dst := range targets {
+		if err := dst.db.Sync(); err != nil {
+			return err
+		}
+	}
+	for _, key := range moved {
+		if err := src.db.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put 写入key所在的分片
+func (s *ShardedDB) Put(key []byte, value []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owner := s.ring.get(key)
+	if err := owner.db.Put(key, value); err != nil {
+		return err
+	}
+	//旧的数据还没有迁移，删除之后迁移不会覆盖这次写入
+	if owner.meta.Joining {
+		return s.oldRing.get(key).db.Delete(key)
+	}
+	return nil
+}
+
+// Delete 删除key所在的分片中的数据
+func (s *ShardedDB) Delete(key []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owner := s.ring.get(key)
+	if err := owner.db.Delete(key); err != nil {
+		return err
+	}
+	if owner.meta.Joining {
+		return s.oldRing.get(key).db.Delete(key)
+	}
+	return nil
+}
+
+// Get 读取key所在的分片中的数据
+func (s *ShardedDB) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(key)
+}
+
+// 调用时持有s.mu的读锁
+func (s *ShardedDB) get(key []byte) ([]byte, error) {
+	owner := s.ring.get(key)
+	value, err := owner.db.Get(key)
+	if err == selferror.ErrKeyNotFound && owner.meta.Joining {
+		return s.oldRing.get(key).db.Get(key)
+	}
+	return value, err
+}
+
+// MultiGet 并发地从各个分片读取多个key，返回的value和keys一一对应，不存在的key对应的value为nil
+func (s *ShardedDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	groups := make(map[*shard][]int)
+	for i, key := range keys {
+		owner := s.ring.get(key)
+		groups[owner] = append(groups[owner], i)
+	}
+
+	values := make([][]byte, len(keys))
+	errs := make(chan error, len(groups))
+	var wg sync.WaitGroup
+	for _, indexes := range groups {
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+			for _, i := range indexes {
+				value, err := s.get(keys[i])
+				if err == selferror.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				values[i] = value
+			}
+		}(indexes)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// ListKeys 所有分片中的key，按照key排序
+func (s *ShardedDB) ListKeys() [][]byte {
+	iterator := s.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	var keys [][]byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Key())
+	}
+	return keys
+}
+
+// Fold 按照key的顺序遍历所有分片中的数据，函数返回false时终止遍历
+func (s *ShardedDB) Fold(fn func(key []byte, value []byte) bool) error {
+	iterator := s.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Stat 汇总所有分片的统计信息
+// 布隆过滤器的误判率按照key的数量加权平均，merge的进度是所有分片的进度之和
+func (s *ShardedDB) Stat() *Stat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stat := &Stat{}
+	var bloomRate, estimatedBloomRate float64
+	for _, sh := range s.shards {
+		shardStat := sh.db.Stat()
+		stat.KeyNum += shardStat.KeyNum
+		stat.DataFileNum += shardStat.DataFileNum
+		stat.ReclaimableSize += shardStat.ReclaimableSize
+		stat.DiskSize += shardStat.DiskSize
+		stat.OpenFileNum += shardStat.OpenFileNum
+		stat.ValueCacheHits += shardStat.ValueCacheHits
+		stat.ValueCacheMisses += shardStat.ValueCacheMisses
+		stat.ValueCacheSize += shardStat.ValueCacheSize
+		mergeMergeStatus(&stat.Merge, shardStat.Merge)
+		bloomRate += shardStat.BloomFilterFalsePositiveRate * float64(shardStat.KeyNum)
+		estimatedBloomRate += shardStat.BloomFilterEstimatedFalsePositiveRate * float64(shardStat.KeyNum)
+		stat.HintFileErrors += shardStat.HintFileErrors
+		if shardStat.LastHintFileError != "" {
+			stat.LastHintFileError = shardStat.LastHintFileError
+		}
+	}
+	if stat.KeyNum > 0 {
+		stat.BloomFilterFalsePositiveRate = bloomRate / float64(stat.KeyNum)
+		stat.BloomFilterEstimatedFalsePositiveRate = estimatedBloomRate / float64(stat.KeyNum)
+	}
+	return stat
+}
+
+// 汇总merge的进度，开始时间取最早的，结束时间取最晚的，还有分片在merge时结束时间为零值
+func mergeMergeStatus(total *MergeStatus, status MergeStatus) {
+	if !status.StartTime.IsZero() && (total.StartTime.IsZero() || status.StartTime.Before(total.StartTime)) {
+		total.StartTime = status.StartTime
+	}
+	if status.FinishTime.After(total.FinishTime) {
+		total.FinishTime = status.FinishTime
+	}
+	total.Running = total.Running || status.Running
+	if total.Running {
+		total.FinishTime = time.Time{}
+	}
+	total.TotalFiles += status.TotalFiles
+	total.FilesProcessed += status.FilesProcessed
+	total.TotalBytes += status.TotalBytes
+	total.BytesRead += status.BytesRead
+	total.BytesWritten += status.BytesWritten
+	total.KeysRewritten += status.KeysRewritten
+	if total.Error == "" {
+		total.Error = status.Error
+	}
+}
+
+// Merge 依次merge每个分片，没有达到merge阈值的分片会被跳过
+func (s *ShardedDB) Merge() error {
+	s.mu.RLock()
+	shards := s.shards
+	s.mu.RUnlock()
+	for _, sh := range shards {
+		if err := sh.db.Merge(); err != nil && err != selferror.ErrMergeRatioUnreached {
+			return fmt.Errorf("merge shard %d: %w", sh.meta.Id, err)
+		}
+	}
+	return nil
+}
+
+// Sync 持久化所有分片的数据
+func (s *ShardedDB) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sh := range s.shards {
+		if err := sh.db.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭所有分片
+func (s *ShardedDB) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, sh := range s.shards {
+		if closeErr := sh.db.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.shards = nil
+	return err
+}
+
+// 一致性哈希环
+type hashRing struct {
+	points []uint64 //虚拟节点在环上的位置，从小到大排序
+	owners []*shard //每个虚拟节点所属的分片
+}
+
+func newHashRing(shards []*shard, virtualNodes int) *hashRing {
+	ring := &hashRing{}
+	type point struct {
+		hash  uint64
+		owner *shard
+	}
+	var points []point
+	for _, sh := range shards {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{hash: hashBytes([]byte(fmt.Sprintf("shard-%d-%d", sh.meta.Id, i))), owner: sh})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	for _, p := range points {
+		ring.points = append(ring.points, p.hash)
+		ring.owners = append(ring.owners, p.owner)
+	}
+	return ring
+}
+
+// key所在的分片，即环上顺时针方向第一个虚拟节点所属的分片
+func (r *hashRing) get(key []byte) *shard {
+	hash := hashBytes(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// fnv对相似的短key分布不够均匀，再经过murmur3的finalizer打散
+func hashBytes(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// ShardedIterator 按照key的顺序合并所有分片的迭代器
+type ShardedIterator struct {
+	iterators []*Iterator
+	shards    map[*Iterator]*shard //迭代器所属的分片
+	ring      *hashRing            //创建迭代器时的哈希环
+	heap      *iteratorHeap
+	current   *Iterator
+}
+
+// NewIterator 创建合并所有分片的迭代器
+func (s *ShardedDB) NewIterator(opts IteratorOptions) *ShardedIterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it := &ShardedIterator{
+		shards: make(map[*Iterator]*shard, len(s.shards)),
+		ring:   s.ring,
+		heap:   &iteratorHeap{reverse: opts.Reverse},
+	}
+	for _, sh := range s.shards {
+		iterator := sh.db.NewIterator(opts)
+		it.iterators = append(it.iterators, iterator)
+		it.shards[iterator] = sh
+	}
+	return it
+}
+
+// Rewind 回到第一个数据
+func (it *ShardedIterator) Rewind() {
+	for _, iterator := range it.iterators {
+		iterator.Rewind()
+	}
+	it.reset()
+}
+
+// Seek 从第一个大于（反向时小于）等于key的数据开始遍历
+func (it *ShardedIterator) Seek(key []byte) {
+	for _, iterator := range it.iterators {
+		iterator.Seek(key)
+	}
+	it.reset()
+}
+
+// Next 跳转到下一个key
+func (it *ShardedIterator) Next() {
+	if it.current == nil {
+		return
+	}
+	it.current.Next()
+	if it.current.Valid() {
+		heap.Push(it.heap, it.current)
+	}
+	it.pop()
+}
+
+func (it *ShardedIterator) Valid() bool {
+	return it.current != nil
+}
+
+func (it *ShardedIterator) Key() []byte {
+	return it.current.Key()
+}
+
+func (it *ShardedIterator) Value() ([]byte, error) {
+	return it.current.Value()
+}
+
+// Close 关闭所有分片的迭代器
+func (it *ShardedIterator) Close() {
+	for _, iterator := range it.iterators {
+		iterator.Close()
+	}
+}
+
+func (it *ShardedIterator) reset() {
+	it.heap.items = it.heap.items[:0]
+	for _, iterator := range it.iterators {
+		if iterator.Valid() {
+			it.heap.items = append(it.heap.items, iterator)
+		}
+	}
+	heap.Init(it.heap)
+	it.pop()
+}
+
+// 取出最小（反向时最大）的key，迁移期间同一个key可能同时在两个分片中，跳过重复的key
+// 重复的key使用负责这个key的分片中的数据，其他分片中的是还没有迁移的旧数据
+func (it *ShardedIterator) pop() {
+	if it.heap.Len() == 0 {
+		it.current = nil
+		return
+	}
+	it.current = heap.Pop(it.heap).(*Iterator)
+	if it.heap.Len() == 0 || !bytes.Equal(it.heap.items[0].Key(), it.current.Key()) {
+		return
+	}
+	owner := it.ring.get(it.current.Key())
+	for it.heap.Len() > 0 && bytes.Equal(it.heap.items[0].Key(), it.current.Key()) {
+		duplicate := heap.Pop(it.heap).(*Iterator)
+		if it.shards[duplicate] == owner {
+			it.current, duplicate = duplicate, it.current
+		}
+		duplicate.Next()
+		if duplicate.Valid() {
+			heap.Push(it.heap, duplicate)
+		}
+	}
+}
+
+type iteratorHeap struct {
+	items   []*Iterator
+	reverse bool
+}
+
+func (h *iteratorHeap) Len() int { return len(h.items) }
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.items[i].Key(), h.items[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *iteratorHeap) Push(x interface{}) { h.items = append(h.items, x.(*Iterator)) }
+
+func (h *iteratorHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
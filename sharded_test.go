@@ -0,0 +1,157 @@
+package bitcast_go
+
+import (
+	"bitcast-go/fio"
+	"bitcast-go/selferror"
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func shardedTestOptions(t *testing.T, n int) ShardedOptions {
+	root, _ := os.MkdirTemp("", "bitcask-go-sharded")
+	opts := DefaultShardedOptions
+	opts.Options = DefaultOptions
+	opts.RebalanceBatchSize = 100
+	for i := 0; i < n; i++ {
+		opts.Dirs = append(opts.Dirs, shardTestDir(root, i))
+	}
+	t.Cleanup(func() {
+		_ = fio.MemFS.RemoveAll(root)
+		_ = os.RemoveAll(root)
+	})
+	return opts
+}
+
+func shardTestDir(root string, i int) string {
+	return filepath.Join(root, fmt.Sprintf("shard-%d", i))
+}
+
+// 每个分片中key的数量
+func shardKeyNums(s *ShardedDB) []uint {
+	var nums []uint
+	for _, sh := range s.shards {
+		nums = append(nums, sh.db.Stat().KeyNum)
+	}
+	return nums
+}
+
+func assertShardedData(t *testing.T, s *ShardedDB, expected map[string][]byte) {
+	var total uint
+	for _, num := range shardKeyNums(s) {
+		total += num
+	}
+	//迁移之后没有重复的key
+	assert.Equal(t, uint(len(expected)), total)
+	assert.Equal(t, uint(len(expected)), s.Stat().KeyNum)
+	for key, value := range expected {
+		actual, err := s.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, actual)
+	}
+}
+
+func TestShardedDB(t *testing.T) {
+	opts := shardedTestOptions(t, 3)
+	s, err := OpenSharded(opts)
+	assert.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, s.Put(testKey(i), testValue(i)))
+		expected[string(testKey(i))] = testValue(i)
+	}
+	assert.Nil(t, s.Delete(testKey(0)))
+	delete(expected, string(testKey(0)))
+	_, err = s.Get(testKey(0))
+	assert.Equal(t, selferror.ErrKeyNotFound, err)
+	for _, num := range shardKeyNums(s) {
+		assert.Greater(t, num, uint(200))
+	}
+	assertShardedData(t, s, expected)
+
+	//跨分片批量读取
+	values, err := s.MultiGet([][]byte{testKey(1), testKey(0), testKey(999), testKey(5000)})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{testValue(1), nil, testValue(999), nil}, values)
+
+	//合并之后的有序迭代
+	keys := s.ListKeys()
+	assert.Equal(t, 999, len(keys))
+	for i := 1; i < len(keys); i++ {
+		assert.True(t, bytes.Compare(keys[i-1], keys[i]) < 0)
+	}
+	iterator := s.NewIterator(IteratorOptions{Reverse: true})
+	iterator.Seek(testKey(500))
+	for i := 500; i > 495; i-- {
+		assert.True(t, iterator.Valid())
+		assert.Equal(t, testKey(i), iterator.Key())
+		value, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i), value)
+		iterator.Next()
+	}
+	iterator.Close()
+	iterator = s.NewIterator(IteratorOptions{Prefix: []byte("bitcask-go-key-00000001")})
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		count++
+	}
+	iterator.Close()
+	assert.Equal(t, 10, count)
+
+	//添加分片，迁移期间继续写入
+	root := filepath.Dir(opts.Dirs[0])
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 1000; i += 3 {
+			assert.Nil(t, s.Put(testKey(i), []byte("updated")))
+		}
+	}()
+	assert.Nil(t, s.AddShard(shardTestDir(root, 3)))
+	wg.Wait()
+	for i := 1; i < 1000; i += 3 {
+		expected[string(testKey(i))] = []byte("updated")
+	}
+	assert.Equal(t, 4, len(s.shards))
+	assert.Greater(t, shardKeyNums(s)[3], uint(100))
+	assertShardedData(t, s, expected)
+	assert.Equal(t, selferror.ErrShardExists, s.AddShard(shardTestDir(root, 3)))
+
+	//同一个key同时在多个分片中时，迭代器使用负责这个key的分片中的数据
+	owner := s.ring.get(testKey(1))
+	for _, sh := range s.shards {
+		if sh != owner {
+			assert.Nil(t, sh.db.Put(testKey(1), []byte("stale")))
+		}
+	}
+	iterator = s.NewIterator(DefaultIteratorOptions)
+	iterator.Seek(testKey(1))
+	assert.Equal(t, testKey(1), iterator.Key())
+	value, err := iterator.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("updated"), value)
+	iterator.Next()
+	assert.Equal(t, testKey(2), iterator.Key())
+	iterator.Close()
+	for _, sh := range s.shards {
+		if sh != owner {
+			assert.Nil(t, sh.db.Delete(testKey(1)))
+		}
+	}
+	assert.Nil(t, s.Close())
+
+	//分片的目录顺序变化不影响路由，新的目录加入时迁移数据
+	opts.Dirs = []string{shardTestDir(root, 4), shardTestDir(root, 3), shardTestDir(root, 2), shardTestDir(root, 1), shardTestDir(root, 0)}
+	s, err = OpenSharded(opts)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Greater(t, shardKeyNums(s)[4], uint(100))
+	assertShardedData(t, s, expected)
+}
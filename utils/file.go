@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"context"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -23,14 +25,10 @@ func DirSize(dirPath string) (int64, error) {
 	return size, err
 }
 
-// 获取磁盘剩余可用空间大小
-func AvailableDiskSize() (uint64, error) {
-	wd, err := syscall.Getwd()
-	if err != nil {
-		return 0, err
-	}
+// 获取目录所在磁盘的剩余可用空间大小
+func AvailableDiskSize(dirPath string) (uint64, error) {
 	var stat syscall.Statfs_t
-	err = syscall.Statfs(wd, &stat)
+	err := syscall.Statfs(dirPath, &stat)
 	if err != nil {
 		return 0, err
 	}
@@ -38,15 +36,22 @@ func AvailableDiskSize() (uint64, error) {
 }
 
 func CopyDir(src, dest string, exclude []string) error {
+	return CopyDirCtx(context.Background(), src, dest, exclude)
+}
+
+// 拷贝目录，ctx被取消时停止拷贝并返回ctx的错误，已经拷贝的文件不会被删除
+func CopyDirCtx(ctx context.Context, src, dest string, exclude []string) error {
 	//目标不存在则创建
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
-		os.MkdirAll(dest, os.ModePerm)
-		if err != nil {
+		if err := os.MkdirAll(dest, os.ModePerm); err != nil {
 			return err
 		}
 	}
 
 	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		fileName := strings.Replace(path, src, "", 1) //取出后部分的文件名称
 		if fileName == "" {
 			return nil
@@ -65,10 +70,28 @@ func CopyDir(src, dest string, exclude []string) error {
 			return os.MkdirAll(filepath.Join(dest, fileName), info.Mode())
 		}
 
-		data, err := os.ReadFile(filepath.Join(src, fileName))
-		if err != nil {
-			return err
-		}
-		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
+		return CopyFile(filepath.Join(src, fileName), filepath.Join(dest, fileName), info.Mode())
 	})
 }
+
+// 流式拷贝一个文件，不会把整个文件读到内存中，拷贝完成之后持久化
+func CopyFile(src, dest string, perm fs.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimiter 限制每秒处理的字节数，非并发安全
+// 按照从开始到现在的平均速率进行限制，超出时等待，直到平均速率回到限制之内
+type RateLimiter struct {
+	bytesPerSec int64
+	start       time.Time
+	bytes       int64
+}
+
+// NewRateLimiter bytesPerSec小于等于0时不做限制
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+// WaitN 处理n个字节，超过速率限制时等待，ctx被取消时返回ctx的错误
+func (l *RateLimiter) WaitN(ctx context.Context, n int64) error {
+	if l.bytesPerSec <= 0 {
+		return nil
+	}
+	l.bytes += n
+	expected := time.Duration(float64(l.bytes) / float64(l.bytesPerSec) * float64(time.Second))
+	wait := expected - time.Since(l.start)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,391 @@
+package bitcast_go
+
+import (
+	"bitcast-go/data"
+	"bitcast-go/selferror"
+	"bytes"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//订阅数据变更：写入成功并更新内存索引之后，按照更新索引的顺序把变更事件发给订阅者
+//每个订阅者最多缓存BufferSize条事件，消费太慢导致缓存满了的订阅者会被关闭，之后可以从最后收到的事件的位置重新订阅
+//重新订阅时先读取数据文件中的数据，再接收新的写入，事件至少会被投递一次，可能重复
+
+type WatchEventType = byte
+
+const (
+	WatchPut WatchEventType = iota
+	WatchDelete
+	//事务提交，事务中的每条数据的事件之后会有一条提交事件
+	WatchBatchCommit
+)
+
+// WatchPosition 数据文件中的位置，订阅时从这个位置之后的数据开始读取
+type WatchPosition struct {
+	Fid    uint32
+	Offset int64
+}
+
+// WatchEvent 一次数据变更
+type WatchEvent struct {
+	Type  WatchEventType
+	Key   []byte //提交事件没有key
+	Value []byte
+	SeqNo uint64 //事务序列号，非事务的写入为0
+	//从这个位置重新订阅，可以收到这条事件之后的事件
+	//事务中的数据的位置是事务开始的位置，重新订阅时会收到整个事务
+	Position WatchPosition
+}
+
+// Watcher 数据变更的订阅者
+type Watcher struct {
+	db         *DB
+	prefix     []byte
+	bufferSize int
+	events     chan *WatchEvent
+	notify     chan struct{}
+	done       chan struct{}
+	exited     chan struct{}
+	mu         *sync.Mutex
+	queue      []*WatchEvent //还没有投递的新写入的事件
+	stopped    bool
+	err        error
+}
+
+// Watch 订阅数据变更，通过Events获取事件
+func (db *DB) Watch(opts WatchOptions) (*Watcher, error) {
+	if opts.BufferSize <= 0 {
+		return nil, selferror.ErrInvalidWatchBufferSize
+	}
+	w := &Watcher{
+		db:         db,
+		prefix:     opts.Prefix,
+		bufferSize: opts.BufferSize,
+		events:     make(chan *WatchEvent),
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		exited:     make(chan struct{}),
+		mu:         new(sync.Mutex),
+	}
+
+	//注册订阅者的同时确定需要从数据文件中读取的范围，之后的写入都会直接发给订阅者
+	db.fileRemoveLock.RLock()
+	if opts.From != nil {
+		if err := db.checkWatchPosition(*opts.From); err != nil {
+			db.fileRemoveLock.RUnlock()
+			return nil, err
+		}
+	}
+	//组提交中已经追加但还没有通知订阅者的写入完成之后再确定读取的范围，避免重复
+	db.writeLock.Lock()
+	db.mu.Lock()
+	var replay *watchReplay
+	if opts.From != nil {
+		replay = db.newWatchReplay(*opts.From)
+	}
+	db.watchers[w] = struct{}{}
+	db.mu.Unlock()
+	db.writeLock.Unlock()
+	db.fileRemoveLock.RUnlock()
+
+	go w.run(replay)
+	return w, nil
+}
+
+// Events 变更事件，订阅被关闭之后会被关闭，可以通过Err获取关闭的原因
+func (w *Watcher) Events() <-chan *WatchEvent {
+	return w.events
+}
+
+// Err 订阅被关闭的原因，主动关闭或者数据库关闭时为nil
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close 取消订阅
+func (w *Watcher) Close() {
+	w.db.mu.Lock()
+	delete(w.db.watchers, w)
+	w.db.mu.Unlock()
+	w.stop(nil)
+	<-w.exited
+}
+
+func (w *Watcher) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	w.err = err
+	w.queue = nil
+	close(w.done)
+}
+
+// 加入新写入的事件，缓存满了的时候关闭订阅，调用时持有db.mu
+func (w *Watcher) publish(events []*WatchEvent) {
+	var matched []*WatchEvent
+	for _, event := range events {
+		if event.Type == WatchBatchCommit {
+			//事务中有数据匹配时才发送提交事件
+			if len(matched) > 0 && matched[len(matched)-1].SeqNo == event.SeqNo {
+				matched = append(matched, event)
+			}
+			continue
+		}
+		if bytes.HasPrefix(event.Key, w.prefix) {
+			matched = append(matched, event)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	if len(w.queue)+len(matched) > w.bufferSize {
+		w.mu.Unlock()
+		delete(w.db.watchers, w)
+		w.stop(selferror.ErrWatcherTooSlow)
+		return
+	}
+	w.queue = append(w.queue, matched...)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 先投递数据文件中的事件，再投递新写入的事件
+func (w *Watcher) run(replay *watchReplay) {
+	defer close(w.exited)
+	defer close(w.events)
+
+	if replay != nil {
+		if err := replay.run(w); err != nil {
+			w.db.mu.Lock()
+			delete(w.db.watchers, w)
+			w.db.mu.Unlock()
+			w.stop(err)
+			return
+		}
+	}
+	for {
+		w.mu.Lock()
+		events := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		if len(events) == 0 {
+			select {
+			case <-w.notify:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+		for _, event := range events {
+			if !w.send(event) {
+				return
+			}
+		}
+	}
+}
+
+// 投递一条事件，订阅被关闭时返回false
+func (w *Watcher) send(event *WatchEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// 根据写入的记录生成变更事件，调用时持有db.mu
+func (db *DB) notifyWatchers(records []*data.LogRecord, positions []*data.LogRecordPos) {
+	if len(db.watchers) == 0 {
+		return
+	}
+	events := make([]*WatchEvent, 0, len(records))
+	start := WatchPosition{Fid: positions[0].Fid, Offset: positions[0].Offset}
+	for i, record := range records {
+		realKey, seqNo := parseLogRecordKey(record.Key)
+		position := start
+		if seqNo == nonTransactionSeqNo || record.Type == data.LogRecordTnxFinished {
+			position = positionAfter(positions[i])
+		}
+		//写入的value可能会被调用方修改，需要拷贝
+		events = append(events, newWatchEvent(record, realKey, seqNo, position, true))
+	}
+	for w := range db.watchers {
+		w.publish(events)
+	}
+}
+
+// 关闭所有的订阅者
+func (db *DB) closeWatchers() {
+	db.mu.Lock()
+	watchers := db.watchers
+	db.watchers = make(map[*Watcher]struct{})
+	db.mu.Unlock()
+	for w := range watchers {
+		w.stop(nil)
+		<-w.exited
+	}
+}
+
+func newWatchEvent(record *data.LogRecord, realKey []byte, seqNo uint64, position WatchPosition, copyValue bool) *WatchEvent {
+	event := &WatchEvent{SeqNo: seqNo, Position: position}
+	switch record.Type {
+	case data.LogRecordTnxFinished:
+		event.Type = WatchBatchCommit
+		return event
+	case data.LogRecordDeleted:
+		event.Type = WatchDelete
+	default:
+		event.Type = WatchPut
+		event.Value = record.Value
+		if copyValue {
+			event.Value = append([]byte{}, record.Value...)
+		}
+	}
+	event.Key = realKey
+	return event
+}
+
+func positionAfter(pos *data.LogRecordPos) WatchPosition {
+	return WatchPosition{Fid: pos.Fid, Offset: pos.Offset + int64(pos.Size)}
+}
+
+// 订阅的位置在最近一次merge的文件中时，之前的历史数据已经被清理掉了，调用时持有fileRemoveLock
+func (db *DB) checkWatchPosition(from WatchPosition) error {
+	if _, err := db.fs.Stat(filepath.Join(db.option.DirPath, data.MergeFinishedFileName)); err != nil {
+		return nil
+	}
+	nonMergeFileId, err := db.getNonMergeFileId(db.option.DirPath)
+	if err != nil {
+		return err
+	}
+	if from.Fid < nonMergeFileId {
+		return selferror.ErrWatchPositionUnavailable
+	}
+	return nil
+}
+
+// 重新订阅时需要从数据文件中读取的范围
+type watchReplay struct {
+	db              *DB
+	from            WatchPosition
+	end             WatchPosition //注册订阅者时活跃文件写入的位置，之后的数据会直接发给订阅者
+	fileIds         []uint32
+	mergeGeneration uint64
+}
+
+// 调用时持有db.mu
+func (db *DB) newWatchReplay(from WatchPosition) *watchReplay {
+	replay := &watchReplay{db: db, from: from, mergeGeneration: db.mergeGeneration}
+	for fileId := range db.olderFiles {
+		if fileId >= from.Fid {
+			replay.fileIds = append(replay.fileIds, fileId)
+		}
+	}
+	if db.activeFile != nil {
+		replay.end = WatchPosition{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOff}
+		if db.activeFile.FileId >= from.Fid {
+			replay.fileIds = append(replay.fileIds, db.activeFile.FileId)
+		}
+	}
+	sort.Slice(replay.fileIds, func(i, j int) bool {
+		return replay.fileIds[i] < replay.fileIds[j]
+	})
+	return replay
+}
+
+func (r *watchReplay) run(w *Watcher) error {
+	//事务的数据在读到提交的记录之后才会投递
+	transactionEvents := make(map[uint64][]*WatchEvent)
+	for _, fileId := range r.fileIds {
+		dataFile, err := r.openDataFile(fileId)
+		if err != nil {
+			return err
+		}
+		err = r.replayDataFile(w, dataFile, transactionEvents)
+		_ = dataFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 打开数据文件的时候检查期间有没有完成merge，打开之后merge替换文件也不影响读取
+func (r *watchReplay) openDataFile(fileId uint32) (*data.DataFile, error) {
+	r.db.fileRemoveLock.RLock()
+	defer r.db.fileRemoveLock.RUnlock()
+	if r.db.mergeGeneration != r.mergeGeneration {
+		return nil, selferror.ErrWatchPositionUnavailable
+	}
+	return data.OpenDataFile(r.db.dataFileDir(fileId), fileId, r.db.fs.IoType())
+}
+
+func (r *watchReplay) replayDataFile(w *Watcher, dataFile *data.DataFile, transactionEvents map[uint64][]*WatchEvent) error {
+	var offset int64
+	if dataFile.FileId == r.from.Fid {
+		offset = r.from.Offset
+	}
+	for {
+		if dataFile.FileId == r.end.Fid && offset >= r.end.Offset {
+			return nil
+		}
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size)}
+		offset += size
+
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		if seqNo == nonTransactionSeqNo {
+			event := newWatchEvent(logRecord, realKey, seqNo, positionAfter(pos), false)
+			if bytes.HasPrefix(event.Key, w.prefix) && !w.send(event) {
+				return nil
+			}
+			continue
+		}
+		if logRecord.Type != data.LogRecordTnxFinished {
+			position := WatchPosition{Fid: pos.Fid, Offset: pos.Offset}
+			if pending := transactionEvents[seqNo]; len(pending) > 0 {
+				position = pending[0].Position
+			}
+			transactionEvents[seqNo] = append(transactionEvents[seqNo], newWatchEvent(logRecord, realKey, seqNo, position, false))
+			continue
+		}
+
+		var matched bool
+		for _, event := range transactionEvents[seqNo] {
+			if bytes.HasPrefix(event.Key, w.prefix) {
+				matched = true
+				if !w.send(event) {
+					return nil
+				}
+			}
+		}
+		delete(transactionEvents, seqNo)
+		if matched && !w.send(newWatchEvent(logRecord, nil, seqNo, positionAfter(pos), false)) {
+			return nil
+		}
+	}
+}